@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ncabatoff/process-exporter/proc"
+)
+
+// serveCgroup serves /debug/cgroup, which tells whether cgroups can be read:
+// for process-exporter itself, or for the proc given by the pid parameter,
+// its cgroups and what each controller we use gives, see proc.CgroupCheck.
+// format is json or text.
+func (p *NamedProcessCollector) serveCgroup(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	check := p.fs.SelfCgroupCheck()
+	if s := q.Get("pid"); s != "" {
+		pid, err := strconv.Atoi(s)
+		if err != nil || pid <= 0 {
+			http.Error(w, fmt.Sprintf("bad pid %q", s), http.StatusBadRequest)
+			return
+		}
+		if check, err = p.fs.CgroupCheck(pid); err == proc.ErrProcNotExist {
+			http.Error(w, fmt.Sprintf("no process %d", pid), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	switch q.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(check); err != nil {
+			log.Printf("error writing cgroup check: %v", err)
+		}
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := writeCgroupCheck(w, check); err != nil {
+			log.Printf("error writing cgroup check: %v", err)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("bad format %q, want json or text", q.Get("format")), http.StatusBadRequest)
+	}
+}
+
+// writeCgroupCheck writes check to w for people to read: the proc's cgroups
+// as in /proc/<pid>/cgroup, then for each controller whether it could be
+// read, from which dir, and its limits and usage, or why not.
+func writeCgroupCheck(w io.Writer, check proc.CgroupCheck) error {
+	var b strings.Builder
+	pid := "self"
+	if check.Pid != 0 {
+		pid = strconv.Itoa(check.Pid)
+	}
+	fmt.Fprintf(&b, "pid: %s\ncgroup version: v%d\n", pid, check.Version)
+	if check.Error != "" {
+		fmt.Fprintf(&b, "error: %s\n", check.Error)
+	}
+	for _, cg := range check.Cgroups {
+		fmt.Fprintf(&b, "cgroup: %d:%s:%s\n", cg.HierarchyID, strings.Join(cg.Controllers, ","), cg.Path)
+	}
+	for _, cc := range check.Controllers {
+		switch {
+		case !cc.Mounted:
+			fmt.Fprintf(&b, "\n%s: NOT MOUNTED\n", cc.Controller)
+		case !cc.Readable:
+			fmt.Fprintf(&b, "\n%s: UNREADABLE in %s\n", cc.Controller, cc.Dir)
+		default:
+			fmt.Fprintf(&b, "\n%s: ok in %s\n", cc.Controller, cc.Dir)
+		}
+		if cc.Error != "" {
+			fmt.Fprintf(&b, "  error: %s\n", cc.Error)
+		}
+		for _, kv := range []struct {
+			what   string
+			values map[string]string
+		}{{"limit", cc.Limits}, {"usage", cc.Usage}} {
+			names := make([]string, 0, len(kv.values))
+			for name := range kv.values {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(&b, "  %s %s: %s\n", kv.what, name, kv.values[name])
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ncabatoff/process-exporter/proc"
+)
+
+// TestServeCgroup verifies that /debug/cgroup dumps the cgroups of the proc
+// given, as JSON or for people to read.
+func TestServeCgroup(t *testing.T) {
+	pc, err := NewProcessCollector(fixtureOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	pc.serveCgroup(rec, httptest.NewRequest("GET", "/debug/cgroup?pid=14804&format=text", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	const dir = "../../fixtures/cgroupv2/system.slice/process-exporter.service"
+	want := `pid: 14804
+cgroup version: v2
+cgroup: 0::/system.slice/process-exporter.service
+
+memory: ok in ` + dir + `
+  limit memory: 536870912
+  usage current: 104857600
+
+cpu: ok in ` + dir + `
+  limit period_us: 100000
+  limit quota_us: 50000
+  usage usage_seconds: 2.5
+
+cpuset: ok in ` + dir + `
+  limit effective_cpus: 4
+
+pids: ok in ` + dir + `
+  limit max: 4096
+  usage current: 12
+`
+	if diff := cmp.Diff(rec.Body.String(), want); diff != "" {
+		t.Errorf("text differs: (-got +want)\n%s", diff)
+	}
+
+	rec = httptest.NewRecorder()
+	pc.serveCgroup(rec, httptest.NewRequest("GET", "/debug/cgroup?pid=14804", nil))
+	var got proc.CgroupCheck
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("bad JSON %s: %v", rec.Body, err)
+	}
+	if got.Pid != 14804 || got.Version != 2 || len(got.Controllers) != 4 {
+		t.Errorf("got pid %d, version %d, %d controllers, want 14804, 2, 4",
+			got.Pid, got.Version, len(got.Controllers))
+	}
+
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{"pid=x", http.StatusBadRequest},
+		{"pid=99999", http.StatusNotFound},
+		{"format=xml", http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		pc.serveCgroup(rec, httptest.NewRequest("GET", "/debug/cgroup?"+tc.query, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%q: got status %d, want %d", tc.query, rec.Code, tc.code)
+		}
+	}
+}
+
+// TestWriteCgroupCheckUnmounted verifies that controllers that can't be read
+// are marked as such, with why.
+func TestWriteCgroupCheckUnmounted(t *testing.T) {
+	check := proc.CgroupCheck{
+		Version: 1,
+		Controllers: []proc.CgroupControllerCheck{
+			{Controller: "memory", Error: "no memory cgroup"},
+			{Controller: "cpu", Mounted: true, Dir: "/sys/fs/cgroup/cpu", Error: "permission denied"},
+		},
+	}
+	var b strings.Builder
+	if err := writeCgroupCheck(&b, check); err != nil {
+		t.Fatal(err)
+	}
+	want := `pid: self
+cgroup version: v1
+
+memory: NOT MOUNTED
+  error: no memory cgroup
+
+cpu: UNREADABLE in /sys/fs/cgroup/cpu
+  error: permission denied
+`
+	if diff := cmp.Diff(b.String(), want); diff != "" {
+		t.Errorf("text differs: (-got +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	common "github.com/ncabatoff/process-exporter"
+	"github.com/ncabatoff/process-exporter/config"
+	"github.com/ncabatoff/process-exporter/proc"
+)
+
+// checkConfig checks the config files paths stand for, printing every error
+// found to w, see config.CheckFiles.  If they're valid and procfsPath isn't
+// empty, it goes on to print the group each proc under procfsPath would be
+// put in.  It returns false if the config isn't valid or the procs can't be
+// read.
+func checkConfig(w io.Writer, paths config.Paths, procfsPath string, children bool) bool {
+	if errs := config.CheckFiles(paths); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(w, err)
+		}
+		fmt.Fprintf(w, "%d errors\n", len(errs))
+		return false
+	}
+	fmt.Fprintln(w, "OK")
+	if procfsPath == "" {
+		return true
+	}
+
+	cfg, err := config.ReadFiles(paths, false)
+	if err == nil {
+		err = dryRun(w, cfg, procfsPath, children)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "error matching procs under %s: %v\n", procfsPath, err)
+		return false
+	}
+	return true
+}
+
+// dryRun prints the group cfg puts each proc under procfsPath in, or - if
+// none, as a scrape would with -children set to children.
+func dryRun(w io.Writer, cfg *config.Config, procfsPath string, children bool) error {
+	var namer common.MatchNamer = cfg.MatchNamers
+	fs, err := proc.NewFS(procfsPath, false)
+	if err != nil {
+		return err
+	}
+	fs.GatherRuntime = needsRuntime(namer)
+	fs.GatherCgroupPath = needsCgroupPath(namer)
+	fs.EnvVars = envVars(namer)
+	fs.GatherListeningPorts = needsListeningPorts(namer)
+
+	grouper := proc.NewGrouper(namer, children, false, false, false)
+	if cfg.OtherGroup != nil {
+		grouper.SetOtherGroup(cfg.OtherGroup.Name, cfg.OtherGroup.KernelThreads)
+	}
+	if _, _, err := grouper.Update(fs.AllProcs()); err != nil {
+		return err
+	}
+	groups := make(map[int]string)
+	for _, s := range grouper.ProcSamples() {
+		groups[s.ID.Pid] = s.GroupName
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "PID\tCOMM\tGROUP\tCMDLINE\n")
+	procs := fs.AllProcs()
+	for procs.Next() {
+		static, err := procs.GetStatic()
+		if err != nil {
+			continue
+		}
+		id, _ := procs.GetProcID()
+		group, ok := groups[id.Pid]
+		if !ok {
+			group = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", id.Pid, static.Name, group, joinCmdline(static.Cmdline))
+	}
+	if err := procs.Close(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ncabatoff/process-exporter/config"
+)
+
+// TestCheckConfig verifies that an invalid config fails the check with all
+// its errors listed, and that a valid one is run against a procfs snapshot.
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("process_names:\n  - name: \"{{.Exe}}\"\n    comm: [bash]\n  - comm: [sh]\n    cmdlin: [x]\nlabels: {mode: x}\n")
+	var out bytes.Buffer
+	if checkConfig(&out, config.Paths{path}, "../../fixtures", true) {
+		t.Errorf("invalid config passed the check")
+	}
+	for _, want := range []string{"can't evaluate field Exe", `unknown key "cmdlin"`, `label "mode"`, "3 errors"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "PID") {
+		t.Errorf("invalid config was run against procs:\n%s", out.String())
+	}
+
+	write("process_names:\n  - name: \"{{.Comm}}\"\n    cmdline: ['-procnames (?P<what>\\S+)']\n  - name: bash\n    comm: [bash]\n")
+	out.Reset()
+	if !checkConfig(&out, config.Paths{path}, "../../fixtures", true) {
+		t.Errorf("valid config failed the check:\n%s", out.String())
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{"OK", "PID COMM GROUP CMDLINE",
+		"14804 process-exporte process-exporte ./process-exporter -procnames bash"}
+	if len(lines) != len(want) {
+		t.Fatalf("got output:\n%s", out.String())
+	}
+	for i, line := range lines {
+		if got := strings.Join(strings.Fields(line), " "); got != want[i] {
+			t.Errorf("line %d: got %q, want %q", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/ncabatoff/process-exporter/proc"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type (
+	// subCollector is a part of the metrics that can be enabled or disabled
+	// independently of the others.  Disabling it skips the reads it needs,
+	// not just the metrics it emits.
+	subCollector struct {
+		// name identifies the collector in the -collector.<name> flags and
+		// the collector label of namedprocess_collector_enabled.
+		name string
+		help string
+		// enabledByDefault is the default of the -collector.<name> flag.
+		enabledByDefault bool
+		// overridable is true if process_names entries may turn the
+		// collector on or off for their groups, see common.CollectorsNamer.
+		overridable bool
+		// probe, if not nil, returns an error if the collector can't work,
+		// e.g. for lack of privileges, in which case it's disabled.  It's
+		// run once at startup, so it must be cheap.
+		probe func(fs *proc.FS) error
+		// descs are those of the metrics the collector emits, see
+		// NamedProcessCollector.SubCollector.
+		descs []*prometheus.Desc
+		// series, if not nil, picks the collector's series of descs, for
+		// a family it shares with the metrics of no collector.
+		series func(m *dto.Metric) bool
+	}
+
+	// subCollectorView is a sub-collector of a NamedProcessCollector as a
+	// prometheus.Collector of its own, see NamedProcessCollector.SubCollector.
+	subCollectorView struct {
+		pc *NamedProcessCollector
+		c  *subCollector
+	}
+
+	// collectorFlags holds the -collector.<name> and -no-collector.<name>
+	// flags of each sub-collector.
+	collectorFlags struct {
+		enable, disable map[string]*bool
+	}
+)
+
+// subCollectors are the sub-collectors, in the order they're reported.
+var subCollectors = []subCollector{
+	{
+		name:             "io",
+		help:             "I/O bytes and syscalls, read from /proc/<pid>/io",
+		enabledByDefault: true,
+		overridable:      true,
+		probe:            (*proc.FS).CheckIO,
+		descs:            []*prometheus.Desc{readBytesDesc, writeBytesDesc, cancelledWriteBytesDesc, ioSyscallsDesc},
+	},
+	{
+		name:             "threads",
+		help:             "per-thread metrics and per-thread states and context switches, read from /proc/<pid>/task",
+		enabledByDefault: true,
+		overridable:      true,
+		probe:            procFileProbe("task"),
+		descs: []*prometheus.Desc{threadCountDesc, threadCpuSecsDesc, threadIoBytesDesc,
+			threadMajorPageFaultsDesc, threadMinorPageFaultsDesc, threadContextSwitchesDesc},
+	},
+	{
+		name:             "smaps",
+		help:             "proportional and unique memory of the groups -gather-smaps or the config file ask for, read from /proc/<pid>/smaps_rollup",
+		enabledByDefault: true,
+		overridable:      true,
+		probe:            procFileProbe("smaps_rollup"),
+		descs:            []*prometheus.Desc{membytesDesc},
+		series:           labelSeries("memtype", "proportionalResident", "proportionalSwapped", "unique"),
+	},
+	{
+		name:             "wchan",
+		help:             "thread wchans, read from /proc/<pid>/wchan",
+		enabledByDefault: true,
+		probe:            procFileProbe("wchan"),
+		descs:            []*prometheus.Desc{threadWchanDesc, blockedDesc},
+	},
+	{
+		name:             "cgroup",
+		help:             "cgroup metrics, read from /proc/<pid>/cgroup and cgroupfs",
+		enabledByDefault: true,
+		probe:            procFileProbe("cgroup"),
+		descs: []*prometheus.Desc{cgroupMemoryDesc, cgroupCPUThrottledSecsDesc, cgroupCPUThrottledPeriodsDesc,
+			cgroupMemoryPressureDesc, cgroupOOMKillsDesc, cgroupPgStealDesc, cgroupOOMGroupDesc,
+			cgroupMemoryLimitChangesDesc, cgroupsDesc, threadsPidsRatioDesc, cgroupDescendantsDesc,
+			cgroupDyingDescendantsDesc, cgroupReadErrorsDesc, cgroupReadDurationDesc},
+	},
+	{
+		name:             "netdev",
+		help:             "traffic of the network namespaces of groups, read from /proc/<pid>/ns/net and /proc/<pid>/net/dev",
+		enabledByDefault: false,
+		probe:            (*proc.FS).CheckNetDev,
+		descs:            []*prometheus.Desc{netReceiveBytesDesc, netTransmitBytesDesc, netReceivePacketsDesc, netTransmitPacketsDesc},
+	},
+	{
+		name:             "capability",
+		help:             "counts of processes holding each capability given by -capabilities, read from CapEff in /proc/<pid>/status",
+		enabledByDefault: true,
+		descs:            []*prometheus.Desc{capabilityDesc},
+	},
+	{
+		name:             "sched_policy",
+		help:             "counts of processes, or threads if the threads collector is enabled, by scheduling policy, and of realtime processes, read from /proc/<pid>/stat",
+		enabledByDefault: false,
+		descs:            []*prometheus.Desc{schedPolicyDesc, realtimeProcsDesc},
+	},
+	{
+		name:             "cpus_allowed",
+		help:             "the fewest CPUs the processes of each group may run on, read from Cpus_allowed_list in /proc/<pid>/status",
+		enabledByDefault: false,
+		descs:            []*prometheus.Desc{minCPUsAllowedDesc},
+	},
+}
+
+// procFileProbe returns a probe checking that the kernel provides the named
+// file of procs, see proc.FS.CheckProcFile.
+func procFileProbe(name string) func(fs *proc.FS) error {
+	return func(fs *proc.FS) error {
+		return fs.CheckProcFile(name)
+	}
+}
+
+// labelSeries returns a subCollector.series picking those whose label name
+// has one of values.
+func labelSeries(name string, values ...string) func(m *dto.Metric) bool {
+	return func(m *dto.Metric) bool {
+		for _, l := range m.Label {
+			if l.GetName() != name {
+				continue
+			}
+			for _, v := range values {
+				if l.GetValue() == v {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// constHistogram returns the observations of h so far as a metric of desc, so
+// that a sub-collector can own it like its other metrics.
+func constHistogram(desc *prometheus.Desc, h prometheus.Histogram) prometheus.Metric {
+	var m dto.Metric
+	if err := h.Write(&m); err != nil {
+		return prometheus.NewInvalidMetric(desc, err)
+	}
+	buckets := make(map[float64]uint64, len(m.Histogram.Bucket))
+	for _, b := range m.Histogram.Bucket {
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return prometheus.MustNewConstHistogram(desc, m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum(), buckets)
+}
+
+// owns returns whether a metric of the collector, with its descs as p uses
+// them, is one of c's.
+func (c *subCollector) owns(p *NamedProcessCollector) func(m prometheus.Metric) bool {
+	descs := make(map[*prometheus.Desc]bool, len(c.descs))
+	for _, d := range c.descs {
+		descs[p.desc(d)] = true
+	}
+	return func(m prometheus.Metric) bool {
+		if !descs[m.Desc()] {
+			return false
+		}
+		if c.series == nil {
+			return true
+		}
+		var pb dto.Metric
+		return m.Write(&pb) == nil && c.series(&pb)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (v subCollectorView) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range v.c.descs {
+		ch <- v.pc.desc(d)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (v subCollectorView) Collect(ch chan<- prometheus.Metric) {
+	v.pc.collect(ch, v.c)
+}
+
+// newCollectorFlags defines the flags enabling and disabling each
+// sub-collector.
+func newCollectorFlags() collectorFlags {
+	cf := collectorFlags{enable: make(map[string]*bool), disable: make(map[string]*bool)}
+	for _, c := range subCollectors {
+		cf.enable[c.name] = flag.Bool("collector."+c.name, c.enabledByDefault,
+			"enable the "+c.name+" collector: "+c.help)
+		cf.disable[c.name] = flag.Bool("no-collector."+c.name, false,
+			"disable the "+c.name+" collector")
+	}
+	return cf
+}
+
+// enabled returns whether each sub-collector is enabled by the flags.
+func (cf collectorFlags) enabled() map[string]bool {
+	enabled := make(map[string]bool)
+	for _, c := range subCollectors {
+		enabled[c.name] = *cf.enable[c.name] && !*cf.disable[c.name]
+	}
+	return enabled
+}
+
+// probeCollectors returns whether each sub-collector is enabled: by enabled
+// if it has an entry there, by default otherwise, and only if its probe
+// succeeds.  It also returns whether each works, so that the overridable
+// ones can be turned on for some groups even if they're disabled.  An entry
+// that isn't a sub-collector is an error.
+func probeCollectors(fs *proc.FS, enabled map[string]bool) (active, available map[string]bool, err error) {
+	active = make(map[string]bool)
+	available = make(map[string]bool)
+	for _, c := range subCollectors {
+		on, ok := enabled[c.name]
+		if !ok {
+			on = c.enabledByDefault
+		}
+		works := on || c.overridable
+		if works && c.probe != nil {
+			if err := c.probe(fs); err != nil {
+				if on {
+					log.Printf("disabling %s collector: %v", c.name, err)
+				}
+				works = false
+			}
+		}
+		active[c.name] = on && works
+		available[c.name] = works
+	}
+	for name := range enabled {
+		if _, ok := active[name]; !ok {
+			return nil, nil, fmt.Errorf("unknown collector %q", name)
+		}
+	}
+	return active, available, nil
+}
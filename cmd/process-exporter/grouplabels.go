@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	common "github.com/ncabatoff/process-exporter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// groupDescSpec holds the arguments a group desc was created with, so that it
+// can be recreated with the labels of groups added.
+type groupDescSpec struct {
+	fqName         string
+	help           string
+	variableLabels []string
+	constLabels    prometheus.Labels
+}
+
+// groupDescSpecs holds the spec of each desc created by newGroupDesc.
+var groupDescSpecs = make(map[*prometheus.Desc]groupDescSpec)
+
+// newGroupDesc is prometheus.NewDesc for the descs of metrics whose first
+// label is groupname, to which the labels of groups are added.
+func newGroupDesc(fqName, help string, variableLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	desc := prometheus.NewDesc(fqName, help, variableLabels, constLabels)
+	groupDescSpecs[desc] = groupDescSpec{fqName, help, variableLabels, constLabels}
+	return desc
+}
+
+// desc returns the desc the collector uses in place of desc: that with the
+// labels of groups added if desc is a group desc and groups have labels,
+// desc itself otherwise.
+func (p *NamedProcessCollector) desc(desc *prometheus.Desc) *prometheus.Desc {
+	if d, ok := p.groupDescs[desc]; ok {
+		return d
+	}
+	return desc
+}
+
+// groupMetric is prometheus.MustNewConstMetric, adding the labels of the group
+// named by the first of labelValues if desc is a group desc.
+func (p *NamedProcessCollector) groupMetric(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labelValues ...string) prometheus.Metric {
+	d, ok := p.groupDescs[desc]
+	if !ok {
+		return prometheus.MustNewConstMetric(desc, valueType, value, labelValues...)
+	}
+	labels := p.labelsNamer.GroupLabels(labelValues[0])
+	values := make([]string, 0, len(labelValues)+len(p.groupLabelNames))
+	values = append(values, labelValues...)
+	for _, name := range p.groupLabelNames {
+		values = append(values, labels[name])
+	}
+	return prometheus.MustNewConstMetric(d, valueType, value, values...)
+}
+
+// setGroupLabels makes the collector add the labels of groups given by ln to
+// their series.  A label that is already one of a group metric's own is an
+// error.
+func (p *NamedProcessCollector) setGroupLabels(ln common.LabelsNamer) error {
+	names := ln.GroupLabelNames()
+	groupDescs := make(map[*prometheus.Desc]*prometheus.Desc, len(groupDescSpecs))
+	for desc, spec := range groupDescSpecs {
+		labels := make([]string, 0, len(spec.variableLabels)+len(names))
+		labels = append(labels, spec.variableLabels...)
+		for _, name := range names {
+			for _, l := range spec.variableLabels {
+				if name == l {
+					return fmt.Errorf("group label %q is already a label of %s", name, spec.fqName)
+				}
+			}
+			labels = append(labels, name)
+		}
+		groupDescs[desc] = prometheus.NewDesc(spec.fqName, spec.help, labels, spec.constLabels)
+	}
+	p.labelsNamer, p.groupLabelNames, p.groupDescs = ln, names, groupDescs
+	return nil
+}
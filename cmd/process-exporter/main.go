@@ -8,6 +8,8 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +19,7 @@ import (
 	"github.com/ncabatoff/process-exporter/proc"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 	promVersion "github.com/prometheus/common/version"
 )
 
@@ -41,6 +44,10 @@ walking the process tree upwards.  In other words, resource usage of
 subprocesses is added to their parent's usage unless the subprocess identifies
 as a different group name.
 
+The -other-group option gathers every process that isn't part of any group into
+a group of its own with the given name, so that the groups add up to the whole
+machine.  Kernel threads are included unless -other-group-kernel-threads=false.
+
 Command-line process selection (procnames/namemapping):
 
   Every process not in the procnames list is ignored.  Otherwise, all processes
@@ -73,84 +80,222 @@ Config file process selection (filename.yml):
 }
 
 var (
-	numprocsDesc = prometheus.NewDesc(
+	numprocsDesc = newGroupDesc(
 		"namedprocess_namegroup_num_procs",
 		"number of processes in this group",
 		[]string{"groupname"},
 		nil)
 
-	cpuSecsDesc = prometheus.NewDesc(
+	procStartsDesc = newGroupDesc(
+		"namedprocess_namegroup_process_starts_total",
+		"number of processes that have joined this group",
+		[]string{"groupname"},
+		nil)
+
+	procExitsDesc = newGroupDesc(
+		"namedprocess_namegroup_process_exits_total",
+		"number of processes that have left this group",
+		[]string{"groupname"},
+		nil)
+
+	cpuSecsDesc = newGroupDesc(
 		"namedprocess_namegroup_cpu_seconds_total",
-		"Cpu user usage in seconds",
+		"Cpu user/system usage in seconds, and optionally that of reaped children",
 		[]string{"groupname", "mode"},
 		nil)
 
-	readBytesDesc = prometheus.NewDesc(
+	readBytesDesc = newGroupDesc(
 		"namedprocess_namegroup_read_bytes_total",
 		"number of bytes read by this group",
 		[]string{"groupname"},
 		nil)
 
-	writeBytesDesc = prometheus.NewDesc(
+	writeBytesDesc = newGroupDesc(
 		"namedprocess_namegroup_write_bytes_total",
 		"number of bytes written by this group",
 		[]string{"groupname"},
 		nil)
 
-	majorPageFaultsDesc = prometheus.NewDesc(
+	cancelledWriteBytesDesc = newGroupDesc(
+		"namedprocess_namegroup_cancelled_write_bytes_total",
+		"number of bytes counted in write_bytes_total but never written, e.g. due to truncating dirty pagecache",
+		[]string{"groupname"},
+		nil)
+
+	ioSyscallsDesc = newGroupDesc(
+		"namedprocess_namegroup_io_syscalls_total",
+		"number of read/write syscalls",
+		[]string{"groupname", "iomode"},
+		nil)
+
+	majorPageFaultsDesc = newGroupDesc(
 		"namedprocess_namegroup_major_page_faults_total",
 		"Major page faults",
 		[]string{"groupname"},
 		nil)
 
-	minorPageFaultsDesc = prometheus.NewDesc(
+	minorPageFaultsDesc = newGroupDesc(
 		"namedprocess_namegroup_minor_page_faults_total",
 		"Minor page faults",
 		[]string{"groupname"},
 		nil)
 
-	contextSwitchesDesc = prometheus.NewDesc(
+	contextSwitchesDesc = newGroupDesc(
 		"namedprocess_namegroup_context_switches_total",
 		"Context switches",
 		[]string{"groupname", "ctxswitchtype"},
 		nil)
 
-	membytesDesc = prometheus.NewDesc(
+	membytesDesc = newGroupDesc(
 		"namedprocess_namegroup_memory_bytes",
 		"number of bytes of memory in use",
 		[]string{"groupname", "memtype"},
 		nil)
 
-	openFDsDesc = prometheus.NewDesc(
+	cgroupMemoryDesc = newGroupDesc(
+		"namedprocess_namegroup_cgroup_memory_bytes",
+		"memory of the distinct memory cgroups of this group's procs, per -cgroup-memory: current usage, working set or limit",
+		[]string{"groupname"},
+		nil)
+
+	cgroupCPUThrottledSecsDesc = newGroupDesc(
+		"namedprocess_namegroup_cgroup_cpu_throttled_seconds_total",
+		"time the distinct cpu cgroups of this group's procs were throttled for",
+		[]string{"groupname"},
+		nil)
+
+	cgroupCPUThrottledPeriodsDesc = newGroupDesc(
+		"namedprocess_namegroup_cgroup_cpu_throttled_periods_total",
+		"number of periods in which the distinct cpu cgroups of this group's procs were throttled",
+		[]string{"groupname"},
+		nil)
+
+	cgroupMemoryPressureDesc = newGroupDesc(
+		"namedprocess_namegroup_cgroup_memory_pressure_ratio",
+		"share of the last 10s in which some task was stalled on memory, highest among the group's cgroups",
+		[]string{"groupname"},
+		nil)
+
+	processAgeDesc = newGroupDesc(
+		"namedprocess_namegroup_process_age_seconds",
+		"number of processes in this group no older than le seconds",
+		[]string{"groupname", "le"},
+		nil)
+
+	cgroupsDesc = newGroupDesc(
+		"namedprocess_namegroup_cgroups",
+		"number of distinct memory cgroups the processes of this group are in",
+		[]string{"groupname"},
+		nil)
+
+	cgroupOOMKillsDesc = newGroupDesc(
+		"namedprocess_namegroup_cgroup_oom_kills_total",
+		"number of processes OOM-killed in the memory cgroups of this group's procs, accumulated across cgroup recreation",
+		[]string{"groupname"},
+		nil)
+
+	cgroupPgStealDesc = newGroupDesc(
+		"namedprocess_namegroup_cgroup_pgsteal_total",
+		"number of pages reclaimed from the memory cgroups of this group's procs, accumulated across cgroup recreation",
+		[]string{"groupname"},
+		nil)
+
+	cgroupOOMGroupDesc = newGroupDesc(
+		"namedprocess_namegroup_cgroup_oom_group",
+		"number of the memory cgroups of this group's procs that are OOM-killed as a whole, i.e. have memory.oom.group set",
+		[]string{"groupname"},
+		nil)
+
+	cgroupMemoryLimitChangesDesc = newGroupDesc(
+		"namedprocess_namegroup_cgroup_memory_limit_changes_total",
+		"number of times the memory limit of one of the memory cgroups of this group's procs changed between scrapes",
+		[]string{"groupname"},
+		nil)
+
+	openFDsDesc = newGroupDesc(
 		"namedprocess_namegroup_open_filedesc",
 		"number of open file descriptors for this group",
 		[]string{"groupname"},
 		nil)
 
-	worstFDRatioDesc = prometheus.NewDesc(
+	worstFDRatioDesc = newGroupDesc(
 		"namedprocess_namegroup_worst_fd_ratio",
 		"the worst (closest to 1) ratio between open fds and max fds among all procs in this group",
 		[]string{"groupname"},
 		nil)
 
-	startTimeDesc = prometheus.NewDesc(
+	startTimeDesc = newGroupDesc(
 		"namedprocess_namegroup_oldest_start_time_seconds",
 		"start time in seconds since 1970/01/01 of oldest process in group",
 		[]string{"groupname"},
 		nil)
 
-	numThreadsDesc = prometheus.NewDesc(
+	newestStartTimeDesc = newGroupDesc(
+		"namedprocess_namegroup_newest_start_time_seconds",
+		"start time in seconds since 1970/01/01 of newest process in group",
+		[]string{"groupname"},
+		nil)
+
+	numThreadsDesc = newGroupDesc(
 		"namedprocess_namegroup_num_threads",
 		"Number of threads",
 		[]string{"groupname"},
 		nil)
 
-	statesDesc = prometheus.NewDesc(
+	worstThreadsDesc = newGroupDesc(
+		"namedprocess_namegroup_worst_threads",
+		"highest number of threads of any process in this group",
+		[]string{"groupname"},
+		nil)
+
+	threadsPidsRatioDesc = newGroupDesc(
+		"namedprocess_namegroup_threads_pids_limit_ratio",
+		"number of threads in this group divided by the pids.max limits of the distinct pids cgroups of its procs",
+		[]string{"groupname"},
+		nil)
+
+	statesDesc = newGroupDesc(
 		"namedprocess_namegroup_states",
 		"Number of processes in states Running, Sleeping, Waiting, Zombie, or Other",
 		[]string{"groupname", "state"},
 		nil)
 
+	zombiesDesc = newGroupDesc(
+		"namedprocess_namegroup_zombies",
+		"number of zombie processes this group's selectors match at the time of the scrape",
+		[]string{"groupname"},
+		nil)
+
+	lowestNiceDesc = newGroupDesc(
+		"namedprocess_namegroup_lowest_nice",
+		"lowest nice value of any process in this group",
+		[]string{"groupname"},
+		nil)
+
+	highestPriorityDesc = newGroupDesc(
+		"namedprocess_namegroup_highest_priority",
+		"highest scheduling priority of any process in this group, i.e. lowest priority value",
+		[]string{"groupname"},
+		nil)
+
+	realtimeProcsDesc = newGroupDesc(
+		"namedprocess_namegroup_realtime_procs",
+		"number of processes in this group with a realtime scheduling policy",
+		[]string{"groupname"},
+		nil)
+
+	minCPUsAllowedDesc = newGroupDesc(
+		"namedprocess_namegroup_min_cpus_allowed",
+		"fewest CPUs any process in this group may run on, from its affinity",
+		[]string{"groupname"},
+		nil)
+
+	orphanedZombiesDesc = prometheus.NewDesc(
+		"namedprocess_orphaned_zombies",
+		"number of zombie processes, tracked or not, whose parent is pid 1",
+		nil,
+		nil)
+
 	scrapeErrorsDesc = prometheus.NewDesc(
 		"namedprocess_scrape_errors",
 		"general scrape errors: no proc metrics collected during a cycle",
@@ -169,49 +314,227 @@ var (
 		nil,
 		nil)
 
-	threadWchanDesc = prometheus.NewDesc(
+	scrapeCounterRegressionsDesc = prometheus.NewDesc(
+		"namedprocess_scrape_counter_regressions_total",
+		"incremented each time a counter of a tracked proc or thread was found to have decreased, which is then ignored",
+		nil,
+		nil)
+
+	scrapeIOSkippedDesc = prometheus.NewDesc(
+		"namedprocess_scrape_io_skipped_procs_total",
+		"incremented each time a proc's I/O stats can't be read for want of permission, which leaves its I/O counters unchanged",
+		nil,
+		nil)
+
+	scrapeReadErrorsDesc = prometheus.NewDesc(
+		"namedprocess_scrape_read_errors_total",
+		"number of errors reading procs, by reason: permission_denied, vanished, parse_error, cgroup_read_error or other",
+		[]string{"reason"},
+		nil)
+
+	scrapePartialProcsDesc = prometheus.NewDesc(
+		"namedprocess_scrape_procs_partial",
+		"number of procs with incomplete data in the last scrape",
+		nil,
+		nil)
+
+	scrapeDurationDesc = prometheus.NewDesc(
+		"namedprocess_scrape_duration_seconds",
+		"time taken by the last scrape to read and group procs",
+		nil,
+		nil)
+
+	scrapeProcsScannedDesc = prometheus.NewDesc(
+		"namedprocess_scrape_procs_scanned",
+		"number of procs read by the last scrape, whether tracked or not",
+		nil,
+		nil)
+
+	scrapeProcsMatchedDesc = prometheus.NewDesc(
+		"namedprocess_scrape_procs_matched",
+		"number of procs belonging to a group in the last scrape",
+		nil,
+		nil)
+
+	scrapeGroupsDesc = prometheus.NewDesc(
+		"namedprocess_scrape_groups",
+		"number of groups reported by the last scrape",
+		nil,
+		nil)
+
+	cgroupDescendantsDesc = prometheus.NewDesc(
+		"namedprocess_cgroup_descendants",
+		"number of descendant cgroups of the root v2 cgroup",
+		nil,
+		nil)
+
+	cgroupDyingDescendantsDesc = prometheus.NewDesc(
+		"namedprocess_cgroup_dying_descendants",
+		"number of removed descendant cgroups of the root v2 cgroup still being torn down",
+		nil,
+		nil)
+
+	cgroupReadDurationDesc = prometheus.NewDesc(
+		"namedprocess_cgroup_read_duration_seconds",
+		"time taken by scrapes to read cgroupfs",
+		nil,
+		nil)
+
+	cgroupReadErrorsDesc = prometheus.NewDesc(
+		"namedprocess_cgroup_read_errors_total",
+		"number of times reading a cgroup file failed, by error class",
+		[]string{"class"},
+		nil)
+
+	threadWchanDesc = newGroupDesc(
 		"namedprocess_namegroup_threads_wchan",
 		"Number of threads in this group waiting on each wchan",
 		[]string{"groupname", "wchan"},
 		nil)
 
-	threadCountDesc = prometheus.NewDesc(
+	blockedDesc = newGroupDesc(
+		"namedprocess_namegroup_blocked",
+		"Number of processes in this group in uninterruptible sleep on each wchan",
+		[]string{"groupname", "wchan"},
+		nil)
+
+	netReceiveBytesDesc = newGroupDesc(
+		"namedprocess_namegroup_net_receive_bytes_total",
+		"bytes received on the interfaces of the network namespaces of this group's procs, counted in full for every group with procs in a namespace",
+		[]string{"groupname"},
+		nil)
+
+	netTransmitBytesDesc = newGroupDesc(
+		"namedprocess_namegroup_net_transmit_bytes_total",
+		"bytes transmitted on the interfaces of the network namespaces of this group's procs, counted in full for every group with procs in a namespace",
+		[]string{"groupname"},
+		nil)
+
+	netReceivePacketsDesc = newGroupDesc(
+		"namedprocess_namegroup_net_receive_packets_total",
+		"packets received on the interfaces of the network namespaces of this group's procs, counted in full for every group with procs in a namespace",
+		[]string{"groupname"},
+		nil)
+
+	netTransmitPacketsDesc = newGroupDesc(
+		"namedprocess_namegroup_net_transmit_packets_total",
+		"packets transmitted on the interfaces of the network namespaces of this group's procs, counted in full for every group with procs in a namespace",
+		[]string{"groupname"},
+		nil)
+
+	capabilityDesc = newGroupDesc(
+		"namedprocess_namegroup_capability",
+		"number of processes in this group with each capability given by -capabilities in their effective set",
+		[]string{"groupname", "capability"},
+		nil)
+
+	schedPolicyDesc = newGroupDesc(
+		"namedprocess_namegroup_sched_policy",
+		"number of processes in this group, or of threads if the threads collector is enabled, with each scheduling policy",
+		[]string{"groupname", "policy"},
+		nil)
+
+	threadCountDesc = newGroupDesc(
 		"namedprocess_namegroup_thread_count",
 		"Number of threads in this group with same threadname",
 		[]string{"groupname", "threadname"},
 		nil)
 
-	threadCpuSecsDesc = prometheus.NewDesc(
+	threadCpuSecsDesc = newGroupDesc(
 		"namedprocess_namegroup_thread_cpu_seconds_total",
 		"Cpu user/system usage in seconds",
 		[]string{"groupname", "threadname", "mode"},
 		nil)
 
-	threadIoBytesDesc = prometheus.NewDesc(
+	threadIoBytesDesc = newGroupDesc(
 		"namedprocess_namegroup_thread_io_bytes_total",
 		"number of bytes read/written by these threads",
 		[]string{"groupname", "threadname", "iomode"},
 		nil)
 
-	threadMajorPageFaultsDesc = prometheus.NewDesc(
+	threadMajorPageFaultsDesc = newGroupDesc(
 		"namedprocess_namegroup_thread_major_page_faults_total",
 		"Major page faults for these threads",
 		[]string{"groupname", "threadname"},
 		nil)
 
-	threadMinorPageFaultsDesc = prometheus.NewDesc(
+	threadMinorPageFaultsDesc = newGroupDesc(
 		"namedprocess_namegroup_thread_minor_page_faults_total",
 		"Minor page faults for these threads",
 		[]string{"groupname", "threadname"},
 		nil)
 
-	threadContextSwitchesDesc = prometheus.NewDesc(
+	threadContextSwitchesDesc = newGroupDesc(
 		"namedprocess_namegroup_thread_context_switches_total",
 		"Context switches for these threads",
 		[]string{"groupname", "threadname", "ctxswitchtype"},
 		nil)
+
+	pidCpuSecsDesc = newGroupDesc(
+		"namedprocess_pid_cpu_seconds_total",
+		"CPU user/system usage in seconds of a process, or of the remainder",
+		[]string{"groupname", "pid", "instance_id", "mode"},
+		nil)
+
+	pidMembytesDesc = newGroupDesc(
+		"namedprocess_pid_memory_bytes",
+		"memory in bytes of a process, or of the remainder",
+		[]string{"groupname", "pid", "instance_id", "memtype"},
+		nil)
+
+	pidReadBytesDesc = newGroupDesc(
+		"namedprocess_pid_read_bytes_total",
+		"number of bytes read by a process, or by the remainder",
+		[]string{"groupname", "pid", "instance_id"},
+		nil)
+
+	pidWriteBytesDesc = newGroupDesc(
+		"namedprocess_pid_write_bytes_total",
+		"number of bytes written by a process, or by the remainder",
+		[]string{"groupname", "pid", "instance_id"},
+		nil)
+
+	pidMajorPageFaultsDesc = newGroupDesc(
+		"namedprocess_pid_major_page_faults_total",
+		"major page faults of a process, or of the remainder",
+		[]string{"groupname", "pid", "instance_id"},
+		nil)
+
+	pidOpenFDsDesc = newGroupDesc(
+		"namedprocess_pid_open_filedesc",
+		"number of open file descriptors of a process, or of the remainder",
+		[]string{"groupname", "pid", "instance_id"},
+		nil)
+
+	pidNumThreadsDesc = newGroupDesc(
+		"namedprocess_pid_num_threads",
+		"number of threads of a process, or of the remainder",
+		[]string{"groupname", "pid", "instance_id"},
+		nil)
+
+	pidUserDesc = newGroupDesc(
+		"namedprocess_pid_user",
+		"always 1, with the effective user of a process by name, or by uid if it has none",
+		[]string{"groupname", "pid", "instance_id", "user"},
+		nil)
+
+	pidRemainderProcsDesc = prometheus.NewDesc(
+		"namedprocess_pid_remainder_procs",
+		"number of tracked processes not among the top ones reported per pid",
+		nil,
+		nil)
+
+	collectorEnabledDesc = prometheus.NewDesc(
+		"namedprocess_collector_enabled",
+		"1 if the collector is enabled, 0 if it was disabled by flag or found not to work",
+		[]string{"collector"},
+		nil)
 )
 
+// pidRemainder is the pid label value of the per-pid series of the processes
+// not among the top ones.
+const pidRemainder = "remainder"
+
 type (
 	prefixRegex struct {
 		prefix string
@@ -221,8 +544,151 @@ type (
 	nameMapperRegex struct {
 		mapping map[string]*prefixRegex
 	}
+
+	// collectorsNamer wraps a MatchNamer to resolve which of the
+	// overridable collectors read the procs of each group, see collectors.
+	collectorsNamer struct {
+		common.MatchNamer
+		// enabled is whether each collector is enabled, see
+		// probeCollectors.
+		enabled map[string]bool
+		// available is whether each collector works, see probeCollectors.
+		available map[string]bool
+		// gatherSMaps is true if smaps are read for every group, whatever
+		// its item says, as long as the smaps collector is enabled.
+		gatherSMaps bool
+	}
 )
 
+// overridableCollectors are the collectors process_names entries may turn on
+// or off for their groups, see common.CollectorsNamer.
+var overridableCollectors = []string{"smaps", "threads", "io"}
+
+// collectors returns whether each of the overridable collectors is on for a
+// group turning those in overrides on or off: as overrides says, or as
+// they're enabled if it doesn't say, smaps only with -gather-smaps.  Items
+// can't turn smaps off when -gather-smaps turns them on for all groups.  None
+// is on if it doesn't work.
+func (n collectorsNamer) collectors(overrides map[string]bool) map[string]bool {
+	on := make(map[string]bool, len(overridableCollectors))
+	for _, c := range overridableCollectors {
+		v, ok := overrides[c]
+		if c == "smaps" && n.gatherSMaps && n.enabled[c] {
+			v = true
+		} else if !ok {
+			v = n.enabled[c] && c != "smaps"
+		}
+		on[c] = v && n.available[c]
+	}
+	return on
+}
+
+// groupCollectors returns the collectors groupname turns on or off.
+func (n collectorsNamer) groupCollectors(groupname string) map[string]bool {
+	if cn, ok := n.MatchNamer.(common.CollectorsNamer); ok && groupname != "" {
+		return cn.GroupCollectors(groupname)
+	}
+	return nil
+}
+
+// GatherSMaps implements common.SMapsNamer.  Besides the groups turning
+// smaps on, the wrapped namer may ask for them for groups of its own if the
+// smaps collector is enabled.
+func (n collectorsNamer) GatherSMaps(groupname string) bool {
+	overrides := n.groupCollectors(groupname)
+	if _, ok := overrides["smaps"]; !ok && n.enabled["smaps"] {
+		if sn, ok := n.MatchNamer.(common.SMapsNamer); ok && sn.GatherSMaps(groupname) {
+			return true
+		}
+	}
+	return n.collectors(overrides)["smaps"]
+}
+
+// Gather implements common.GatherNamer.
+func (n collectorsNamer) Gather(groupname, collector string) bool {
+	return n.collectors(n.groupCollectors(groupname))[collector]
+}
+
+// GroupDefinition implements common.DefinitionNamer.
+func (n collectorsNamer) GroupDefinition(groupname string) string {
+	return groupDefinition(n.MatchNamer, groupname)
+}
+
+// TrackChildren implements common.ChildrenNamer.
+func (n collectorsNamer) TrackChildren(groupname string) bool {
+	return trackChildren(n.MatchNamer, groupname)
+}
+
+// Excluded implements common.ExcludeNamer.
+func (n collectorsNamer) Excluded(nacl common.ProcAttributes) bool {
+	return excluded(n.MatchNamer, nacl)
+}
+
+// MinAge implements common.MinAgeNamer.
+func (n collectorsNamer) MinAge(groupname string) time.Duration {
+	return minAge(n.MatchNamer, groupname)
+}
+
+// ParentDepth implements common.ParentNamer.
+func (n collectorsNamer) ParentDepth() int {
+	return parentDepth(n.MatchNamer)
+}
+
+// Explain implements common.ExplainNamer.
+func (n collectorsNamer) Explain(nacl common.ProcAttributes) common.MatchExplanation {
+	return explain(n.MatchNamer, nacl)
+}
+
+// explain returns why namer does or doesn't match nacl, only its verdict if
+// it can't tell more.
+func explain(namer common.MatchNamer, nacl common.ProcAttributes) common.MatchExplanation {
+	if en, ok := namer.(common.ExplainNamer); ok {
+		return en.Explain(nacl)
+	}
+	var ex common.MatchExplanation
+	ex.Matched, ex.GroupName = namer.MatchAndName(nacl)
+	return ex
+}
+
+// parentDepth returns how many ancestors namer matches procs by.
+func parentDepth(namer common.MatchNamer) int {
+	if pn, ok := namer.(common.ParentNamer); ok {
+		return pn.ParentDepth()
+	}
+	return 0
+}
+
+// excluded returns true if namer excludes the proc from every group.
+func excluded(namer common.MatchNamer, nacl common.ProcAttributes) bool {
+	en, ok := namer.(common.ExcludeNamer)
+	return ok && en.Excluded(nacl)
+}
+
+// minAge returns how old namer wants the procs it puts in groupname to be
+// before they're tracked.
+func minAge(namer common.MatchNamer, groupname string) time.Duration {
+	if mn, ok := namer.(common.MinAgeNamer); ok {
+		return mn.MinAge(groupname)
+	}
+	return 0
+}
+
+// trackChildren returns true if namer asks for the children of the procs in
+// groupname to join it.
+func trackChildren(namer common.MatchNamer, groupname string) bool {
+	cn, ok := namer.(common.ChildrenNamer)
+	return ok && cn.TrackChildren(groupname)
+}
+
+// groupDefinition returns the definition namer gives groupname, if it gives
+// definitions.
+func groupDefinition(namer common.MatchNamer, groupname string) string {
+	if dn, ok := namer.(common.DefinitionNamer); ok {
+		return dn.GroupDefinition(groupname)
+	}
+	return ""
+}
+
 func (nmr *nameMapperRegex) String() string {
 	return fmt.Sprintf("%+v", nmr.mapping)
 }
@@ -279,7 +745,73 @@ func (nmr *nameMapperRegex) MatchAndName(nacl common.ProcAttributes) (bool, stri
 
 func init() {
 	promVersion.Version = version
-	prometheus.MustRegister(promVersion.NewCollector("process_exporter"))
+}
+
+// parseAgeBuckets parses a comma-separated list of increasing durations,
+// which may use the units d and w as well as those of time.ParseDuration.
+func parseAgeBuckets(s string) ([]time.Duration, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var buckets []time.Duration
+	for _, field := range strings.Split(s, ",") {
+		d, err := model.ParseDuration(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		bound := time.Duration(d)
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket %q isn't greater than the one before", field)
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
+}
+
+// unlistedSchedPolicy returns true if policy isn't one of proc.SchedPolicies,
+// which are reported for every group whether they have members or not.
+func unlistedSchedPolicy(policy string) bool {
+	for _, p := range proc.SchedPolicies {
+		if p == policy {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCapabilities parses a comma-separated list of capabilities, see
+// proc.ParseCapability, into their bits.  Each may only be given once.
+func parseCapabilities(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var bits []int
+	seen := make(map[int]bool)
+	for _, field := range strings.Split(s, ",") {
+		bit, err := proc.ParseCapability(field)
+		if err != nil {
+			return nil, err
+		}
+		if seen[bit] {
+			return nil, fmt.Errorf("capability %q given twice", field)
+		}
+		seen[bit] = true
+		bits = append(bits, bit)
+	}
+	return bits, nil
+}
+
+// wrapRegisterer returns reg wrapped to prefix metric names with namespace,
+// if not empty, and to add labels to every series.  Registering fails if a
+// label in labels is already one of a metric's own.
+func wrapRegisterer(reg prometheus.Registerer, namespace string, labels map[string]string) prometheus.Registerer {
+	if namespace != "" {
+		reg = prometheus.WrapRegistererWithPrefix(namespace+"_", reg)
+	}
+	if len(labels) > 0 {
+		reg = prometheus.WrapRegistererWith(labels, reg)
+	}
+	return reg
 }
 
 func main() {
@@ -294,25 +826,69 @@ func main() {
 			"comma-separated list of process names to monitor")
 		procfsPath = flag.String("procfs", "/proc",
 			"path to read proc data from")
+		cgroupfsPath = flag.String("cgroupfs", "",
+			"path to read cgroup data from; if empty, cgroup mounts are found from mountinfo")
+		cgroupfsNoSymlinks = flag.Bool("cgroupfs-no-symlinks", false,
+			"open cgroup files with openat2, refusing symlinks and paths leaving the cgroup mount; falls back to a plain open on kernels without openat2")
+		cgroupMemory = flag.String("cgroup-memory", string(proc.CgroupMemoryCurrent),
+			"cgroup memory value to report per group: current, working_set or limit")
 		nameMapping = flag.String("namemapping", "",
 			"comma-separated list, alternating process name and capturing regex to apply to cmdline")
 		children = flag.Bool("children", true,
 			"if a proc is tracked, track with it any children that aren't part of their own group")
 		threads = flag.Bool("threads", true,
 			"report on per-threadname metrics as well")
-		smaps = flag.Bool("gather-smaps", true,
-			"gather metrics from smaps file, which contains proportional resident memory size")
+		childCPU = flag.Bool("child-cpu", false,
+			"report CPU time of reaped children as cpu_seconds_total mode=\"child\"")
+		smaps = flag.Bool("gather-smaps", false,
+			"gather metrics from smaps file, which contains proportional and unique resident memory size, for all groups")
 		man = flag.Bool("man", false,
 			"print manual")
-		configPath = flag.String("config.path", "",
-			"path to YAML config file")
+		configCheck = flag.Bool("config.check", false,
+			"check the -config.path files, listing every error found, and exit with status 0 if they're valid or 1 if not")
+		configCheckProcfs = flag.String("config.check.procfs", "",
+			"with -config.check, also print the group each process under this procfs path, e.g. a snapshot, would be put in")
+		metricsNamespace = flag.String("metrics.namespace", "",
+			"if not empty, prefix all metric names with this and an underscore")
+		staleGroupTTL = flag.Duration("stale-group-ttl", 0,
+			"if positive, stop reporting groups that have had no processes for this long")
+		otherGroup = flag.String("other-group", "",
+			"if not empty, the name of a group for all procs that aren't part of another group")
+		otherKernelThreads = flag.Bool("other-group-kernel-threads", true,
+			"include kernel threads in the -other-group group")
+		perPid = flag.Bool("per-pid", false,
+			"report per process rather than per group, requires -per-pid.top")
+		perPidTop = flag.Int("per-pid.top", 0,
+			"if positive, report per process for this many processes, folding the others into a remainder")
+		perPidBy = flag.String("per-pid.by", string(proc.ProcRankCPU),
+			"what -per-pid.top ranks processes by: cpu, i.e. CPU used since the last scrape, rss, fds or threads")
+		perPidUser = flag.Bool("per-pid.user", false,
+			"with -per-pid.top, also report the user of each process as namedprocess_pid_user")
+		blockedWchans = flag.Int("blocked-wchans", 0,
+			"if positive, report processes in uninterruptible sleep by wchan for up to this many wchans per group")
+		netdevExcludeLoopback = flag.Bool("netdev.exclude-loopback", false,
+			"leave the traffic of lo out of the netdev collector's metrics")
+		netdevIncludeHost = flag.Bool("netdev.include-host", false,
+			"attribute the traffic of the host network namespace, that of pid 1, to the groups with processes in it too")
+		capabilities = flag.String("capabilities", "",
+			"if not empty, comma-separated capabilities such as cap_sys_admin,cap_net_raw to count each group's processes holding, by name or bit number")
+		processAgeBuckets = flag.String("process-age-buckets", "",
+			"if not empty, comma-separated increasing upper bounds such as 1m,1h,1d of the buckets to count each group's processes by age into")
 		recheck = flag.Bool("recheck", false,
 			"recheck process names on each scrape")
+		recheckInterval = flag.Duration("recheck-interval", 0,
+			"if positive, recheck the names of processes not in any group this often")
+		readWorkers = flag.Int("read-workers", runtime.NumCPU(),
+			"how many processes to read from procfs at once, lowered if need be to stay within the open files limit")
 		debug = flag.Bool("debug", false,
 			"log debugging information to stdout")
 		showVersion = flag.Bool("version", false,
 			"print version information and exit")
+		collectorFlags = newCollectorFlags()
+		configPaths    config.Paths
 	)
+	flag.Var(&configPaths, "config.path",
+		"path to YAML config file, or to a directory of *.yml files; may be repeated, the files being merged")
 	flag.Parse()
 
 	if *showVersion {
@@ -325,22 +901,61 @@ func main() {
 		return
 	}
 
-	var matchnamer common.MatchNamer
+	if *configCheck {
+		if len(configPaths) == 0 {
+			log.Fatalf("-config.check requires -config.path")
+		}
+		if !checkConfig(os.Stdout, configPaths, *configCheckProcfs, *children) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *configCheckProcfs != "" {
+		log.Fatalf("-config.check.procfs requires -config.check")
+	}
+
+	var (
+		matchnamer   common.MatchNamer
+		constLabels  map[string]string
+		cgroupFilter *proc.CgroupFilter
+		fileConfig   *config.Config
+	)
 
-	if *configPath != "" {
+	if len(configPaths) > 0 {
 		if *nameMapping != "" || *procNames != "" {
 			log.Fatalf("-config.path cannot be used with -namemapping or -procnames")
 		}
 
-		cfg, err := config.ReadFile(*configPath, *debug)
+		cfg, err := config.ReadFiles(configPaths, *debug)
 		if err != nil {
-			log.Fatalf("error reading config file %q: %v", *configPath, err)
+			log.Fatalf("Error reading config: %v", err)
 		}
-		log.Printf("Reading metrics from %s based on %q", *procfsPath, *configPath)
+		log.Printf("Reading metrics from %s based on %q", *procfsPath, configPaths.String())
+		fileConfig = cfg
 		matchnamer = cfg.MatchNamers
 		if *debug {
 			log.Printf("using config matchnamer: %v", cfg.MatchNamers)
 		}
+		if cfg.OtherGroup != nil && *otherGroup == "" {
+			*otherGroup = cfg.OtherGroup.Name
+			*otherKernelThreads = cfg.OtherGroup.KernelThreads
+		}
+		if cfg.StaleGroupTTL > 0 && *staleGroupTTL == 0 {
+			*staleGroupTTL = cfg.StaleGroupTTL
+		}
+		if cfg.RecheckInterval > 0 && *recheckInterval == 0 {
+			*recheckInterval = cfg.RecheckInterval
+		}
+		if cfg.RecheckOnScrape {
+			*recheck = true
+		}
+		constLabels = cfg.Labels
+		if cfg.CgroupFilter != nil {
+			cgroupFilter = &proc.CgroupFilter{
+				Prefixes: cfg.CgroupFilter.Prefixes,
+				Regexp:   cfg.CgroupFilter.Regex,
+			}
+		}
 	} else {
 		namemapper, err := parseNameMapper(*nameMapping)
 		if err != nil {
@@ -364,22 +979,67 @@ func main() {
 		matchnamer = namemapper
 	}
 
+	cgroupMemorySource, err := proc.ParseCgroupMemorySource(*cgroupMemory)
+	if err != nil {
+		log.Fatalf("Bad -cgroup-memory: %v", err)
+	}
+
+	perPidRank, err := proc.ParseProcRank(*perPidBy)
+	if err != nil {
+		log.Fatalf("Bad -per-pid.by: %v", err)
+	}
+
+	capabilityBits, err := parseCapabilities(*capabilities)
+	if err != nil {
+		log.Fatalf("Bad -capabilities: %v", err)
+	}
+
+	ageBuckets, err := parseAgeBuckets(*processAgeBuckets)
+	if err != nil {
+		log.Fatalf("Bad -process-age-buckets: %v", err)
+	}
+
 	pc, err := NewProcessCollector(
 		ProcessCollectorOption{
-			ProcFSPath:  *procfsPath,
-			Children:    *children,
-			Threads:     *threads,
-			GatherSMaps: *smaps,
-			Namer:       matchnamer,
-			Recheck:     *recheck,
-			Debug:       *debug,
+			ProcFSPath:         *procfsPath,
+			CgroupFSPath:       *cgroupfsPath,
+			CgroupNoSymlinks:   *cgroupfsNoSymlinks,
+			CgroupFilter:       cgroupFilter,
+			CgroupMemory:       cgroupMemorySource,
+			Children:           *children,
+			Threads:            *threads,
+			GatherSMaps:        *smaps,
+			ChildCPU:           *childCPU,
+			Namer:              matchnamer,
+			Recheck:            *recheck,
+			RecheckInterval:    *recheckInterval,
+			ReadWorkers:        *readWorkers,
+			Debug:              *debug,
+			OtherGroup:         *otherGroup,
+			OtherKernelThreads: *otherKernelThreads,
+			PerPid:             *perPid || *perPidTop > 0,
+			PerPidTop:          *perPidTop,
+			PerPidRank:         perPidRank,
+			PerPidUser:         *perPidUser,
+			BlockedWchans:      *blockedWchans,
+			StaleGroupTTL:      *staleGroupTTL,
+			Collectors:         collectorFlags.enabled(),
+			AgeBuckets:         ageBuckets,
+			Capabilities:       capabilityBits,
+			NetDevNoLoopback:   *netdevExcludeLoopback,
+			NetDevIncludeHost:  *netdevIncludeHost,
 		},
 	)
 	if err != nil {
 		log.Fatalf("Error initializing: %v", err)
 	}
 
-	prometheus.MustRegister(pc)
+	reg := wrapRegisterer(prometheus.DefaultRegisterer, *metricsNamespace, constLabels)
+	for _, c := range []prometheus.Collector{promVersion.NewCollector("process_exporter"), pc} {
+		if err := reg.Register(c); err != nil {
+			log.Fatalf("Error registering metrics: %v", err)
+		}
+	}
 
 	if *onceToStdoutDelay != 0 {
 		// We throw away the first result because that first collection primes the pump, and
@@ -392,7 +1052,25 @@ func main() {
 		return
 	}
 
+	if len(configPaths) > 0 {
+		reloader := newConfigReloader(configPaths, *debug, pc, fileConfig)
+		if err := reg.Register(reloader.success); err != nil {
+			log.Fatalf("Error registering metrics: %v", err)
+		}
+		http.HandleFunc("/-/reload", reloader.serveReload)
+		http.HandleFunc("/debug/config", reloader.serveConfig)
+		reloader.watchSIGHUP()
+	} else {
+		http.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "no config file, see -config.path", http.StatusNotFound)
+		})
+	}
+
 	http.Handle(*metricsPath, promhttp.Handler())
+	http.HandleFunc("/debug/cgroup", pc.serveCgroup)
+
+	http.HandleFunc("/debug/top", pc.serveTop)
+	http.HandleFunc("/debug/match", pc.serveMatch)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
@@ -400,6 +1078,9 @@ func main() {
 			<body>
 			<h1>Named Process Exporter</h1>
 			<p><a href="` + *metricsPath + `">Metrics</a></p>
+			<p><a href="/debug/cgroup">Cgroup self-check</a></p>
+			<p><a href="/debug/top?by=rss&amp;n=20&amp;format=text">Top processes</a></p>
+			<p><a href="/debug/config">Config</a></p>
 			</body>
 			</html>`))
 	})
@@ -412,46 +1093,240 @@ type (
 	scrapeRequest struct {
 		results chan<- prometheus.Metric
 		done    chan struct{}
+		// collector, if not nil, is the sub-collector whose metrics alone
+		// are sent to results.
+		collector *subCollector
 	}
 
 	ProcessCollectorOption struct {
-		ProcFSPath  string
-		Children    bool
-		Threads     bool
-		GatherSMaps bool
-		Namer       common.MatchNamer
-		Recheck     bool
-		Debug       bool
+		ProcFSPath   string
+		CgroupFSPath string
+		CgroupMemory proc.CgroupMemorySource
+		Children     bool
+		Threads      bool
+		GatherSMaps  bool
+		ChildCPU     bool
+		Namer        common.MatchNamer
+		Recheck      bool
+		Debug        bool
+		// RecheckInterval, if positive, is how often procs that aren't
+		// tracked are matched again, when Recheck isn't set.
+		RecheckInterval time.Duration
+		// ReadWorkers, if more than one, is how many procs are read at
+		// once, see proc.Grouper.SetReadWorkers.  It's lowered to
+		// proc.MaxReadWorkers if it's more.
+		ReadWorkers int
+		// OtherGroup, if not empty, is the name of the group of procs not
+		// in any other group.  OtherKernelThreads includes kernel threads.
+		OtherGroup         string
+		OtherKernelThreads bool
+		// PerPid reports on the PerPidTop procs ranked highest by
+		// PerPidRank rather than on groups.  A cap is required, so that the
+		// number of series stays bounded.
+		PerPid     bool
+		PerPidTop  int
+		PerPidRank proc.ProcRank
+		// PerPidUser reports the user of each of those procs, see
+		// pidUserDesc.
+		PerPidUser bool
+		// BlockedWchans, if positive, reports the procs of each group in
+		// uninterruptible sleep by wchan, for that many wchans.
+		BlockedWchans int
+		// StaleGroupTTL, if positive, is how long a group may have no procs
+		// before it stops being reported.
+		StaleGroupTTL time.Duration
+		// Collectors enables or disables sub-collectors by name, see
+		// subCollectors.  Those it doesn't name have their default.
+		Collectors map[string]bool
+		// AgeBuckets, if not empty, are the increasing upper bounds of the
+		// buckets each group's procs are counted into by age.
+		AgeBuckets []time.Duration
+		// CgroupNoSymlinks refuses symlinks when reading cgroup files, see
+		// proc.FS.CgroupNoSymlinks.
+		CgroupNoSymlinks bool
+		// CgroupFilter, if not nil, restricts the procs scraped to those it
+		// matches, see proc.FS.CgroupFilter.
+		CgroupFilter *proc.CgroupFilter
+		// Capabilities are the bits of the capabilities to count the procs
+		// of each group holding.
+		Capabilities []int
+		// NetDevNoLoopback and NetDevIncludeHost configure the netdev
+		// collector, see proc.NewNetDevCounter.
+		NetDevNoLoopback  bool
+		NetDevIncludeHost bool
 	}
 
 	NamedProcessCollector struct {
 		scrapeChan chan scrapeRequest
+		// samplesChan asks for the state of the tracked procs.
+		samplesChan chan chan []proc.ProcSample
+		// reloadChan asks for the namer to be replaced, see Reload.
+		reloadChan chan reloadRequest
+		// matchChan asks for how a proc is matched, see explain.
+		matchChan chan matchRequest
 		*proc.Grouper
-		threads              bool
-		smaps                bool
+		threads bool
+		io      bool
+		// vmPin is true if the kernel reports pinned memory, see
+		// proc.FS.CheckVmPin.
+		vmPin bool
+		// rssBreakdown is true if the kernel reports the anon, file and
+		// shmem parts of resident memory, see proc.FS.CheckRssBreakdown.
+		rssBreakdown bool
+		childCPU     bool
+		// namer is the namer groups are named by, as wrapped to tell which
+		// collectors read the procs of each group.
+		namer                collectorsNamer
+		cgroupMemory         proc.CgroupMemorySource
+		oomKills             *proc.OOMKillCounter
+		pgSteal              *proc.PgStealCounter
+		cpuThrottling        *proc.CPUThrottlingCounter
+		limitChanges         *proc.CgroupLimitChangeCounter
+		netDev               *proc.NetDevCounter
 		source               proc.Source
+		fs                   *proc.FS
 		scrapeErrors         int
 		scrapeProcReadErrors int
 		scrapePartialErrors  int
-		debug                bool
+		scrapePartialProcs   int
+		// scrapeCounterRegressions counts the counters of tracked procs
+		// found to have decreased, see proc.CollectErrors.
+		scrapeCounterRegressions int
+		// scrapeIOSkipped counts the procs whose I/O stats were skipped,
+		// see proc.CollectErrors.
+		scrapeIOSkipped int
+		scrapeDuration  time.Duration
+		// collectionDuration observes the time taken by each scrape to
+		// read procs and their cgroups.
+		collectionDuration prometheus.Histogram
+		// cgroupReadDuration observes the time taken by each scrape to read
+		// cgroupfs, reported as cgroupReadDurationDesc.
+		cgroupReadDuration prometheus.Histogram
+		// perPidTop, if positive, is the number of procs to report on
+		// individually rather than reporting on groups, ranked by
+		// perPidRank.
+		perPidTop  int
+		perPidRank proc.ProcRank
+		perPidUser bool
+		// pidRemainder accumulates the counts of the procs not among the
+		// top ones in each scrape.
+		pidRemainder proc.Counts
+		// blockedWchans is the number of wchans per group to report blocked
+		// procs on, or 0 not to.
+		blockedWchans int
+		// ageBuckets are the bounds of the process age buckets, if any.
+		ageBuckets []time.Duration
+		// capabilities are the bits of the capabilities to report, if any.
+		capabilities []int
+		// collectors is whether each sub-collector is enabled.
+		collectors map[string]bool
+		// labelsNamer, if not nil, gives the labels of groups, named by
+		// groupLabelNames.  groupDescs then maps each group desc to the one
+		// with those labels added, see groupMetric.
+		labelsNamer     common.LabelsNamer
+		groupLabelNames []string
+		groupDescs      map[*prometheus.Desc]*prometheus.Desc
+		debug           bool
 	}
 )
 
 func NewProcessCollector(options ProcessCollectorOption) (*NamedProcessCollector, error) {
+	if options.PerPid && options.PerPidTop <= 0 {
+		return nil, fmt.Errorf("per-pid mode requires a positive limit on the number of procs")
+	}
+
 	fs, err := proc.NewFS(options.ProcFSPath, options.Debug)
 	if err != nil {
 		return nil, err
 	}
 
-	fs.GatherSMaps = options.GatherSMaps
+	collectors, available, err := probeCollectors(fs, options.Collectors)
+	if err != nil {
+		return nil, err
+	}
+
+	// The FS reads what any group may want, and the Tracker chooses what
+	// to read of each proc according to its group.
+	namer := collectorsNamer{options.Namer, collectors, available, options.GatherSMaps}
+	fs.GatherIO = available["io"]
+	fs.GatherThreads = available["threads"]
+	fs.GatherWchan = collectors["wchan"]
+	if !collectors["cgroup"] {
+		options.CgroupMemory = ""
+	}
+	fs.GatherCgroups = options.CgroupMemory != ""
+	if options.CgroupFSPath != "" {
+		fs.CgroupMountPoint = options.CgroupFSPath
+	}
+	fs.CgroupNoSymlinks = options.CgroupNoSymlinks
+	fs.CgroupFilter = options.CgroupFilter
+	if !collectors["capability"] {
+		options.Capabilities = nil
+	}
+	fs.GatherCapabilities = len(options.Capabilities) > 0
+	fs.GatherNetns = collectors["netdev"]
+	fs.GatherSchedPolicy = collectors["sched_policy"]
+	fs.GatherCPUsAllowed = collectors["cpus_allowed"]
+	fs.GatherRuntime = needsRuntime(options.Namer)
+	fs.GatherCgroupPath = needsCgroupPath(options.Namer)
+	fs.EnvVars = envVars(options.Namer)
+	fs.GatherListeningPorts = needsListeningPorts(options.Namer)
+	threads := options.Threads && available["threads"]
 	p := &NamedProcessCollector{
-		scrapeChan: make(chan scrapeRequest),
-		Grouper:    proc.NewGrouper(options.Namer, options.Children, options.Threads, options.Recheck, options.Debug),
-		source:     fs,
-		threads:    options.Threads,
-		smaps:      options.GatherSMaps,
-		debug:      options.Debug,
+		scrapeChan:    make(chan scrapeRequest),
+		samplesChan:   make(chan chan []proc.ProcSample),
+		reloadChan:    make(chan reloadRequest),
+		matchChan:     make(chan matchRequest),
+		Grouper:       proc.NewGrouper(namer, options.Children, threads, options.Recheck, options.Debug),
+		source:        fs,
+		fs:            fs,
+		threads:       threads,
+		io:            fs.GatherIO,
+		vmPin:         fs.CheckVmPin(),
+		rssBreakdown:  fs.CheckRssBreakdown(),
+		childCPU:      options.ChildCPU,
+		namer:         namer,
+		cgroupMemory:  options.CgroupMemory,
+		oomKills:      proc.NewOOMKillCounter(fs),
+		pgSteal:       proc.NewPgStealCounter(fs),
+		cpuThrottling: proc.NewCPUThrottlingCounter(fs),
+		limitChanges:  proc.NewCgroupLimitChangeCounter(fs),
+		collectionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "namedprocess_scrape_collection_duration_seconds",
+			Help: "time taken by scrapes to read procs and their cgroups",
+		}),
+		cgroupReadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "namedprocess_cgroup_read_duration_seconds",
+			Help:    "time taken by scrapes to read cgroupfs",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		perPidTop:     options.PerPidTop,
+		perPidRank:    options.PerPidRank,
+		perPidUser:    options.PerPidUser,
+		blockedWchans: options.BlockedWchans,
+		ageBuckets:    options.AgeBuckets,
+		capabilities:  options.Capabilities,
+		collectors:    collectors,
+		debug:         options.Debug,
+	}
+	if collectors["netdev"] {
+		p.netDev = proc.NewNetDevCounter(fs, options.NetDevNoLoopback, options.NetDevIncludeHost)
 	}
+	if ln, ok := options.Namer.(common.LabelsNamer); ok && len(ln.GroupLabelNames()) > 0 {
+		if err := p.setGroupLabels(ln); err != nil {
+			return nil, err
+		}
+	}
+	p.SetOtherGroup(options.OtherGroup, options.OtherKernelThreads)
+	p.SetStaleGroupTTL(options.StaleGroupTTL)
+	p.SetRecheckInterval(options.RecheckInterval)
+	p.SetAgeBuckets(options.AgeBuckets)
+	readWorkers := options.ReadWorkers
+	if max := proc.MaxReadWorkers(); readWorkers > max {
+		log.Printf("reading procs with %d workers rather than %d, to stay within the open files limit", max, readWorkers)
+		readWorkers = max
+	}
+	p.SetReadWorkers(readWorkers)
 
 	colErrs, _, err := p.Update(p.source.AllProcs())
 	if err != nil {
@@ -462,6 +1337,8 @@ func NewProcessCollector(options ProcessCollectorOption) (*NamedProcessCollector
 	}
 	p.scrapePartialErrors += colErrs.Partial
 	p.scrapeProcReadErrors += colErrs.Read
+	p.scrapeCounterRegressions += colErrs.Regressions
+	p.scrapeIOSkipped += colErrs.IOSkipped
 
 	go p.start()
 
@@ -470,146 +1347,594 @@ func NewProcessCollector(options ProcessCollectorOption) (*NamedProcessCollector
 
 // Describe implements prometheus.Collector.
 func (p *NamedProcessCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- cpuSecsDesc
-	ch <- numprocsDesc
-	ch <- readBytesDesc
-	ch <- writeBytesDesc
-	ch <- membytesDesc
-	ch <- openFDsDesc
-	ch <- worstFDRatioDesc
-	ch <- startTimeDesc
-	ch <- majorPageFaultsDesc
-	ch <- minorPageFaultsDesc
-	ch <- contextSwitchesDesc
-	ch <- numThreadsDesc
-	ch <- statesDesc
-	ch <- scrapeErrorsDesc
-	ch <- scrapeProcReadErrorsDesc
-	ch <- scrapePartialErrorsDesc
-	ch <- threadWchanDesc
-	ch <- threadCountDesc
-	ch <- threadCpuSecsDesc
-	ch <- threadIoBytesDesc
-	ch <- threadMajorPageFaultsDesc
-	ch <- threadMinorPageFaultsDesc
-	ch <- threadContextSwitchesDesc
+	ch <- p.desc(cpuSecsDesc)
+	ch <- p.desc(numprocsDesc)
+	ch <- p.desc(procStartsDesc)
+	ch <- p.desc(procExitsDesc)
+	ch <- p.desc(readBytesDesc)
+	ch <- p.desc(writeBytesDesc)
+	ch <- p.desc(cancelledWriteBytesDesc)
+	ch <- p.desc(ioSyscallsDesc)
+	ch <- p.desc(membytesDesc)
+	ch <- p.desc(cgroupMemoryDesc)
+	ch <- p.desc(cgroupCPUThrottledSecsDesc)
+	ch <- p.desc(cgroupCPUThrottledPeriodsDesc)
+	ch <- p.desc(cgroupMemoryPressureDesc)
+	ch <- p.desc(cgroupOOMKillsDesc)
+	ch <- p.desc(cgroupPgStealDesc)
+	ch <- p.desc(cgroupOOMGroupDesc)
+	ch <- p.desc(cgroupMemoryLimitChangesDesc)
+	ch <- p.desc(cgroupsDesc)
+	ch <- p.desc(processAgeDesc)
+	ch <- p.desc(openFDsDesc)
+	ch <- p.desc(worstFDRatioDesc)
+	ch <- p.desc(startTimeDesc)
+	ch <- p.desc(newestStartTimeDesc)
+	ch <- p.desc(majorPageFaultsDesc)
+	ch <- p.desc(minorPageFaultsDesc)
+	ch <- p.desc(contextSwitchesDesc)
+	ch <- p.desc(numThreadsDesc)
+	ch <- p.desc(worstThreadsDesc)
+	ch <- p.desc(threadsPidsRatioDesc)
+	ch <- p.desc(statesDesc)
+	ch <- p.desc(zombiesDesc)
+	ch <- p.desc(lowestNiceDesc)
+	ch <- p.desc(highestPriorityDesc)
+	ch <- p.desc(realtimeProcsDesc)
+	ch <- p.desc(minCPUsAllowedDesc)
+	ch <- p.desc(orphanedZombiesDesc)
+	ch <- p.desc(scrapeErrorsDesc)
+	ch <- p.desc(scrapeProcReadErrorsDesc)
+	ch <- p.desc(scrapeReadErrorsDesc)
+	ch <- p.desc(scrapePartialProcsDesc)
+	ch <- p.desc(scrapePartialErrorsDesc)
+	ch <- p.desc(scrapeCounterRegressionsDesc)
+	ch <- p.desc(scrapeIOSkippedDesc)
+	ch <- p.desc(scrapeDurationDesc)
+	ch <- p.desc(scrapeProcsScannedDesc)
+	ch <- p.desc(scrapeProcsMatchedDesc)
+	ch <- p.desc(scrapeGroupsDesc)
+	ch <- p.collectionDuration.Desc()
+	ch <- p.desc(cgroupReadDurationDesc)
+	ch <- p.desc(cgroupDescendantsDesc)
+	ch <- p.desc(cgroupDyingDescendantsDesc)
+	ch <- p.desc(cgroupReadErrorsDesc)
+	ch <- p.desc(threadWchanDesc)
+	ch <- p.desc(blockedDesc)
+	ch <- p.desc(capabilityDesc)
+	ch <- p.desc(schedPolicyDesc)
+	ch <- p.desc(netReceiveBytesDesc)
+	ch <- p.desc(netTransmitBytesDesc)
+	ch <- p.desc(netReceivePacketsDesc)
+	ch <- p.desc(netTransmitPacketsDesc)
+	ch <- p.desc(threadCountDesc)
+	ch <- p.desc(threadCpuSecsDesc)
+	ch <- p.desc(threadIoBytesDesc)
+	ch <- p.desc(threadMajorPageFaultsDesc)
+	ch <- p.desc(threadMinorPageFaultsDesc)
+	ch <- p.desc(threadContextSwitchesDesc)
+	ch <- p.desc(pidCpuSecsDesc)
+	ch <- p.desc(pidMembytesDesc)
+	ch <- p.desc(pidReadBytesDesc)
+	ch <- p.desc(pidWriteBytesDesc)
+	ch <- p.desc(pidMajorPageFaultsDesc)
+	ch <- p.desc(pidOpenFDsDesc)
+	ch <- p.desc(pidNumThreadsDesc)
+	ch <- p.desc(pidUserDesc)
+	ch <- p.desc(pidRemainderProcsDesc)
+	ch <- collectorEnabledDesc
 }
 
 // Collect implements prometheus.Collector.
 func (p *NamedProcessCollector) Collect(ch chan<- prometheus.Metric) {
-	req := scrapeRequest{results: ch, done: make(chan struct{})}
+	p.collect(ch, nil)
+}
+
+// collect scrapes, sending the metrics of collector to ch, or all of them if
+// it's nil.
+func (p *NamedProcessCollector) collect(ch chan<- prometheus.Metric, collector *subCollector) {
+	req := scrapeRequest{results: ch, done: make(chan struct{}), collector: collector}
 	p.scrapeChan <- req
 	<-req.done
 }
 
+// SubCollector returns the named sub-collector as a prometheus.Collector, to
+// be registered instead of p if only some of its metrics are wanted.  Each
+// scrapes on its own, so registering several costs as many scrapes, while p
+// collects them all, and the metrics of no sub-collector, in one.  It
+// collects nothing if the sub-collector is disabled.
+func (p *NamedProcessCollector) SubCollector(name string) (prometheus.Collector, error) {
+	for i := range subCollectors {
+		if subCollectors[i].name == name {
+			return subCollectorView{p, &subCollectors[i]}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown collector %q", name)
+}
+
 func (p *NamedProcessCollector) start() {
-	for req := range p.scrapeChan {
-		ch := req.results
-		p.scrape(ch)
-		req.done <- struct{}{}
+	for {
+		select {
+		case req := <-p.scrapeChan:
+			if req.collector != nil {
+				p.scrapeOwned(req.results, req.collector.owns(p))
+			} else {
+				p.scrape(req.results)
+			}
+			req.done <- struct{}{}
+		case samples := <-p.samplesChan:
+			samples <- p.ProcSamples()
+		case req := <-p.reloadChan:
+			p.setNamer(req.namer)
+			close(req.done)
+		case req := <-p.matchChan:
+			req.result <- p.explainPid(req.pid)
+		}
 	}
 }
 
+// procSamples returns the state of the tracked procs as of the last scrape.
+// It's safe to call concurrently with scrapes.
+func (p *NamedProcessCollector) procSamples() []proc.ProcSample {
+	samples := make(chan []proc.ProcSample)
+	p.samplesChan <- samples
+	return <-samples
+}
+
+// cgroupMetrics returns the metrics of group gname read from the cgroups of
+// its procs.  Controllers that aren't mounted are silently skipped.
+func (p *NamedProcessCollector) cgroupMetrics(gname string, gcounts proc.Group) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	if p.cgroupMemory != "" {
+		if v, ok, err := p.fs.CgroupsMemory(gcounts.Cgroups, p.cgroupMemory); proc.IgnoreControllerNotMounted(err) != nil {
+			if p.debug {
+				log.Printf("error reading cgroup memory for group %q: %v", gname, err)
+			}
+		} else if ok {
+			metrics = append(metrics, p.groupMetric(cgroupMemoryDesc,
+				prometheus.GaugeValue, float64(v), gname))
+		}
+	}
+	if !p.fs.GatherCgroups {
+		return metrics
+	}
+	if n, err := p.fs.CgroupsCount(gcounts.Cgroups); proc.IgnoreControllerNotMounted(err) != nil {
+		if p.debug {
+			log.Printf("error counting cgroups for group %q: %v", gname, err)
+		}
+	} else if n > 0 {
+		metrics = append(metrics, p.groupMetric(cgroupsDesc,
+			prometheus.GaugeValue, float64(n), gname))
+	}
+	if thr, ok, err := p.cpuThrottling.Update(gname, gcounts.Cgroups); proc.IgnoreControllerNotMounted(err) != nil {
+		if p.debug {
+			log.Printf("error reading cgroup cpu throttling for group %q: %v", gname, err)
+		}
+	} else if ok {
+		metrics = append(metrics,
+			p.groupMetric(cgroupCPUThrottledSecsDesc,
+				prometheus.CounterValue, thr.ThrottledSeconds, gname),
+			p.groupMetric(cgroupCPUThrottledPeriodsDesc,
+				prometheus.CounterValue, float64(thr.ThrottledPeriods), gname))
+	}
+	if ratio, ok, err := p.fs.CgroupsMemoryPressure(gcounts.Cgroups); proc.IgnoreControllerNotMounted(err) != nil {
+		if p.debug {
+			log.Printf("error reading cgroup memory pressure for group %q: %v", gname, err)
+		}
+	} else if ok {
+		metrics = append(metrics, p.groupMetric(cgroupMemoryPressureDesc,
+			prometheus.GaugeValue, ratio, gname))
+	}
+	if kills, ok, err := p.oomKills.Update(gname, gcounts.Cgroups); proc.IgnoreControllerNotMounted(err) != nil {
+		if p.debug {
+			log.Printf("error reading cgroup oom kills for group %q: %v", gname, err)
+		}
+	} else if ok {
+		metrics = append(metrics, p.groupMetric(cgroupOOMKillsDesc,
+			prometheus.CounterValue, float64(kills), gname))
+	}
+	if steal, ok, err := p.pgSteal.Update(gname, gcounts.Cgroups); proc.IgnoreControllerNotMounted(err) != nil {
+		if p.debug {
+			log.Printf("error reading cgroup reclaim for group %q: %v", gname, err)
+		}
+	} else if ok {
+		metrics = append(metrics, p.groupMetric(cgroupPgStealDesc,
+			prometheus.CounterValue, float64(steal), gname))
+	}
+	if n, ok, err := p.fs.CgroupsOOMGroup(gcounts.Cgroups); proc.IgnoreControllerNotMounted(err) != nil {
+		if p.debug {
+			log.Printf("error reading cgroup oom group for group %q: %v", gname, err)
+		}
+	} else if ok {
+		metrics = append(metrics, p.groupMetric(cgroupOOMGroupDesc,
+			prometheus.GaugeValue, float64(n), gname))
+	}
+	if changes, ok, err := p.limitChanges.Update(gname, gcounts.Cgroups); proc.IgnoreControllerNotMounted(err) != nil {
+		if p.debug {
+			log.Printf("error reading cgroup memory limit for group %q: %v", gname, err)
+		}
+	} else if ok {
+		metrics = append(metrics, p.groupMetric(cgroupMemoryLimitChangesDesc,
+			prometheus.CounterValue, float64(changes), gname))
+	}
+	if limit, ok, err := p.fs.CgroupsPidsMax(gcounts.Cgroups); proc.IgnoreControllerNotMounted(err) != nil {
+		if p.debug {
+			log.Printf("error reading cgroup pids limit for group %q: %v", gname, err)
+		}
+	} else if ok {
+		metrics = append(metrics, p.groupMetric(threadsPidsRatioDesc,
+			prometheus.GaugeValue, float64(gcounts.NumThreads)/float64(limit), gname))
+	}
+	return metrics
+}
+
+// scrapePids emits the metrics of the top procs individually and those of
+// the others as a remainder.  Only the top procs of the current scrape are
+// reported, so the series of a pid that drops out of the top go stale.  The
+// remainder's counters accumulate what the procs in it used during each
+// scrape, so they never decrease as procs move in and out of the top.
+func (p *NamedProcessCollector) scrapePids(ch chan<- prometheus.Metric) {
+	top, rest := proc.TopProcs(p.ProcSamples(), p.perPidTop, p.perPidRank)
+	var remainder proc.ProcSample
+	for _, s := range rest {
+		p.pidRemainder.Add(s.Latest)
+		remainder.Memory.ResidentBytes += s.Memory.ResidentBytes
+		remainder.Memory.VirtualBytes += s.Memory.VirtualBytes
+		remainder.Memory.VmSwapBytes += s.Memory.VmSwapBytes
+		if s.Filedesc.Open > 0 {
+			remainder.Filedesc.Open += s.Filedesc.Open
+		}
+		remainder.NumThreads += s.NumThreads
+	}
+	remainder.Counts = p.pidRemainder
+
+	for _, s := range top {
+		pid, instanceID := strconv.Itoa(s.ID.Pid), strconv.FormatUint(s.ID.StartTimeRel, 10)
+		p.emitPid(ch, s, s.GroupName, pid, instanceID)
+		if p.perPidUser {
+			ch <- p.groupMetric(pidUserDesc, prometheus.GaugeValue, 1, s.GroupName, pid, instanceID, s.Username)
+		}
+	}
+	p.emitPid(ch, remainder, "", pidRemainder, "")
+	ch <- prometheus.MustNewConstMetric(pidRemainderProcsDesc,
+		prometheus.GaugeValue, float64(len(rest)))
+}
+
+// emitPid emits the per-pid metrics of s with the given labels.
+func (p *NamedProcessCollector) emitPid(ch chan<- prometheus.Metric, s proc.ProcSample, gname, pid, instanceID string) {
+	ch <- p.groupMetric(pidCpuSecsDesc,
+		prometheus.CounterValue, s.Counts.CPUUserTime, gname, pid, instanceID, "user")
+	ch <- p.groupMetric(pidCpuSecsDesc,
+		prometheus.CounterValue, s.Counts.CPUSystemTime, gname, pid, instanceID, "system")
+	ch <- p.groupMetric(pidMembytesDesc,
+		prometheus.GaugeValue, float64(s.Memory.ResidentBytes), gname, pid, instanceID, "resident")
+	ch <- p.groupMetric(pidMembytesDesc,
+		prometheus.GaugeValue, float64(s.Memory.VirtualBytes), gname, pid, instanceID, "virtual")
+	ch <- p.groupMetric(pidMembytesDesc,
+		prometheus.GaugeValue, float64(s.Memory.VmSwapBytes), gname, pid, instanceID, "swapped")
+	if p.io && p.namer.Gather(gname, "io") {
+		ch <- p.groupMetric(pidReadBytesDesc,
+			prometheus.CounterValue, float64(s.Counts.ReadBytes), gname, pid, instanceID)
+		ch <- p.groupMetric(pidWriteBytesDesc,
+			prometheus.CounterValue, float64(s.Counts.WriteBytes), gname, pid, instanceID)
+	}
+	ch <- p.groupMetric(pidMajorPageFaultsDesc,
+		prometheus.CounterValue, float64(s.Counts.MajorPageFaults), gname, pid, instanceID)
+	ch <- p.groupMetric(pidOpenFDsDesc,
+		prometheus.GaugeValue, float64(s.Filedesc.Open), gname, pid, instanceID)
+	ch <- p.groupMetric(pidNumThreadsDesc,
+		prometheus.GaugeValue, float64(s.NumThreads), gname, pid, instanceID)
+}
+
+// scrapeOwned scrapes, sending only the metrics owns returns true for to ch.
+func (p *NamedProcessCollector) scrapeOwned(ch chan<- prometheus.Metric, owns func(prometheus.Metric) bool) {
+	metrics := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range metrics {
+			if owns(m) {
+				ch <- m
+			}
+		}
+	}()
+	p.scrape(metrics)
+	close(metrics)
+	<-done
+}
+
 func (p *NamedProcessCollector) scrape(ch chan<- prometheus.Metric) {
+	start := time.Now()
 	permErrs, groups, err := p.Update(p.source.AllProcs())
+	p.scrapeDuration = time.Since(start)
 	p.scrapePartialErrors += permErrs.Partial
+	p.scrapePartialProcs = permErrs.PartialProcs
+	p.scrapeCounterRegressions += permErrs.Regressions
+	p.scrapeIOSkipped += permErrs.IOSkipped
+
+	// Read all the cgroup metrics in one batch, so that the time spent in
+	// cgroupfs is measured by a single timer.
+	cgroupStart := time.Now()
+	cgroupMetrics := make(map[string][]prometheus.Metric, len(groups))
+	if p.perPidTop == 0 {
+		for gname, gcounts := range groups {
+			cgroupMetrics[gname] = p.cgroupMetrics(gname, gcounts)
+		}
+	}
+	var netTraffic map[string]proc.NetTraffic
+	if p.netDev != nil && p.perPidTop == 0 {
+		netTraffic = p.netDev.Update(groups)
+	}
+	var (
+		cgstat    proc.CgroupStat
+		cgstatErr error
+	)
+	if p.collectors["cgroup"] {
+		cgstat, cgstatErr = p.fs.CgroupStat(proc.Cgroup{Path: "/"})
+	}
+	if p.collectors["cgroup"] {
+		p.cgroupReadDuration.Observe(time.Since(cgroupStart).Seconds())
+	}
+	p.collectionDuration.Observe(time.Since(start).Seconds())
+
 	if err != nil {
 		p.scrapeErrors++
 		log.Printf("error reading procs: %v", err)
+	} else if p.perPidTop > 0 {
+		p.scrapePids(ch)
 	} else {
 		for gname, gcounts := range groups {
-			ch <- prometheus.MustNewConstMetric(numprocsDesc,
+			// Groups whose I/O isn't read have none to report.
+			io := p.io && p.namer.Gather(gname, "io")
+			ch <- p.groupMetric(numprocsDesc,
 				prometheus.GaugeValue, float64(gcounts.Procs), gname)
-			ch <- prometheus.MustNewConstMetric(membytesDesc,
+			ch <- p.groupMetric(procStartsDesc,
+				prometheus.CounterValue, float64(gcounts.Starts), gname)
+			ch <- p.groupMetric(procExitsDesc,
+				prometheus.CounterValue, float64(gcounts.Exits), gname)
+			ch <- p.groupMetric(membytesDesc,
 				prometheus.GaugeValue, float64(gcounts.Memory.ResidentBytes), gname, "resident")
-			ch <- prometheus.MustNewConstMetric(membytesDesc,
+			ch <- p.groupMetric(membytesDesc,
 				prometheus.GaugeValue, float64(gcounts.Memory.VirtualBytes), gname, "virtual")
-			ch <- prometheus.MustNewConstMetric(membytesDesc,
+			ch <- p.groupMetric(membytesDesc,
 				prometheus.GaugeValue, float64(gcounts.Memory.VmSwapBytes), gname, "swapped")
-			ch <- prometheus.MustNewConstMetric(startTimeDesc,
+			ch <- p.groupMetric(membytesDesc,
+				prometheus.GaugeValue, float64(gcounts.Memory.LockedBytes), gname, "locked")
+			if p.vmPin {
+				ch <- p.groupMetric(membytesDesc,
+					prometheus.GaugeValue, float64(gcounts.Memory.PinnedBytes), gname, "pinned")
+			}
+			if p.rssBreakdown {
+				ch <- p.groupMetric(membytesDesc,
+					prometheus.GaugeValue, float64(gcounts.Memory.ResidentAnonBytes), gname, "residentAnon")
+				ch <- p.groupMetric(membytesDesc,
+					prometheus.GaugeValue, float64(gcounts.Memory.ResidentFileBytes), gname, "residentFile")
+				ch <- p.groupMetric(membytesDesc,
+					prometheus.GaugeValue, float64(gcounts.Memory.ResidentShmemBytes), gname, "residentShmem")
+			}
+			for _, m := range cgroupMetrics[gname] {
+				ch <- m
+			}
+			ch <- p.groupMetric(startTimeDesc,
 				prometheus.GaugeValue, float64(gcounts.OldestStartTime.Unix()), gname)
-			ch <- prometheus.MustNewConstMetric(openFDsDesc,
+			ch <- p.groupMetric(newestStartTimeDesc,
+				prometheus.GaugeValue, float64(gcounts.NewestStartTime.Unix()), gname)
+			ch <- p.groupMetric(openFDsDesc,
 				prometheus.GaugeValue, float64(gcounts.OpenFDs), gname)
-			ch <- prometheus.MustNewConstMetric(worstFDRatioDesc,
+			ch <- p.groupMetric(worstFDRatioDesc,
 				prometheus.GaugeValue, float64(gcounts.WorstFDratio), gname)
-			ch <- prometheus.MustNewConstMetric(cpuSecsDesc,
+			ch <- p.groupMetric(cpuSecsDesc,
 				prometheus.CounterValue, gcounts.CPUUserTime, gname, "user")
-			ch <- prometheus.MustNewConstMetric(cpuSecsDesc,
+			ch <- p.groupMetric(cpuSecsDesc,
 				prometheus.CounterValue, gcounts.CPUSystemTime, gname, "system")
-			ch <- prometheus.MustNewConstMetric(readBytesDesc,
-				prometheus.CounterValue, float64(gcounts.ReadBytes), gname)
-			ch <- prometheus.MustNewConstMetric(writeBytesDesc,
-				prometheus.CounterValue, float64(gcounts.WriteBytes), gname)
-			ch <- prometheus.MustNewConstMetric(majorPageFaultsDesc,
+			if p.childCPU {
+				ch <- p.groupMetric(cpuSecsDesc,
+					prometheus.CounterValue, gcounts.CPUChildTime, gname, "child")
+			}
+			if io {
+				ch <- p.groupMetric(readBytesDesc,
+					prometheus.CounterValue, float64(gcounts.ReadBytes), gname)
+				ch <- p.groupMetric(writeBytesDesc,
+					prometheus.CounterValue, float64(gcounts.WriteBytes), gname)
+				ch <- p.groupMetric(cancelledWriteBytesDesc,
+					prometheus.CounterValue, float64(gcounts.CancelledWriteBytes), gname)
+				ch <- p.groupMetric(ioSyscallsDesc,
+					prometheus.CounterValue, float64(gcounts.ReadSyscalls), gname, "read")
+				ch <- p.groupMetric(ioSyscallsDesc,
+					prometheus.CounterValue, float64(gcounts.WriteSyscalls), gname, "write")
+			}
+			ch <- p.groupMetric(majorPageFaultsDesc,
 				prometheus.CounterValue, float64(gcounts.MajorPageFaults), gname)
-			ch <- prometheus.MustNewConstMetric(minorPageFaultsDesc,
+			ch <- p.groupMetric(minorPageFaultsDesc,
 				prometheus.CounterValue, float64(gcounts.MinorPageFaults), gname)
-			ch <- prometheus.MustNewConstMetric(contextSwitchesDesc,
+			ch <- p.groupMetric(contextSwitchesDesc,
 				prometheus.CounterValue, float64(gcounts.CtxSwitchVoluntary), gname, "voluntary")
-			ch <- prometheus.MustNewConstMetric(contextSwitchesDesc,
+			ch <- p.groupMetric(contextSwitchesDesc,
 				prometheus.CounterValue, float64(gcounts.CtxSwitchNonvoluntary), gname, "nonvoluntary")
-			ch <- prometheus.MustNewConstMetric(numThreadsDesc,
+			ch <- p.groupMetric(numThreadsDesc,
 				prometheus.GaugeValue, float64(gcounts.NumThreads), gname)
-			ch <- prometheus.MustNewConstMetric(statesDesc,
+			ch <- p.groupMetric(worstThreadsDesc,
+				prometheus.GaugeValue, float64(gcounts.WorstThreads), gname)
+			ch <- p.groupMetric(statesDesc,
 				prometheus.GaugeValue, float64(gcounts.States.Running), gname, "Running")
-			ch <- prometheus.MustNewConstMetric(statesDesc,
+			ch <- p.groupMetric(statesDesc,
 				prometheus.GaugeValue, float64(gcounts.States.Sleeping), gname, "Sleeping")
-			ch <- prometheus.MustNewConstMetric(statesDesc,
+			ch <- p.groupMetric(statesDesc,
 				prometheus.GaugeValue, float64(gcounts.States.Waiting), gname, "Waiting")
-			ch <- prometheus.MustNewConstMetric(statesDesc,
+			ch <- p.groupMetric(statesDesc,
 				prometheus.GaugeValue, float64(gcounts.States.Zombie), gname, "Zombie")
-			ch <- prometheus.MustNewConstMetric(statesDesc,
+			ch <- p.groupMetric(statesDesc,
 				prometheus.GaugeValue, float64(gcounts.States.Other), gname, "Other")
+			ch <- p.groupMetric(zombiesDesc,
+				prometheus.GaugeValue, float64(gcounts.Zombies), gname)
+			ch <- p.groupMetric(lowestNiceDesc,
+				prometheus.GaugeValue, float64(gcounts.LowestNice), gname)
+			ch <- p.groupMetric(highestPriorityDesc,
+				prometheus.GaugeValue, float64(gcounts.HighestPriority), gname)
+			if gcounts.MinCPUsAllowed > 0 {
+				ch <- p.groupMetric(minCPUsAllowedDesc,
+					prometheus.GaugeValue, float64(gcounts.MinCPUsAllowed), gname)
+			}
 
 			for wchan, count := range gcounts.Wchans {
-				ch <- prometheus.MustNewConstMetric(threadWchanDesc,
+				ch <- p.groupMetric(threadWchanDesc,
 					prometheus.GaugeValue, float64(count), gname, wchan)
 			}
+			if p.blockedWchans > 0 {
+				for wchan, count := range proc.TopBlocked(gcounts.Blocked, p.blockedWchans) {
+					ch <- p.groupMetric(blockedDesc,
+						prometheus.GaugeValue, float64(count), gname, wchan)
+				}
+			}
+
+			if traffic, ok := netTraffic[gname]; ok {
+				ch <- p.groupMetric(netReceiveBytesDesc,
+					prometheus.CounterValue, float64(traffic.ReceiveBytes), gname)
+				ch <- p.groupMetric(netTransmitBytesDesc,
+					prometheus.CounterValue, float64(traffic.TransmitBytes), gname)
+				ch <- p.groupMetric(netReceivePacketsDesc,
+					prometheus.CounterValue, float64(traffic.ReceivePackets), gname)
+				ch <- p.groupMetric(netTransmitPacketsDesc,
+					prometheus.CounterValue, float64(traffic.TransmitPackets), gname)
+			}
 
-			if p.smaps {
-				ch <- prometheus.MustNewConstMetric(membytesDesc,
+			for _, bit := range p.capabilities {
+				ch <- p.groupMetric(capabilityDesc, prometheus.GaugeValue,
+					float64(gcounts.Capabilities[bit]), gname, proc.CapabilityName(bit))
+			}
+
+			if p.collectors["sched_policy"] {
+				ch <- p.groupMetric(realtimeProcsDesc,
+					prometheus.GaugeValue, float64(gcounts.Realtime), gname)
+				for _, policy := range proc.SchedPolicies {
+					ch <- p.groupMetric(schedPolicyDesc, prometheus.GaugeValue,
+						float64(gcounts.SchedPolicies[policy]), gname, policy)
+				}
+				for policy, count := range gcounts.SchedPolicies {
+					if unlistedSchedPolicy(policy) {
+						ch <- p.groupMetric(schedPolicyDesc, prometheus.GaugeValue,
+							float64(count), gname, policy)
+					}
+				}
+			}
+
+			if len(p.ageBuckets) > 0 {
+				for i, bound := range p.ageBuckets {
+					var n uint64
+					if gcounts.AgeBuckets != nil {
+						n = gcounts.AgeBuckets[i]
+					}
+					ch <- p.groupMetric(processAgeDesc, prometheus.GaugeValue, float64(n),
+						gname, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64))
+				}
+				ch <- p.groupMetric(processAgeDesc, prometheus.GaugeValue, float64(gcounts.Procs),
+					gname, "+Inf")
+			}
+
+			// Omit rather than report zero when smaps is disabled for the
+			// group or couldn't be read, e.g. due to lack of privileges.
+			if gcounts.SMapsProcs > 0 {
+				ch <- p.groupMetric(membytesDesc,
 					prometheus.GaugeValue, float64(gcounts.Memory.ProportionalBytes), gname, "proportionalResident")
-				ch <- prometheus.MustNewConstMetric(membytesDesc,
+				ch <- p.groupMetric(membytesDesc,
 					prometheus.GaugeValue, float64(gcounts.Memory.ProportionalSwapBytes), gname, "proportionalSwapped")
+				ch <- p.groupMetric(membytesDesc,
+					prometheus.GaugeValue, float64(gcounts.Memory.UniqueBytes), gname, "unique")
 			}
 
 			if p.threads {
 				for _, thr := range gcounts.Threads {
-					ch <- prometheus.MustNewConstMetric(threadCountDesc,
+					ch <- p.groupMetric(threadCountDesc,
 						prometheus.GaugeValue, float64(thr.NumThreads),
 						gname, thr.Name)
-					ch <- prometheus.MustNewConstMetric(threadCpuSecsDesc,
+					ch <- p.groupMetric(threadCpuSecsDesc,
 						prometheus.CounterValue, float64(thr.CPUUserTime),
 						gname, thr.Name, "user")
-					ch <- prometheus.MustNewConstMetric(threadCpuSecsDesc,
+					ch <- p.groupMetric(threadCpuSecsDesc,
 						prometheus.CounterValue, float64(thr.CPUSystemTime),
 						gname, thr.Name, "system")
-					ch <- prometheus.MustNewConstMetric(threadIoBytesDesc,
-						prometheus.CounterValue, float64(thr.ReadBytes),
-						gname, thr.Name, "read")
-					ch <- prometheus.MustNewConstMetric(threadIoBytesDesc,
-						prometheus.CounterValue, float64(thr.WriteBytes),
-						gname, thr.Name, "write")
-					ch <- prometheus.MustNewConstMetric(threadMajorPageFaultsDesc,
+					if io {
+						ch <- p.groupMetric(threadIoBytesDesc,
+							prometheus.CounterValue, float64(thr.ReadBytes),
+							gname, thr.Name, "read")
+						ch <- p.groupMetric(threadIoBytesDesc,
+							prometheus.CounterValue, float64(thr.WriteBytes),
+							gname, thr.Name, "write")
+					}
+					ch <- p.groupMetric(threadMajorPageFaultsDesc,
 						prometheus.CounterValue, float64(thr.MajorPageFaults),
 						gname, thr.Name)
-					ch <- prometheus.MustNewConstMetric(threadMinorPageFaultsDesc,
+					ch <- p.groupMetric(threadMinorPageFaultsDesc,
 						prometheus.CounterValue, float64(thr.MinorPageFaults),
 						gname, thr.Name)
-					ch <- prometheus.MustNewConstMetric(threadContextSwitchesDesc,
+					ch <- p.groupMetric(threadContextSwitchesDesc,
 						prometheus.CounterValue, float64(thr.CtxSwitchVoluntary),
 						gname, thr.Name, "voluntary")
-					ch <- prometheus.MustNewConstMetric(threadContextSwitchesDesc,
+					ch <- p.groupMetric(threadContextSwitchesDesc,
 						prometheus.CounterValue, float64(thr.CtxSwitchNonvoluntary),
 						gname, thr.Name, "nonvoluntary")
 				}
 			}
 		}
 	}
+
+	if err == nil {
+		ch <- prometheus.MustNewConstMetric(orphanedZombiesDesc,
+			prometheus.GaugeValue, float64(p.OrphanedZombies()))
+	}
+
+	if cgstatErr != nil {
+		if p.debug {
+			log.Printf("error reading root cgroup.stat: %v", cgstatErr)
+		}
+	} else if p.collectors["cgroup"] {
+		ch <- prometheus.MustNewConstMetric(cgroupDescendantsDesc,
+			prometheus.GaugeValue, float64(cgstat.NrDescendants))
+		ch <- prometheus.MustNewConstMetric(cgroupDyingDescendantsDesc,
+			prometheus.GaugeValue, float64(cgstat.NrDyingDescendants))
+	}
+
+	if p.collectors["cgroup"] {
+		ch <- constHistogram(cgroupReadDurationDesc, p.cgroupReadDuration)
+	}
+	for class, n := range p.fs.CgroupReadErrors() {
+		ch <- prometheus.MustNewConstMetric(cgroupReadErrorsDesc,
+			prometheus.CounterValue, float64(n), class)
+	}
+
 	ch <- prometheus.MustNewConstMetric(scrapeErrorsDesc,
 		prometheus.CounterValue, float64(p.scrapeErrors))
 	ch <- prometheus.MustNewConstMetric(scrapeProcReadErrorsDesc,
 		prometheus.CounterValue, float64(p.scrapeProcReadErrors))
 	ch <- prometheus.MustNewConstMetric(scrapePartialErrorsDesc,
 		prometheus.CounterValue, float64(p.scrapePartialErrors))
+	readErrs := p.fs.ReadErrors()
+	for _, reason := range []string{proc.ReadErrPermission, proc.ReadErrVanished,
+		proc.ReadErrParse, proc.ReadErrCgroup, proc.ReadErrOther} {
+		ch <- prometheus.MustNewConstMetric(scrapeReadErrorsDesc,
+			prometheus.CounterValue, float64(readErrs[reason]), reason)
+	}
+	ch <- prometheus.MustNewConstMetric(scrapePartialProcsDesc,
+		prometheus.GaugeValue, float64(p.scrapePartialProcs))
+	ch <- prometheus.MustNewConstMetric(scrapeCounterRegressionsDesc,
+		prometheus.CounterValue, float64(p.scrapeCounterRegressions))
+	ch <- prometheus.MustNewConstMetric(scrapeIOSkippedDesc,
+		prometheus.CounterValue, float64(p.scrapeIOSkipped))
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc,
+		prometheus.GaugeValue, p.scrapeDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(scrapeProcsScannedDesc,
+		prometheus.GaugeValue, float64(p.ProcsScanned()))
+	ch <- prometheus.MustNewConstMetric(scrapeProcsMatchedDesc,
+		prometheus.GaugeValue, float64(p.ProcsMatched()))
+	ch <- prometheus.MustNewConstMetric(scrapeGroupsDesc,
+		prometheus.GaugeValue, float64(len(groups)))
+	ch <- p.collectionDuration
+	for _, c := range subCollectors {
+		enabled := 0.0
+		if p.collectors[c.name] {
+			enabled = 1
+		}
+		ch <- prometheus.MustNewConstMetric(collectorEnabledDesc,
+			prometheus.GaugeValue, enabled, c.name)
+	}
 }
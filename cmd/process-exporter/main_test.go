@@ -0,0 +1,850 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	common "github.com/ncabatoff/process-exporter"
+	"github.com/ncabatoff/process-exporter/config"
+	"github.com/ncabatoff/process-exporter/proc"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fixtureOptions returns options for a collector reading procs and cgroups
+// from the fixtures.
+func fixtureOptions() ProcessCollectorOption {
+	return ProcessCollectorOption{
+		ProcFSPath:   "../../fixtures",
+		CgroupFSPath: "../../fixtures/cgroupv2",
+		CgroupMemory: proc.CgroupMemoryCurrent,
+		Namer:        &nameMapperRegex{map[string]*prefixRegex{"process-exporte": nil}},
+	}
+}
+
+// gatherer returns a registry holding a collector created with options.
+func gatherer(t *testing.T, options ProcessCollectorOption) prometheus.Gatherer {
+	pc, err := NewProcessCollector(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(pc)
+	return reg
+}
+
+// gather returns the metric families gathered from g by name.
+func gather(t *testing.T, g prometheus.Gatherer) map[string]*dto.MetricFamily {
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily)
+	for _, mf := range mfs {
+		byName[mf.GetName()] = mf
+	}
+	return byName
+}
+
+// TestCollectorSelfMetrics verifies that the collector's own metrics are
+// emitted once per scrape, and that each scrape's duration is observed once.
+func TestCollectorSelfMetrics(t *testing.T) {
+	reg := gatherer(t, fixtureOptions())
+	for scrapes := 1; scrapes <= 2; scrapes++ {
+		got := make(map[string]float64)
+		for _, mf := range gather(t, reg) {
+			if len(mf.Metric) != 1 {
+				continue
+			}
+			m := mf.Metric[0]
+			switch {
+			case m.Gauge != nil:
+				got[mf.GetName()] = m.Gauge.GetValue()
+			case m.Histogram != nil:
+				got[mf.GetName()] = float64(m.Histogram.GetSampleCount())
+			}
+		}
+		if _, ok := got["namedprocess_scrape_duration_seconds"]; !ok {
+			t.Errorf("scrape %d: scrape duration not emitted exactly once", scrapes)
+		}
+		for name, want := range map[string]float64{
+			"namedprocess_scrape_procs_scanned":               1,
+			"namedprocess_scrape_procs_matched":               1,
+			"namedprocess_scrape_groups":                      1,
+			"namedprocess_scrape_collection_duration_seconds": float64(scrapes),
+		} {
+			if v, ok := got[name]; !ok {
+				t.Errorf("scrape %d: %s not emitted exactly once", scrapes, name)
+			} else if v != want {
+				t.Errorf("scrape %d: got %s %v, want %v", scrapes, name, v, want)
+			}
+		}
+	}
+}
+
+// TestCollectorCgroupReadDuration verifies that the time spent reading
+// cgroups is observed once per scrape.
+func TestCollectorCgroupReadDuration(t *testing.T) {
+	reg := gatherer(t, fixtureOptions())
+	for scrapes := uint64(1); scrapes <= 2; scrapes++ {
+		mfs := gather(t, reg)
+		if _, ok := mfs["namedprocess_namegroup_cgroup_memory_bytes"]; !ok {
+			t.Fatalf("scrape %d: no cgroup memory read", scrapes)
+		}
+		mf, ok := mfs["namedprocess_cgroup_read_duration_seconds"]
+		if !ok {
+			t.Fatalf("scrape %d: cgroup read duration not emitted", scrapes)
+		}
+		h := mf.Metric[0].GetHistogram()
+		if h.GetSampleCount() != scrapes || h.GetSampleSum() <= 0 {
+			t.Errorf("scrape %d: got %d observations summing to %v, want %d with a positive sum",
+				scrapes, h.GetSampleCount(), h.GetSampleSum(), scrapes)
+		}
+	}
+
+	options := fixtureOptions()
+	options.Collectors = map[string]bool{"cgroup": false}
+	if _, ok := gather(t, gatherer(t, options))["namedprocess_cgroup_read_duration_seconds"]; ok {
+		t.Errorf("got cgroup read duration with the cgroup collector disabled")
+	}
+}
+
+// TestCollectorNumThreads verifies that a group's thread count is the sum
+// of its procs' num_threads from stat, so that it's reported without listing
+// their task dirs, which the fixture proc doesn't have.
+func TestCollectorNumThreads(t *testing.T) {
+	mfs := gather(t, gatherer(t, fixtureOptions()))
+	for name, want := range map[string]float64{
+		"namedprocess_namegroup_num_procs":   1,
+		"namedprocess_namegroup_num_threads": 7,
+	} {
+		mf, ok := mfs[name]
+		if !ok {
+			t.Fatalf("%s not emitted", name)
+		}
+		if got := mf.Metric[0].GetGauge().GetValue(); got != want {
+			t.Errorf("got %s %v, want %v", name, got, want)
+		}
+	}
+}
+
+// TestCollectorPerPid verifies that per-pid mode requires a cap, and that it
+// reports the top procs and the remainder rather than groups.
+func TestCollectorPerPid(t *testing.T) {
+	options := fixtureOptions()
+	options.PerPid = true
+	if _, err := NewProcessCollector(options); err == nil {
+		t.Errorf("expected error creating per-pid collector without a cap")
+	}
+
+	options.PerPidTop = 1
+	options.PerPidRank = proc.ProcRankRSS
+	mfs := gather(t, gatherer(t, options))
+	if _, ok := mfs["namedprocess_namegroup_num_procs"]; ok {
+		t.Errorf("got group metrics in per-pid mode")
+	}
+	mf, ok := mfs["namedprocess_pid_num_threads"]
+	if !ok {
+		t.Fatalf("no per-pid metrics")
+	}
+	got := make(map[string]float64)
+	for _, m := range mf.Metric {
+		labels := make(map[string]string)
+		for _, l := range m.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		got[labels["groupname"]+"/"+labels["pid"]] = m.Gauge.GetValue()
+	}
+	want := map[string]float64{"process-exporte/14804": 7, "/" + pidRemainder: 0}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("per-pid threads differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestCollectorPerPidUser verifies that the user of each top proc is
+// reported only if asked for, by name if its uid has one.
+func TestCollectorPerPidUser(t *testing.T) {
+	options := fixtureOptions()
+	options.PerPidTop = 1
+	options.PerPidRank = proc.ProcRankRSS
+	if _, ok := gather(t, gatherer(t, options))["namedprocess_pid_user"]; ok {
+		t.Errorf("got per-pid user without PerPidUser")
+	}
+
+	options.PerPidUser = true
+	mf, ok := gather(t, gatherer(t, options))["namedprocess_pid_user"]
+	if !ok || len(mf.Metric) != 1 {
+		t.Fatalf("got per-pid user %v, want one series", mf)
+	}
+	want := "1000"
+	if u, err := user.LookupId("1000"); err == nil {
+		want = u.Username
+	}
+	labels := make(map[string]string)
+	for _, l := range mf.Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["pid"] != "14804" || labels["user"] != want {
+		t.Errorf("got pid %q with user %q, want 14804 with %q", labels["pid"], labels["user"], want)
+	}
+}
+
+// TestCollectorCgroupMemoryPressure verifies that the memory pressure of a
+// group's cgroup is reported as a ratio.
+func TestCollectorCgroupMemoryPressure(t *testing.T) {
+	mfs := gather(t, gatherer(t, fixtureOptions()))
+	mf, ok := mfs["namedprocess_namegroup_cgroup_memory_pressure_ratio"]
+	if !ok {
+		t.Fatalf("cgroup memory pressure not emitted")
+	}
+	if got := mf.Metric[0].GetGauge().GetValue(); len(mf.Metric) != 1 || got != 0.025 {
+		t.Errorf("got %d series, first %v, want one of 0.025", len(mf.Metric), got)
+	}
+}
+
+// TestCollectorLockedMemory verifies that locked and pinned memory, and the
+// breakdown of resident memory, are reported among a group's memory types.
+func TestCollectorLockedMemory(t *testing.T) {
+	mf, ok := gather(t, gatherer(t, fixtureOptions()))["namedprocess_namegroup_memory_bytes"]
+	if !ok {
+		t.Fatalf("memory not emitted")
+	}
+	got := make(map[string]float64)
+	for _, m := range mf.Metric {
+		for _, l := range m.Label {
+			if l.GetName() == "memtype" {
+				got[l.GetValue()] = m.Gauge.GetValue()
+			}
+		}
+	}
+	for memtype, want := range map[string]float64{"locked": 65536, "pinned": 16384,
+		"residentAnon": 5120 * 1024, "residentFile": 2688 * 1024, "residentShmem": 68 * 1024} {
+		if got[memtype] != want {
+			t.Errorf("got %s memory %v, want %v", memtype, got[memtype], want)
+		}
+	}
+}
+
+// TestCollectorNamespaceLabels verifies that the namespace and constant
+// labels apply to every series, and that a constant label can't replace one
+// of the collector's own.
+func TestCollectorNamespaceLabels(t *testing.T) {
+	pc, err := NewProcessCollector(fixtureOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	labels := map[string]string{"team": "payments"}
+	if err := wrapRegisterer(reg, "payments", labels).Register(pc); err != nil {
+		t.Fatal(err)
+	}
+	mfs := gather(t, reg)
+	if _, ok := mfs["payments_namedprocess_namegroup_num_procs"]; !ok {
+		t.Errorf("namespaced num_procs not emitted")
+	}
+	for name, mf := range mfs {
+		if !strings.HasPrefix(name, "payments_namedprocess_") {
+			t.Errorf("got metric %s without namespace", name)
+		}
+		for _, m := range mf.Metric {
+			found := false
+			for _, l := range m.Label {
+				found = found || l.GetName() == "team" && l.GetValue() == "payments"
+			}
+			if !found {
+				t.Errorf("got %s series without team label: %v", name, m.Label)
+			}
+		}
+	}
+
+	pc, err = NewProcessCollector(fixtureOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg = prometheus.NewPedanticRegistry()
+	if err := wrapRegisterer(reg, "", map[string]string{"groupname": "x"}).Register(pc); err == nil {
+		t.Errorf("expected error registering with a groupname constant label")
+	}
+}
+
+// TestCollectorSubCollectors verifies that a disabled sub-collector's metrics
+// and reads are skipped, that those whose probe fails are disabled, and that
+// the active set is reported.
+func TestCollectorSubCollectors(t *testing.T) {
+	options := fixtureOptions()
+	options.Collectors = map[string]bool{"nosuch": true}
+	if _, err := NewProcessCollector(options); err == nil {
+		t.Errorf("expected error creating collector with unknown sub-collector")
+	}
+
+	options.Collectors = map[string]bool{"cgroup": false}
+	pc, err := NewProcessCollector(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(pc)
+	mfs := gather(t, reg)
+	if _, ok := mfs["namedprocess_namegroup_cgroup_memory_bytes"]; ok {
+		t.Errorf("got cgroup metrics with the cgroup collector disabled")
+	}
+	for _, s := range pc.procSamples() {
+		if s.Cgroups != nil {
+			t.Errorf("got cgroups %v for pid %d with the cgroup collector disabled", s.Cgroups, s.ID.Pid)
+		}
+	}
+
+	got := make(map[string]float64)
+	for _, m := range mfs["namedprocess_collector_enabled"].GetMetric() {
+		got[m.Label[0].GetValue()] = m.Gauge.GetValue()
+	}
+	// The fixtures have no /proc/1/io, task dir, smaps_rollup or wchan, and
+	// netdev, sched_policy and cpus_allowed are off by default.
+	want := map[string]float64{"io": 0, "threads": 0, "smaps": 0, "wchan": 0, "cgroup": 0, "netdev": 0,
+		"capability": 1, "sched_policy": 0, "cpus_allowed": 0}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("enabled collectors differ: (-got +want)\n%s", diff)
+	}
+
+	options.Collectors = nil
+	got = make(map[string]float64)
+	for _, m := range gather(t, gatherer(t, options))["namedprocess_collector_enabled"].GetMetric() {
+		got[m.Label[0].GetValue()] = m.Gauge.GetValue()
+	}
+	if got["cgroup"] != 1 {
+		t.Errorf("got cgroup collector enabled %v by default, want 1", got["cgroup"])
+	}
+}
+
+// TestCollectorsNamer verifies that the collectors a group turns on or off
+// take precedence over their global settings, except smaps with
+// -gather-smaps, but can't turn on one that doesn't work.
+func TestCollectorsNamer(t *testing.T) {
+	cfg, err := config.GetConfig(`
+process_names:
+  - name: jvm
+    comm: [java]
+    threads: true
+    io: false
+  - name: db
+    comm: [postgres]
+    smaps: true
+  - name: cache
+    comm: [redis]
+    smaps: false
+    threads: true
+  - name: other
+    comm: [bash]
+`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := collectorsNamer{cfg.MatchNamers,
+		map[string]bool{"io": true, "threads": false, "smaps": true},
+		map[string]bool{"io": true, "threads": true, "smaps": true},
+		true}
+	got := make(map[string]map[string]bool)
+	for _, comm := range []string{"java", "postgres", "redis", "bash"} {
+		_, name := n.MatchAndName(common.ProcAttributes{Name: comm})
+		got[name] = map[string]bool{"smaps": n.GatherSMaps(name),
+			"threads": n.Gather(name, "threads"), "io": n.Gather(name, "io")}
+	}
+	got["new procs"] = map[string]bool{"threads": n.Gather("", "threads"), "io": n.Gather("", "io")}
+	want := map[string]map[string]bool{
+		"jvm":       {"smaps": true, "threads": true, "io": false},
+		"db":        {"smaps": true, "threads": false, "io": true},
+		"cache":     {"smaps": true, "threads": true, "io": true},
+		"other":     {"smaps": true, "threads": false, "io": true},
+		"new procs": {"threads": false, "io": true},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("collectors differ: (-got +want)\n%s", diff)
+	}
+
+	n.gatherSMaps = false
+	if !n.GatherSMaps("db") || n.GatherSMaps("cache") || n.GatherSMaps("other") {
+		t.Errorf("got smaps for db %v, cache %v, other %v without -gather-smaps, want true, false, false",
+			n.GatherSMaps("db"), n.GatherSMaps("cache"), n.GatherSMaps("other"))
+	}
+
+	n.available["threads"] = false
+	if n.Gather("jvm", "threads") {
+		t.Errorf("got threads read for jvm with the threads collector not working")
+	}
+}
+
+// TestCollectorGroupLabels verifies that the labels the config gives a group
+// are added to all its series, and that they can't replace a metric's own.
+func TestCollectorGroupLabels(t *testing.T) {
+	cfg, err := config.GetConfig(`
+process_names:
+  - comm: [process-exporte]
+    labels: {tier: critical}
+`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := fixtureOptions()
+	options.Namer = cfg.MatchNamers
+	mfs := gather(t, gatherer(t, options))
+	if _, ok := mfs["namedprocess_namegroup_num_procs"]; !ok {
+		t.Fatalf("num_procs not emitted")
+	}
+	for name, mf := range mfs {
+		for _, m := range mf.Metric {
+			labels := make(map[string]string)
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if _, ok := labels["groupname"]; ok && labels["tier"] != "critical" {
+				t.Errorf("got %s series without tier label: %v", name, labels)
+			}
+		}
+	}
+
+	cfg, err = config.GetConfig(`
+process_names:
+  - comm: [process-exporte]
+    labels: {mode: x}
+`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.Namer = cfg.MatchNamers
+	if _, err := NewProcessCollector(options); err == nil {
+		t.Errorf("expected error creating collector with a mode group label")
+	}
+}
+
+// kubepodsProcfs returns a procfs holding the fixture proc 14804, in
+// /system.slice/process-exporter.service, and a copy of it as 14805 in a
+// kubepods cgroup.
+func kubepodsProcfs(t *testing.T) string {
+	fixtures, err := filepath.Abs("../../fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := ioutil.TempDir("", "cgroups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := func(target, name string) {
+		if err := os.Symlink(filepath.Join(fixtures, target), filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link("stat", "stat")
+	link("14804", "14804")
+	link("14804", "self")
+	if err := os.Mkdir(filepath.Join(root, "14805"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cmdline", "comm", "fd", "io", "limits", "stat", "status"} {
+		link(filepath.Join("14804", name), filepath.Join("14805", name))
+	}
+	cgroup := []byte("0::/kubepods.slice/kubepods-pod1.slice/cri-ctr1.scope\n")
+	if err := ioutil.WriteFile(filepath.Join(root, "14805", "cgroup"), cgroup, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// TestCollectorCgroups verifies that the distinct cgroups of a group's procs
+// are counted, using a copy of the fixture proc in another cgroup.
+func TestCollectorCgroups(t *testing.T) {
+	root := kubepodsProcfs(t)
+	defer os.RemoveAll(root)
+
+	options := fixtureOptions()
+	options.ProcFSPath = root
+	mf, ok := gather(t, gatherer(t, options))["namedprocess_namegroup_cgroups"]
+	if !ok {
+		t.Fatalf("cgroups not emitted")
+	}
+	if got := mf.Metric[0].GetGauge().GetValue(); len(mf.Metric) != 1 || got != 2 {
+		t.Errorf("got %d series, first %v, want one of 2", len(mf.Metric), got)
+	}
+}
+
+// TestCollectorCgroupFilter verifies that procs outside the cgroups of the
+// filter produce no metrics.
+func TestCollectorCgroupFilter(t *testing.T) {
+	root := kubepodsProcfs(t)
+	defer os.RemoveAll(root)
+
+	options := fixtureOptions()
+	options.ProcFSPath = root
+	options.PerPid = true
+	options.PerPidTop = 2
+	options.PerPidRank = proc.ProcRankRSS
+	pids := func() map[string]bool {
+		t.Helper()
+		got := make(map[string]bool)
+		for _, mf := range gather(t, gatherer(t, options)) {
+			for _, m := range mf.Metric {
+				for _, l := range m.Label {
+					if l.GetName() == "pid" && l.GetValue() != pidRemainder {
+						got[l.GetValue()] = true
+					}
+				}
+			}
+		}
+		return got
+	}
+
+	if diff := cmp.Diff(pids(), map[string]bool{"14804": true, "14805": true}); diff != "" {
+		t.Errorf("unfiltered pids differ: (-got +want)\n%s", diff)
+	}
+	for _, filter := range []proc.CgroupFilter{
+		{Prefixes: []string{"/kubepods.slice"}},
+		{Regexp: regexp.MustCompile(`/cri-\w+\.scope$`)},
+	} {
+		filter := filter
+		options.CgroupFilter = &filter
+		if diff := cmp.Diff(pids(), map[string]bool{"14805": true}); diff != "" {
+			t.Errorf("%+v: filtered pids differ: (-got +want)\n%s", filter, diff)
+		}
+	}
+}
+
+// TestCollectorCgroupMemoryLimitChanges verifies that a change of the memory
+// limit of a group's cgroup between scrapes is counted.
+func TestCollectorCgroupMemoryLimitChanges(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroupfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "system.slice", "process-exporter.service")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("memory\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	write("memory.max", "1073741824\n")
+
+	options := fixtureOptions()
+	options.CgroupFSPath = root
+	g := gatherer(t, options)
+	changes := func() float64 {
+		t.Helper()
+		mf, ok := gather(t, g)["namedprocess_namegroup_cgroup_memory_limit_changes_total"]
+		if !ok {
+			t.Fatalf("memory limit changes not emitted")
+		}
+		return mf.Metric[0].GetCounter().GetValue()
+	}
+
+	if got := changes(); got != 0 {
+		t.Errorf("got %v changes before any, want 0", got)
+	}
+	write("memory.max", "2147483648\n")
+	if got := changes(); got != 1 {
+		t.Errorf("got %v changes after resize, want 1", got)
+	}
+	if got := changes(); got != 1 {
+		t.Errorf("got %v changes with limit unchanged, want 1", got)
+	}
+}
+
+// TestCollectorNetDev verifies that the netdev collector is off by default
+// and when on reports the traffic of the fixture proc's namespace, with or
+// without loopback.
+func TestCollectorNetDev(t *testing.T) {
+	options := fixtureOptions()
+	if _, ok := gather(t, gatherer(t, options))["namedprocess_namegroup_net_receive_bytes_total"]; ok {
+		t.Errorf("got network traffic with the netdev collector off")
+	}
+
+	// The fixtures have no pid 1 whose namespace could be left out.
+	options.Collectors = map[string]bool{"netdev": true}
+	options.NetDevIncludeHost = true
+	for _, tc := range []struct {
+		noLoopback           bool
+		rx, tx               float64
+		rxPackets, txPackets float64
+	}{{false, 2001000, 301000, 1510, 910}, {true, 2000000, 300000, 1500, 900}} {
+		options.NetDevNoLoopback = tc.noLoopback
+		mfs := gather(t, gatherer(t, options))
+		rx, tx := mfs["namedprocess_namegroup_net_receive_bytes_total"], mfs["namedprocess_namegroup_net_transmit_bytes_total"]
+		if rx == nil || tx == nil {
+			t.Fatalf("network traffic not emitted")
+		}
+		if got := rx.Metric[0].GetCounter().GetValue(); got != tc.rx {
+			t.Errorf("noLoopback=%v: got %v bytes received, want %v", tc.noLoopback, got, tc.rx)
+		}
+		if got := tx.Metric[0].GetCounter().GetValue(); got != tc.tx {
+			t.Errorf("noLoopback=%v: got %v bytes transmitted, want %v", tc.noLoopback, got, tc.tx)
+		}
+		rxp, txp := mfs["namedprocess_namegroup_net_receive_packets_total"], mfs["namedprocess_namegroup_net_transmit_packets_total"]
+		if rxp == nil || txp == nil {
+			t.Fatalf("network packets not emitted")
+		}
+		if got := rxp.Metric[0].GetCounter().GetValue(); got != tc.rxPackets {
+			t.Errorf("noLoopback=%v: got %v packets received, want %v", tc.noLoopback, got, tc.rxPackets)
+		}
+		if got := txp.Metric[0].GetCounter().GetValue(); got != tc.txPackets {
+			t.Errorf("noLoopback=%v: got %v packets transmitted, want %v", tc.noLoopback, got, tc.txPackets)
+		}
+	}
+}
+
+// TestCollectorIO verifies that the I/O counters of a group sum what its
+// procs read and write between scrapes, and don't drop when a proc exits.
+func TestCollectorIO(t *testing.T) {
+	fixtures, err := filepath.Abs("../../fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := ioutil.TempDir("", "io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// The io collector is only enabled if pid 1's io can be read.
+	for _, name := range []string{"stat", "14804", "self", "1"} {
+		target := name
+		if name == "self" || name == "1" {
+			target = "14804"
+		}
+		if err := os.Symlink(filepath.Join(fixtures, target), filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pid := filepath.Join(root, "14805")
+	if err := os.Mkdir(pid, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cmdline", "comm", "fd", "limits", "stat", "status"} {
+		if err := os.Symlink(filepath.Join(fixtures, "14804", name), filepath.Join(pid, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeIO := func(read, write int) {
+		io := "rchar: 0\nwchar: 0\nsyscr: 0\nsyscw: 0\nread_bytes: " + strconv.Itoa(read) +
+			"\nwrite_bytes: " + strconv.Itoa(write) + "\ncancelled_write_bytes: 0\n"
+		if err := ioutil.WriteFile(filepath.Join(pid, "io"), []byte(io), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeIO(4096, 8192)
+
+	options := fixtureOptions()
+	options.ProcFSPath = root
+	g := gatherer(t, options)
+	for i, step := range []struct {
+		change      func()
+		read, write float64
+	}{
+		{func() {}, 0, 0},
+		{func() { writeIO(5096, 8692) }, 1000, 500},
+		{func() { os.RemoveAll(pid) }, 1000, 500},
+	} {
+		step.change()
+		mfs := gather(t, g)
+		read, write := mfs["namedprocess_namegroup_read_bytes_total"], mfs["namedprocess_namegroup_write_bytes_total"]
+		if read == nil || write == nil {
+			t.Fatalf("%d: I/O counters not emitted", i)
+		}
+		if got := read.Metric[0].GetCounter().GetValue(); got != step.read {
+			t.Errorf("%d: got %v bytes read, want %v", i, got, step.read)
+		}
+		if got := write.Metric[0].GetCounter().GetValue(); got != step.write {
+			t.Errorf("%d: got %v bytes written, want %v", i, got, step.write)
+		}
+		if skipped := mfs["namedprocess_scrape_io_skipped_procs_total"]; skipped == nil ||
+			skipped.Metric[0].GetCounter().GetValue() != 0 {
+			t.Errorf("%d: got skipped procs %v, want 0", i, skipped)
+		}
+	}
+}
+
+// TestParseCapabilities verifies that capabilities are parsed into bits and
+// may not be repeated.
+func TestParseCapabilities(t *testing.T) {
+	got, err := parseCapabilities("cap_sys_admin, net_raw,45")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, []int{21, 13, 45}); diff != "" {
+		t.Errorf("capabilities differ: (-got +want)\n%s", diff)
+	}
+	for _, bad := range []string{"cap_sys_admin,21", "cap_sys_wizard", "cap_chown,"} {
+		if _, err := parseCapabilities(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+// TestCollectorCapabilities verifies that each group reports how many of its
+// procs hold each capability asked for, including those none hold.
+func TestCollectorCapabilities(t *testing.T) {
+	options := fixtureOptions()
+	if _, ok := gather(t, gatherer(t, options))["namedprocess_namegroup_capability"]; ok {
+		t.Errorf("got capability series without -capabilities")
+	}
+
+	options.Capabilities = []int{12, 21, 45}
+	mf, ok := gather(t, gatherer(t, options))["namedprocess_namegroup_capability"]
+	if !ok {
+		t.Fatalf("capabilities not emitted")
+	}
+	got := make(map[string]float64)
+	for _, m := range mf.Metric {
+		for _, l := range m.Label {
+			if l.GetName() == "capability" {
+				got[l.GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	want := map[string]float64{"cap_net_admin": 1, "cap_sys_admin": 0, "45": 0}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("capabilities differ: (-got +want)\n%s", diff)
+	}
+
+	options.Collectors = map[string]bool{"capability": false}
+	if _, ok := gather(t, gatherer(t, options))["namedprocess_namegroup_capability"]; ok {
+		t.Errorf("got capability series with the capability collector disabled")
+	}
+}
+
+// TestCollectorMinCPUsAllowed verifies that each group reports the smallest
+// affinity of its procs with the cpus_allowed collector.
+func TestCollectorMinCPUsAllowed(t *testing.T) {
+	options := fixtureOptions()
+	if _, ok := gather(t, gatherer(t, options))["namedprocess_namegroup_min_cpus_allowed"]; ok {
+		t.Errorf("got min CPUs allowed with the cpus_allowed collector disabled")
+	}
+
+	options.Collectors = map[string]bool{"cpus_allowed": true}
+	mf, ok := gather(t, gatherer(t, options))["namedprocess_namegroup_min_cpus_allowed"]
+	if !ok {
+		t.Fatalf("min CPUs allowed not emitted")
+	}
+	if len(mf.Metric) != 1 || mf.Metric[0].GetGauge().GetValue() != 8 {
+		t.Errorf("got %v, want one group with 8 CPUs allowed", mf.Metric)
+	}
+}
+
+// TestCollectorSchedPolicy verifies that every standard scheduling policy is
+// reported for each group with the sched_policy collector, including those no
+// proc has, as are realtime procs.
+func TestCollectorSchedPolicy(t *testing.T) {
+	options := fixtureOptions()
+	mfs := gather(t, gatherer(t, options))
+	for _, name := range []string{"namedprocess_namegroup_sched_policy", "namedprocess_namegroup_realtime_procs"} {
+		if _, ok := mfs[name]; ok {
+			t.Errorf("got %s with the sched_policy collector disabled", name)
+		}
+	}
+
+	options.Collectors = map[string]bool{"sched_policy": true}
+	mfs = gather(t, gatherer(t, options))
+	if mf, ok := mfs["namedprocess_namegroup_realtime_procs"]; !ok || mf.Metric[0].GetGauge().GetValue() != 0 {
+		t.Errorf("got realtime procs %v, want 0 for the fixture proc", mf)
+	}
+	mf, ok := mfs["namedprocess_namegroup_sched_policy"]
+	if !ok {
+		t.Fatalf("sched policies not emitted")
+	}
+	got := make(map[string]float64)
+	for _, m := range mf.Metric {
+		for _, l := range m.Label {
+			if l.GetName() == "policy" {
+				got[l.GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	want := map[string]float64{"other": 1, "fifo": 0, "rr": 0, "batch": 0, "idle": 0, "deadline": 0}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("sched policies differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestParseAgeBuckets verifies that age buckets must be increasing durations.
+func TestParseAgeBuckets(t *testing.T) {
+	got, err := parseAgeBuckets("1m, 10m,1h,1d,1w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("buckets differ: (-got +want)\n%s", diff)
+	}
+	for _, bad := range []string{"1m,1m", "1h,1m", "soon", "1m,"} {
+		if _, err := parseAgeBuckets(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+// TestCollectorProcessAge verifies that a group's procs are reported by age
+// in cumulative buckets ending with +Inf.
+func TestCollectorProcessAge(t *testing.T) {
+	options := fixtureOptions()
+	options.AgeBuckets = []time.Duration{time.Minute, 7 * 24 * time.Hour}
+	mf, ok := gather(t, gatherer(t, options))["namedprocess_namegroup_process_age_seconds"]
+	if !ok {
+		t.Fatalf("process age not emitted")
+	}
+	got := make(map[string]float64)
+	for _, m := range mf.Metric {
+		for _, l := range m.Label {
+			if l.GetName() == "le" {
+				got[l.GetValue()] = m.Gauge.GetValue()
+			}
+		}
+	}
+	// The fixture proc started years ago.
+	want := map[string]float64{"60": 0, "604800": 0, "+Inf": 1}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("process age differs: (-got +want)\n%s", diff)
+	}
+}
+
+// TestCollectorSubCollectorViews verifies that each sub-collector can be
+// registered as a collector of its own, all of them alongside each other, and
+// that they emit only their own metrics.
+func TestCollectorSubCollectorViews(t *testing.T) {
+	pc, err := NewProcessCollector(fixtureOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.SubCollector("nosuch"); err == nil {
+		t.Errorf("expected error getting unknown sub-collector")
+	}
+	reg := prometheus.NewPedanticRegistry()
+	for _, c := range subCollectors {
+		sc, err := pc.SubCollector(c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reg.Register(sc); err != nil {
+			t.Fatalf("registering %s collector: %v", c.name, err)
+		}
+	}
+	// The pedantic registry fails if a view emits what it doesn't describe.
+	mfs := gather(t, reg)
+	for _, name := range []string{"namedprocess_namegroup_cgroup_memory_bytes", "namedprocess_cgroup_read_duration_seconds"} {
+		if _, ok := mfs[name]; !ok {
+			t.Errorf("%s not emitted by the cgroup collector", name)
+		}
+	}
+	if _, ok := mfs["namedprocess_namegroup_num_procs"]; ok {
+		t.Errorf("got num_procs, which is no sub-collector's, from the sub-collectors")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/ncabatoff/process-exporter/proc"
+)
+
+type (
+	// matchRequest asks the collector how the proc with pid is matched.
+	matchRequest struct {
+		pid    int
+		result chan matchResult
+	}
+
+	matchResult struct {
+		explanation proc.ProcExplanation
+		err         error
+	}
+)
+
+// explainPid returns why the proc with pid is or isn't in a group.  It must
+// be called between scrapes, since matching isn't safe concurrently.
+func (p *NamedProcessCollector) explainPid(pid int) matchResult {
+	pr, err := p.fs.Proc(pid)
+	if err != nil {
+		return matchResult{err: err}
+	}
+	pe, err := p.Explain(pr)
+	return matchResult{pe, err}
+}
+
+// explain returns why the proc with pid is or isn't in a group, see
+// proc.ProcExplanation.  It's safe to call concurrently with scrapes.
+func (p *NamedProcessCollector) explain(pid int) (proc.ProcExplanation, error) {
+	req := matchRequest{pid: pid, result: make(chan matchResult)}
+	p.matchChan <- req
+	res := <-req.result
+	return res.explanation, res.err
+}
+
+// serveMatch serves /debug/match, which tells as JSON how the proc given by
+// the pid parameter is matched: what the namer is told of it, how each of
+// its selectors fares, its verdict and the group the proc is in.
+func (p *NamedProcessCollector) serveMatch(w http.ResponseWriter, r *http.Request) {
+	s := r.URL.Query().Get("pid")
+	pid, err := strconv.Atoi(s)
+	if err != nil || pid <= 0 {
+		http.Error(w, fmt.Sprintf("bad pid %q", s), http.StatusBadRequest)
+		return
+	}
+	pe, err := p.explain(pid)
+	if err == proc.ErrProcNotExist {
+		http.Error(w, fmt.Sprintf("no process %d", pid), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(pe); err != nil {
+		log.Printf("error writing match explanation: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	common "github.com/ncabatoff/process-exporter"
+	"github.com/ncabatoff/process-exporter/config"
+	"github.com/ncabatoff/process-exporter/proc"
+)
+
+// TestServeMatch verifies that /debug/match tells how each entry fares
+// against a proc, with the captures of those that match, and the group the
+// proc is in.
+func TestServeMatch(t *testing.T) {
+	cfg, err := config.GetConfig(`
+process_names:
+  - name: bash
+    comm: [bash]
+  - name: "{{.Matches.what}}"
+    comm: [process-exporte]
+    cmdline: ['-procnames (?P<what>\S+)']
+`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := fixtureOptions()
+	options.Namer = cfg.MatchNamers
+	pc, err := NewProcessCollector(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	pc.serveMatch(rec, httptest.NewRequest("GET", "/debug/match?pid=14804", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	var got proc.ProcExplanation
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("bad JSON %s: %v", rec.Body, err)
+	}
+	want := common.MatchExplanation{
+		Entries: []common.EntryExplanation{
+			{Name: "bash", Matchers: []common.MatcherResult{{Matcher: "comms: [bash]"}}},
+			{Name: "{{.Matches.what}}", Matchers: []common.MatcherResult{
+				{Matcher: "comms: [process-exporte]", Passed: true},
+				{Matcher: `cmdlines: [-procnames (?P<what>\S+)]`, Passed: true, Captures: map[string]string{"what": "bash"}},
+			}, Matched: true, GroupName: "bash"},
+		},
+		Matched:   true,
+		GroupName: "bash",
+	}
+	if diff := cmp.Diff(got.MatchExplanation, want); diff != "" {
+		t.Errorf("explanation differs: (-got +want)\n%s", diff)
+	}
+	if got.Pid != 14804 || got.Group != "bash" || got.Attributes.Name != "process-exporte" {
+		t.Errorf("got pid %d in group %q with comm %q, want 14804 in bash with process-exporte",
+			got.Pid, got.Group, got.Attributes.Name)
+	}
+
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{"", http.StatusBadRequest},
+		{"pid=x", http.StatusBadRequest},
+		{"pid=99999", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		pc.serveMatch(rec, httptest.NewRequest("GET", "/debug/match?"+tc.query, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%q: got status %d, want %d", tc.query, rec.Code, tc.code)
+		}
+	}
+}
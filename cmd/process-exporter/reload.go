@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	common "github.com/ncabatoff/process-exporter"
+	"github.com/ncabatoff/process-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// reloadRequest asks the collector to replace its namer.  done is
+	// closed once it has.
+	reloadRequest struct {
+		namer common.MatchNamer
+		done  chan struct{}
+	}
+
+	// configReloader reloads the process_names of the config files into a
+	// collector, on SIGHUP or a POST to /-/reload.  Other settings only take
+	// effect on restart.
+	configReloader struct {
+		// paths are those of the config files and directories, read again
+		// in whole on every reload, see config.ReadFiles.
+		paths config.Paths
+		debug bool
+		pc    *NamedProcessCollector
+		// mu serializes reloads, and guards cfg.
+		mu sync.Mutex
+		// cfg is the config in effect: that read at startup, with the
+		// process_names of the last successful reload.
+		cfg *config.Config
+		// success is 1 if the last reload succeeded, 0 if it failed.
+		success prometheus.Gauge
+	}
+)
+
+// Reload replaces the namer groups are named by, see proc.Grouper.SetNamer.
+// Since the names of the group labels are part of the series, the namer must
+// give the same ones as before.  It's safe to call concurrently with scrapes.
+func (p *NamedProcessCollector) Reload(namer common.MatchNamer) error {
+	var names []string
+	if ln, ok := namer.(common.LabelsNamer); ok {
+		names = ln.GroupLabelNames()
+	}
+	if len(names) > 0 || len(p.groupLabelNames) > 0 {
+		if !reflect.DeepEqual(names, p.groupLabelNames) {
+			return fmt.Errorf("group label names changed from %v to %v, which requires a restart",
+				p.groupLabelNames, names)
+		}
+	}
+	if needsRuntime(namer) && !p.fs.GatherRuntime {
+		return fmt.Errorf("matching by runtime requires a restart")
+	}
+	if needsCgroupPath(namer) && !p.fs.GatherCgroupPath {
+		return fmt.Errorf("matching by cgroup requires a restart")
+	}
+	if needsListeningPorts(namer) && !p.fs.GatherListeningPorts {
+		return fmt.Errorf("matching by listening port requires a restart")
+	}
+	for _, name := range envVars(namer) {
+		if !contains(p.fs.EnvVars, name) {
+			return fmt.Errorf("matching by environment variable %q requires a restart", name)
+		}
+	}
+	req := reloadRequest{namer: namer, done: make(chan struct{})}
+	p.reloadChan <- req
+	<-req.done
+	return nil
+}
+
+// needsRuntime returns true if namer matches or names procs by container
+// runtime, see common.RuntimeNamer.
+func needsRuntime(namer common.MatchNamer) bool {
+	rn, ok := namer.(common.RuntimeNamer)
+	return ok && rn.NeedsRuntime()
+}
+
+// needsCgroupPath returns true if namer matches procs by cgroup path, see
+// common.CgroupPathNamer.
+func needsCgroupPath(namer common.MatchNamer) bool {
+	cn, ok := namer.(common.CgroupPathNamer)
+	return ok && cn.NeedsCgroupPath()
+}
+
+// needsListeningPorts returns true if namer matches procs by the ports they
+// listen on, see common.PortsNamer.
+func needsListeningPorts(namer common.MatchNamer) bool {
+	pn, ok := namer.(common.PortsNamer)
+	return ok && pn.NeedsListeningPorts()
+}
+
+// envVars returns the environment variables namer matches procs by, see
+// common.EnvNamer.
+func envVars(namer common.MatchNamer) []string {
+	if en, ok := namer.(common.EnvNamer); ok {
+		return en.EnvVars()
+	}
+	return nil
+}
+
+func contains(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// setNamer replaces the namer, between scrapes.
+func (p *NamedProcessCollector) setNamer(namer common.MatchNamer) {
+	if ln, ok := namer.(common.LabelsNamer); ok && p.labelsNamer != nil {
+		p.labelsNamer = ln
+	}
+	p.namer.MatchNamer = namer
+	p.SetNamer(p.namer)
+}
+
+func newConfigReloader(paths config.Paths, debug bool, pc *NamedProcessCollector, cfg *config.Config) *configReloader {
+	// The config in effect gives the collectors reading each entry's groups.
+	effective := *cfg
+	effective.Collectors = pc.namer.collectors
+	r := &configReloader{
+		paths: paths,
+		debug: debug,
+		pc:    pc,
+		cfg:   &effective,
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "namedprocess_config_last_reload_successful",
+			Help: "whether the last reload of the config file succeeded",
+		}),
+	}
+	r.success.Set(1)
+	return r
+}
+
+// reload reads the config files again and replaces the collector's namer
+// with their process_names.  If one can't be read or they're invalid, the
+// old namer is kept.
+func (r *configReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg, err := config.ReadFiles(r.paths, r.debug)
+	if err == nil {
+		err = r.pc.Reload(cfg.MatchNamers)
+	}
+	if err != nil {
+		r.success.Set(0)
+		log.Printf("Error reloading config %q, keeping the old config: %v", r.paths.String(), err)
+		return err
+	}
+	r.success.Set(1)
+	effective := *r.cfg
+	effective.MatchNamers = cfg.MatchNamers
+	r.cfg = &effective
+	log.Printf("Reloaded config %q", r.paths.String())
+	return nil
+}
+
+// serveConfig serves /debug/config, which gives the config in effect as
+// JSON, see config.Config.MarshalJSON.
+func (r *configReloader) serveConfig(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r.cfg); err != nil {
+		log.Printf("error writing config: %v", err)
+	}
+}
+
+// serveReload serves /-/reload, which reloads the config file on POST.
+func (r *configReloader) serveReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "reloading requires a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// watchSIGHUP reloads the config file every time the process gets SIGHUP.
+func (r *configReloader) watchSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			r.reload()
+		}
+	}()
+}
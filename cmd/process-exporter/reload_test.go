@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ncabatoff/process-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestConfigReload verifies that reloading the config file renames groups
+// without a restart, and that an invalid config is reported and leaves the
+// old one in place.
+func TestConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("process_names:\n  - name: pe\n    comm: [process-exporte]\n")
+	cfg, err := config.ReadFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := fixtureOptions()
+	options.Namer = cfg.MatchNamers
+	pc, err := NewProcessCollector(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := newConfigReloader(config.Paths{path}, false, pc, cfg)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(pc, reloader.success)
+
+	check := func(step string, wantCode int, wantSuccess float64, wantProcs map[string]float64) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		reloader.serveReload(rec, httptest.NewRequest("POST", "/-/reload", nil))
+		if rec.Code != wantCode {
+			t.Errorf("%s: got status %d, want %d: %s", step, rec.Code, wantCode, rec.Body)
+		}
+		mfs := gather(t, reg)
+		if got := mfs["namedprocess_config_last_reload_successful"].Metric[0].GetGauge().GetValue(); got != wantSuccess {
+			t.Errorf("%s: got last reload successful %v, want %v", step, got, wantSuccess)
+		}
+		procs := make(map[string]float64)
+		for _, m := range mfs["namedprocess_namegroup_num_procs"].Metric {
+			procs[m.Label[0].GetValue()] = m.GetGauge().GetValue()
+		}
+		if diff := cmp.Diff(procs, wantProcs); diff != "" {
+			t.Errorf("%s: num_procs differs: (-got +want)\n%s", step, diff)
+		}
+	}
+
+	write("process_names:\n  - name: pe\n    comm: [\n")
+	check("invalid", http.StatusInternalServerError, 0, map[string]float64{"pe": 1})
+
+	write("process_names:\n  - name: pe\n    comm: [process-exporte]\n    labels: {team: infra}\n")
+	check("labels added", http.StatusInternalServerError, 0, map[string]float64{"pe": 1})
+
+	// The old group is still reported, with no procs, since there's no
+	// stale group TTL.
+	write("process_names:\n  - name: renamed\n    comm: [process-exporte]\n")
+	check("renamed", http.StatusOK, 1, map[string]float64{"pe": 0, "renamed": 1})
+
+	// The config in effect has the new process_names.
+	rec := httptest.NewRecorder()
+	reloader.serveConfig(rec, httptest.NewRequest("GET", "/debug/config", nil))
+	var effective struct {
+		ProcessNames []struct {
+			Name string `json:"name"`
+		} `json:"process_names"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &effective); err != nil {
+		t.Fatalf("bad config JSON %s: %v", rec.Body, err)
+	}
+	if len(effective.ProcessNames) != 1 || effective.ProcessNames[0].Name != "renamed" {
+		t.Errorf("got config in effect %s, want process_names renamed", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	reloader.serveReload(rec, httptest.NewRequest("GET", "/-/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for GET, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+// TestConfigReloadDir verifies that reloading a config directory picks up
+// files added to it, and keeps the old config if they conflict.
+func TestConfigReloadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("10-none.yml", "process_names:\n  - name: none\n    comm: [none]\n")
+	paths := config.Paths{dir}
+	cfg, err := config.ReadFiles(paths, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := fixtureOptions()
+	options.Namer = cfg.MatchNamers
+	pc, err := NewProcessCollector(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := newConfigReloader(paths, false, pc, cfg)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(pc)
+
+	check := func(step string, wantCode int, wantGroups []string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		reloader.serveReload(rec, httptest.NewRequest("POST", "/-/reload", nil))
+		if rec.Code != wantCode {
+			t.Errorf("%s: got status %d, want %d: %s", step, rec.Code, wantCode, rec.Body)
+		}
+		var groups []string
+		for _, m := range gather(t, reg)["namedprocess_namegroup_num_procs"].Metric {
+			if m.GetGauge().GetValue() > 0 {
+				groups = append(groups, m.Label[0].GetValue())
+			}
+		}
+		if diff := cmp.Diff(groups, wantGroups); diff != "" {
+			t.Errorf("%s: groups with procs differ: (-got +want)\n%s", step, diff)
+		}
+	}
+
+	// The new file comes first, so its group gets the proc.
+	write("05-pe.yml", "process_names:\n  - name: pe\n    comm: [process-exporte]\n")
+	check("file added", http.StatusOK, []string{"pe"})
+
+	write("20-none.yml", "process_names:\n  - name: none\n    comm: [process-exporte]\n")
+	check("group repeated", http.StatusInternalServerError, []string{"pe"})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/ncabatoff/process-exporter/proc"
+)
+
+const (
+	// defaultTopProcs and maxTopProcs are the default and largest number of
+	// procs /debug/top reports on.
+	defaultTopProcs = 20
+	maxTopProcs     = 1000
+	// maxTopCmdline is the length in bytes command lines are truncated to.
+	maxTopCmdline = 200
+)
+
+// topProc is a proc as reported by /debug/top.
+type topProc struct {
+	Pid         int     `json:"pid"`
+	Comm        string  `json:"comm"`
+	Cmdline     string  `json:"cmdline"`
+	Group       string  `json:"group"`
+	Cgroup      string  `json:"cgroup"`
+	CPUsAllowed int     `json:"cpus_allowed"`
+	Value       float64 `json:"value"`
+}
+
+// cgroupPath returns the path of the v2 cgroup among cgroups, or if there's
+// none that of the first v1 one.
+func cgroupPath(cgroups []proc.Cgroup) string {
+	for _, cg := range cgroups {
+		if cg.HierarchyID == 0 {
+			return cg.Path
+		}
+	}
+	if len(cgroups) > 0 {
+		return cgroups[0].Path
+	}
+	return ""
+}
+
+// joinCmdline returns cmdline joined by spaces, truncated to at most
+// maxTopCmdline bytes without splitting a rune.
+func joinCmdline(cmdline []string) string {
+	s := strings.Join(cmdline, " ")
+	if len(s) <= maxTopCmdline {
+		return s
+	}
+	n := maxTopCmdline
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// topProcs returns the n tracked procs ranked highest by rank, as of the
+// last scrape.
+func (p *NamedProcessCollector) topProcs(n int, rank proc.ProcRank) []topProc {
+	top, _ := proc.TopProcs(p.procSamples(), n, rank)
+	procs := make([]topProc, 0, len(top))
+	for _, s := range top {
+		procs = append(procs, topProc{
+			Pid:         s.ID.Pid,
+			Comm:        s.Name,
+			Cmdline:     joinCmdline(s.Cmdline),
+			Group:       s.GroupName,
+			Cgroup:      cgroupPath(s.Cgroups),
+			CPUsAllowed: s.CPUsAllowed,
+			Value:       rank.Value(s),
+		})
+	}
+	return procs
+}
+
+// serveTop serves /debug/top, which reports the tracked procs ranked highest
+// by the by parameter, one of cpu, rss, fds or threads, as seen by the last
+// scrape.  n is the number of procs, and format is json or text.
+func (p *NamedProcessCollector) serveTop(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	by := q.Get("by")
+	if by == "" {
+		by = string(proc.ProcRankRSS)
+	}
+	rank, err := proc.ParseProcRank(by)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := defaultTopProcs
+	if s := q.Get("n"); s != "" {
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 || n > maxTopProcs {
+			http.Error(w, fmt.Sprintf("bad n %q, want 1 to %d", s, maxTopProcs), http.StatusBadRequest)
+			return
+		}
+	}
+
+	procs := p.topProcs(n, rank)
+	switch q.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(procs); err != nil {
+			log.Printf("error writing top procs: %v", err)
+		}
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "PID\tCOMM\tGROUP\tCGROUP\tCPUS\t%s\tCMDLINE\n", strings.ToUpper(by))
+		for _, tp := range procs {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%g\t%s\n",
+				tp.Pid, tp.Comm, tp.Group, tp.Cgroup, tp.CPUsAllowed, tp.Value, tp.Cmdline)
+		}
+		if err := tw.Flush(); err != nil {
+			log.Printf("error writing top procs: %v", err)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("bad format %q, want json or text", q.Get("format")), http.StatusBadRequest)
+	}
+}
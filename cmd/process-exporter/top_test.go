@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestServeTop verifies that /debug/top reports the tracked procs as the
+// collector sees them, in JSON or as a table, and rejects bad parameters.
+func TestServeTop(t *testing.T) {
+	options := fixtureOptions()
+	options.Collectors = map[string]bool{"cpus_allowed": true}
+	pc, err := NewProcessCollector(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		pc.serveTop(rec, httptest.NewRequest("GET", "/debug/top?"+query, nil))
+		return rec
+	}
+
+	rec := get("by=threads&n=5")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	var got []topProc
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []topProc{{
+		Pid:         14804,
+		Comm:        "process-exporte",
+		Cmdline:     "./process-exporter -procnames bash",
+		Group:       "process-exporte",
+		Cgroup:      "/system.slice/process-exporter.service",
+		CPUsAllowed: 8,
+		Value:       7,
+	}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("top procs differ: (-got +want)\n%s", diff)
+	}
+
+	rec = get("format=text")
+	if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); len(lines) != 2 ||
+		!strings.HasPrefix(lines[0], "PID") || !strings.HasPrefix(lines[1], "14804") {
+		t.Errorf("got table %q, want a header and one row", rec.Body)
+	}
+
+	for _, query := range []string{"by=vsz", "n=0", "n=x", "format=xml"} {
+		if rec := get(query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// TestJoinCmdline verifies that long command lines are truncated without
+// splitting a rune.
+func TestJoinCmdline(t *testing.T) {
+	short := []string{"sleep", "60"}
+	if got := joinCmdline(short); got != "sleep 60" {
+		t.Errorf("got %q, want %q", got, "sleep 60")
+	}
+	ascii := strings.Repeat("a", maxTopCmdline+10)
+	if got := joinCmdline([]string{ascii}); got != ascii[:maxTopCmdline] {
+		t.Errorf("got %d bytes, want %d", len(got), maxTopCmdline)
+	}
+	// A 3-byte rune straddling the limit is left out whole.
+	long := strings.Repeat("a", maxTopCmdline-1) + strings.Repeat("€", 3)
+	got := joinCmdline([]string{long})
+	if !utf8.ValidString(got) || got != long[:maxTopCmdline-1] {
+		t.Errorf("got %q, want the %d bytes before the first rune", got, maxTopCmdline-1)
+	}
+}
@@ -12,6 +12,46 @@ type (
 		Username  string
 		PID       int
 		StartTime time.Time
+		// Runtime is the container runtime of the proc, such as docker,
+		// if the namer is a RuntimeNamer that needs it.
+		Runtime string
+		// Exe is the path of the executable, or empty if it can't be read.
+		// It may end with " (deleted)" if the file has been replaced.
+		Exe string
+		// EffectiveUID and RealUID are the proc's uids.  Username and
+		// RealUsername are their names, or the uids as strings if they have
+		// none.
+		EffectiveUID int
+		RealUID      int
+		RealUsername string
+		// CgroupPath is the cgroup path of the proc, that in the v2 unified
+		// hierarchy or else in systemd's v1 one, if the namer is a
+		// CgroupPathNamer that needs it.  ContainerID and SystemdUnit are
+		// the innermost container and systemd unit it's in, if any.
+		// SystemdUnits are all the units it's in, innermost first.
+		CgroupPath   string
+		ContainerID  string
+		SystemdUnit  string
+		SystemdUnits []string
+		// Env holds the environment variables of the proc asked for by
+		// the namer if it's an EnvNamer.  It's nil if they can't be read.
+		Env map[string]string
+		// Parents are the proc's ancestors, its parent first, up to the
+		// depth asked for by the namer if it's a ParentNamer.  They stop
+		// at the first one that isn't known, and before init, since a proc
+		// whose parent exited is reparented to it.
+		Parents []ParentAttributes
+		// ListeningPorts are the TCP and UDP ports the proc listens on, as
+		// "tcp/<port>" or "udp/<port>", if the namer is a PortsNamer that
+		// needs them.
+		ListeningPorts []string
+	}
+
+	// ParentAttributes describes an ancestor of a proc.
+	ParentAttributes struct {
+		Name string
+		// Exe is the path of the executable, as in ProcAttributes.
+		Exe string
 	}
 
 	MatchNamer interface {
@@ -20,4 +60,165 @@ type (
 		MatchAndName(ProcAttributes) (bool, string)
 		fmt.Stringer
 	}
+
+	// SMapsNamer may be implemented by a MatchNamer to ask for the costly
+	// smaps-based memory metrics to be gathered for some of the groups it names.
+	SMapsNamer interface {
+		// GatherSMaps returns true if smaps should be read for the procs
+		// in the named group.
+		GatherSMaps(groupname string) bool
+	}
+
+	// CollectorsNamer may be implemented by a MatchNamer to turn some of the
+	// costly per-proc collectors, "smaps", "threads" or "io", on or off for
+	// some of the groups it names, whatever their global setting.
+	CollectorsNamer interface {
+		// GroupCollectors returns whether each collector the named group
+		// turns on or off is on, by collector name.
+		GroupCollectors(groupname string) map[string]bool
+	}
+
+	// GatherNamer may be implemented by a MatchNamer to choose which of the
+	// optional per-proc reads are done for the procs of each group.
+	GatherNamer interface {
+		// Gather returns true if the named collector, "threads" or "io",
+		// should read the procs in the named group, or if groupname is
+		// empty, the procs not yet in one.
+		Gather(groupname, collector string) bool
+	}
+
+	// LabelsNamer may be implemented by a MatchNamer to attach labels to the
+	// series of the groups it names.
+	LabelsNamer interface {
+		// GroupLabelNames returns the names of the labels any group may
+		// have, in a fixed order.
+		GroupLabelNames() []string
+		// GroupLabels returns the labels of the named group.
+		GroupLabels(groupname string) map[string]string
+	}
+
+	// RuntimeNamer may be implemented by a MatchNamer that matches or names
+	// procs by container runtime, which is only read when needed.
+	RuntimeNamer interface {
+		// NeedsRuntime returns true if ProcAttributes.Runtime must be set.
+		NeedsRuntime() bool
+	}
+
+	// CgroupPathNamer may be implemented by a MatchNamer that matches or
+	// names procs by cgroup path, which is only read when needed.
+	CgroupPathNamer interface {
+		// NeedsCgroupPath returns true if ProcAttributes.CgroupPath must
+		// be set.
+		NeedsCgroupPath() bool
+	}
+
+	// EnvNamer may be implemented by a MatchNamer that matches procs by
+	// environment variables, which are only read when needed.
+	EnvNamer interface {
+		// EnvVars returns the names of the variables ProcAttributes.Env
+		// must hold, if set.
+		EnvVars() []string
+	}
+
+	// PortsNamer may be implemented by a MatchNamer that matches procs by
+	// the ports they listen on, which are only found when needed.
+	PortsNamer interface {
+		// NeedsListeningPorts returns true if ProcAttributes.ListeningPorts
+		// must be set.
+		NeedsListeningPorts() bool
+	}
+
+	// ChildrenNamer may be implemented by a MatchNamer to have the
+	// descendants of the procs in some groups join their group.
+	ChildrenNamer interface {
+		// TrackChildren returns true if procs that aren't matched
+		// themselves join the named group when their parent is in it.
+		TrackChildren(groupname string) bool
+	}
+
+	// DefinitionNamer may be implemented by a MatchNamer to identify the
+	// definition that names each group, so that when the namer is replaced
+	// a group whose definition changed can be told from one that kept it.
+	DefinitionNamer interface {
+		// GroupDefinition returns the definition that named the group, or
+		// "" if it hasn't been named.
+		GroupDefinition(groupname string) string
+	}
+
+	// ParentNamer may be implemented by a MatchNamer that matches procs by
+	// their ancestors.
+	ParentNamer interface {
+		// ParentDepth returns how many ancestors ProcAttributes.Parents
+		// must hold at most.
+		ParentDepth() int
+	}
+
+	// ExcludeNamer may be implemented by a MatchNamer to exclude some procs
+	// from every group, including the other group, whatever they'd match.
+	ExcludeNamer interface {
+		// Excluded returns true if the proc must not be tracked.  It's
+		// asked before anything but the proc's attributes is read, and
+		// only once per proc.
+		Excluded(ProcAttributes) bool
+	}
+
+	// MinAgeNamer may be implemented by a MatchNamer to leave procs alone
+	// until they're old enough, e.g. so that the many short-lived procs of
+	// a build aren't read at all.
+	MinAgeNamer interface {
+		// MinAge returns how long after it started a proc MatchAndName
+		// put in groupname, or "" if it didn't match, may be tracked.
+		// It's asked before anything but the proc's attributes is read,
+		// on each update until the proc is old enough.
+		MinAge(groupname string) time.Duration
+	}
+
+	// ExplainNamer may be implemented by a MatchNamer to tell why it does or
+	// doesn't match a proc, for debugging.
+	ExplainNamer interface {
+		// Explain returns the namer's verdict on the proc along with how
+		// each of its selectors fared.  Unlike MatchAndName it evaluates
+		// them all rather than stopping at the first that fails.
+		Explain(ProcAttributes) MatchExplanation
+	}
+
+	// MatchExplanation tells why a namer does or doesn't match a proc.
+	MatchExplanation struct {
+		// Excludes are the outcomes of the namer's global excludes, any
+		// of which passing excludes the proc.
+		Excludes []MatcherResult `json:"excludes,omitempty"`
+		// Entries are the outcomes of the namer's entries, e.g. the items
+		// of a config file's process_names, in order.
+		Entries []EntryExplanation `json:"entries,omitempty"`
+		// Matched and GroupName are the namer's verdict, as given by
+		// MatchAndName: the name of the first entry to match, unless the
+		// proc is excluded.
+		Matched   bool   `json:"matched"`
+		GroupName string `json:"group_name"`
+	}
+
+	// EntryExplanation tells how an entry of a namer fared against a proc.
+	EntryExplanation struct {
+		// Name is the entry's name template.
+		Name string `json:"name"`
+		// Matchers are the outcomes of the entry's selectors, all of which
+		// must pass for it to match.
+		Matchers []MatcherResult `json:"matchers"`
+		// Excludes are the outcomes of the entry's excludes, any of which
+		// passing keeps it from matching.
+		Excludes []MatcherResult `json:"excludes,omitempty"`
+		// Matched is true if the entry matches, and GroupName is then the
+		// name it renders.
+		Matched   bool   `json:"matched"`
+		GroupName string `json:"group_name,omitempty"`
+	}
+
+	// MatcherResult is the outcome of a selector against a proc.
+	MatcherResult struct {
+		Matcher string `json:"matcher"`
+		Passed  bool   `json:"passed"`
+		// Captures are the named groups captured by the selector's
+		// regexes, if it passed.
+		Captures map[string]string `json:"captures,omitempty"`
+	}
 )
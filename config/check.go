@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// topLevelKeys are the keys a config file may have.
+var topLevelKeys = map[string]bool{
+	"process_names": true, "exclude": true, "other_group": true, "stale_group_ttl": true,
+	"recheck_interval": true, "recheck_on_scrape": true, "min_age": true, "labels": true, "cgroup_filter": true,
+	"ignore_case": true, "anchored": true,
+}
+
+// entryKeys are the keys a process_names entry may have.  getMatchNamer
+// takes any other key to be a selector, which getMatchers then ignores.
+var entryKeys = map[string]bool{
+	"name": true, "labels": true, "smaps": true, "threads": true, "io": true, "track_children": true, "min_age": true, "env": true,
+	"user_uid": true, "exclude": true, "ignore_case": true, "anchored": true,
+	"comm": true, "exe": true, "cmdline": true, "user": true, "runtime": true,
+	"cgroup": true, "cgroup_prefix": true,
+	"parent_comm": true, "parent_exe": true, "parent_depth": true, "pidfile": true, "pidfile_comm": true,
+	"listening_port": true, "group_by": true, "units": true, "exclude_units": true, "user_units": true, "fallback": true,
+}
+
+// Check validates content as GetConfig does, but returns every error found
+// rather than the first, and is stricter: it rejects repeated and unknown
+// keys, which GetConfig ignores, name templates using fields that don't
+// exist or captures none of their entry's regexes has, entries repeating an
+// earlier one, and an other_group named like a process_names group.
+func Check(content string) []error {
+	var yamldata map[string]interface{}
+	if err := yaml.UnmarshalStrict([]byte(content), &yamldata); err != nil {
+		return []error{err}
+	}
+	cfg, errs := getConfig(yamldata, true)
+	if cfg != nil {
+		cfg.logWarnings()
+	}
+	return errs
+}
+
+// checkEntryKeys returns an error for each unknown key of a process_names
+// entry.
+func checkEntryKeys(yamlmn interface{}) []error {
+	nm, ok := yamlmn.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	var keys []string
+	for k := range nm {
+		if key, ok := k.(string); ok && !entryKeys[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var errs []error
+	for _, key := range keys {
+		errs = append(errs, fmt.Errorf("unknown key %q", key))
+	}
+	return errs
+}
+
+// checkTemplate executes m's name template as if every capture of its
+// regexes had matched, so that fields that don't exist and captures that
+// don't, which would otherwise only show as empty names, are errors.
+func checkTemplate(m *matchNamer) error {
+	matches := make(map[string]string)
+	addCaptures := func(r *regexp.Regexp) {
+		for _, name := range r.SubexpNames() {
+			if name != "" {
+				matches[name] = name
+			}
+		}
+	}
+	for _, mc := range m.andMatcher {
+		switch mc := mc.(type) {
+		case *cmdlineMatcher:
+			for _, r := range mc.regexes {
+				addCaptures(r)
+			}
+		case *cgroupMatcher:
+			for _, r := range mc.regexes {
+				addCaptures(r)
+			}
+		case *envMatcher:
+			for _, v := range mc.vars {
+				addCaptures(v.regex)
+			}
+		}
+	}
+	tmpl, err := m.template.Clone()
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Option("missingkey=error").Execute(ioutil.Discard, &templateParams{Matches: matches}); err != nil {
+		return fmt.Errorf("bad name template: %v", err)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m, sorted.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -5,13 +5,20 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"text/template/parse"
 	"time"
 
 	common "github.com/ncabatoff/process-exporter"
+	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v2"
 )
 
@@ -23,18 +30,121 @@ type (
 
 	FirstMatcher struct {
 		matchers []common.MatchNamer
+		// smapsGroups holds the names given by matchers with smaps enabled.
+		smapsGroups map[string]bool
+		// groupLabels holds the labels of the names given by matchers with
+		// labels, those of the first matcher to give each name.  It's
+		// shared by the copies of the FirstMatcher.
+		groupLabels *groupLabels
+		// labelNames are the names of the labels of all matchers, sorted.
+		labelNames []string
+		// groupDefinitions holds the definitions of the matchers that
+		// first gave each name.
+		groupDefinitions map[string]string
+		// childrenGroups holds the names given by matchers with
+		// track_children enabled.
+		childrenGroups map[string]bool
+		// groupCollectors holds the collectors turned on or off for the
+		// names given by matchers that do, by the first matcher to give
+		// each name.
+		groupCollectors map[string]map[string]bool
+		// excludes are the global exclude selectors, any of which keeps
+		// a proc out of every group.
+		excludes []andMatcher
+		// minAge is the global min_age, and groupMinAges holds the
+		// min_age of the names given by matchers with one of their own,
+		// that of the first matcher to give each name.
+		minAge       time.Duration
+		groupMinAges map[string]time.Duration
+	}
+
+	// groupLabels holds, for up to maxGroupLabelNames names given by
+	// matchers with labels, the index of the first matcher to give each.
+	// Matching may be done concurrently, so it's locked.
+	groupLabels struct {
+		sync.Mutex
+		matchers []common.MatchNamer
+		names    map[string]groupLabelsEntry
+		// static holds the labels of the names that don't depend on the
+		// procs matched, which are known without matching any, for when
+		// names is full.
+		static map[string]map[string]string
+		// full is true once names has been found full.
+		full bool
+	}
+
+	// groupLabelsEntry is the matcher that first gave a name, and whether
+	// another with different labels was found to give it too.
+	groupLabelsEntry struct {
+		matcher  int
+		conflict bool
 	}
 
 	Config struct {
 		MatchNamers FirstMatcher
+		// OtherGroup, if not nil, asks for the procs not matched by
+		// MatchNamers to be gathered into a group of their own.
+		OtherGroup *OtherGroup
+		// StaleGroupTTL, if positive, is how long a group may have no procs
+		// before it stops being reported.
+		StaleGroupTTL time.Duration
+		// RecheckInterval, if positive, is how often procs that aren't
+		// tracked are matched again.
+		RecheckInterval time.Duration
+		// RecheckOnScrape asks for procs that aren't tracked to be matched
+		// again on every scrape.
+		RecheckOnScrape bool
+		// Labels are constant labels added to every series.
+		Labels map[string]string
+		// CgroupFilter, if not nil, restricts the procs scraped to those in
+		// some cgroups.
+		CgroupFilter *CgroupFilter
+		// Collectors, if not nil, gives the collectors in effect for the
+		// groups of a process_names entry from those the entry turns on
+		// or off, which depends on the global settings.  MarshalJSON then
+		// gives them as the entry's collectors.
+		Collectors func(overrides map[string]bool) map[string]bool
+		// warnings are what's valid but suspect about the config, logged
+		// once it's read.
+		warnings []string
+	}
+
+	// CgroupFilter selects the procs to scrape by cgroup path: those with a
+	// path in one of the Prefixes subtrees or matching Regex.
+	CgroupFilter struct {
+		Prefixes []string
+		Regex    *regexp.Regexp
+	}
+
+	// OtherGroup configures the group of procs that aren't matched.
+	OtherGroup struct {
+		// Name is the name of the group, "other" by default.
+		Name string
+		// KernelThreads is true if kernel threads belong in the group,
+		// which is the default.
+		KernelThreads bool
 	}
 
+	// commMatcher matches procs whose comm is one of comms, lowercased if
+	// ignoreCase.
 	commMatcher struct {
-		comms map[string]struct{}
+		comms      map[string]struct{}
+		ignoreCase bool
 	}
 
+	// exeMatcher matches procs whose executable has one of the base names
+	// of exes, and the path it maps to unless that's empty, lowercased if
+	// ignoreCase.
 	exeMatcher struct {
-		exes map[string]string
+		exes       map[string]string
+		ignoreCase bool
+	}
+
+	// nameOptions are how the comm, exe and cmdline selectors of an entry
+	// or exclude match: ignoring case, and for cmdline regexes, matching
+	// the whole command line only, as comm and exe always do.
+	nameOptions struct {
+		ignoreCase, anchored bool
 	}
 
 	cmdlineMatcher struct {
@@ -42,8 +152,84 @@ type (
 		captures map[string]string
 	}
 
+	runtimeMatcher struct {
+		runtimes map[string]struct{}
+	}
+
+	// cgroupMatcher matches procs whose cgroup path is in the subtree of
+	// one of prefixes or matches one of regexes.
+	cgroupMatcher struct {
+		prefixes []string
+		regexes  []*regexp.Regexp
+		captures map[string]string
+	}
+
+	// envMatcher matches procs whose environment sets each of vars to a
+	// value matching its regex.
+	envMatcher struct {
+		vars     []envVar
+		captures map[string]string
+	}
+
+	envVar struct {
+		name  string
+		regex *regexp.Regexp
+	}
+
+	// userMatcher matches procs by user, given as names or numeric uids.
+	userMatcher struct {
+		names map[string]struct{}
+		uids  map[int]struct{}
+		// real is true to match the real rather than the effective uid.
+		real bool
+	}
+
+	// parentMatcher matches procs one of whose ancestors, up to depth of
+	// them, has one of comms, if any, and one of exes, if any.  Comms are
+	// lowercase if ignoreCase.
+	parentMatcher struct {
+		comms      map[string]struct{}
+		exes       *exeMatcher
+		depth      int
+		ignoreCase bool
+	}
+
+	// pidfileMatcher matches the procs whose pid is in one of the pid files
+	// matching globs, unless the file is stale, and whose comm matches comm
+	// if it's set.
+	pidfileMatcher struct {
+		globs []string
+		comm  *regexp.Regexp
+		// pids are the pids read from the files, with the mtime of the
+		// file giving each, as of when they were read.
+		pids map[int]time.Time
+		read time.Time
+	}
+
+	// portMatcher matches procs listening on one of ports, given as
+	// "tcp/<port>" or "udp/<port>".
+	portMatcher struct {
+		ports map[string]struct{}
+	}
+
 	andMatcher []Matcher
 
+	// unitGroup names procs after the systemd unit they're in, for
+	// group_by: systemd_unit.
+	unitGroup struct {
+		// units are the globs the unit must match, any unit if empty.
+		// The innermost unit that does names the proc.
+		units []string
+		// excludeUnits are the globs of units whose procs, however deep,
+		// aren't matched.
+		excludeUnits []string
+		// userUnits is true to name the units of a user's service manager
+		// user@<uid>/<unit>, false not to match their procs.
+		userUnits bool
+		// fallback names the procs in no unit, if not empty.
+		fallback string
+	}
+
 	templateNamer struct {
 		template *template.Template
 	}
@@ -51,6 +237,39 @@ type (
 	matchNamer struct {
 		andMatcher
 		templateNamer
+		// excludes are the entry's exclude selectors, any of which keeps
+		// a proc out of its group even if it matches.
+		excludes []andMatcher
+		// unitGroup, if not nil, names procs instead of the template.
+		unitGroup *unitGroup
+		// smaps is true if smaps should be read for the procs matched.
+		smaps bool
+		// collectors are the collectors the entry turns on or off for its
+		// groups, by key: smaps, threads or io.
+		collectors map[string]bool
+		// labels are added to the series of the groups named.
+		labels map[string]string
+		// staticName is the name given if it doesn't depend on the procs
+		// matched, empty otherwise.
+		staticName string
+		// definition is the process_names entry, marshalled again so that
+		// its formatting and key order don't matter.
+		definition string
+		// needsRuntime is true if the entry matches or names procs by
+		// container runtime.
+		needsRuntime bool
+		// needsCgroupPath is true if the entry matches procs by cgroup
+		// path.
+		needsCgroupPath bool
+		// realUID is true if the entry matches and names procs by their
+		// real rather than effective uid.
+		realUID bool
+		// trackChildren is true if the children of the procs matched join
+		// their group.
+		trackChildren bool
+		// minAge, if not nil, is how old the procs matched must be to be
+		// tracked, instead of the global min_age.
+		minAge *time.Duration
 	}
 
 	templateParams struct {
@@ -61,23 +280,124 @@ type (
 		PID       int
 		StartTime time.Time
 		Matches   map[string]string
+		Runtime   string
+		// CgroupPath, ContainerID and SystemdUnit are only read for procs
+		// if some template uses them, see templateFields.
+		CgroupPath  string
+		ContainerID string
+		SystemdUnit string
 	}
 )
 
+// pidfileRefresh is how long the pids read from pid files are used before
+// the files are read again, so that they're read about once per scrape
+// rather than once per proc matched.
+const pidfileRefresh = time.Second
+
+// pidfileStartSlack is how long after its pid file was written a proc may
+// seem to have started, start times being only as precise as the boot time.
+const pidfileStartSlack = time.Second
+
+// runtimes are the container runtimes procs can be matched by, as given by
+// proc.CgroupsRuntime.
+var runtimes = map[string]bool{
+	"docker": true, "containerd": true, "crio": true, "podman": true, "systemd": true, "unknown": true,
+}
+
+// exporterLabels are the labels of the exporter's own metrics, which constant
+// labels can't also be.  Keep in step with the descs of cmd/process-exporter.
+var exporterLabels = map[string]bool{
+	"capability": true, "class": true, "collector": true, "ctxswitchtype": true,
+	"groupname": true, "instance_id": true, "iomode": true, "le": true,
+	"memtype": true, "mode": true, "pid": true, "policy": true, "reason": true,
+	"state": true, "threadname": true, "user": true, "wchan": true,
+}
+
 func (c *cmdlineMatcher) String() string {
 	return fmt.Sprintf("cmdlines: %+v", c.regexes)
 
 }
 
 func (e *exeMatcher) String() string {
+	if e.ignoreCase {
+		return fmt.Sprintf("exes: %+v ignoring case", e.exes)
+	}
 	return fmt.Sprintf("exes: %+v", e.exes)
 }
 
+func (r *runtimeMatcher) String() string {
+	var runtimes = make([]string, 0, len(r.runtimes))
+	for rt := range r.runtimes {
+		runtimes = append(runtimes, rt)
+	}
+	sort.Strings(runtimes)
+	return fmt.Sprintf("runtimes: %+v", runtimes)
+}
+
+func (m *cgroupMatcher) String() string {
+	return fmt.Sprintf("cgroups: %+v %+v", m.prefixes, m.regexes)
+}
+
+func (m *envMatcher) String() string {
+	var vars = make([]string, 0, len(m.vars))
+	for _, v := range m.vars {
+		vars = append(vars, v.name+"="+v.regex.String())
+	}
+	return fmt.Sprintf("env: %+v", vars)
+}
+
+func (m *pidfileMatcher) String() string {
+	if m.comm != nil {
+		return fmt.Sprintf("pidfiles: %+v comm %s", m.globs, m.comm)
+	}
+	return fmt.Sprintf("pidfiles: %+v", m.globs)
+}
+
+func (m *portMatcher) String() string {
+	ports := make([]string, 0, len(m.ports))
+	for port := range m.ports {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	return fmt.Sprintf("listening_ports: %+v", ports)
+}
+
+func (u *userMatcher) String() string {
+	var users = make([]string, 0, len(u.names)+len(u.uids))
+	for name := range u.names {
+		users = append(users, name)
+	}
+	for uid := range u.uids {
+		users = append(users, strconv.Itoa(uid))
+	}
+	sort.Strings(users)
+	return fmt.Sprintf("users: %+v", users)
+}
+
+func (m *parentMatcher) String() string {
+	var comms = make([]string, 0, len(m.comms))
+	for comm := range m.comms {
+		comms = append(comms, comm)
+	}
+	sort.Strings(comms)
+	var exes map[string]string
+	if m.exes != nil {
+		exes = m.exes.exes
+	}
+	if m.ignoreCase {
+		return fmt.Sprintf("parents: %+v %+v depth %d ignoring case", comms, exes, m.depth)
+	}
+	return fmt.Sprintf("parents: %+v %+v depth %d", comms, exes, m.depth)
+}
+
 func (c *commMatcher) String() string {
 	var comms = make([]string, 0, len(c.comms))
 	for cm := range c.comms {
 		comms = append(comms, cm)
 	}
+	if c.ignoreCase {
+		return fmt.Sprintf("comms: %+v ignoring case", comms)
+	}
 	return fmt.Sprintf("comms: %+v", comms)
 }
 
@@ -86,26 +406,256 @@ func (f FirstMatcher) String() string {
 }
 
 func (f FirstMatcher) MatchAndName(nacl common.ProcAttributes) (bool, string) {
-	for _, m := range f.matchers {
+	if f.Excluded(nacl) {
+		return false, ""
+	}
+	for i, m := range f.matchers {
 		if matched, name := m.MatchAndName(nacl); matched {
+			if mn, ok := m.(*matchNamer); ok {
+				if mn.smaps {
+					f.smapsGroups[name] = true
+				}
+				if mn.trackChildren {
+					f.childrenGroups[name] = true
+				}
+				if mn.labels != nil {
+					f.groupLabels.add(name, i)
+				}
+				if _, ok := f.groupDefinitions[name]; !ok {
+					f.groupDefinitions[name] = mn.definition
+				}
+				if _, ok := f.groupCollectors[name]; !ok && mn.collectors != nil {
+					f.groupCollectors[name] = mn.collectors
+				}
+				if _, ok := f.groupMinAges[name]; !ok && mn.minAge != nil {
+					f.groupMinAges[name] = *mn.minAge
+				}
+			}
 			return true, name
 		}
 	}
 	return false, ""
 }
 
+// Excluded implements common.ExcludeNamer.  It returns true if the proc
+// matches one of the global exclude selectors.
+func (f FirstMatcher) Excluded(nacl common.ProcAttributes) bool {
+	return anyMatch(f.excludes, nacl)
+}
+
+// GatherSMaps implements common.SMapsNamer.  It returns true if groupname
+// was given by a process_names entry with smaps enabled.
+func (f FirstMatcher) GatherSMaps(groupname string) bool {
+	return f.smapsGroups[groupname]
+}
+
+// GroupCollectors implements common.CollectorsNamer.  It returns the
+// collectors the process_names entry that gave groupname turns on or off.
+func (f FirstMatcher) GroupCollectors(groupname string) map[string]bool {
+	return f.groupCollectors[groupname]
+}
+
+// MinAge implements common.MinAgeNamer.  It returns the min_age of the
+// process_names entry that first gave groupname if it has one, else the
+// global one.
+func (f FirstMatcher) MinAge(groupname string) time.Duration {
+	if minAge, ok := f.groupMinAges[groupname]; ok {
+		return minAge
+	}
+	return f.minAge
+}
+
+// TrackChildren implements common.ChildrenNamer.  It returns true if
+// groupname was given by a process_names entry with track_children enabled.
+func (f FirstMatcher) TrackChildren(groupname string) bool {
+	return f.childrenGroups[groupname]
+}
+
+// GroupLabelNames implements common.LabelsNamer.
+func (f FirstMatcher) GroupLabelNames() []string {
+	return f.labelNames
+}
+
+// GroupLabels implements common.LabelsNamer.  It returns the labels of the
+// process_names entry that first gave groupname.
+func (f FirstMatcher) GroupLabels(groupname string) map[string]string {
+	return f.groupLabels.get(groupname)
+}
+
+// maxGroupLabelNames is how many names given by templates the labels of
+// are kept.  Past that, the groups of new names only have the labels of
+// fixed names.
+const maxGroupLabelNames = 10000
+
+// newGroupLabels returns the groupLabels of matchers.
+func newGroupLabels(matchers []common.MatchNamer) *groupLabels {
+	gl := &groupLabels{
+		matchers: matchers,
+		names:    make(map[string]groupLabelsEntry),
+		static:   make(map[string]map[string]string),
+	}
+	for _, m := range matchers {
+		if mn := m.(*matchNamer); mn.staticName != "" && mn.labels != nil {
+			if _, ok := gl.static[mn.staticName]; !ok {
+				gl.static[mn.staticName] = mn.labels
+			}
+		}
+	}
+	return gl
+}
+
+// add records that the matcher at index i, which has labels, gave name.  If
+// another gave it first with different labels, which only templates can do,
+// those are kept and the conflict logged, once.
+func (gl *groupLabels) add(name string, i int) {
+	gl.Lock()
+	defer gl.Unlock()
+	entry, ok := gl.names[name]
+	if !ok {
+		if len(gl.names) < maxGroupLabelNames {
+			gl.names[name] = groupLabelsEntry{matcher: i}
+		} else if !gl.full {
+			log.Printf("more than %d groups with labels, new ones only get the labels of fixed names", maxGroupLabelNames)
+			gl.full = true
+		}
+		return
+	}
+	if entry.matcher != i && !entry.conflict &&
+		!sameLabels(gl.labels(entry.matcher), gl.labels(i)) {
+		log.Printf("group %q is named by process_names entries %d and %d, which have different labels, keeping those of %d",
+			name, entry.matcher, i, entry.matcher)
+		entry.conflict = true
+		gl.names[name] = entry
+	}
+}
+
+// get returns the labels of the first matcher to give name.
+func (gl *groupLabels) get(name string) map[string]string {
+	gl.Lock()
+	defer gl.Unlock()
+	if entry, ok := gl.names[name]; ok {
+		return gl.labels(entry.matcher)
+	}
+	return gl.static[name]
+}
+
+// labels returns the labels of the matcher at index i.
+func (gl *groupLabels) labels(i int) map[string]string {
+	return gl.matchers[i].(*matchNamer).labels
+}
+
+// NeedsRuntime implements common.RuntimeNamer.  It returns true if any
+// process_names entry has a runtime selector or uses .Runtime in its name.
+func (f FirstMatcher) NeedsRuntime() bool {
+	for _, m := range f.matchers {
+		if mn, ok := m.(*matchNamer); ok && mn.needsRuntime {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsCgroupPath implements common.CgroupPathNamer.  It returns true if any
+// process_names entry has a cgroup or cgroup_prefix selector.
+func (f FirstMatcher) NeedsCgroupPath() bool {
+	for _, m := range f.matchers {
+		if mn, ok := m.(*matchNamer); ok && mn.needsCgroupPath {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsListeningPorts implements common.PortsNamer.  It returns true if any
+// process_names entry has a listening_port selector.
+func (f FirstMatcher) NeedsListeningPorts() bool {
+	for _, m := range f.matchers {
+		mn, ok := m.(*matchNamer)
+		if !ok {
+			continue
+		}
+		for _, matcher := range mn.andMatcher {
+			if _, ok := matcher.(*portMatcher); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParentDepth implements common.ParentNamer.  It returns the largest
+// parent_depth of the process_names entries with a parent selector.
+func (f FirstMatcher) ParentDepth() int {
+	depth := 0
+	for _, m := range f.matchers {
+		mn, ok := m.(*matchNamer)
+		if !ok {
+			continue
+		}
+		for _, matcher := range mn.andMatcher {
+			if pm, ok := matcher.(*parentMatcher); ok && pm.depth > depth {
+				depth = pm.depth
+			}
+		}
+	}
+	return depth
+}
+
+// EnvVars implements common.EnvNamer.  It returns the sorted names of the
+// variables in the env selectors of all process_names entries.
+func (f FirstMatcher) EnvVars() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range f.matchers {
+		mn, ok := m.(*matchNamer)
+		if !ok {
+			continue
+		}
+		for _, matcher := range mn.andMatcher {
+			if em, ok := matcher.(*envMatcher); ok {
+				for _, v := range em.vars {
+					if !seen[v.name] {
+						seen[v.name] = true
+						names = append(names, v.name)
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GroupDefinition implements common.DefinitionNamer.  It returns the
+// process_names entry that first gave groupname.
+func (f FirstMatcher) GroupDefinition(groupname string) string {
+	return f.groupDefinitions[groupname]
+}
+
 func (m *matchNamer) String() string {
 	return fmt.Sprintf("%+v", m.andMatcher)
 }
 
 func (m *matchNamer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
-	if !m.Match(nacl) {
+	if !m.Match(nacl) || anyMatch(m.excludes, nacl) {
 		return false, ""
 	}
+	if m.unitGroup != nil {
+		return m.unitGroup.name(nacl)
+	}
 
 	matches := make(map[string]string)
 	for _, m := range m.andMatcher {
-		if mc, ok := m.(*cmdlineMatcher); ok {
+		switch mc := m.(type) {
+		case *cmdlineMatcher:
+			for k, v := range mc.captures {
+				matches[k] = v
+			}
+		case *cgroupMatcher:
+			for k, v := range mc.captures {
+				matches[k] = v
+			}
+		case *envMatcher:
 			for k, v := range mc.captures {
 				matches[k] = v
 			}
@@ -118,29 +668,239 @@ func (m *matchNamer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
 		exebase = filepath.Base(exefull)
 	}
 
+	username := nacl.Username
+	if m.realUID {
+		username = nacl.RealUsername
+	}
+
 	var buf bytes.Buffer
-	m.template.Execute(&buf, &templateParams{
-		Comm:      nacl.Name,
-		ExeBase:   exebase,
-		ExeFull:   exefull,
-		Matches:   matches,
-		Username:  nacl.Username,
-		PID:       nacl.PID,
-		StartTime: nacl.StartTime,
+	err := m.template.Execute(&buf, &templateParams{
+		Comm:        nacl.Name,
+		ExeBase:     exebase,
+		ExeFull:     exefull,
+		Matches:     matches,
+		Username:    username,
+		PID:         nacl.PID,
+		StartTime:   nacl.StartTime,
+		Runtime:     nacl.Runtime,
+		CgroupPath:  nacl.CgroupPath,
+		ContainerID: nacl.ContainerID,
+		SystemdUnit: nacl.SystemdUnit,
 	})
-	return true, buf.String()
+	// An empty name isn't a usable group, e.g. if the proc is in no
+	// container and the name is just {{.ContainerID}}, so it's no match.
+	if err != nil || buf.Len() == 0 {
+		return false, ""
+	}
+	return true, strings.ToValidUTF8(buf.String(), "\uFFFD")
+}
+
+// name returns the name of the proc's group: its innermost unit matching
+// units, prefixed by its user's service manager if it has one, or the
+// fallback if it's in no unit matching units.  Procs in any excluded unit,
+// and in user units unless userUnits, aren't matched.
+func (u *unitGroup) name(nacl common.ProcAttributes) (bool, string) {
+	for _, unit := range nacl.SystemdUnits {
+		if matchGlobs(u.excludeUnits, unit) {
+			return false, ""
+		}
+	}
+	for i, unit := range nacl.SystemdUnits {
+		if len(u.units) > 0 && !matchGlobs(u.units, unit) {
+			continue
+		}
+		for _, outer := range nacl.SystemdUnits[i+1:] {
+			if strings.HasPrefix(outer, "user@") && strings.HasSuffix(outer, ".service") {
+				if !u.userUnits {
+					return false, ""
+				}
+				return true, strings.TrimSuffix(outer, ".service") + "/" + unit
+			}
+		}
+		return true, unit
+	}
+	return u.fallback != "", u.fallback
+}
+
+// matchGlobs returns true if name matches any of globs.
+func matchGlobs(globs []string, name string) bool {
+	for _, glob := range globs {
+		if matched, _ := path.Match(glob, name); matched {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *commMatcher) Match(nacl common.ProcAttributes) bool {
-	_, found := m.comms[nacl.Name]
+	name := nacl.Name
+	if m.ignoreCase {
+		name = strings.ToLower(name)
+	}
+	_, found := m.comms[name]
 	return found
 }
 
-func (m *exeMatcher) Match(nacl common.ProcAttributes) bool {
-	if len(nacl.Cmdline) == 0 {
+func (m *runtimeMatcher) Match(nacl common.ProcAttributes) bool {
+	_, found := m.runtimes[nacl.Runtime]
+	return found
+}
+
+// Match returns true if the cgroup path is in one of the prefix subtrees or
+// matches one of the regexes, whose captures are those of the first regex to
+// match.
+func (m *cgroupMatcher) Match(nacl common.ProcAttributes) bool {
+	if nacl.CgroupPath == "" {
+		return false
+	}
+	for k := range m.captures {
+		delete(m.captures, k)
+	}
+	for _, prefix := range m.prefixes {
+		if prefix == "/" || nacl.CgroupPath == prefix || strings.HasPrefix(nacl.CgroupPath, prefix+"/") {
+			return true
+		}
+	}
+	for _, regex := range m.regexes {
+		captures := regex.FindStringSubmatch(nacl.CgroupPath)
+		if captures == nil {
+			continue
+		}
+		for i, name := range regex.SubexpNames() {
+			m.captures[name] = captures[i]
+		}
+		return true
+	}
+	return false
+}
+
+// Match returns true if every variable is set to a value matching its
+// regex.  A proc whose environment can't be read doesn't match.
+func (m *envMatcher) Match(nacl common.ProcAttributes) bool {
+	for k := range m.captures {
+		delete(m.captures, k)
+	}
+	for _, v := range m.vars {
+		value, ok := nacl.Env[v.name]
+		if !ok {
+			return false
+		}
+		captures := v.regex.FindStringSubmatch(value)
+		if captures == nil {
+			return false
+		}
+		for i, name := range v.regex.SubexpNames() {
+			if name != "" {
+				m.captures[name] = captures[i]
+			}
+		}
+	}
+	return true
+}
+
+// Match returns true if one of the known ancestors up to depth matches.  A
+// proc whose parent isn't known, e.g. because it exited, doesn't match.
+func (m *parentMatcher) Match(nacl common.ProcAttributes) bool {
+	for i, parent := range nacl.Parents {
+		if i == m.depth {
+			break
+		}
+		if m.comms != nil {
+			name := parent.Name
+			if m.ignoreCase {
+				name = strings.ToLower(name)
+			}
+			if _, found := m.comms[name]; !found {
+				continue
+			}
+		}
+		if m.exes == nil || m.exes.Match(common.ProcAttributes{Exe: parent.Exe}) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match matches the proc if a pid file gives its pid and was written after
+// it started: one written before names an earlier proc whose pid has since
+// been reused.  Files that are missing or don't hold a pid give none.
+func (m *pidfileMatcher) Match(nacl common.ProcAttributes) bool {
+	if now := time.Now(); m.pids == nil || now.Sub(m.read) >= pidfileRefresh {
+		m.pids, m.read = readPidfiles(m.globs), now
+	}
+	written, ok := m.pids[nacl.PID]
+	if !ok || nacl.StartTime.After(written.Add(pidfileStartSlack)) {
 		return false
 	}
-	thisbase := filepath.Base(nacl.Cmdline[0])
+	return m.comm == nil || m.comm.MatchString(nacl.Name)
+}
+
+// readPidfiles returns the pids in the files matching globs, with the mtime
+// of the file giving each.  A file holds a pid on its first line.
+func readPidfiles(globs []string) map[int]time.Time {
+	pids := make(map[int]time.Time)
+	for _, glob := range globs {
+		paths, _ := filepath.Glob(glob)
+		for _, path := range paths {
+			fi, err := os.Stat(path)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			line := strings.SplitN(string(content), "\n", 2)[0]
+			if pid, err := strconv.Atoi(strings.TrimSpace(line)); err == nil && pid > 0 {
+				if written, ok := pids[pid]; !ok || fi.ModTime().After(written) {
+					pids[pid] = fi.ModTime()
+				}
+			}
+		}
+	}
+	return pids
+}
+
+// Match matches the proc if it listens on one of the ports.
+func (m *portMatcher) Match(nacl common.ProcAttributes) bool {
+	for _, port := range nacl.ListeningPorts {
+		if _, found := m.ports[port]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// Match matches the user by uid, or by name if the uid has one.
+func (m *userMatcher) Match(nacl common.ProcAttributes) bool {
+	uid, name := nacl.EffectiveUID, nacl.Username
+	if m.real {
+		uid, name = nacl.RealUID, nacl.RealUsername
+	}
+	if _, found := m.uids[uid]; found {
+		return true
+	}
+	_, found := m.names[name]
+	return found
+}
+
+// Match matches either the executable, as still its own if it's been
+// deleted, e.g. by a package upgrade, or argv[0], which is what the proc was
+// started as, e.g. python for a symlink to python3.11.
+func (m *exeMatcher) Match(nacl common.ProcAttributes) bool {
+	if exe := strings.TrimSuffix(nacl.Exe, " (deleted)"); exe != "" && m.matches(exe) {
+		return true
+	}
+	return len(nacl.Cmdline) > 0 && m.matches(nacl.Cmdline[0])
+}
+
+// matches returns true if exe has one of the base names, and is the path
+// given with it if there was one.
+func (m *exeMatcher) matches(exe string) bool {
+	if m.ignoreCase {
+		exe = strings.ToLower(exe)
+	}
+	thisbase := filepath.Base(exe)
 	fqpath, found := m.exes[thisbase]
 	if !found {
 		return false
@@ -149,13 +909,18 @@ func (m *exeMatcher) Match(nacl common.ProcAttributes) bool {
 		return true
 	}
 
-	return fqpath == nacl.Cmdline[0]
+	return fqpath == exe
 }
 
+// Match returns true if every regex matches the cmdline, its args joined by
+// spaces as the NUL bytes separating them in /proc/<pid>/cmdline would be by
+// ps.  Invalid UTF-8 is replaced first, so that captures used in group names
+// are valid label values.
 func (m *cmdlineMatcher) Match(nacl common.ProcAttributes) bool {
+	cmdline := strings.ToValidUTF8(strings.Join(nacl.Cmdline, " "), "\uFFFD")
 	for _, regex := range m.regexes {
-		captures := regex.FindStringSubmatch(strings.Join(nacl.Cmdline, " "))
-		if m.captures == nil {
+		captures := regex.FindStringSubmatch(cmdline)
+		if captures == nil {
 			return false
 		}
 		subexpNames := regex.SubexpNames()
@@ -170,6 +935,16 @@ func (m *cmdlineMatcher) Match(nacl common.ProcAttributes) bool {
 	return true
 }
 
+// anyMatch returns true if any of matchers matches.
+func anyMatch(matchers []andMatcher, nacl common.ProcAttributes) bool {
+	for _, m := range matchers {
+		if m.Match(nacl) {
+			return true
+		}
+	}
+	return false
+}
+
 func (m andMatcher) Match(nacl common.ProcAttributes) bool {
 	for _, matcher := range m {
 		if !matcher.Match(nacl) {
@@ -199,35 +974,382 @@ func GetConfig(content string, debug bool) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	cfg, errs := getConfig(yamldata, false)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	cfg.logWarnings()
+	return cfg, nil
+}
+
+// logWarnings logs the warnings found when the config was read.
+func (cfg *Config) logWarnings() {
+	for _, w := range cfg.warnings {
+		log.Printf("warning: %s", w)
+	}
+}
+
+// getConfig extracts Config from the parsed YAML.  Unless check, it stops at
+// the first error; if check, it goes on to find them all, leaving out of the
+// config what's bad, and it's strict too, see Check.
+func getConfig(yamldata map[string]interface{}, check bool) (*Config, []error) {
+	var errs []error
+	// bad records an error, and returns true if that's the end of it.
+	bad := func(format string, a ...interface{}) bool {
+		errs = append(errs, fmt.Errorf(format, a...))
+		return !check
+	}
+
+	if check {
+		for _, key := range sortedKeys(yamldata) {
+			if !topLevelKeys[key] {
+				bad("unknown top-level key %q", key)
+			}
+		}
+	}
 	yamlProcnames, ok := yamldata["process_names"]
 	if !ok {
-		return nil, fmt.Errorf("error parsing YAML config: no top-level 'process_names' key")
+		bad("error parsing YAML config: no top-level 'process_names' key")
+		return nil, errs
 	}
 	procnames, ok := yamlProcnames.([]interface{})
 	if !ok {
-		return nil, fmt.Errorf("error parsing YAML config: 'process_names' is not a list")
+		bad("error parsing YAML config: 'process_names' is not a list")
+		return nil, errs
 	}
 
-	var cfg Config
-	for i, procname := range procnames {
-		mn, err := getMatchNamer(procname)
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse process_name entry %d: %v", i, err)
+	cfg := Config{MatchNamers: FirstMatcher{
+		smapsGroups:      make(map[string]bool),
+		groupDefinitions: make(map[string]string),
+		childrenGroups:   make(map[string]bool),
+		groupCollectors:  make(map[string]map[string]bool),
+		groupMinAges:     make(map[string]time.Duration),
+	}}
+	var opts nameOptions
+	for _, key := range []string{"ignore_case", "anchored"} {
+		if v, ok := yamldata[key]; ok {
+			value, ok := v.(bool)
+			if !ok && bad("non-boolean value %v for %s", v, key) {
+				return nil, errs
+			}
+			if key == "ignore_case" {
+				opts.ignoreCase = value
+			} else {
+				opts.anchored = value
+			}
 		}
-		cfg.MatchNamers.matchers = append(cfg.MatchNamers.matchers, mn)
 	}
 
-	return &cfg, nil
-}
-
-func getMatchNamer(yamlmn interface{}) (common.MatchNamer, error) {
+	labelNames := make(map[string]bool)
+	staticLabels := make(map[string]map[string]string)
+	definitions := make(map[string]int)
+	var entries []int
+	for i, procname := range procnames {
+		if check {
+			for _, err := range checkEntryKeys(procname) {
+				bad("process_name entry %d: %v", i, err)
+			}
+		}
+		mn, err := getMatchNamer(procname, opts)
+		if err != nil {
+			if bad("unable to parse process_name entry %d: %v", i, err) {
+				return nil, errs
+			}
+			continue
+		}
+		cfg.MatchNamers.matchers = append(cfg.MatchNamers.matchers, mn)
+		entries = append(entries, i)
+
+		m := mn.(*matchNamer)
+		if check {
+			if err := checkTemplate(m); err != nil {
+				bad("process_name entry %d: %v", i, err)
+			}
+			if j, ok := definitions[m.definition]; ok {
+				bad("process_name entry %d repeats entry %d", i, j)
+			} else {
+				definitions[m.definition] = i
+			}
+		}
+		for name := range m.labels {
+			labelNames[name] = true
+		}
+		if m.staticName == "" {
+			continue
+		}
+		if labels, ok := staticLabels[m.staticName]; ok && !sameLabels(labels, m.labels) {
+			if bad("process_name entry %d: group %q has labels %v, but an earlier entry gives it %v",
+				i, m.staticName, m.labels, labels) {
+				return nil, errs
+			}
+			continue
+		}
+		staticLabels[m.staticName] = m.labels
+	}
+	for name := range labelNames {
+		cfg.MatchNamers.labelNames = append(cfg.MatchNamers.labelNames, name)
+	}
+	sort.Strings(cfg.MatchNamers.labelNames)
+	for k, mn := range cfg.MatchNamers.matchers {
+		m := mn.(*matchNamer)
+		if m.staticName != "" || m.labels == nil {
+			continue
+		}
+		for name, labels := range staticLabels {
+			if labels != nil && !sameLabels(labels, m.labels) && m.mayName(name) {
+				if bad("process_name entry %d: its name template may give group %q labels %v, but an entry with that name gives it %v",
+					entries[k], name, m.labels, labels) {
+					return nil, errs
+				}
+			}
+		}
+	}
+	cfg.MatchNamers.groupLabels = newGroupLabels(cfg.MatchNamers.matchers)
+
+	var err error
+	if yamlExclude, ok := yamldata["exclude"]; ok {
+		cfg.MatchNamers.excludes, err = getExcludes(yamlExclude, opts)
+		if err != nil && bad("unable to parse exclude: %v", err) {
+			return nil, errs
+		}
+	}
+	for k, mn := range cfg.MatchNamers.matchers {
+		i, m := entries[k], mn.(*matchNamer)
+		for j, exclude := range m.excludes {
+			if excludesAll(m.andMatcher, exclude) {
+				cfg.warnings = append(cfg.warnings, fmt.Sprintf(
+					"process_name entry %d matches nothing, its exclude entry %d excludes every proc it matches", i, j))
+			}
+		}
+		for j, exclude := range cfg.MatchNamers.excludes {
+			if excludesAll(m.andMatcher, exclude) {
+				cfg.warnings = append(cfg.warnings, fmt.Sprintf(
+					"process_name entry %d matches nothing, global exclude entry %d excludes every proc it matches", i, j))
+			}
+		}
+	}
+
+	if yamlOther, ok := yamldata["other_group"]; ok {
+		cfg.OtherGroup, err = getOtherGroup(yamlOther)
+		if err != nil && bad("unable to parse other_group: %v", err) {
+			return nil, errs
+		}
+		if check && cfg.OtherGroup != nil {
+			if _, ok := staticLabels[cfg.OtherGroup.Name]; ok {
+				bad("other_group name %q is also the name of a process_name group", cfg.OtherGroup.Name)
+			}
+		}
+	}
+
+	if yamlTTL, ok := yamldata["stale_group_ttl"]; ok {
+		cfg.StaleGroupTTL, err = getDuration("stale_group_ttl", yamlTTL)
+		if err != nil && bad("%v", err) {
+			return nil, errs
+		}
+	}
+
+	if yamlInterval, ok := yamldata["recheck_interval"]; ok {
+		cfg.RecheckInterval, err = getDuration("recheck_interval", yamlInterval)
+		if err != nil && bad("%v", err) {
+			return nil, errs
+		}
+	}
+
+	if yamlMinAge, ok := yamldata["min_age"]; ok {
+		cfg.MatchNamers.minAge, err = getDuration("min_age", yamlMinAge)
+		if err != nil && bad("%v", err) {
+			return nil, errs
+		}
+	}
+
+	if yamlRecheck, ok := yamldata["recheck_on_scrape"]; ok {
+		cfg.RecheckOnScrape, ok = yamlRecheck.(bool)
+		if !ok && bad("non-boolean value %v for recheck_on_scrape", yamlRecheck) {
+			return nil, errs
+		}
+	}
+
+	if yamlLabels, ok := yamldata["labels"]; ok {
+		cfg.Labels, err = getLabels(yamlLabels)
+		if err != nil && bad("unable to parse labels: %v", err) {
+			return nil, errs
+		}
+		for name := range cfg.Labels {
+			if exporterLabels[name] && bad("label %q is already a label of the exporter's metrics", name) {
+				return nil, errs
+			}
+			if labelNames[name] && bad("label %q is both a constant label and a group label", name) {
+				return nil, errs
+			}
+		}
+	}
+
+	if yamlFilter, ok := yamldata["cgroup_filter"]; ok {
+		cfg.CgroupFilter, err = getCgroupFilter(yamlFilter)
+		if err != nil && bad("unable to parse cgroup_filter: %v", err) {
+			return nil, errs
+		}
+	}
+
+	return &cfg, errs
+}
+
+// getDuration parses the value of key, a positive duration.
+func getDuration(key string, v interface{}) (time.Duration, error) {
+	value, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("non-string value %v for %s", v, key)
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad duration %q for %s", value, key)
+	}
+	return d, nil
+}
+
+// getCgroupFilter parses the cgroup_filter section, which needs prefixes, a
+// regex or both.
+func getCgroupFilter(yamlfilter interface{}) (*CgroupFilter, error) {
+	cf, ok := yamlfilter.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a map")
+	}
+	var filter CgroupFilter
+	for k, v := range cf {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("non-string key %v", k)
+		}
+
+		switch key {
+		case "prefixes":
+			values, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("non-list value %v for key %q", v, key)
+			}
+			for _, value := range values {
+				prefix, ok := value.(string)
+				if !ok || !strings.HasPrefix(prefix, "/") {
+					return nil, fmt.Errorf("bad prefix %v, want an absolute cgroup path", value)
+				}
+				filter.Prefixes = append(filter.Prefixes, prefix)
+			}
+		case "regex":
+			value, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string value %v for key %q", v, key)
+			}
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad regex %q: %v", value, err)
+			}
+			filter.Regex = re
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	if len(filter.Prefixes) == 0 && filter.Regex == nil {
+		return nil, fmt.Errorf("no prefixes or regex")
+	}
+	return &filter, nil
+}
+
+// getLabels parses a labels section.
+func getLabels(yamllabels interface{}) (map[string]string, error) {
+	ls, ok := yamllabels.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a map")
+	}
+	labels := make(map[string]string, len(ls))
+	for k, v := range ls {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("non-string key %v", k)
+		}
+		if !model.LabelName(key).IsValid() || strings.HasPrefix(key, model.ReservedLabelPrefix) {
+			return nil, fmt.Errorf("invalid label name %q", key)
+		}
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("non-string value %v for label %q", v, key)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// getOtherGroup parses the other_group section, which may be empty to use
+// the defaults.
+func getOtherGroup(yamlother interface{}) (*OtherGroup, error) {
+	other := OtherGroup{Name: "other", KernelThreads: true}
+	if yamlother == nil {
+		return &other, nil
+	}
+	og, ok := yamlother.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a map")
+	}
+	for k, v := range og {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("non-string key %v", k)
+		}
+
+		switch key {
+		case "name":
+			value, ok := v.(string)
+			if !ok || value == "" {
+				return nil, fmt.Errorf("bad value %v for key %q", v, key)
+			}
+			other.Name = value
+		case "kernel_threads":
+			value, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("non-bool value %v for key %q", v, key)
+			}
+			other.KernelThreads = value
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	return &other, nil
+}
+
+// getMatchNamer parses a process_names entry, whose names match as opts says
+// unless it sets ignore_case or anchored itself.
+func getMatchNamer(yamlmn interface{}, opts nameOptions) (common.MatchNamer, error) {
 	nm, ok := yamlmn.(map[interface{}]interface{})
 	if !ok {
 		return nil, fmt.Errorf("not a map")
 	}
+	// The name options are read first, since excludes need them.
+	for _, key := range []string{"ignore_case", "anchored"} {
+		if v, ok := nm[key]; ok {
+			value, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("non-bool value %v for key %q", v, key)
+			}
+			if key == "ignore_case" {
+				opts.ignoreCase = value
+			} else {
+				opts.anchored = value
+			}
+		}
+	}
 
 	var smap = make(map[string][]string)
 	var nametmpl string
+	var smaps, trackChildren bool
+	var collectors map[string]bool
+	var labels map[string]string
+	var realUID bool
+	var env map[string]string
+	var excludes []andMatcher
+	var minAge *time.Duration
+	var pidfileComm *regexp.Regexp
+	var ug *unitGroup
+	unitKeys := make(map[string]interface{})
+	parentDepth := 1
 	for k, v := range nm {
 		key, ok := k.(string)
 		if !ok {
@@ -240,48 +1362,540 @@ func getMatchNamer(yamlmn interface{}) (common.MatchNamer, error) {
 				return nil, fmt.Errorf("non-string value %v for key %q", v, key)
 			}
 			nametmpl = value
-		} else {
-			vals, ok := v.([]interface{})
+		} else if key == "labels" {
+			var err error
+			if labels, err = getLabels(v); err != nil {
+				return nil, fmt.Errorf("bad labels: %v", err)
+			}
+			if _, ok := labels["groupname"]; ok {
+				return nil, fmt.Errorf("bad labels: groupname is reserved for the group name")
+			}
+		} else if key == "smaps" || key == "threads" || key == "io" {
+			value, ok := v.(bool)
 			if !ok {
-				return nil, fmt.Errorf("non-string array value %v for key %q", v, key)
+				return nil, fmt.Errorf("non-bool value %v for key %q", v, key)
+			}
+			if key == "smaps" {
+				smaps = value
+			}
+			if collectors == nil {
+				collectors = make(map[string]bool)
 			}
-			var strs []string
-			for i, si := range vals {
-				s, ok := si.(string)
-				if !ok {
-					return nil, fmt.Errorf("non-string value %v in list[%d] for key %q", v, i, key)
+			collectors[key] = value
+		} else if key == "track_children" {
+			value, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("non-bool value %v for key %q", v, key)
+			}
+			trackChildren = value
+		} else if key == "env" {
+			var err error
+			if env, err = getEnv(v); err != nil {
+				return nil, fmt.Errorf("bad env: %v", err)
+			}
+		} else if key == "pidfile_comm" {
+			value, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string value %v for key %q", v, key)
+			}
+			expr := value
+			if opts.ignoreCase {
+				expr = "(?i)" + expr
+			}
+			r, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("bad pidfile_comm regex %q: %v", value, err)
+			}
+			pidfileComm = r
+		} else if key == "parent_depth" {
+			value, ok := v.(int)
+			if !ok || value < 1 {
+				return nil, fmt.Errorf("bad value %v for key %q, want a positive number", v, key)
+			}
+			parentDepth = value
+		} else if key == "user_uid" {
+			value, ok := v.(string)
+			if !ok || (value != "effective" && value != "real") {
+				return nil, fmt.Errorf("bad value %v for key %q, want effective or real", v, key)
+			}
+			realUID = value == "real"
+		} else if key == "group_by" {
+			if v != "systemd_unit" {
+				return nil, fmt.Errorf("bad value %v for key %q, want systemd_unit", v, key)
+			}
+			ug = &unitGroup{userUnits: true}
+		} else if key == "units" || key == "exclude_units" || key == "user_units" || key == "fallback" {
+			unitKeys[key] = v
+		} else if key == "ignore_case" || key == "anchored" {
+			// Read above.
+		} else if key == "min_age" {
+			value, ok := v.(string)
+			d, err := time.ParseDuration(value)
+			if !ok || err != nil || d < 0 {
+				return nil, fmt.Errorf("bad value %v for key %q, want a duration", v, key)
+			}
+			minAge = &d
+		} else if key == "exclude" {
+			var err error
+			if excludes, err = getExcludes(v, opts); err != nil {
+				return nil, fmt.Errorf("bad exclude: %v", err)
+			}
+		} else {
+			strs, err := getStrings(key, v)
+			if err != nil {
+				return nil, err
+			}
+			smap[key] = strs
+		}
+	}
+
+	if ug != nil {
+		if nametmpl != "" {
+			return nil, fmt.Errorf("name can't be given with group_by")
+		}
+		if err := getUnitGroup(ug, unitKeys); err != nil {
+			return nil, err
+		}
+		nametmpl = "{{.SystemdUnit}}"
+	} else if len(unitKeys) > 0 {
+		return nil, fmt.Errorf("units, exclude_units, user_units and fallback need group_by")
+	}
+	if nametmpl == "" {
+		nametmpl = "{{.ExeBase}}"
+	}
+
+	// With group_by, every proc is matched unless selectors are given.
+	var matchers andMatcher
+	var err error
+	if ug == nil || len(smap) > 0 || env != nil {
+		matchers, err = getMatchers(smap, env, realUID, opts, fmt.Sprintf("group %q", nametmpl))
+		if err != nil {
+			return nil, err
+		}
+	}
+	hasParent := false
+	for _, m := range matchers {
+		if pm, ok := m.(*parentMatcher); ok {
+			pm.depth, hasParent = parentDepth, true
+		}
+	}
+	if _, ok := nm["parent_depth"]; ok && !hasParent {
+		return nil, fmt.Errorf("parent_depth without parent_comm or parent_exe")
+	}
+	if pidfileComm != nil {
+		hasPidfile := false
+		for _, m := range matchers {
+			if pm, ok := m.(*pidfileMatcher); ok {
+				pm.comm, hasPidfile = pidfileComm, true
+			}
+		}
+		if !hasPidfile {
+			return nil, fmt.Errorf("pidfile_comm without pidfile")
+		}
+	}
+
+	tmpl := template.New("cmdname").Option("missingkey=zero")
+	tmpl, err = tmpl.Parse(nametmpl)
+	if err != nil {
+		return nil, fmt.Errorf("bad name template %q: %v", nametmpl, err)
+	}
+
+	var staticName string
+	if !strings.Contains(nametmpl, "{{") {
+		staticName = nametmpl
+	}
+	// The name options in effect are part of the definition, wherever
+	// they're set, since they change what it matches.
+	defn := make(map[interface{}]interface{}, len(nm)+2)
+	for k, v := range nm {
+		defn[k] = v
+	}
+	delete(defn, "ignore_case")
+	delete(defn, "anchored")
+	if opts.ignoreCase {
+		defn["ignore_case"] = true
+	}
+	if opts.anchored {
+		defn["anchored"] = true
+	}
+	definition, err := yaml.Marshal(defn)
+	if err != nil {
+		return nil, err
+	}
+	fields := templateFields(tmpl)
+	_, hasRuntime := smap["runtime"]
+	_, hasCgroup := smap["cgroup"]
+	_, hasCgroupPrefix := smap["cgroup_prefix"]
+	needsRuntime := hasRuntime || fields["Runtime"]
+	needsCgroupPath := hasCgroup || hasCgroupPrefix ||
+		fields["CgroupPath"] || fields["ContainerID"] || fields["SystemdUnit"]
+	needsCgroupPath = needsCgroupPath || ug != nil
+	return &matchNamer{matchers, templateNamer{tmpl}, excludes, ug, smaps, collectors, labels, staticName,
+		string(definition), needsRuntime, needsCgroupPath, realUID, trackChildren, minAge}, nil
+}
+
+// getUnitGroup parses the keys that go with group_by: systemd_unit into ug.
+func getUnitGroup(ug *unitGroup, keys map[string]interface{}) error {
+	for key, v := range keys {
+		switch key {
+		case "units", "exclude_units":
+			globs, err := getStrings(key, v)
+			if err != nil {
+				return err
+			}
+			for _, glob := range globs {
+				if _, err := path.Match(glob, ""); err != nil {
+					return fmt.Errorf("bad glob %q for key %q: %v", glob, key, err)
 				}
-				strs = append(strs, s)
+			}
+			if key == "units" {
+				ug.units = globs
+			} else {
+				ug.excludeUnits = globs
+			}
+		case "user_units":
+			value, ok := v.(bool)
+			if !ok {
+				return fmt.Errorf("non-bool value %v for key %q", v, key)
+			}
+			ug.userUnits = value
+		case "fallback":
+			value, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("non-string value %v for key %q", v, key)
+			}
+			ug.fallback = value
+		}
+	}
+	return nil
+}
+
+// newExeMatcher returns a matcher for exes, given as base names or full
+// paths.
+func newExeMatcher(exe []string, ignoreCase bool) *exeMatcher {
+	exes := make(map[string]string)
+	for _, e := range exe {
+		if ignoreCase {
+			e = strings.ToLower(e)
+		}
+		if strings.Contains(e, "/") {
+			exes[filepath.Base(e)] = e
+		} else {
+			exes[e] = ""
+		}
+	}
+	return &exeMatcher{exes, ignoreCase}
+}
+
+// getStrings parses the list value of a selector key, where user may also
+// give numeric uids.
+func getStrings(key string, v interface{}) ([]string, error) {
+	vals, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("non-string array value %v for key %q", v, key)
+	}
+	var strs []string
+	for i, si := range vals {
+		if n, ok := si.(int); ok && (key == "user" || key == "listening_port") {
+			si = strconv.Itoa(n)
+		}
+		s, ok := si.(string)
+		if !ok {
+			return nil, fmt.Errorf("non-string value %v in list[%d] for key %q", v, i, key)
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// getExcludes parses an exclude list, whose entries select procs by comm,
+// exe, cmdline and user as process_names entries do, matching names as opts
+// says.  A proc is excluded if it matches any entry.
+func getExcludes(yamlexclude interface{}, opts nameOptions) ([]andMatcher, error) {
+	entries, ok := yamlexclude.([]interface{})
+	if !ok || len(entries) == 0 {
+		return nil, fmt.Errorf("not a non-empty list")
+	}
+	var excludes []andMatcher
+	for i, entry := range entries {
+		em, ok := entry.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("entry %d is not a map", i)
+		}
+		smap := make(map[string][]string)
+		for k, v := range em {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v in entry %d", k, i)
+			}
+			switch key {
+			case "comm", "exe", "cmdline", "user":
+			default:
+				return nil, fmt.Errorf("unknown key %q in entry %d", key, i)
+			}
+			strs, err := getStrings(key, v)
+			if err != nil {
+				return nil, err
 			}
 			smap[key] = strs
 		}
+		matchers, err := getMatchers(smap, nil, false, opts, fmt.Sprintf("exclude entry %d", i))
+		if err != nil {
+			return nil, err
+		}
+		excludes = append(excludes, matchers)
+	}
+	return excludes, nil
+}
+
+// excludesAll returns true if every proc matching include matches exclude
+// too, as far as can be told from the selectors alone: each of exclude's
+// matchers either matches any proc or is implied by one of include's.
+func excludesAll(include, exclude andMatcher) bool {
+	for _, e := range exclude {
+		implied := matchesAll(e)
+		for _, m := range include {
+			implied = implied || implies(m, e)
+		}
+		if !implied {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAll returns true if e matches any proc: it's a cmdline matcher
+// whose regexes match the empty string, and so any cmdline, since they
+// have no anchors or escapes that could be assertions.
+func matchesAll(e Matcher) bool {
+	cm, ok := e.(*cmdlineMatcher)
+	if !ok {
+		return false
+	}
+	for _, r := range cm.regexes {
+		if !r.MatchString("") || strings.ContainsAny(r.String(), "^$\\") {
+			return false
+		}
+	}
+	return true
+}
+
+// implies returns true if every proc m matches is matched by e, which is of
+// the same kind.
+func implies(m, e Matcher) bool {
+	switch e := e.(type) {
+	case *commMatcher:
+		m, ok := m.(*commMatcher)
+		if !ok || (m.ignoreCase && !e.ignoreCase) {
+			return false
+		}
+		for comm := range m.comms {
+			if e.ignoreCase {
+				comm = strings.ToLower(comm)
+			}
+			if _, ok := e.comms[comm]; !ok {
+				return false
+			}
+		}
+		return true
+	case *exeMatcher:
+		m, ok := m.(*exeMatcher)
+		if !ok || (m.ignoreCase && !e.ignoreCase) {
+			return false
+		}
+		for base, path := range m.exes {
+			if e.ignoreCase {
+				base, path = strings.ToLower(base), strings.ToLower(path)
+			}
+			if epath, ok := e.exes[base]; !ok || (epath != "" && epath != path) {
+				return false
+			}
+		}
+		return true
+	case *userMatcher:
+		m, ok := m.(*userMatcher)
+		if !ok || m.real != e.real {
+			return false
+		}
+		for name := range m.names {
+			if _, ok := e.names[name]; !ok {
+				return false
+			}
+		}
+		for uid := range m.uids {
+			if _, ok := e.uids[uid]; !ok {
+				return false
+			}
+		}
+		return true
+	case *cmdlineMatcher:
+		m, ok := m.(*cmdlineMatcher)
+		if !ok {
+			return false
+		}
+		for _, er := range e.regexes {
+			found := false
+			for _, r := range m.regexes {
+				found = found || r.String() == er.String()
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
 	}
+	return false
+}
 
+// endsWithDollar returns true if regex ends with a $ assertion, rather than
+// with an escaped $, i.e. one preceded by an odd number of backslashes.
+func endsWithDollar(regex string) bool {
+	if !strings.HasSuffix(regex, "$") {
+		return false
+	}
+	backslashes := 0
+	for i := len(regex) - 2; i >= 0 && regex[i] == '\\'; i-- {
+		backslashes++
+	}
+	return backslashes%2 == 0
+}
+
+// getMatchers returns the matchers for the selector keys of smap and env,
+// all of which a proc must match, with comm, exe and cmdline matching as
+// opts says.  what names the selector in errors.
+func getMatchers(smap map[string][]string, env map[string]string, realUID bool, opts nameOptions, what string) (andMatcher, error) {
 	var matchers andMatcher
 	if comm, ok := smap["comm"]; ok {
 		comms := make(map[string]struct{})
 		for _, c := range comm {
+			if opts.ignoreCase {
+				c = strings.ToLower(c)
+			}
 			comms[c] = struct{}{}
 		}
-		matchers = append(matchers, &commMatcher{comms})
+		matchers = append(matchers, &commMatcher{comms, opts.ignoreCase})
 	}
 	if exe, ok := smap["exe"]; ok {
-		exes := make(map[string]string)
-		for _, e := range exe {
-			if strings.Contains(e, "/") {
-				exes[filepath.Base(e)] = e
+		matchers = append(matchers, newExeMatcher(exe, opts.ignoreCase))
+	}
+	parentComm, hasParentComm := smap["parent_comm"]
+	parentExe, hasParentExe := smap["parent_exe"]
+	if hasParentComm || hasParentExe {
+		pm := &parentMatcher{depth: 1, ignoreCase: opts.ignoreCase}
+		if hasParentComm {
+			pm.comms = make(map[string]struct{})
+			for _, c := range parentComm {
+				if opts.ignoreCase {
+					c = strings.ToLower(c)
+				}
+				pm.comms[c] = struct{}{}
+			}
+		}
+		if hasParentExe {
+			pm.exes = newExeMatcher(parentExe, opts.ignoreCase)
+		}
+		matchers = append(matchers, pm)
+	}
+	if pidfile, ok := smap["pidfile"]; ok {
+		for _, glob := range pidfile {
+			if _, err := filepath.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("bad pidfile glob %q for %s: %v", glob, what, err)
+			}
+		}
+		matchers = append(matchers, &pidfileMatcher{globs: pidfile})
+	}
+	if ports, ok := smap["listening_port"]; ok {
+		pm := &portMatcher{ports: make(map[string]struct{})}
+		for _, p := range ports {
+			// A bare port stands for both protocols.
+			protos, port := []string{"tcp", "udp"}, p
+			if i := strings.IndexByte(p, '/'); i >= 0 {
+				protos, port = []string{p[:i]}, p[i+1:]
+			}
+			n, err := strconv.ParseUint(port, 10, 16)
+			if err != nil || n == 0 || (protos[0] != "tcp" && protos[0] != "udp") {
+				return nil, fmt.Errorf("bad listening_port %q for %s, want a port, tcp/<port> or udp/<port>", p, what)
+			}
+			for _, proto := range protos {
+				pm.ports[fmt.Sprintf("%s/%d", proto, n)] = struct{}{}
+			}
+		}
+		matchers = append(matchers, pm)
+	}
+	if runtime, ok := smap["runtime"]; ok {
+		rts := make(map[string]struct{})
+		for _, r := range runtime {
+			if !runtimes[r] {
+				return nil, fmt.Errorf("unknown runtime %q", r)
+			}
+			rts[r] = struct{}{}
+		}
+		matchers = append(matchers, &runtimeMatcher{rts})
+	}
+	if user, ok := smap["user"]; ok {
+		um := &userMatcher{names: make(map[string]struct{}), uids: make(map[int]struct{}), real: realUID}
+		for _, u := range user {
+			if uid, err := strconv.Atoi(u); err == nil {
+				if uid < 0 {
+					return nil, fmt.Errorf("bad uid %d", uid)
+				}
+				um.uids[uid] = struct{}{}
 			} else {
-				exes[e] = ""
+				um.names[u] = struct{}{}
 			}
 		}
-		matchers = append(matchers, &exeMatcher{exes})
+		matchers = append(matchers, um)
+	}
+	_, hasCgroup := smap["cgroup"]
+	_, hasCgroupPrefix := smap["cgroup_prefix"]
+	if hasCgroup || hasCgroupPrefix {
+		cm := &cgroupMatcher{captures: make(map[string]string)}
+		for _, prefix := range smap["cgroup_prefix"] {
+			if !strings.HasPrefix(prefix, "/") {
+				return nil, fmt.Errorf("bad cgroup prefix %q, want an absolute cgroup path", prefix)
+			}
+			if prefix != "/" {
+				prefix = strings.TrimSuffix(prefix, "/")
+			}
+			cm.prefixes = append(cm.prefixes, prefix)
+		}
+		for _, c := range smap["cgroup"] {
+			r, err := regexp.Compile(c)
+			if err != nil {
+				return nil, fmt.Errorf("bad cgroup regex %q for %s: %v", c, what, err)
+			}
+			cm.regexes = append(cm.regexes, r)
+		}
+		matchers = append(matchers, cm)
+	}
+	if env != nil {
+		em := &envMatcher{captures: make(map[string]string)}
+		for name, value := range env {
+			r, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad env regex %q for variable %q of %s: %v", value, name, what, err)
+			}
+			em.vars = append(em.vars, envVar{name, r})
+		}
+		sort.Slice(em.vars, func(i, j int) bool { return em.vars[i].name < em.vars[j].name })
+		matchers = append(matchers, em)
 	}
 	if cmdline, ok := smap["cmdline"]; ok {
 		var rs []*regexp.Regexp
 		for _, c := range cmdline {
-			r, err := regexp.Compile(c)
+			expr := c
+			if opts.anchored {
+				if strings.HasPrefix(c, "^") || endsWithDollar(c) {
+					return nil, fmt.Errorf("cmdline regex %q for %s is anchored already, and anchored is set", c, what)
+				}
+				expr = "^(?:" + expr + ")$"
+			}
+			if opts.ignoreCase {
+				expr = "(?i)" + expr
+			}
+			r, err := regexp.Compile(expr)
 			if err != nil {
-				return nil, fmt.Errorf("bad cmdline regex %q: %v", c, err)
+				return nil, fmt.Errorf("bad cmdline regex %q for %s: %v", c, what, err)
 			}
 			rs = append(rs, r)
 		}
@@ -293,15 +1907,123 @@ func getMatchNamer(yamlmn interface{}) (common.MatchNamer, error) {
 	if len(matchers) == 0 {
 		return nil, fmt.Errorf("no matchers provided")
 	}
+	return matchers, nil
+}
 
-	if nametmpl == "" {
-		nametmpl = "{{.ExeBase}}"
+// templateFields returns the names of the fields of templateParams used by
+// tmpl, so that those costly to read are only read when used.  Fields used
+// inside a with or range, whose dot isn't templateParams, count too.
+func templateFields(tmpl *template.Template) map[string]bool {
+	fields := make(map[string]bool)
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, c := range n.Nodes {
+					walk(c)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, cmd := range n.Cmds {
+					walk(cmd)
+				}
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.FieldNode:
+			fields[n.Ident[0]] = true
+		}
 	}
-	tmpl := template.New("cmdname")
-	tmpl, err := tmpl.Parse(nametmpl)
-	if err != nil {
-		return nil, fmt.Errorf("bad name template %q: %v", nametmpl, err)
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			walk(t.Tree.Root)
+		}
 	}
+	return fields
+}
 
-	return &matchNamer{matchers, templateNamer{tmpl}}, nil
+// getEnv parses an env selector, a map of variable names to regexes their
+// values must match, or to nothing if any value will do.
+func getEnv(yamlenv interface{}) (map[string]string, error) {
+	em, ok := yamlenv.(map[interface{}]interface{})
+	if !ok || len(em) == 0 {
+		return nil, fmt.Errorf("not a non-empty map")
+	}
+	env := make(map[string]string, len(em))
+	for k, v := range em {
+		name, ok := k.(string)
+		if !ok || name == "" || strings.Contains(name, "=") {
+			return nil, fmt.Errorf("bad variable name %v", k)
+		}
+		if v == nil {
+			env[name] = ""
+			continue
+		}
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("non-string value %v for variable %q", v, name)
+		}
+		env[name] = value
+	}
+	return env, nil
+}
+
+// mayName returns true if the name template of m may give name, which it
+// may if name is the template with something in place of each action.
+func (m *matchNamer) mayName(name string) bool {
+	var pattern strings.Builder
+	pattern.WriteString("^(?s)")
+	text := m.template.Root.String()
+	for {
+		start := strings.Index(text, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(text[start:], "}}")
+		if end < 0 {
+			break
+		}
+		pattern.WriteString(regexp.QuoteMeta(text[:start]))
+		pattern.WriteString(".*")
+		text = text[start+end+2:]
+	}
+	pattern.WriteString(regexp.QuoteMeta(text))
+	pattern.WriteString("$")
+	re, err := regexp.Compile(pattern.String())
+	return err != nil || re.MatchString(name)
+}
+
+// sameLabels returns true if a and b hold the same labels.
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
 }
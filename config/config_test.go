@@ -1,9 +1,16 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	// "github.com/kylelemons/godebug/pretty"
 	common "github.com/ncabatoff/process-exporter"
 	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -93,3 +100,1335 @@ process_names:
 	c.Check(found, Equals, true)
 	c.Check(name, Equals, now.String())
 }
+
+func (s MySuite) TestConfigExe(c *C) {
+	yml := `
+process_names:
+  - exe:
+    - /usr/sbin/nginx
+    - postgres
+    comm:
+    - nginx
+    - postgres
+    name: "{{.Comm}}"
+  - comm:
+    - nginx
+    name: spoofed
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	for _, tc := range []struct {
+		attrs common.ProcAttributes
+		name  string
+	}{
+		// The full path must be that of the executable, a basename only
+		// has to match its basename.
+		{common.ProcAttributes{Name: "nginx", Cmdline: []string{"nginx: master process"}, Exe: "/usr/sbin/nginx"}, "nginx"},
+		{common.ProcAttributes{Name: "postgres", Cmdline: []string{"postgres"}, Exe: "/usr/lib/postgresql/14/bin/postgres"}, "postgres"},
+		// A replaced executable still matches.
+		{common.ProcAttributes{Name: "nginx", Cmdline: []string{"nginx"}, Exe: "/usr/sbin/nginx (deleted)"}, "nginx"},
+		// Either the executable or argv[0] may match, whether or not the
+		// executable is known.
+		{common.ProcAttributes{Name: "nginx", Cmdline: []string{"/usr/sbin/nginx"}, Exe: "/opt/nginx/sbin/nginx"}, "nginx"},
+		{common.ProcAttributes{Name: "nginx", Cmdline: []string{"nginx"}, Exe: "/tmp/x/nginx"}, "spoofed"},
+		{common.ProcAttributes{Name: "nginx", Cmdline: []string{"/usr/sbin/nginx"}}, "nginx"},
+		{common.ProcAttributes{Name: "postgres", Cmdline: []string{"postgres"}, Exe: "/usr/lib/postgresql/14/bin/postgres-14"}, "postgres"},
+		{common.ProcAttributes{Name: "nginx", Cmdline: []string{"nginx"}}, "spoofed"},
+		// With both exe and comm, both must match.
+		{common.ProcAttributes{Name: "worker", Cmdline: []string{"postgres"}, Exe: "/usr/bin/postgres"}, ""},
+	} {
+		found, name := cfg.MatchNamers.MatchAndName(tc.attrs)
+		c.Check(found, Equals, tc.name != "", Commentf("%+v", tc.attrs))
+		c.Check(name, Equals, tc.name, Commentf("%+v", tc.attrs))
+	}
+}
+
+func (s MySuite) TestConfigUser(c *C) {
+	yml := `
+process_names:
+  - user:
+    - backup
+    - 1001
+    name: backup
+  - user:
+    - postgres
+    user_uid: real
+    comm:
+    - sudo
+    name: "sudo-as-{{.Username}}"
+  - comm:
+    - cron
+    name: "cron-{{.Username}}"
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	for _, tc := range []struct {
+		attrs common.ProcAttributes
+		name  string
+	}{
+		{common.ProcAttributes{Name: "tar", Username: "backup", EffectiveUID: 34}, "backup"},
+		// A uid the exporter has no name for matches by number.
+		{common.ProcAttributes{Name: "rsync", Username: "1001", EffectiveUID: 1001}, "backup"},
+		{common.ProcAttributes{Name: "rsync", Username: "app", EffectiveUID: 1001}, "backup"},
+		{common.ProcAttributes{Name: "sudo", Username: "root", RealUsername: "postgres", RealUID: 26},
+			"sudo-as-postgres"},
+		{common.ProcAttributes{Name: "sudo", Username: "postgres", RealUsername: "root"}, ""},
+		{common.ProcAttributes{Name: "cron", Username: "root"}, "cron-root"},
+		{common.ProcAttributes{Name: "cron", Username: "1002", EffectiveUID: 1002}, "cron-1002"},
+	} {
+		found, name := cfg.MatchNamers.MatchAndName(tc.attrs)
+		c.Check(found, Equals, tc.name != "", Commentf("%+v", tc.attrs))
+		c.Check(name, Equals, tc.name, Commentf("%+v", tc.attrs))
+	}
+
+	_, err = GetConfig(`
+process_names:
+  - user:
+    - backup
+    user_uid: saved
+`, false)
+	c.Check(err, NotNil)
+}
+
+func (s MySuite) TestConfigTrackChildren(c *C) {
+	yml := `
+process_names:
+  - comm:
+    - transcoder
+    track_children: true
+  - comm:
+    - bash
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "transcoder"})
+	c.Check(found, Equals, true)
+	c.Check(cfg.MatchNamers.TrackChildren(name), Equals, true)
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "bash"})
+	c.Check(found, Equals, true)
+	c.Check(cfg.MatchNamers.TrackChildren(name), Equals, false)
+
+	_, err = GetConfig("process_names:\n  - comm: [bash]\n    track_children: yes please\n", false)
+	c.Check(err, NotNil)
+}
+
+// TestConfigExclude checks that exclusion wins over inclusion: global
+// excludes keep procs out of every group, while a group's own excludes only
+// keep them out of it, so they may still match later entries.
+func (s MySuite) TestConfigExclude(c *C) {
+	yml := `
+exclude:
+  - comm:
+    - kworker/0:1
+  - cmdline:
+    - ^\[.*\]$
+process_names:
+  - name: postgres
+    comm:
+    - postgres
+    exclude:
+    - cmdline:
+      - autovacuum
+    - user:
+      - 0
+  - name: "other-{{.Comm}}"
+    cmdline:
+    - .+
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	for _, tc := range []struct {
+		nacl  common.ProcAttributes
+		found bool
+		name  string
+	}{
+		{common.ProcAttributes{Name: "postgres", Cmdline: []string{"postgres: checkpointer"}, EffectiveUID: 26},
+			true, "postgres"},
+		{common.ProcAttributes{Name: "postgres", Cmdline: []string{"postgres: autovacuum launcher"}, EffectiveUID: 26},
+			true, "other-postgres"},
+		{common.ProcAttributes{Name: "postgres", Cmdline: []string{"postgres"}, EffectiveUID: 0},
+			true, "other-postgres"},
+		{common.ProcAttributes{Name: "kworker/0:1", Cmdline: []string{"kworker"}}, false, ""},
+		{common.ProcAttributes{Name: "kthreadd", Cmdline: []string{"[kthreadd]"}}, false, ""},
+		{common.ProcAttributes{Name: "bash", Cmdline: []string{"bash"}}, true, "other-bash"},
+	} {
+		found, name := cfg.MatchNamers.MatchAndName(tc.nacl)
+		c.Check(found, Equals, tc.found, Commentf("%+v", tc.nacl))
+		c.Check(name, Equals, tc.name, Commentf("%+v", tc.nacl))
+		c.Check(cfg.MatchNamers.Excluded(tc.nacl), Equals, !tc.found, Commentf("%+v", tc.nacl))
+	}
+
+	for _, yml := range []string{
+		"exclude: [comm]\nprocess_names:\n  - comm: [bash]\n",
+		"exclude:\n  - runtime: [docker]\nprocess_names:\n  - comm: [bash]\n",
+		"exclude:\n  - {}\nprocess_names:\n  - comm: [bash]\n",
+		"process_names:\n  - comm: [bash]\n    exclude:\n      - cmdline: ['(']\n",
+		"process_names:\n  - comm: [bash]\n    exclude: []\n",
+	} {
+		_, err := GetConfig(yml, false)
+		c.Check(err, NotNil, Commentf(yml))
+	}
+}
+
+// TestConfigParent checks that parent_comm and parent_exe match procs by
+// the ancestors they're given, up to parent_depth.
+func (s MySuite) TestConfigParent(c *C) {
+	yml := `
+process_names:
+  - name: cron-jobs
+    comm:
+    - sh
+    parent_comm:
+    - cron
+  - name: deploys
+    parent_exe:
+    - /opt/agent/bin/agent
+    parent_depth: 3
+  - name: agent-children
+    parent_comm:
+    - agent
+    parent_exe:
+    - agent
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.ParentDepth(), Equals, 3)
+
+	cron := common.ParentAttributes{Name: "cron", Exe: "/usr/sbin/cron"}
+	agent := common.ParentAttributes{Name: "agent", Exe: "/opt/agent/bin/agent"}
+	bash := common.ParentAttributes{Name: "bash", Exe: "/bin/bash"}
+	for _, tc := range []struct {
+		name    string
+		parents []common.ParentAttributes
+		found   bool
+		want    string
+	}{
+		{"sh", []common.ParentAttributes{cron}, true, "cron-jobs"},
+		{"sh", []common.ParentAttributes{bash, cron}, false, ""},
+		{"sh", []common.ParentAttributes{bash, bash, agent}, true, "deploys"},
+		{"sh", []common.ParentAttributes{bash, bash, bash, agent}, false, ""},
+		{"sh", nil, false, ""},
+		{"sh", []common.ParentAttributes{{Name: "agent", Exe: "/usr/bin/agent"}}, true, "agent-children"},
+		{"sh", []common.ParentAttributes{{Name: "agent"}}, false, ""},
+	} {
+		found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: tc.name, Parents: tc.parents})
+		c.Check(found, Equals, tc.found, Commentf("%+v", tc.parents))
+		c.Check(name, Equals, tc.want, Commentf("%+v", tc.parents))
+	}
+
+	for _, yml := range []string{
+		"process_names:\n  - comm: [sh]\n    parent_depth: 2\n",
+		"process_names:\n  - parent_comm: [cron]\n    parent_depth: 0\n",
+		"process_names:\n  - parent_comm: [cron]\n    parent_depth: many\n",
+	} {
+		_, err := GetConfig(yml, false)
+		c.Check(err, NotNil, Commentf(yml))
+	}
+}
+
+// TestConfigGroupBySystemdUnit checks that group_by names procs after their
+// innermost unit matching units, that user units are prefixed by their
+// manager or dropped, and that unitless procs go to the fallback.
+func (s MySuite) TestConfigGroupBySystemdUnit(c *C) {
+	system := []string{"nginx.service", "system.slice"}
+	inScope := []string{"run-r1.scope", "cron.service", "system.slice"}
+	session := []string{"session-3.scope", "user-1000.slice", "user.slice"}
+	user := []string{"foo.service", "app.slice", "user@1000.service", "user-1000.slice", "user.slice"}
+	for _, tc := range []struct {
+		yml   string
+		units []string
+		found bool
+		want  string
+	}{
+		{"group_by: systemd_unit", system, true, "nginx.service"},
+		{"group_by: systemd_unit", inScope, true, "run-r1.scope"},
+		{"group_by: systemd_unit\nunits: ['*.service']", inScope, true, "cron.service"},
+		{"group_by: systemd_unit\nunits: ['*.service']", session, false, ""},
+		{"group_by: systemd_unit\nunits: ['*.service']\nfallback: unitless", session, true, "unitless"},
+		{"group_by: systemd_unit\nfallback: unitless", nil, true, "unitless"},
+		{"group_by: systemd_unit", nil, false, ""},
+		{"group_by: systemd_unit", user, true, "user@1000/foo.service"},
+		{"group_by: systemd_unit\nuser_units: false", user, false, ""},
+		{"group_by: systemd_unit\nexclude_units: ['session-*.scope']", session, false, ""},
+		{"group_by: systemd_unit\nexclude_units: ['session-*.scope']", system, true, "nginx.service"},
+		{"group_by: systemd_unit\nunits: ['*.service']\nexclude_units: ['session-*.scope']\nfallback: unitless",
+			session, false, ""},
+		{"group_by: systemd_unit\nexclude_units: [system.slice]", inScope, false, ""},
+		{"group_by: systemd_unit\ncomm: [nginx]", system, true, "nginx.service"},
+		{"group_by: systemd_unit\ncomm: [apache2]", system, false, ""},
+	} {
+		cfg, err := GetConfig("process_names:\n  - "+strings.Replace(tc.yml, "\n", "\n    ", -1)+"\n", false)
+		c.Assert(err, IsNil, Commentf(tc.yml))
+		c.Check(cfg.MatchNamers.NeedsCgroupPath(), Equals, true)
+		nacl := common.ProcAttributes{Name: "nginx", SystemdUnits: tc.units}
+		found, name := cfg.MatchNamers.MatchAndName(nacl)
+		c.Check(found, Equals, tc.found, Commentf(tc.yml))
+		c.Check(name, Equals, tc.want, Commentf(tc.yml))
+	}
+
+	for _, yml := range []string{
+		"group_by: comm",
+		"group_by: systemd_unit\nname: foo",
+		"group_by: systemd_unit\nunits: ['[']",
+		"group_by: systemd_unit\nuser_units: no thanks",
+		"comm: [nginx]\nfallback: unitless",
+	} {
+		_, err := GetConfig("process_names:\n  - "+strings.Replace(yml, "\n", "\n    ", -1)+"\n", false)
+		c.Check(err, NotNil, Commentf(yml))
+	}
+}
+
+// TestConfigExcludesAll checks which excludes are known to exclude every
+// proc their group matches, which is warned about.
+func (s MySuite) TestConfigExcludesAll(c *C) {
+	for _, tc := range []struct {
+		include, exclude string
+		want             bool
+	}{
+		{"comm: [postgres]", "cmdline: [autovacuum]", false},
+		{"comm: [postgres]", "comm: [postgres, bash]", true},
+		{"comm: [postgres, bash]", "comm: [postgres]", false},
+		{"comm: [postgres]\ncmdline: [autovacuum]", "cmdline: [autovacuum]", true},
+		{"comm: [postgres]", "cmdline: ['.*']", true},
+		{"comm: [postgres]", "cmdline: ['^.*$']", false},
+		{"exe: [/usr/bin/postgres]", "exe: [postgres]", true},
+		{"exe: [postgres]", "exe: [/usr/bin/postgres]", false},
+		{"user: [postgres, 26]", "user: [26, postgres, root]", true},
+		{"user: [postgres]\nuser_uid: real", "user: [postgres]", false},
+		{"comm: [postgres]", "comm: [postgres]\nuser: [root]", false},
+	} {
+		include, err := getMatchNamer(mustYAML(c, tc.include), nameOptions{})
+		c.Assert(err, IsNil)
+		excludes, err := getExcludes([]interface{}{mustYAML(c, tc.exclude)}, nameOptions{})
+		c.Assert(err, IsNil)
+		c.Check(excludesAll(include.(*matchNamer).andMatcher, excludes[0]), Equals, tc.want,
+			Commentf(tc.include+" excluding "+tc.exclude))
+	}
+}
+
+// mustYAML parses a selector map.
+func mustYAML(c *C, s string) interface{} {
+	var v map[interface{}]interface{}
+	c.Assert(yaml.Unmarshal([]byte(s), &v), IsNil)
+	return v
+}
+
+func (s MySuite) TestConfigSMaps(c *C) {
+	yml := `
+process_names:
+  - exe:
+    - httpd
+    smaps: true
+  - exe:
+    - bash
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	httpd := common.ProcAttributes{Name: "httpd", Cmdline: []string{"/usr/sbin/httpd"}}
+	bash := common.ProcAttributes{Name: "bash", Cmdline: []string{"/bin/bash"}}
+	found, name := cfg.MatchNamers.MatchAndName(httpd)
+	c.Check(found, Equals, true)
+	c.Check(cfg.MatchNamers.GatherSMaps(name), Equals, true)
+	found, name = cfg.MatchNamers.MatchAndName(bash)
+	c.Check(found, Equals, true)
+	c.Check(cfg.MatchNamers.GatherSMaps(name), Equals, false)
+
+	_, err = GetConfig(`
+process_names:
+  - exe:
+    - httpd
+    smaps: "yes"
+`, false)
+	c.Check(err, NotNil)
+}
+
+func (s MySuite) TestConfigOtherGroup(c *C) {
+	procNames := `
+process_names:
+  - exe:
+    - bash
+`
+	cfg, err := GetConfig(procNames, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.OtherGroup, IsNil)
+
+	cfg, err = GetConfig(procNames+"other_group:\n", false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.OtherGroup, DeepEquals, &OtherGroup{Name: "other", KernelThreads: true})
+
+	cfg, err = GetConfig(procNames+`
+other_group:
+  name: unmatched
+  kernel_threads: false
+`, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.OtherGroup, DeepEquals, &OtherGroup{Name: "unmatched", KernelThreads: false})
+
+	_, err = GetConfig(procNames+`
+other_group:
+  kernel_threads: "no"
+`, false)
+	c.Check(err, NotNil)
+}
+
+func (s MySuite) TestConfigStaleGroupTTL(c *C) {
+	procNames := `
+process_names:
+  - exe:
+    - bash
+`
+	cfg, err := GetConfig(procNames, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.StaleGroupTTL, Equals, time.Duration(0))
+
+	cfg, err = GetConfig(procNames+"stale_group_ttl: 10m\n", false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.StaleGroupTTL, Equals, 10*time.Minute)
+
+	for _, bad := range []string{"10", "-1m", "0s", "soon"} {
+		_, err = GetConfig(procNames+"stale_group_ttl: "+bad+"\n", false)
+		c.Check(err, NotNil, Commentf("stale_group_ttl: %s", bad))
+	}
+}
+
+func (s MySuite) TestConfigCmdline(c *C) {
+	yml := `
+process_names:
+  - comm:
+    - python
+    cmdline:
+    - /opt/(?P<App>[^/]+)/main\.py
+    name: "py:{{.Matches.App}}"
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	mn := cfg.MatchNamers.matchers[0]
+
+	for _, tc := range []struct {
+		attrs common.ProcAttributes
+		found bool
+		name  string
+	}{
+		{common.ProcAttributes{Name: "python", Cmdline: []string{"python", "/opt/app1/main.py"}}, true, "py:app1"},
+		{common.ProcAttributes{Name: "python", Cmdline: []string{"python", "/opt/app2/main.py", "-v"}}, true, "py:app2"},
+		// Both the comm and the cmdline must match.
+		{common.ProcAttributes{Name: "python3", Cmdline: []string{"python", "/opt/app1/main.py"}}, false, ""},
+		{common.ProcAttributes{Name: "python", Cmdline: []string{"python", "/srv/app1/main.py"}}, false, ""},
+		// Invalid UTF-8 doesn't make it into the name.
+		{common.ProcAttributes{Name: "python", Cmdline: []string{"python", "/opt/app\xff/main.py"}}, true, "py:app\uFFFD"},
+	} {
+		found, name := mn.MatchAndName(tc.attrs)
+		c.Check(found, Equals, tc.found, Commentf("%v", tc.attrs.Cmdline))
+		c.Check(name, Equals, tc.name, Commentf("%v", tc.attrs.Cmdline))
+	}
+
+	_, err = GetConfig(`
+process_names:
+  - cmdline:
+    - "main(.py"
+    name: app
+`, false)
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, `.*"main\(\.py".*"app".*`)
+}
+
+func (s MySuite) TestConfigRuntime(c *C) {
+	yml := `
+process_names:
+  - comm:
+    - nginx
+    runtime:
+    - docker
+    - crio
+    name: "nginx-{{.Runtime}}"
+  - comm:
+    - bash
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.NeedsRuntime(), Equals, true)
+
+	for _, tc := range []struct {
+		runtime string
+		found   bool
+		name    string
+	}{
+		{"docker", true, "nginx-docker"},
+		{"crio", true, "nginx-crio"},
+		{"systemd", false, ""},
+	} {
+		found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "nginx", Runtime: tc.runtime})
+		c.Check(found, Equals, tc.found, Commentf("%s", tc.runtime))
+		c.Check(name, Equals, tc.name, Commentf("%s", tc.runtime))
+	}
+
+	cfg, err = GetConfig("process_names:\n  - comm: [bash]\n", false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.NeedsRuntime(), Equals, false)
+	cfg, err = GetConfig("process_names:\n  - comm: [bash]\n    name: \"{{.Comm}}@{{.Runtime}}\"\n", false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.NeedsRuntime(), Equals, true)
+
+	_, err = GetConfig("process_names:\n  - runtime: [lxc]\n", false)
+	c.Check(err, ErrorMatches, `.*unknown runtime "lxc".*`)
+}
+
+func (s MySuite) TestConfigCgroup(c *C) {
+	yml := `
+process_names:
+  - cgroup_prefix:
+    - /system.slice/foo.service/
+    name: foo
+  - cgroup:
+    - ^/kubepods\.slice/kubepods-burstable\.slice/kubepods-burstable-pod(?P<pod>[^.]+)\.slice/
+    name: "burstable-{{.Matches.pod}}"
+  - comm:
+    - bash
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.NeedsCgroupPath(), Equals, true)
+
+	for _, tc := range []struct {
+		path string
+		name string
+	}{
+		{"/system.slice/foo.service", "foo"},
+		{"/system.slice/foo.service/worker", "foo"},
+		{"/system.slice/foo.service2", ""},
+		{"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1234.slice/cri-containerd-ab.scope",
+			"burstable-1234"},
+		{"/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1234.slice/cri-containerd-ab.scope", ""},
+		{"", ""},
+	} {
+		found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "sleep", CgroupPath: tc.path})
+		c.Check(found, Equals, tc.name != "", Commentf("%s", tc.path))
+		c.Check(name, Equals, tc.name, Commentf("%s", tc.path))
+	}
+
+	cfg, err = GetConfig("process_names:\n  - comm: [bash]\n", false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.NeedsCgroupPath(), Equals, false)
+
+	_, err = GetConfig("process_names:\n  - cgroup_prefix: [system.slice]\n", false)
+	c.Check(err, ErrorMatches, `.*bad cgroup prefix.*`)
+	_, err = GetConfig("process_names:\n  - cgroup: [\"(\"]\n", false)
+	c.Check(err, ErrorMatches, `.*bad cgroup regex.*`)
+}
+
+func (s MySuite) TestConfigEnv(c *C) {
+	yml := `
+process_names:
+  - env:
+      TASK_FAMILY: "^(?P<family>[a-z]+)$"
+    name: "task-{{.Matches.family}}"
+  - env:
+      DEBUG:
+      APP_ROLE: worker
+    comm:
+    - python
+    name: debug-worker
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.EnvVars(), DeepEquals, []string{"APP_ROLE", "DEBUG", "TASK_FAMILY"})
+
+	for _, tc := range []struct {
+		env  map[string]string
+		name string
+	}{
+		{map[string]string{"TASK_FAMILY": "web"}, "task-web"},
+		{map[string]string{"TASK_FAMILY": "Web"}, ""},
+		{map[string]string{"DEBUG": "", "APP_ROLE": "queue-worker"}, "debug-worker"},
+		{map[string]string{"APP_ROLE": "worker"}, ""},
+		// The environment couldn't be read.
+		{nil, ""},
+	} {
+		found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "python", Env: tc.env})
+		c.Check(found, Equals, tc.name != "", Commentf("%v", tc.env))
+		c.Check(name, Equals, tc.name, Commentf("%v", tc.env))
+	}
+
+	cfg, err = GetConfig("process_names:\n  - comm: [bash]\n", false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.EnvVars(), IsNil)
+
+	_, err = GetConfig("process_names:\n  - env: [TASK_FAMILY]\n", false)
+	c.Check(err, ErrorMatches, `.*bad env.*`)
+	_, err = GetConfig("process_names:\n  - env: {TASK_FAMILY: \"(\"}\n", false)
+	c.Check(err, ErrorMatches, `.*bad env regex.*`)
+}
+
+func (s MySuite) TestConfigTemplateCgroupVars(c *C) {
+	yml := `
+process_names:
+  - comm:
+    - nginx
+    name: "{{.SystemdUnit}}/{{.ExeBase}}"
+  - comm:
+    - sleep
+    name: "{{.ContainerID}}"
+  - comm:
+    - sleep
+    name: "{{.Matches.missing}}nocontainer"
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.NeedsCgroupPath(), Equals, true)
+
+	for _, tc := range []struct {
+		attrs common.ProcAttributes
+		name  string
+	}{
+		{common.ProcAttributes{Name: "nginx", Cmdline: []string{"/usr/sbin/nginx"},
+			CgroupPath: "/system.slice/nginx.service", SystemdUnit: "nginx.service"}, "nginx.service/nginx"},
+		// Missing values render empty.
+		{common.ProcAttributes{Name: "nginx", Cmdline: []string{"/usr/sbin/nginx"}}, "/nginx"},
+		{common.ProcAttributes{Name: "sleep", ContainerID: "4f1b2c3d4e5f"}, "4f1b2c3d4e5f"},
+		// An empty name doesn't match, leaving the proc to later entries.
+		{common.ProcAttributes{Name: "sleep"}, "nocontainer"},
+		// Names are made valid label values.
+		{common.ProcAttributes{Name: "nginx", Cmdline: []string{"/usr/sbin/ngin\xffx"}}, "/ngin\uFFFDx"},
+	} {
+		found, name := cfg.MatchNamers.MatchAndName(tc.attrs)
+		c.Check(found, Equals, true, Commentf("%+v", tc.attrs))
+		c.Check(name, Equals, tc.name, Commentf("%+v", tc.attrs))
+	}
+
+	for _, tc := range []struct {
+		tmpl string
+		want bool
+	}{
+		{"{{.ExeBase}}", false},
+		{"{{.CgroupPath}}", true},
+		{"{{if .SystemdUnit}}{{.SystemdUnit}}{{else}}{{.Comm}}{{end}}", true},
+		{"{{with .ContainerID}}{{.}}{{end}}", true},
+		{"{{printf \"%.12s\" .ContainerID}}", true},
+		{"x.ContainerID", false},
+	} {
+		cfg, err := GetConfig("process_names:\n  - comm: [bash]\n    name: '"+tc.tmpl+"'\n", false)
+		c.Assert(err, IsNil, Commentf("%s", tc.tmpl))
+		c.Check(cfg.MatchNamers.NeedsCgroupPath(), Equals, tc.want, Commentf("%s", tc.tmpl))
+	}
+}
+
+func (s MySuite) TestConfigRecheck(c *C) {
+	procNames := `
+process_names:
+  - exe:
+    - bash
+`
+	cfg, err := GetConfig(procNames, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.RecheckInterval, Equals, time.Duration(0))
+	c.Check(cfg.RecheckOnScrape, Equals, false)
+
+	cfg, err = GetConfig(procNames+"recheck_interval: 5m\nrecheck_on_scrape: true\n", false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.RecheckInterval, Equals, 5*time.Minute)
+	c.Check(cfg.RecheckOnScrape, Equals, true)
+
+	for _, bad := range []string{"recheck_interval: 10", "recheck_interval: 0s",
+		"recheck_interval: often", "recheck_on_scrape: 1", "recheck_on_scrape: sure"} {
+		_, err = GetConfig(procNames+bad+"\n", false)
+		c.Check(err, NotNil, Commentf("%s", bad))
+	}
+}
+
+func (s MySuite) TestConfigLabels(c *C) {
+	procNames := `
+process_names:
+  - exe:
+    - bash
+`
+	cfg, err := GetConfig(procNames, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.Labels, IsNil)
+
+	cfg, err = GetConfig(procNames+"labels: {team: payments, env: prod}\n", false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.Labels, DeepEquals, map[string]string{"team": "payments", "env": "prod"})
+
+	for _, bad := range []string{"[team]", "{team: [a]}", "{1team: a}", "{__name__: a}", "{te-am: a}",
+		"{groupname: a}", "{mode: a}", "{memtype: a}", "{pid: a}", "{wchan: a}"} {
+		_, err = GetConfig(procNames+"labels: "+bad+"\n", false)
+		c.Check(err, NotNil, Commentf("labels: %s", bad))
+	}
+}
+
+func (s MySuite) TestConfigCgroupFilter(c *C) {
+	procNames := `
+process_names:
+  - exe:
+    - bash
+`
+	cfg, err := GetConfig(procNames, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.CgroupFilter, IsNil)
+
+	cfg, err = GetConfig(procNames+`
+cgroup_filter:
+  prefixes: [/kubepods.slice, /system.slice/docker.service]
+  regex: '^/kubepods/'
+`, false)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.CgroupFilter, NotNil)
+	c.Check(cfg.CgroupFilter.Prefixes, DeepEquals, []string{"/kubepods.slice", "/system.slice/docker.service"})
+	c.Check(cfg.CgroupFilter.Regex.String(), Equals, "^/kubepods/")
+
+	for _, bad := range []string{"{}", "[/kubepods]", "{prefixes: /kubepods}", "{prefixes: [kubepods]}",
+		"{regex: '('}", "{regex: [a]}", "{prefix: [/kubepods]}"} {
+		_, err = GetConfig(procNames+"cgroup_filter: "+bad+"\n", false)
+		c.Check(err, NotNil, Commentf("cgroup_filter: %s", bad))
+	}
+}
+
+func (s MySuite) TestConfigGroupLabels(c *C) {
+	cfg, err := GetConfig(`
+process_names:
+  - comm:
+    - bash
+    labels: {tier: critical}
+  - name: "{{.Comm}}"
+    exe:
+    - sshd
+    labels: {owner: search}
+  - comm:
+    - cat
+`, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.GroupLabelNames(), DeepEquals, []string{"owner", "tier"})
+
+	for _, name := range []string{"bash", "sshd", "cat"} {
+		found, _ := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: name, Cmdline: []string{name}})
+		c.Check(found, Equals, true, Commentf("%s", name))
+	}
+	c.Check(cfg.MatchNamers.GroupLabels("bash"), DeepEquals, map[string]string{"tier": "critical"})
+	c.Check(cfg.MatchNamers.GroupLabels("sshd"), DeepEquals, map[string]string{"owner": "search"})
+	c.Check(cfg.MatchNamers.GroupLabels("cat"), IsNil)
+
+	for _, bad := range []string{
+		// Reserved and invalid names.
+		"  - comm: [bash]\n    labels: {groupname: x}\n",
+		"  - comm: [bash]\n    labels: {__tier: x}\n",
+		"  - comm: [bash]\n    labels: [tier]\n",
+		// The same group with conflicting labels.
+		"  - comm: [bash]\n    name: shells\n    labels: {tier: critical}\n" +
+			"  - comm: [zsh]\n    name: shells\n    labels: {tier: batch}\n",
+		"  - comm: [bash]\n    name: shells\n    labels: {tier: critical}\n" +
+			"  - comm: [zsh]\n    name: shells\n",
+		// A template that may give the fixed name of another entry,
+		// with different labels.
+		"  - comm: [bash]\n    name: shells\n    labels: {tier: critical}\n" +
+			"  - comm: [zsh]\n    name: \"{{.Comm}}\"\n    labels: {tier: batch}\n",
+		"  - comm: [zsh]\n    name: \"she{{.Comm}}s\"\n    labels: {tier: batch}\n" +
+			"  - comm: [bash]\n    name: shells\n    labels: {tier: critical}\n",
+		// A group label that is also a constant label.
+		"  - comm: [bash]\n    labels: {tier: critical}\nlabels: {tier: all}\n",
+	} {
+		_, err = GetConfig("process_names:\n"+bad, false)
+		c.Check(err, NotNil, Commentf("%s", bad))
+	}
+
+	_, err = GetConfig(`
+process_names:
+  - comm: [bash]
+    name: shells
+    labels: {tier: critical}
+  - comm: [zsh]
+    name: shells
+    labels: {tier: critical}
+`, false)
+	c.Check(err, IsNil)
+
+	// Templates that can't give the fixed name, or give it no labels, are
+	// fine.  A name given by two templates has the labels of the first.
+	cfg, err = GetConfig(`
+process_names:
+  - comm: [bash]
+    name: shells
+    labels: {tier: critical}
+  - comm: [zsh]
+    name: "z-{{.Comm}}"
+    labels: {tier: batch}
+  - comm: [ksh]
+    name: "{{.Comm}}"
+  - comm: [sh]
+    cmdline: [login]
+    name: "sh-{{.Comm}}"
+    labels: {tier: login}
+  - comm: [sh]
+    name: "sh-{{.Comm}}"
+    labels: {tier: batch}
+`, false)
+	c.Assert(err, IsNil)
+	for _, cmdline := range []string{"sh", "login"} {
+		found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "sh", Cmdline: []string{cmdline}})
+		c.Check(found, Equals, true)
+		c.Check(name, Equals, "sh-sh")
+	}
+	c.Check(cfg.MatchNamers.GroupLabels("sh-sh"), DeepEquals, map[string]string{"tier": "batch"})
+	c.Check(cfg.MatchNamers.GroupLabels("shells"), DeepEquals, map[string]string{"tier": "critical"})
+}
+
+// TestGroupLabelsBounded verifies that the labels of names given by templates
+// are kept for a bounded number of names, past which those of fixed names are
+// still known.
+func (s MySuite) TestGroupLabelsBounded(c *C) {
+	cfg, err := GetConfig(`
+process_names:
+  - comm: [bash]
+    name: shells
+    labels: {tier: critical}
+  - name: "n{{.Matches.n}}"
+    cmdline: ['n(?P<n>\d+)']
+    labels: {tier: batch}
+`, false)
+	c.Assert(err, IsNil)
+	for i := 0; i <= maxGroupLabelNames; i++ {
+		cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "x", Cmdline: []string{fmt.Sprintf("n%d", i)}})
+	}
+	c.Check(cfg.MatchNamers.GroupLabels("n0"), DeepEquals, map[string]string{"tier": "batch"})
+	c.Check(cfg.MatchNamers.GroupLabels(fmt.Sprintf("n%d", maxGroupLabelNames)), IsNil)
+	c.Check(cfg.MatchNamers.GroupLabels("shells"), DeepEquals, map[string]string{"tier": "critical"})
+}
+
+// TestConfigCheck verifies that Check reports every error rather than the
+// first, including those GetConfig lets by.
+func (s MySuite) TestConfigCheck(c *C) {
+	yml := `
+process_names:
+  - name: "{{.Matches.svc}}"
+    cmdline: ['(?P<name>foo']
+  - name: "{{.Matches.svcc}}"
+    cmdline: ['(?P<svc>\S+)']
+  - name: "{{.Exe}}"
+    comm: [bash]
+  - name: pe
+    comm: [process-exporte]
+    cmdlin: [x]
+  - name: pe
+    comm: [process-exporte]
+    cmdlin: [x]
+other_group:
+  name: pe
+stale_group_ttl: never
+colour: blue
+`
+	_, err := GetConfig(yml, false)
+	c.Check(err, ErrorMatches, "unable to parse process_name entry 0: bad cmdline regex.*")
+
+	var got []string
+	for _, err := range Check(yml) {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		`unknown top-level key "colour"`,
+		`unable to parse process_name entry 0: bad cmdline regex .*`,
+		`process_name entry 1: bad name template: .*map has no entry for key "svcc"`,
+		`process_name entry 2: bad name template: .*can't evaluate field Exe.*`,
+		`process_name entry 3: unknown key "cmdlin"`,
+		`process_name entry 4: unknown key "cmdlin"`,
+		`process_name entry 4 repeats entry 3`,
+		`other_group name "pe" is also the name of a process_name group`,
+		`bad duration "never" for stale_group_ttl`,
+	}
+	c.Assert(got, HasLen, len(want), Commentf("%q", got))
+	for i := range want {
+		c.Check(got[i], Matches, want[i])
+	}
+
+	// Repeated keys are an error only when checking.
+	yml = "process_names:\n  - comm: [bash]\n    comm: [sh]\n"
+	_, err = GetConfig(yml, false)
+	c.Check(err, IsNil)
+	errs := Check(yml)
+	c.Assert(errs, HasLen, 1)
+	c.Check(errs[0], ErrorMatches, `(?s).*already (defined|set).*`)
+
+	c.Check(Check("process_names:\n  - name: \"{{.Matches.svc}}\"\n    cmdline: ['(?P<svc>\\S+)']\n"), HasLen, 0)
+}
+
+// TestConfigExplain verifies that every selector is evaluated, that
+// excludes are told apart, and that the verdict is MatchAndName's.
+func (s MySuite) TestConfigExplain(c *C) {
+	yml := `
+exclude:
+  - user: [root]
+process_names:
+  - name: "{{.ContainerID}}"
+    comm: [bash]
+  - name: "{{.Matches.svc}}"
+    comm: [postgres]
+    cmdline: ['^(?P<svc>\S+):']
+    exclude:
+      - cmdline: [autovacuum]
+  - name: other
+    cmdline: [.]
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	nacl := common.ProcAttributes{Name: "bash", Cmdline: []string{"bash"}, Username: "alice"}
+	ex := cfg.MatchNamers.Explain(nacl)
+	c.Check(ex.Excludes, DeepEquals, []common.MatcherResult{{Matcher: "[users: [root]]"}})
+	c.Assert(ex.Entries, HasLen, 3)
+	// The template gives an empty name outside containers.
+	c.Check(ex.Entries[0].Matched, Equals, false)
+	c.Check(ex.Entries[0].Matchers, DeepEquals, []common.MatcherResult{
+		{Matcher: "comms: [bash]", Passed: true}, {Matcher: "name"}})
+	c.Check(ex.Entries[1].Matchers, DeepEquals, []common.MatcherResult{
+		{Matcher: "comms: [postgres]"}, {Matcher: "cmdlines: [^(?P<svc>\\S+):]"}})
+	c.Check(ex.Entries[2].Matched, Equals, true)
+	c.Check(ex.Matched, Equals, true)
+	c.Check(ex.GroupName, Equals, "other")
+
+	nacl = common.ProcAttributes{Name: "postgres", Cmdline: []string{"postgres: autovacuum launcher"}, Username: "postgres"}
+	ex = cfg.MatchNamers.Explain(nacl)
+	c.Check(ex.Entries[1].Matchers[1].Captures, DeepEquals, map[string]string{"svc": "postgres"})
+	c.Check(ex.Entries[1].Excludes, DeepEquals, []common.MatcherResult{{Matcher: "[cmdlines: [autovacuum]]", Passed: true}})
+	c.Check(ex.Entries[1].Matched, Equals, false)
+	c.Check(ex.GroupName, Equals, "other")
+
+	// Excluded procs are matched by no entry, whatever their entries say.
+	nacl.Username = "root"
+	ex = cfg.MatchNamers.Explain(nacl)
+	c.Check(ex.Excludes[0].Passed, Equals, true)
+	c.Check(ex.Entries[2].Matched, Equals, true)
+	c.Check(ex.Matched, Equals, false)
+	found, _ := cfg.MatchNamers.MatchAndName(nacl)
+	c.Check(found, Equals, false)
+}
+
+// TestConfigJSON verifies that the config is given as parsed.
+func (s MySuite) TestConfigJSON(c *C) {
+	yml := `
+process_names:
+  - name: "{{.Comm}}"
+    exe: [/usr/bin/bash]
+    labels: {team: infra}
+  - group_by: systemd_unit
+    units: ['*.service']
+other_group: {}
+stale_group_ttl: 1h
+cgroup_filter:
+  regex: ^/system\.slice/
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	data, err := json.Marshal(cfg)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{"process_names":[`+
+		`{"name":"{{.Comm}}","selectors":["exes: map[bash:/usr/bin/bash]"],"labels":{"team":"infra"},"smaps":false,"track_children":false,"real_uid":false},`+
+		`{"name":"{{.SystemdUnit}}","group_by":{"units":["*.service"],"user_units":true},"smaps":false,"track_children":false,"real_uid":false}],`+
+		`"other_group":{"name":"other","kernel_threads":true},"stale_group_ttl":"1h0m0s","recheck_on_scrape":false,`+
+		`"cgroup_filter":{"regex":"^/system\\.slice/"}}`)
+}
+
+// writeFiles writes each of files, a map from name to content, to dir.
+func writeFiles(c *C, dir string, files map[string]string) {
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s MySuite) TestConfigFiles(c *C) {
+	dir := c.MkDir()
+	writeFiles(c, dir, map[string]string{
+		"20-web.yml": `
+process_names:
+  - name: nginx
+    comm: [nginx]
+  - name: nginx
+    comm: [nginx-worker]
+`,
+		"10-db.yaml": `
+process_names:
+  - name: postgres
+    comm: [postgres]
+`,
+		"00-globals.yml": `
+other_group:
+  name: other
+stale_group_ttl: 1h
+`,
+		"README": "not a config file",
+	})
+	extra := filepath.Join(c.MkDir(), "extra.yml")
+	writeFiles(c, filepath.Dir(extra), map[string]string{
+		"extra.yml": "process_names:\n  - name: \"{{.Comm}}\"\n    comm: [bash]\n",
+	})
+
+	files, err := Files([]string{dir, extra})
+	c.Assert(err, IsNil)
+	c.Check(files, DeepEquals, []string{
+		filepath.Join(dir, "00-globals.yml"), filepath.Join(dir, "10-db.yaml"),
+		filepath.Join(dir, "20-web.yml"), extra})
+
+	cfg, err := ReadFiles([]string{dir, extra}, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.OtherGroup.Name, Equals, "other")
+	c.Check(cfg.StaleGroupTTL, Equals, time.Hour)
+	var names []string
+	for _, comm := range []string{"postgres", "nginx", "nginx-worker", "bash"} {
+		_, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: comm})
+		names = append(names, name)
+	}
+	c.Check(names, DeepEquals, []string{"postgres", "nginx", "nginx", "bash"})
+	c.Check(CheckFiles([]string{dir, extra}), HasLen, 0)
+
+	_, err = ReadFiles([]string{c.MkDir()}, false)
+	c.Check(err, ErrorMatches, "no \\*.yml files in config directory .*")
+
+	// Conflicting files: a group given by two of them, a global setting set
+	// twice, and an invalid file, all of which CheckFiles reports.
+	bad := c.MkDir()
+	writeFiles(c, bad, map[string]string{
+		"a.yml": "process_names:\n  - name: pe\n    comm: [process-exporte]\nother_group:\n  name: other\n",
+		"b.yml": "process_names:\n  - name: pe\n    comm: [pe]\nother_group:\n  name: rest\n",
+		"c.yml": "process_names:\n  - name: x\n    cmdline: ['(']\n",
+	})
+	_, err = ReadFiles([]string{bad}, false)
+	c.Check(err, ErrorMatches, ".*c.yml: unable to parse process_name entry 0: bad cmdline regex.*")
+
+	var got []string
+	for _, err := range CheckFiles([]string{bad}) {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		`.*c.yml: unable to parse process_name entry 0: bad cmdline regex.*`,
+		`.*b.yml: other_group is already set by .*a.yml, global settings may only be set by one file`,
+		`.*b.yml: group "pe" is already given by .*a.yml`,
+	}
+	c.Assert(got, HasLen, len(want), Commentf("%q", got))
+	for i := range want {
+		c.Check(got[i], Matches, want[i])
+	}
+
+	writeFiles(c, bad, map[string]string{
+		"c.yml": "process_names:\n  - name: x\n    comm: [x]\n",
+	})
+	_, err = ReadFiles([]string{bad}, false)
+	c.Check(err, ErrorMatches, ".*b.yml: other_group is already set by .*a.yml.*")
+}
+
+func (s MySuite) TestConfigCollectors(c *C) {
+	yml := `
+process_names:
+  - name: jvm
+    comm: [java]
+    threads: true
+    io: false
+  - name: jvm
+    comm: [javac]
+  - name: db
+    comm: [postgres]
+    smaps: true
+  - comm: [bash]
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(Check(yml), HasLen, 0)
+	for _, comm := range []string{"javac", "java", "postgres", "bash"} {
+		cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: comm})
+	}
+	c.Check(cfg.MatchNamers.GroupCollectors("jvm"), DeepEquals, map[string]bool{"threads": true, "io": false})
+	c.Check(cfg.MatchNamers.GroupCollectors("db"), DeepEquals, map[string]bool{"smaps": true})
+	c.Check(cfg.MatchNamers.GroupCollectors("bash"), IsNil)
+	c.Check(cfg.MatchNamers.GatherSMaps("db"), Equals, true)
+
+	out, err := json.Marshal(cfg)
+	c.Assert(err, IsNil)
+	c.Check(string(out), Matches, `.*"name":"jvm","selectors":\["comms: \[java\]"\],"smaps":false,"collectors":\{"io":false,"threads":true\},.*`)
+
+	// With the global settings known, every entry gives those in effect.
+	cfg.Collectors = func(overrides map[string]bool) map[string]bool {
+		on := map[string]bool{"smaps": false, "threads": false, "io": true}
+		for k, v := range overrides {
+			on[k] = v
+		}
+		return on
+	}
+	out, err = json.Marshal(cfg)
+	c.Assert(err, IsNil)
+	c.Check(string(out), Matches, `.*"name":"\{\{\.ExeBase\}\}",[^}]*"collectors":\{"io":true,"smaps":false,"threads":false\}.*`)
+
+	_, err = GetConfig("process_names:\n  - comm: [java]\n    threads: yes please\n", false)
+	c.Check(err, ErrorMatches, `.*non-bool value yes please for key "threads"`)
+}
+
+// TestConfigMinAge verifies that a proc's min age is that of the first entry
+// matching it if it has one, even zero, else the global one, including for
+// procs excluded from every group.
+func (s MySuite) TestConfigMinAge(c *C) {
+	yml := `
+min_age: 2s
+exclude:
+  - cmdline: [--batch]
+process_names:
+  - comm: [cc1]
+    min_age: 1m
+  - comm: [sshd]
+    min_age: 0s
+  - comm: [cc1, bash]
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(Check(yml), HasLen, 0)
+	for _, tc := range []struct {
+		comm, cmdline string
+		want          time.Duration
+	}{
+		{"cc1", "cc1", time.Minute},
+		{"sshd", "sshd", 0},
+		{"bash", "bash", 2 * time.Second},
+		{"make", "make", 2 * time.Second},
+		{"cc1", "--batch", 2 * time.Second},
+	} {
+		_, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: tc.comm, Cmdline: []string{tc.cmdline}})
+		c.Check(cfg.MatchNamers.MinAge(name), Equals, tc.want, Commentf("%s %s", tc.comm, tc.cmdline))
+	}
+
+	out, err := json.Marshal(cfg)
+	c.Assert(err, IsNil)
+	c.Check(string(out), Matches, `.*"selectors":\["comms: \[cc1\]"\],.*"min_age":"1m0s".*"min_age":"2s".*`)
+
+	cfg, err = GetConfig("process_names:\n  - comm: [bash]\n", false)
+	c.Assert(err, IsNil)
+	_, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "bash"})
+	c.Check(cfg.MatchNamers.MinAge(name), Equals, time.Duration(0))
+
+	_, err = GetConfig("process_names:\n  - comm: [bash]\n    min_age: -1s\n", false)
+	c.Check(err, ErrorMatches, `.*bad value -1s for key "min_age", want a duration`)
+	_, err = GetConfig("min_age: 0s\nprocess_names:\n  - comm: [bash]\n", false)
+	c.Check(err, ErrorMatches, `bad duration "0s" for min_age`)
+}
+
+// TestConfigPidfile verifies that procs are matched by the pid files they
+// wrote, unless the file predates them or their comm fails pidfile_comm, and
+// that missing files match nothing.
+func (s MySuite) TestConfigPidfile(c *C) {
+	dir := c.MkDir()
+	written := time.Now().Add(-time.Hour)
+	for name, content := range map[string]string{"a.pid": "1234\n", "b.pid": " 5678 \nextra\n", "bad.pid": "none\n"} {
+		path := filepath.Join(dir, name)
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+		c.Assert(os.Chtimes(path, written, written), IsNil)
+	}
+	yml := `
+process_names:
+  - name: legacy
+    pidfile: [` + filepath.Join(dir, "*.pid") + `]
+    pidfile_comm: ^legacyd$
+  - name: missing
+    pidfile: [` + filepath.Join(dir, "missing.pid") + `]
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(Check(yml), HasLen, 0)
+	for i, tc := range []struct {
+		pid   int
+		comm  string
+		start time.Time
+		want  string
+	}{
+		{1234, "legacyd", written.Add(-time.Minute), "legacy"},
+		{5678, "legacyd", written, "legacy"},
+		{1234, "bash", written.Add(-time.Minute), ""},
+		{1234, "legacyd", written.Add(time.Minute), ""},
+		{4321, "legacyd", written.Add(-time.Minute), ""},
+	} {
+		_, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{PID: tc.pid, Name: tc.comm, StartTime: tc.start})
+		c.Check(name, Equals, tc.want, Commentf("%d", i))
+	}
+
+	_, err = GetConfig("process_names:\n  - comm: [bash]\n    pidfile_comm: bash\n", false)
+	c.Check(err, ErrorMatches, `.*pidfile_comm without pidfile`)
+	_, err = GetConfig("process_names:\n  - pidfile: ['[']\n", false)
+	c.Check(err, ErrorMatches, `.*bad pidfile glob "\[".*`)
+}
+
+func (s MySuite) TestConfigListeningPort(c *C) {
+	yml := `
+process_names:
+  - name: postgres
+    listening_port: [5432]
+  - name: dns
+    listening_port: [udp/53]
+  - name: other
+    comm: [nginx]
+    listening_port: ["tcp/80", "tcp/443"]
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(Check(yml), HasLen, 0)
+	c.Check(cfg.MatchNamers.NeedsListeningPorts(), Equals, true)
+	for i, tc := range []struct {
+		comm  string
+		ports []string
+		want  string
+	}{
+		{"postgres", []string{"tcp/5432"}, "postgres"},
+		{"postgres", []string{"udp/5432"}, "postgres"},
+		{"named", []string{"tcp/53"}, ""},
+		{"named", []string{"tcp/8053", "udp/53"}, "dns"},
+		{"nginx", []string{"tcp/443"}, "other"},
+		{"apache2", []string{"tcp/443"}, ""},
+		{"nginx", nil, ""},
+	} {
+		_, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: tc.comm, ListeningPorts: tc.ports})
+		c.Check(name, Equals, tc.want, Commentf("%d", i))
+	}
+
+	cfg, err = GetConfig("process_names:\n  - comm: [bash]\n", false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.NeedsListeningPorts(), Equals, false)
+	for _, bad := range []string{"0", "65536", "sctp/80", "tcp/http", "tcp/"} {
+		_, err = GetConfig("process_names:\n  - listening_port: ['"+bad+"']\n", false)
+		c.Check(err, ErrorMatches, `.*bad listening_port "`+bad+`".*`)
+	}
+}
+
+func (s MySuite) TestConfigNameOptions(c *C) {
+	procs := []common.ProcAttributes{
+		{Name: "postgres", Cmdline: []string{"postgres", "-D", "/data"}},
+		{Name: "Postgres", Cmdline: []string{"Postgres", "-D", "/data"}},
+		{Name: "pg_dump", Cmdline: []string{"pg_dump", "postgres"}},
+		{Name: "bash", Cmdline: []string{"/usr/bin/postgres-backup.sh"}, Exe: "/usr/bin/bash"},
+		{Name: "BASH", Cmdline: []string{"BASH"}, Exe: "/usr/bin/BASH"},
+	}
+	for _, tc := range []struct {
+		yml  string
+		want []string
+	}{
+		// Unanchored regexes match anywhere, and names are case-sensitive.
+		{`
+process_names:
+  - name: pg
+    cmdline: ['postgres']
+  - name: sh
+    exe: [bash]
+`, []string{"pg", "", "pg", "pg", ""}},
+		{`
+process_names:
+  - name: pg
+    cmdline: ['postgres']
+    ignore_case: true
+  - name: sh
+    exe: [bash]
+    ignore_case: true
+`, []string{"pg", "pg", "pg", "pg", "sh"}},
+		{`
+process_names:
+  - name: pg
+    cmdline: ['postgres( .*)?']
+    anchored: true
+  - name: sh
+    exe: [bash]
+`, []string{"pg", "", "", "sh", ""}},
+		// The global defaults apply unless an entry says otherwise.
+		{`
+ignore_case: true
+anchored: true
+process_names:
+  - name: pg
+    cmdline: ['postgres( .*)?']
+  - name: sh
+    comm: [bash]
+    ignore_case: false
+`, []string{"pg", "pg", "", "sh", ""}},
+		// So they do to excludes, which then only exclude what they match
+		// in full.
+		{`
+anchored: true
+exclude:
+  - cmdline: ['pg_dump']
+process_names:
+  - name: pg
+    cmdline: ['.*postgres.*']
+`, []string{"pg", "", "pg", "pg", ""}},
+		{`
+anchored: true
+exclude:
+  - cmdline: ['pg_dump .*']
+process_names:
+  - name: pg
+    cmdline: ['.*postgres.*']
+`, []string{"pg", "", "", "pg", ""}},
+	} {
+		cfg, err := GetConfig(tc.yml, false)
+		c.Assert(err, IsNil, Commentf("%s", tc.yml))
+		c.Check(Check(tc.yml), HasLen, 0, Commentf("%s", tc.yml))
+		var got []string
+		for _, p := range procs {
+			_, name := cfg.MatchNamers.MatchAndName(p)
+			got = append(got, name)
+		}
+		c.Check(got, DeepEquals, tc.want, Commentf("%s", tc.yml))
+	}
+
+	for _, tc := range []struct {
+		yml, err string
+	}{
+		{"process_names:\n  - cmdline: ['^postgres']\n    anchored: true\n", `.*cmdline regex "\^postgres" for group "{{.ExeBase}}" is anchored already.*`},
+		{"anchored: true\nprocess_names:\n  - cmdline: ['postgres$']\n", `.*cmdline regex "postgres\$" .* is anchored already.*`},
+		{"process_names:\n  - comm: [bash]\n    ignore_case: yes please\n", `.*non-bool value yes please for key "ignore_case".*`},
+		{"ignore_case: 1\nprocess_names:\n  - comm: [bash]\n", `non-boolean value 1 for ignore_case`},
+	} {
+		_, err := GetConfig(tc.yml, false)
+		c.Check(err, ErrorMatches, tc.err, Commentf("%s", tc.yml))
+	}
+	// A leading ^ is fine without anchored, as is a trailing escaped $ with.
+	_, err := GetConfig("process_names:\n  - cmdline: ['^postgres']\n", false)
+	c.Check(err, IsNil)
+	cfg, err := GetConfig("process_names:\n  - cmdline: ['echo \\$']\n    anchored: true\n", false)
+	c.Assert(err, IsNil)
+	found, _ := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "echo", Cmdline: []string{"echo", "$"}})
+	c.Check(found, Equals, true)
+	_, err = GetConfig("process_names:\n  - cmdline: ['echo \\\\$']\n    anchored: true\n", false)
+	c.Check(err, ErrorMatches, `.*is anchored already.*`)
+
+	// ignore_case applies to the parent selectors too.
+	cfg, err = GetConfig(`
+process_names:
+  - name: cron-jobs
+    comm: [SH]
+    parent_comm: [CRON]
+    parent_exe: [/USR/SBIN/CRON]
+    ignore_case: true
+`, false)
+	c.Assert(err, IsNil)
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "sh",
+		Parents: []common.ParentAttributes{{Name: "cron", Exe: "/usr/sbin/cron"}}})
+	c.Check(found, Equals, true)
+}
+
+// TestGroupLabelsConcurrent verifies that names can be matched and their
+// labels looked up at the same time.
+func (s MySuite) TestGroupLabelsConcurrent(c *C) {
+	cfg, err := GetConfig(`
+process_names:
+  - name: "n{{.Matches.n}}"
+    cmdline: ['n(?P<n>\d+)']
+    labels: {tier: batch}
+`, false)
+	c.Assert(err, IsNil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "x", Cmdline: []string{fmt.Sprintf("n%d", i)}})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		cfg.MatchNamers.GroupLabels(fmt.Sprintf("n%d", i))
+	}
+	<-done
+	c.Check(cfg.MatchNamers.GroupLabels("n99"), DeepEquals, map[string]string{"tier": "batch"})
+}
@@ -0,0 +1,209 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+
+	common "github.com/ncabatoff/process-exporter"
+)
+
+type (
+	// configJSON is the form Config takes as JSON, see Config.MarshalJSON.
+	configJSON struct {
+		ProcessNames    []entryJSON       `json:"process_names"`
+		Exclude         []string          `json:"exclude,omitempty"`
+		OtherGroup      *otherGroupJSON   `json:"other_group,omitempty"`
+		StaleGroupTTL   string            `json:"stale_group_ttl,omitempty"`
+		RecheckInterval string            `json:"recheck_interval,omitempty"`
+		RecheckOnScrape bool              `json:"recheck_on_scrape"`
+		MinAge          string            `json:"min_age,omitempty"`
+		Labels          map[string]string `json:"labels,omitempty"`
+		CgroupFilter    *cgroupFilterJSON `json:"cgroup_filter,omitempty"`
+	}
+
+	// entryJSON is a process_names entry as parsed: its selectors are
+	// described by the matchers they became.
+	entryJSON struct {
+		Name          string            `json:"name"`
+		Selectors     []string          `json:"selectors,omitempty"`
+		Exclude       []string          `json:"exclude,omitempty"`
+		GroupBy       *unitGroupJSON    `json:"group_by,omitempty"`
+		Labels        map[string]string `json:"labels,omitempty"`
+		Smaps         bool              `json:"smaps"`
+		Collectors    map[string]bool   `json:"collectors,omitempty"`
+		TrackChildren bool              `json:"track_children"`
+		RealUID       bool              `json:"real_uid"`
+		MinAge        string            `json:"min_age,omitempty"`
+	}
+
+	unitGroupJSON struct {
+		Units        []string `json:"units,omitempty"`
+		ExcludeUnits []string `json:"exclude_units,omitempty"`
+		UserUnits    bool     `json:"user_units"`
+		Fallback     string   `json:"fallback,omitempty"`
+	}
+
+	otherGroupJSON struct {
+		Name          string `json:"name"`
+		KernelThreads bool   `json:"kernel_threads"`
+	}
+
+	cgroupFilterJSON struct {
+		Prefixes []string `json:"prefixes,omitempty"`
+		Regex    string   `json:"regex,omitempty"`
+	}
+)
+
+// MarshalJSON implements json.Marshaler, giving the config as parsed, with
+// the process_names entries' selectors described by the matchers they
+// became, and durations and regexes as strings.  Each entry's collectors
+// are those it turns on or off, or if cfg.Collectors is set, all those in
+// effect for its groups.
+func (cfg *Config) MarshalJSON() ([]byte, error) {
+	out := configJSON{
+		RecheckOnScrape: cfg.RecheckOnScrape,
+		Labels:          cfg.Labels,
+		ProcessNames:    []entryJSON{},
+	}
+	for _, mn := range cfg.MatchNamers.matchers {
+		if m, ok := mn.(*matchNamer); ok {
+			e := m.json()
+			if cfg.Collectors != nil {
+				e.Collectors = cfg.Collectors(m.collectors)
+			}
+			out.ProcessNames = append(out.ProcessNames, e)
+		}
+	}
+	for _, e := range cfg.MatchNamers.excludes {
+		out.Exclude = append(out.Exclude, fmt.Sprint(e))
+	}
+	if cfg.OtherGroup != nil {
+		out.OtherGroup = &otherGroupJSON{cfg.OtherGroup.Name, cfg.OtherGroup.KernelThreads}
+	}
+	if cfg.StaleGroupTTL > 0 {
+		out.StaleGroupTTL = cfg.StaleGroupTTL.String()
+	}
+	if cfg.RecheckInterval > 0 {
+		out.RecheckInterval = cfg.RecheckInterval.String()
+	}
+	if cfg.MatchNamers.minAge > 0 {
+		out.MinAge = cfg.MatchNamers.minAge.String()
+	}
+	if cfg.CgroupFilter != nil {
+		out.CgroupFilter = &cgroupFilterJSON{Prefixes: cfg.CgroupFilter.Prefixes}
+		if cfg.CgroupFilter.Regex != nil {
+			out.CgroupFilter.Regex = cfg.CgroupFilter.Regex.String()
+		}
+	}
+	return json.Marshal(out)
+}
+
+// json returns the entry as it's given by Config.MarshalJSON.
+func (m *matchNamer) json() entryJSON {
+	e := entryJSON{
+		Name:          m.template.Root.String(),
+		Labels:        m.labels,
+		Smaps:         m.smaps,
+		Collectors:    m.collectors,
+		TrackChildren: m.trackChildren,
+		RealUID:       m.realUID,
+	}
+	for _, mc := range m.andMatcher {
+		e.Selectors = append(e.Selectors, fmt.Sprint(mc))
+	}
+	for _, ex := range m.excludes {
+		e.Exclude = append(e.Exclude, fmt.Sprint(ex))
+	}
+	if m.minAge != nil {
+		e.MinAge = m.minAge.String()
+	}
+	if ug := m.unitGroup; ug != nil {
+		e.GroupBy = &unitGroupJSON{ug.units, ug.excludeUnits, ug.userUnits, ug.fallback}
+	}
+	return e
+}
+
+// Explain implements common.ExplainNamer.  Evaluating the entries doesn't
+// affect what GatherSMaps, GroupLabels and the like return.
+func (f FirstMatcher) Explain(nacl common.ProcAttributes) common.MatchExplanation {
+	var ex common.MatchExplanation
+	excluded := false
+	for _, e := range f.excludes {
+		r := common.MatcherResult{Matcher: fmt.Sprint(e), Passed: e.Match(nacl)}
+		excluded = excluded || r.Passed
+		ex.Excludes = append(ex.Excludes, r)
+	}
+	for _, mn := range f.matchers {
+		var ee common.EntryExplanation
+		if m, ok := mn.(*matchNamer); ok {
+			ee = m.explain(nacl)
+		} else {
+			ee.Name = mn.String()
+			ee.Matched, ee.GroupName = mn.MatchAndName(nacl)
+		}
+		if ee.Matched && !excluded && !ex.Matched {
+			ex.Matched, ex.GroupName = true, ee.GroupName
+		}
+		ex.Entries = append(ex.Entries, ee)
+	}
+	return ex
+}
+
+// explain evaluates every selector and exclude of the entry against nacl.
+// If they all allow it but no name results, e.g. because the template gives
+// an empty one or, with group_by, no unit qualifies, a last failed result
+// for the name says so.
+func (m *matchNamer) explain(nacl common.ProcAttributes) common.EntryExplanation {
+	ee := common.EntryExplanation{Name: m.template.Root.String()}
+	passed := true
+	for _, mc := range m.andMatcher {
+		r := common.MatcherResult{Matcher: fmt.Sprint(mc), Passed: mc.Match(nacl)}
+		if r.Passed {
+			r.Captures = captures(mc)
+		}
+		passed = passed && r.Passed
+		ee.Matchers = append(ee.Matchers, r)
+	}
+	for _, e := range m.excludes {
+		r := common.MatcherResult{Matcher: fmt.Sprint(e), Passed: e.Match(nacl)}
+		passed = passed && !r.Passed
+		ee.Excludes = append(ee.Excludes, r)
+	}
+	if !passed {
+		return ee
+	}
+	ee.Matched, ee.GroupName = m.MatchAndName(nacl)
+	if !ee.Matched {
+		what := "name"
+		if m.unitGroup != nil {
+			what = "systemd unit"
+		}
+		ee.Matchers = append(ee.Matchers, common.MatcherResult{Matcher: what})
+	}
+	return ee
+}
+
+// captures returns a copy of the named captures of mc's last match, or nil
+// if it has none.
+func captures(mc Matcher) map[string]string {
+	var from map[string]string
+	switch mc := mc.(type) {
+	case *cmdlineMatcher:
+		from = mc.captures
+	case *cgroupMatcher:
+		from = mc.captures
+	case *envMatcher:
+		from = mc.captures
+	}
+	var to map[string]string
+	for k, v := range from {
+		if k == "" {
+			continue
+		}
+		if to == nil {
+			to = make(map[string]string)
+		}
+		to[k] = v
+	}
+	return to
+}
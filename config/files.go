@@ -0,0 +1,228 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	// Paths are the paths of config files or directories, given by a flag
+	// that may be repeated.
+	Paths []string
+
+	// configFile is a config file as read and validated on its own.
+	configFile struct {
+		path string
+		data map[string]interface{}
+		// cfg is the file's config, or nil if it's invalid.
+		cfg *Config
+	}
+)
+
+// String implements flag.Value.
+func (p *Paths) String() string {
+	return strings.Join(*p, ",")
+}
+
+// Set implements flag.Value, adding a path.
+func (p *Paths) Set(path string) error {
+	*p = append(*p, path)
+	return nil
+}
+
+// Files returns the config files paths stand for, in order.  A path that's a
+// directory stands for the *.yml and *.yaml files in it, in lexical order.
+func Files(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file %q: %v", path, err)
+		}
+		if !fi.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config directory %q: %v", path, err)
+		}
+		var names []string
+		for _, info := range infos {
+			ext := filepath.Ext(info.Name())
+			if !info.IsDir() && (ext == ".yml" || ext == ".yaml") {
+				names = append(names, info.Name())
+			}
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no *.yml files in config directory %q", path)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+	return files, nil
+}
+
+// ReadFiles reads the config files paths stand for, see Files, and merges
+// them into one config: their process_names are concatenated in order,
+// while each other setting, e.g. other_group, may only be given by one of
+// them.  No group name may be given by more than one file, though a file
+// may give one in several entries.  Errors found in a file are prefixed by
+// its path.
+func ReadFiles(paths []string, debug bool) (*Config, error) {
+	files, errs := readFiles(paths, debug, false)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	if len(files) == 1 {
+		files[0].cfg.logWarnings()
+		return files[0].cfg, nil
+	}
+	data, errs := mergeFiles(files)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	cfg, errs := getConfig(data, false)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	cfg.logWarnings()
+	return cfg, nil
+}
+
+// CheckFiles checks the config files paths stand for, as Check does each of
+// them, and their merging as by ReadFiles, returning every error found.
+func CheckFiles(paths []string) []error {
+	files, errs := readFiles(paths, false, true)
+	if len(files) == 1 && len(errs) == 0 {
+		files[0].cfg.logWarnings()
+		return nil
+	}
+	data, merrs := mergeFiles(files)
+	errs = append(errs, merrs...)
+	if len(errs) > 0 {
+		return errs
+	}
+	cfg, errs := getConfig(data, true)
+	if cfg != nil {
+		cfg.logWarnings()
+	}
+	return errs
+}
+
+// readFiles reads and validates on its own each of the config files paths
+// stand for.  A file may leave process_names to the others.  Unless check,
+// it stops at the first error; if check, it checks each file as Check does.
+func readFiles(paths []string, debug, check bool) ([]configFile, []error) {
+	names, err := Files(paths)
+	if err != nil {
+		return nil, []error{err}
+	}
+	unmarshal := yaml.Unmarshal
+	if check {
+		unmarshal = yaml.UnmarshalStrict
+	}
+	var files []configFile
+	var errs []error
+	for _, path := range names {
+		content, err := ioutil.ReadFile(path)
+		if err == nil {
+			if debug {
+				log.Printf("Config file %q contents:\n%s", path, content)
+			}
+			var data map[string]interface{}
+			if err = unmarshal(content, &data); err == nil {
+				files = append(files, configFile{path: path, data: data})
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error reading config file %q: %v", path, err))
+			if !check {
+				return nil, errs
+			}
+			continue
+		}
+
+		f := &files[len(files)-1]
+		data := f.data
+		if _, ok := data["process_names"]; !ok && len(names) > 1 {
+			data = make(map[string]interface{}, len(f.data)+1)
+			for k, v := range f.data {
+				data[k] = v
+			}
+			data["process_names"] = []interface{}{}
+		}
+		cfg, ferrs := getConfig(data, check)
+		for _, err := range ferrs {
+			errs = append(errs, fmt.Errorf("%s: %v", path, err))
+		}
+		if len(ferrs) > 0 && !check {
+			return nil, errs
+		}
+		f.cfg = cfg
+	}
+	return files, errs
+}
+
+// mergeFiles returns the settings of files merged as ReadFiles describes,
+// and every conflict between them.
+func mergeFiles(files []configFile) (map[string]interface{}, []error) {
+	var errs []error
+	merged := make(map[string]interface{})
+	var procnames []interface{}
+	hasProcnames := false
+	setBy := make(map[string]string)
+	groupBy := make(map[string]string)
+	for _, f := range files {
+		for _, key := range sortedKeys(f.data) {
+			if key == "process_names" {
+				hasProcnames = true
+				if entries, ok := f.data[key].([]interface{}); ok {
+					procnames = append(procnames, entries...)
+				}
+				continue
+			}
+			if other, ok := setBy[key]; ok {
+				errs = append(errs, fmt.Errorf("%s: %s is already set by %s, global settings may only be set by one file",
+					f.path, key, other))
+				continue
+			}
+			setBy[key] = f.path
+			merged[key] = f.data[key]
+		}
+		if f.cfg == nil {
+			continue
+		}
+		var names []string
+		for _, mn := range f.cfg.MatchNamers.matchers {
+			if m, ok := mn.(*matchNamer); ok && m.staticName != "" {
+				names = append(names, m.staticName)
+			}
+		}
+		seen := make(map[string]bool)
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if other, ok := groupBy[name]; ok {
+				errs = append(errs, fmt.Errorf("%s: group %q is already given by %s", f.path, name, other))
+				continue
+			}
+			groupBy[name] = f.path
+		}
+	}
+	if hasProcnames {
+		merged["process_names"] = procnames
+	}
+	return merged, errs
+}
@@ -67,7 +67,8 @@ func (n namer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
 
 func newProcIDStatic(pid, ppid int, startTime uint64, name string, cmdline []string) (ID, Static) {
 	return ID{pid, startTime},
-		Static{name, cmdline, ppid, time.Unix(int64(startTime), 0).UTC(), 1000}
+		Static{name, cmdline, ppid, time.Unix(int64(startTime), 0).UTC(), 1000, 1000,
+			Creds{1000, 1000, 1000, 1000}, Creds{1000, 1000, 1000, 1000}, "", "", "", nil, nil}
 }
 
 func newProc(pid int, name string, m Metrics) IDInfo {
@@ -100,6 +101,6 @@ func piinfost(pid int, name string, c Counts, m Memory, f Filedesc, t int, s Sta
 	return IDInfo{
 		ID:      id,
 		Static:  static,
-		Metrics: Metrics{c, m, f, uint64(t), s, ""},
+		Metrics: Metrics{c, m, f, uint64(t), s, "", nil, 0, 0, s.Waiting > 0, "", 0, 0, "", 0, false},
 	}
 }
@@ -0,0 +1,167 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// capabilityNames are the names of the capabilities, indexed by bit, as of
+// Linux 5.9.  Later kernels may have more, which are known by number only.
+var capabilityNames = []string{
+	"cap_chown",
+	"cap_dac_override",
+	"cap_dac_read_search",
+	"cap_fowner",
+	"cap_fsetid",
+	"cap_kill",
+	"cap_setgid",
+	"cap_setuid",
+	"cap_setpcap",
+	"cap_linux_immutable",
+	"cap_net_bind_service",
+	"cap_net_broadcast",
+	"cap_net_admin",
+	"cap_net_raw",
+	"cap_ipc_lock",
+	"cap_ipc_owner",
+	"cap_sys_module",
+	"cap_sys_rawio",
+	"cap_sys_chroot",
+	"cap_sys_ptrace",
+	"cap_sys_pacct",
+	"cap_sys_admin",
+	"cap_sys_boot",
+	"cap_sys_nice",
+	"cap_sys_resource",
+	"cap_sys_time",
+	"cap_sys_tty_config",
+	"cap_mknod",
+	"cap_lease",
+	"cap_audit_write",
+	"cap_audit_control",
+	"cap_setfcap",
+	"cap_mac_override",
+	"cap_mac_admin",
+	"cap_syslog",
+	"cap_wake_alarm",
+	"cap_block_suspend",
+	"cap_audit_read",
+	"cap_perfmon",
+	"cap_bpf",
+	"cap_checkpoint_restore",
+}
+
+// CapabilityName returns the name of the capability with the given bit, e.g.
+// "cap_sys_admin" for 21, or the bit in decimal if it has no known name.
+func CapabilityName(bit int) string {
+	if bit >= 0 && bit < len(capabilityNames) {
+		return capabilityNames[bit]
+	}
+	return strconv.Itoa(bit)
+}
+
+// ParseCapability returns the bit of the capability named s, which may omit
+// the cap_ prefix and is case-insensitive, or be a bit number from 0 to 63.
+func ParseCapability(s string) (int, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if bit, err := strconv.Atoi(name); err == nil {
+		if bit < 0 || bit > 63 {
+			return 0, fmt.Errorf("capability %d out of range 0-63", bit)
+		}
+		return bit, nil
+	}
+	if !strings.HasPrefix(name, "cap_") {
+		name = "cap_" + name
+	}
+	for bit, n := range capabilityNames {
+		if n == name {
+			return bit, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown capability %q", s)
+}
+
+type (
+	// CapabilitySet is a set of capabilities as a mask of their bits, as in
+	// the Cap* lines of /proc/<pid>/status.
+	CapabilitySet uint64
+
+	// ProcCapabilities are the capability sets of a proc, see capabilities(7).
+	ProcCapabilities struct {
+		Inheritable CapabilitySet
+		Permitted   CapabilitySet
+		Effective   CapabilitySet
+		Bounding    CapabilitySet
+		// Ambient is empty on kernels before 4.3, which don't have it.
+		Ambient CapabilitySet
+	}
+)
+
+// Has returns true if the capability with the given bit is in s.
+func (s CapabilitySet) Has(bit int) bool {
+	return bit >= 0 && bit < 64 && s&(1<<uint(bit)) != 0
+}
+
+// Names returns the names of the capabilities in s, see CapabilityName, in
+// order of bit.
+func (s CapabilitySet) Names() []string {
+	var names []string
+	for bit := 0; bit < 64; bit++ {
+		if s.Has(bit) {
+			names = append(names, CapabilityName(bit))
+		}
+	}
+	return names
+}
+
+// parseProcCapabilities returns the capability sets from the contents of
+// /proc/<pid>/status.  All but the ambient set must be present.
+func parseProcCapabilities(data []byte) (ProcCapabilities, error) {
+	var caps ProcCapabilities
+	sets := map[string]*CapabilitySet{
+		"CapInh:": &caps.Inheritable,
+		"CapPrm:": &caps.Permitted,
+		"CapEff:": &caps.Effective,
+		"CapBnd:": &caps.Bounding,
+		"CapAmb:": &caps.Ambient,
+	}
+	found := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		set, ok := sets[fields[0]]
+		if !ok {
+			continue
+		}
+		mask, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return ProcCapabilities{}, fmt.Errorf("malformed %s %q: %v", fields[0], fields[1], err)
+		}
+		*set = CapabilitySet(mask)
+		if fields[0] != "CapAmb:" {
+			found++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ProcCapabilities{}, err
+	}
+	if found < 4 {
+		return ProcCapabilities{}, fmt.Errorf("missing capability sets in status")
+	}
+	return caps, nil
+}
+
+// Capabilities returns the capability sets of the proc with the given pid.
+func (fs *FS) Capabilities(pid int) (ProcCapabilities, error) {
+	data, err := fs.readStatus(pid)
+	if err != nil {
+		return ProcCapabilities{}, err
+	}
+	return parseProcCapabilities(data)
+}
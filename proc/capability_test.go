@@ -0,0 +1,101 @@
+package proc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestParseCapability verifies that capabilities can be given by name, with
+// or without the cap_ prefix, or by bit, and that unknown bits are named by
+// number.
+func TestParseCapability(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		bit  int
+		name string
+	}{
+		{"cap_sys_admin", 21, "cap_sys_admin"},
+		{"SYS_ADMIN", 21, "cap_sys_admin"},
+		{" cap_chown", 0, "cap_chown"},
+		{"cap_checkpoint_restore", 40, "cap_checkpoint_restore"},
+		{"12", 12, "cap_net_admin"},
+		{"45", 45, "45"},
+	} {
+		bit, err := ParseCapability(tc.s)
+		if err != nil {
+			t.Errorf("%q: %v", tc.s, err)
+			continue
+		}
+		if bit != tc.bit || CapabilityName(bit) != tc.name {
+			t.Errorf("%q: got bit %d named %q, want %d named %q", tc.s, bit, CapabilityName(bit), tc.bit, tc.name)
+		}
+	}
+	for _, bad := range []string{"", "cap_sys_wizard", "64", "-1"} {
+		if _, err := ParseCapability(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+// TestReadCapEff verifies that the effective capability set is read from
+// status only if asked for.
+func TestReadCapEff(t *testing.T) {
+	for _, gather := range []bool{false, true} {
+		fs, err := NewFS("../fixtures", false)
+		noerr(t, err)
+		fs.GatherCapabilities = gather
+		procs := fs.AllProcs()
+		var got []uint64
+		for procs.Next() {
+			pii, err := procinfo(procs)
+			noerr(t, err)
+			got = append(got, pii.CapEff)
+		}
+		noerr(t, procs.Close())
+		want := []uint64{0}
+		if gather {
+			want = []uint64{0x3000}
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("gather=%v: CapEff differs: (-got +want)\n%s", gather, diff)
+		}
+	}
+}
+
+// TestCapabilities verifies that all the capability sets are read from the
+// fixture, and that masks are decoded to names.
+func TestCapabilities(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	got, err := fs.Capabilities(14804)
+	noerr(t, err)
+	want := ProcCapabilities{Permitted: 0x3000, Effective: 0x3000, Bounding: 0x3fffffffff}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("capabilities differ: (-got +want)\n%s", diff)
+	}
+	if diff := cmp.Diff(got.Effective.Names(), []string{"cap_net_admin", "cap_net_raw"}); diff != "" {
+		t.Errorf("effective names differ: (-got +want)\n%s", diff)
+	}
+	if names := got.Bounding.Names(); len(names) != 38 || names[0] != "cap_chown" || names[37] != "cap_audit_read" {
+		t.Errorf("got bounding names %v, want cap_chown to cap_audit_read", names)
+	}
+	if names := got.Ambient.Names(); names != nil {
+		t.Errorf("got ambient names %v, want none", names)
+	}
+	if diff := cmp.Diff(CapabilitySet(1<<21|1<<63).Names(), []string{"cap_sys_admin", "63"}); diff != "" {
+		t.Errorf("names differ: (-got +want)\n%s", diff)
+	}
+
+	// Kernels before 4.3 have no ambient set.
+	old := "CapInh:\t0000000000000000\nCapPrm:\t0000000000000001\nCapEff:\t0000000000000001\nCapBnd:\t0000001fffffffff\n"
+	if _, err := parseProcCapabilities([]byte(old)); err != nil {
+		t.Errorf("parsing status without CapAmb: %v", err)
+	}
+	for _, bad := range []string{"CapEff:\t0000000000000001\n", strings.Replace(old, "CapEff", "CapFoo", 1), old + "CapAmb:\tzz\n"} {
+		if _, err := parseProcCapabilities([]byte(bad)); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
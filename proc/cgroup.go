@@ -0,0 +1,2648 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultCgroupMountPoint is where cgroupfs is normally mounted.  It's used
+// when the cgroup mounts can't be found in mountinfo.
+const DefaultCgroupMountPoint = "/sys/fs/cgroup"
+
+// ErrControllerNotMounted is returned, possibly wrapped, by cgroup readers
+// when the hierarchy holding the files of the controller they read isn't
+// mounted, or the proc isn't placed in it, so that callers can tell that
+// apart from a value of zero using errors.Is.  Callers for which that's no
+// different from zero can use IgnoreControllerNotMounted.
+var ErrControllerNotMounted = errors.New("cgroup controller not mounted")
+
+// ErrSwapAccountingDisabled is returned by cgroup swap readers on v1 when the
+// kernel doesn't account swap per cgroup, as when booted without
+// swapaccount=1 on many distributions, so there are no memory.memsw files.
+var ErrSwapAccountingDisabled = errors.New("cgroup swap accounting disabled")
+
+// IgnoreControllerNotMounted returns nil if err is ErrControllerNotMounted,
+// else err.  Since cgroup readers return zero values along with errors, this
+// turns a missing controller into a zero value.
+func IgnoreControllerNotMounted(err error) error {
+	if errors.Is(err, ErrControllerNotMounted) {
+		return nil
+	}
+	return err
+}
+
+// Error classes for CgroupReadErrors.
+const (
+	// CgroupErrPermission is for EACCES and EPERM, e.g. due to restrictive
+	// mount options or an LSM policy.
+	CgroupErrPermission = "permission"
+	// CgroupErrIO is for EIO.
+	CgroupErrIO = "io"
+	// CgroupErrUnsupported is for errors the kernel returns for files it
+	// can't provide, e.g. ENODEV when a controller has been disabled.
+	CgroupErrUnsupported = "unsupported"
+	// CgroupErrOther is for all other errors.
+	CgroupErrOther = "other"
+)
+
+// CgroupMemorySource selects which value of a memory cgroup to report.
+type CgroupMemorySource string
+
+const (
+	// CgroupMemoryCurrent is the memory usage, including page cache.
+	CgroupMemoryCurrent CgroupMemorySource = "current"
+	// CgroupMemoryWorkingSet is the usage minus inactive page cache.
+	CgroupMemoryWorkingSet CgroupMemorySource = "working_set"
+	// CgroupMemoryLimit is the effective hard limit, see CgroupMemMax.
+	CgroupMemoryLimit CgroupMemorySource = "limit"
+)
+
+// CgroupVersion identifies which cgroup API is in use.
+type CgroupVersion int
+
+const (
+	// CgroupV1 means each controller has its own hierarchy.  Hybrid hosts,
+	// which mount an empty v2 hierarchy alongside the v1 ones, count as v1.
+	CgroupV1 CgroupVersion = 1
+	// CgroupV2 means all controllers share the unified hierarchy.
+	CgroupV2 CgroupVersion = 2
+)
+
+// cgroupV1Unlimited is the smallest v1 limit value treated as unlimited.  The
+// kernel reports "no limit" as the largest int64 rounded down to a multiple
+// of the page size, so that's what this allows for, up to 64k pages.
+const cgroupV1Unlimited = math.MaxInt64 &^ 0xffff
+
+type (
+	// Cgroup describes the placement of a process in one cgroup hierarchy,
+	// as given by a line of /proc/<pid>/cgroup.
+	Cgroup struct {
+		// HierarchyID is the v1 hierarchy id, or 0 for the v2 unified hierarchy.
+		HierarchyID int
+		// Controllers are the v1 controllers bound to this hierarchy.  It is
+		// empty for the v2 unified hierarchy.
+		Controllers []string
+		// Path is the cgroup's path relative to the hierarchy's mount point.
+		Path string
+	}
+
+	// CgroupLimit is a limit read from a cgroup file.  Limits have three
+	// states: unset, unlimited, or a value.
+	CgroupLimit struct {
+		// Value is the limit.  It is only meaningful if Set is true and
+		// Unlimited is false.
+		Value uint64
+		// Set is false when no limit was found, e.g. because the file doesn't
+		// exist for this cgroup.
+		Set bool
+		// Unlimited is true when the limit is "max", or the v1 equivalents:
+		// -1, or the largest int64 rounded down to a page size.
+		Unlimited bool
+	}
+
+	// CgroupMemoryInfo describes the memory usage of a cgroup in terms that are
+	// independent of the cgroup version.
+	CgroupMemoryInfo struct {
+		// Usage is the current memory usage in bytes, including page cache.
+		// It is read from memory.current (v2) or memory.usage_in_bytes (v1).
+		Usage uint64
+		// WorkingSet is Usage minus inactive file-backed memory, which is what
+		// the kernel will try hardest to keep around under pressure.
+		WorkingSet uint64
+		// Anon is anonymous memory, read from memory.stat anon (v2) or
+		// total_rss (v1).
+		Anon uint64
+		// File is file-backed memory, read from memory.stat file (v2) or
+		// total_cache (v1).
+		File uint64
+		// Limit is the effective hard limit, see CgroupMemMax.
+		Limit CgroupLimit
+		// Peak is the highest Usage has been, see CgroupMemoryPeak.  It's 0
+		// if the kernel doesn't report it.
+		Peak uint64
+	}
+
+	// CgroupCPUInfo describes the CPU usage of a cgroup in terms that are
+	// independent of the cgroup version.
+	CgroupCPUInfo struct {
+		// UsageSeconds is the total CPU time consumed, read from cpu.stat
+		// usage_usec (v2) or cpuacct.usage (v1).
+		UsageSeconds float64
+		// UserSeconds is the user CPU time consumed, read from cpu.stat
+		// user_usec (v2) or cpuacct.stat user (v1).
+		UserSeconds float64
+		// SystemSeconds is the system CPU time consumed, read from cpu.stat
+		// system_usec (v2) or cpuacct.stat system (v1).
+		SystemSeconds float64
+		// Quota is the CPU time in microseconds allowed per Period, read from
+		// cpu.max (v2) or cpu.cfs_quota_us (v1).
+		Quota CgroupLimit
+		// PeriodMicros is the CFS bandwidth period in microseconds, read from
+		// cpu.max (v2) or cpu.cfs_period_us (v1).
+		PeriodMicros uint64
+		// BurstMicros is the CPU time in microseconds the cgroup may run
+		// beyond Quota in a period, saved from earlier periods, read from
+		// cpu.max.burst (v2) or cpu.cfs_burst_us (v1).  It's 0 if there's no
+		// burst, including on kernels before 5.14, which lack it.
+		BurstMicros uint64
+		// Periods is the number of enforcement periods that have elapsed.
+		Periods uint64
+		// ThrottledPeriods is the number of periods in which the cgroup was throttled.
+		ThrottledPeriods uint64
+		// ThrottledSeconds is the total time the cgroup was throttled for.
+		ThrottledSeconds float64
+	}
+
+	// CgroupCPUAcct is the CPU usage of a v1 cpuacct cgroup, in total and
+	// per CPU.
+	CgroupCPUAcct struct {
+		// UsageNanos is the total CPU time consumed in nanoseconds, read from
+		// cpuacct.usage.
+		UsageNanos uint64
+		// PerCPUNanos is the CPU time consumed on each CPU in nanoseconds,
+		// indexed by CPU number, read from cpuacct.usage_percpu.  It's nil
+		// if that file doesn't exist.
+		PerCPUNanos []uint64
+	}
+
+	// CgroupCPUThrottling describes how much the CPU usage of one or more
+	// cgroups has been throttled by their CFS quota.
+	CgroupCPUThrottling struct {
+		// ThrottledPeriods is the number of periods in which a cgroup was
+		// throttled.
+		ThrottledPeriods uint64
+		// ThrottledSeconds is the total time a cgroup was throttled for.
+		ThrottledSeconds float64
+	}
+
+	// CgroupCpuset describes the CPUs and memory nodes a cgroup may use.
+	CgroupCpuset struct {
+		// CPUs is the configured set of CPUs, from cpuset.cpus.  On v2 it may
+		// be empty, meaning the cgroup uses whatever its parent allows.
+		CPUs []int
+		// EffectiveCPUs is the set of CPUs the cgroup may actually run on,
+		// after CPU hotplug, isolation and ancestors' restrictions are applied.
+		// It is read from cpuset.cpus.effective (v2) or cpuset.effective_cpus (v1).
+		EffectiveCPUs []int
+		// Mems is the configured set of memory nodes, from cpuset.mems.
+		Mems []int
+		// EffectiveMems is the set of memory nodes the cgroup may actually use,
+		// read from cpuset.mems.effective (v2) or cpuset.effective_mems (v1).
+		EffectiveMems []int
+	}
+
+	// CgroupMemLimit is a memory limit along with where it came from.
+	CgroupMemLimit struct {
+		// Limit is the effective limit: the lowest of the limits of the
+		// cgroup and its ancestors.
+		Limit CgroupLimit
+		// Source is the path of the cgroup Limit was read from, or empty if
+		// no limit file was found.
+		Source string
+		// Inherited is true if Source is an ancestor of the cgroup.
+		Inherited bool
+		// Normalized is true if Limit is unlimited because the kernel's
+		// "no limit" sentinel was read, e.g. -1 or v1's huge page-aligned
+		// value, rather than v2's "max".
+		Normalized bool
+		// Undelegated is true if the memory controller isn't enabled in the
+		// cgroup itself, as is usual for containers whose pod's cgroup
+		// enforces the limit, so the cgroup has no memory files of its own.
+		// Only detected on v2.
+		Undelegated bool
+	}
+
+	// CgroupSwapEvents counts the swap limit events of a memory cgroup, as
+	// read from memory.swap.events (v2).
+	CgroupSwapEvents struct {
+		// High is the number of times swap usage went over memory.swap.high.
+		High uint64
+		// Max is the number of times swap usage was about to go over
+		// memory.swap.max, so that swapping out failed.
+		Max uint64
+		// Fail is the number of times swapping out failed, due to Max or to
+		// the system running out of swap.
+		Fail uint64
+	}
+
+	// CgroupMemoryReclaim is the reclaim activity of a v2 memory cgroup, as
+	// read from memory.stat, which tells how well reclaim, including that
+	// triggered by writing memory.reclaim, frees memory.
+	CgroupMemoryReclaim struct {
+		// PgScan is the number of pages scanned for reclaim.
+		PgScan uint64
+		// PgSteal is the number of pages reclaimed.
+		PgSteal uint64
+	}
+
+	// CgroupNUMAStat breaks the memory of a memory cgroup down by NUMA node
+	// and then by type, e.g. anon or file, as read from memory.numa_stat
+	// (v2).  Values are bytes, but for the workingset_* event counts.
+	CgroupNUMAStat map[int]map[string]uint64
+
+	// CgroupMiscResource describes the usage and limit of one resource of the
+	// misc controller, e.g. SEV encrypted VM slots.
+	CgroupMiscResource struct {
+		Current uint64
+		Max     CgroupLimit
+	}
+
+	// CgroupIOParams holds the parameters of a v2 io controller file such as
+	// io.cost.qos, keyed by device number ("major:minor") and then by name.
+	CgroupIOParams map[string]map[string]string
+
+	// CgroupIOCost holds the io.cost parameters, which only exist in the root
+	// cgroup.  A nil map means the file doesn't exist, i.e. io.cost isn't
+	// configured or not supported by the kernel.
+	CgroupIOCost struct {
+		// QoS is read from io.cost.qos, e.g. "enable", "rlat" and "wlat".
+		QoS CgroupIOParams
+		// Model is read from io.cost.model, e.g. "model", "rbps" and "wbps".
+		Model CgroupIOParams
+	}
+
+	// CgroupMemoryMetrics holds the memory controller files of a cgroup.
+	CgroupMemoryMetrics struct {
+		// Current is read from memory.current (v2) or memory.usage_in_bytes (v1).
+		Current uint64
+		// Max is read from memory.max (v2) or memory.limit_in_bytes (v1).
+		Max CgroupLimit
+		// High is read from memory.high.  It's unset on v1.
+		High CgroupLimit
+		// SwapCurrent is read from memory.swap.current (v2), or is
+		// memory.memsw.usage_in_bytes minus Current (v1).
+		SwapCurrent uint64
+		// SwapMax is read from memory.swap.max.  It's unset on v1, whose
+		// memsw limit covers memory and swap together.
+		SwapMax CgroupLimit
+		// SwapEvents is read from memory.swap.events.  It's zero on v1.
+		SwapEvents CgroupSwapEvents
+		// Stat is read from memory.stat.
+		Stat map[string]uint64
+	}
+
+	// CgroupPidsMetrics holds the pids controller files of a cgroup.
+	CgroupPidsMetrics struct {
+		// Current is the number of tasks in the cgroup, from pids.current.
+		Current uint64
+		// Max is the limit on tasks, from pids.max.
+		Max CgroupLimit
+	}
+
+	// CgroupPressureStats is one line of a pressure stall information file.
+	CgroupPressureStats struct {
+		// Avg10, Avg60 and Avg300 are the percentage of time stalled over the
+		// last 10, 60 and 300 seconds.
+		Avg10, Avg60, Avg300 float64
+		// TotalMicros is the total time stalled in microseconds.
+		TotalMicros uint64
+	}
+
+	// CgroupPressure is the pressure stall information of a cgroup for one
+	// resource, read from e.g. cpu.pressure.
+	CgroupPressure struct {
+		// Some is time in which at least one task was stalled.
+		Some CgroupPressureStats
+		// Full is time in which all tasks were stalled.
+		Full CgroupPressureStats
+	}
+
+	// CgroupMetrics holds the metrics of the cgroups of a process, as read by
+	// AllCgroupMetrics.  The fields of controllers whose files weren't found,
+	// e.g. because the controller isn't enabled, are nil.
+	CgroupMetrics struct {
+		Cgroups []Cgroup
+		Memory  *CgroupMemoryMetrics
+		CPU     *CgroupCPUInfo
+		Pids    *CgroupPidsMetrics
+		// Pressure is keyed by resource: "cpu", "memory" or "io".  It's only
+		// available on v2.
+		Pressure map[string]CgroupPressure
+	}
+
+	// CgroupMount is a mounted cgroup hierarchy.
+	CgroupMount struct {
+		// Point is the directory the hierarchy is mounted on.
+		Point string
+		// Root is the cgroup mounted on Point.  It's "/" unless only part of
+		// the hierarchy is mounted, e.g. a bind mount in a container.
+		Root string
+	}
+
+	// CgroupMounts gives where the cgroup hierarchies are mounted.
+	CgroupMounts struct {
+		// Controllers maps each v1 controller, e.g. "memory", or named
+		// hierarchy, e.g. "name=systemd", to the mount of its hierarchy.
+		Controllers map[string]CgroupMount
+		// Unified is the mount of the v2 unified hierarchy, if any.
+		Unified *CgroupMount
+	}
+
+	// CgroupFilter selects procs by their cgroup placement, see
+	// FS.CgroupFilter.  A proc matches if any of its cgroup paths does.
+	CgroupFilter struct {
+		// Prefixes are cgroup subtrees: a path matches if it's one of them
+		// or below one.
+		Prefixes []string
+		// Regexp, if not nil, matches the paths it matches.
+		Regexp *regexp.Regexp
+	}
+
+	// CgroupStat contains data read from a v2 cgroup.stat file.
+	CgroupStat struct {
+		// NrDescendants is the number of visible descendant cgroups.
+		NrDescendants uint64
+		// NrDyingDescendants is the number of descendant cgroups that have
+		// been removed but are still being torn down.
+		NrDyingDescendants uint64
+	}
+)
+
+// parseCgroupString parses a line of /proc/<pid>/cgroup, which has the
+// format hierarchyID:controller1,controller2:path.
+func parseCgroupString(cgroupStr string) (*Cgroup, error) {
+	fields := strings.SplitN(cgroupStr, ":", 3)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("at least 3 fields required, found %d fields in cgroup string: %s", len(fields), cgroupStr)
+	}
+	// Trim each field, so that stray whitespace such as the \r of a CRLF
+	// line ending doesn't end up in the path.
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	hid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hierarchy ID in cgroup string %q: %v", cgroupStr, err)
+	}
+
+	cgroup := &Cgroup{HierarchyID: hid, Path: fields[2]}
+	if fields[1] != "" {
+		cgroup.Controllers = strings.Split(fields[1], ",")
+	}
+	return cgroup, nil
+}
+
+// parseCgroups parses the contents of /proc/<pid>/cgroup, sorted by
+// HierarchyID since the order of its lines isn't the same across kernels.
+// Empty data, as some kernels give for kernel threads, yields an empty slice
+// and no error.
+func parseCgroups(data []byte) ([]Cgroup, error) {
+	cgroups := []Cgroup{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		cgroup, err := parseCgroupString(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		cgroups = append(cgroups, *cgroup)
+	}
+	sort.SliceStable(cgroups, func(i, j int) bool { return cgroups[i].HierarchyID < cgroups[j].HierarchyID })
+	return cgroups, scanner.Err()
+}
+
+// Cgroups returns the placement of pid in each cgroup hierarchy, ordered by
+// HierarchyID, so the v2 unified hierarchy, whose id is 0, comes first.
+// Kernel threads may not belong to any cgroup, in which case the cgroup file
+// is empty and Cgroups returns an empty slice.  Only /proc/<pid>/cgroup is read,
+// not cgroupfs, so it's cheap; readers such as CgroupMemMax take its result
+// to read the limits and usage of the cgroups.
+func (fs *FS) Cgroups(pid int) ([]Cgroup, error) {
+	return fs.readCgroups(strconv.Itoa(pid))
+}
+
+// CgroupsPath returns the path that best tells where a proc placed in
+// cgroups is: that in the v2 unified hierarchy, or failing that in systemd's
+// named v1 hierarchy, which like it follows the unit the proc is in.  It's
+// empty if the proc is in neither.
+func CgroupsPath(cgroups []Cgroup) string {
+	var path string
+	for _, cg := range cgroups {
+		if cg.HierarchyID == 0 {
+			return cg.Path
+		}
+		for _, c := range cg.Controllers {
+			if c == "name=systemd" {
+				path = cg.Path
+			}
+		}
+	}
+	return path
+}
+
+// CgroupsByController returns the placement of pid in each cgroup hierarchy,
+// see Cgroups, keyed by each of the hierarchy's controllers, so that one with
+// co-mounted controllers such as cpu,cpuacct is found under both.  Named
+// hierarchies are keyed like name=systemd, and the v2 unified one by "".
+func (fs *FS) CgroupsByController(pid int) (map[string]Cgroup, error) {
+	cgroups, err := fs.Cgroups(pid)
+	if err != nil {
+		return nil, err
+	}
+	return cgroupsByController(cgroups), nil
+}
+
+func cgroupsByController(cgroups []Cgroup) map[string]Cgroup {
+	byController := make(map[string]Cgroup, len(cgroups))
+	for _, cg := range cgroups {
+		if cg.HierarchyID == 0 {
+			byController[""] = cg
+			continue
+		}
+		for _, c := range cg.Controllers {
+			byController[c] = cg
+		}
+	}
+	return byController
+}
+
+// readCgroups reads and parses the cgroup file in the named dir of procfs.
+func (fs *FS) readCgroups(procdir string) ([]Cgroup, error) {
+	f, err := os.Open(filepath.Join(fs.MountPoint, procdir, "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := cgroupBufPool.Get().(*cgroupBuf)
+	defer buf.release()
+	if buf.data, err = appendAll(buf.data[:0], f); err != nil {
+		return nil, err
+	}
+	return parseCgroups(buf.data)
+}
+
+// Match returns whether any of cgroups is in one of the subtrees of f or
+// matches its regexp.
+func (f CgroupFilter) Match(cgroups []Cgroup) bool {
+	for _, cg := range cgroups {
+		for _, prefix := range f.Prefixes {
+			prefix = strings.TrimSuffix(prefix, "/")
+			if prefix == "" || cg.Path == prefix || strings.HasPrefix(cg.Path, prefix+"/") {
+				return true
+			}
+		}
+		if f.Regexp != nil && f.Regexp.MatchString(cg.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMountInfoField undoes the octal escaping of spaces and other special
+// characters in mountinfo fields.
+var parseMountInfoField = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace
+
+// cgroupMountOptions are the v1 superblock options that aren't controllers.
+var cgroupMountOptions = map[string]bool{
+	"rw": true, "ro": true, "xattr": true, "noprefix": true,
+	"clone_children": true, "cpuset_v2_mode": true, "favordynmods": true,
+}
+
+// parseCgroupMounts parses the cgroup mounts from the contents of
+// /proc/<pid>/mountinfo.  When a hierarchy is mounted more than once, the
+// first mount is used.
+func parseCgroupMounts(data []byte) (CgroupMounts, error) {
+	mounts := CgroupMounts{Controllers: make(map[string]CgroupMount)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || len(fields) < sep+4 {
+			return CgroupMounts{}, fmt.Errorf("malformed mountinfo line: %q", scanner.Text())
+		}
+
+		mount := CgroupMount{Point: parseMountInfoField(fields[4]), Root: parseMountInfoField(fields[3])}
+		switch fields[sep+1] {
+		case "cgroup2":
+			if mounts.Unified == nil {
+				mounts.Unified = &mount
+			}
+		case "cgroup":
+			for _, opt := range strings.Split(fields[sep+3], ",") {
+				if cgroupMountOptions[opt] ||
+					(strings.Contains(opt, "=") && !strings.HasPrefix(opt, "name=")) {
+					continue
+				}
+				if _, ok := mounts.Controllers[opt]; !ok {
+					mounts.Controllers[opt] = mount
+				}
+			}
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// cgroupMountsAt returns the cgroup mounts assuming the usual layout under
+// root: the unified hierarchy on root itself, or one directory per v1
+// hierarchy named after its controllers, plus possibly the unified hierarchy
+// on root/unified.
+func cgroupMountsAt(root string) CgroupMounts {
+	mounts := CgroupMounts{Controllers: make(map[string]CgroupMount)}
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		mounts.Unified = &CgroupMount{Point: root, Root: "/"}
+		return mounts
+	}
+
+	files, _ := ioutil.ReadDir(root)
+	for _, file := range files {
+		dir := filepath.Join(root, file.Name())
+		if file.Name() == "unified" {
+			mounts.Unified = &CgroupMount{Point: dir, Root: "/"}
+			continue
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		mounts.Controllers["name="+file.Name()] = CgroupMount{Point: dir, Root: "/"}
+		for _, c := range strings.Split(file.Name(), ",") {
+			if _, ok := mounts.Controllers[c]; !ok {
+				mounts.Controllers[c] = CgroupMount{Point: dir, Root: "/"}
+			}
+		}
+	}
+	return mounts
+}
+
+// cgroupMounts returns the cgroup mounts, found once and then cached.  If
+// CgroupMountPoint is set the usual layout under it is assumed, otherwise the
+// mounts are parsed from <MountPoint>/self/mountinfo, falling back to the
+// usual layout under DefaultCgroupMountPoint if that finds none.
+func (fs *FS) cgroupMounts() CgroupMounts {
+	fs.cgroupMu.Lock()
+	defer fs.cgroupMu.Unlock()
+	if fs.cgroupMountsCache != nil {
+		return *fs.cgroupMountsCache
+	}
+
+	var mounts CgroupMounts
+	if fs.CgroupMountPoint != "" {
+		mounts = cgroupMountsAt(fs.CgroupMountPoint)
+	} else {
+		data, err := ioutil.ReadFile(filepath.Join(fs.MountPoint, "self", "mountinfo"))
+		if err == nil {
+			mounts, err = parseCgroupMounts(data)
+		}
+		if err == nil && len(mounts.Controllers) == 0 && mounts.Unified == nil {
+			err = fmt.Errorf("no cgroup mounts found")
+		}
+		if err != nil {
+			log.Printf("error finding cgroup mounts, assuming they're under %s: %v",
+				DefaultCgroupMountPoint, err)
+			mounts = cgroupMountsAt(DefaultCgroupMountPoint)
+		}
+	}
+	fs.cgroupMountsCache = &mounts
+	return mounts
+}
+
+// CgroupMountRoot returns where the hierarchies of the given cgroup version
+// are mounted: the mount of each v1 controller, or the v2 unified mount.  All
+// cgroup readers find their files using it.
+func (fs *FS) CgroupMountRoot(version CgroupVersion) (CgroupMounts, error) {
+	mounts := fs.cgroupMounts()
+	switch version {
+	case CgroupV1:
+		if len(mounts.Controllers) == 0 {
+			return CgroupMounts{}, fmt.Errorf("no cgroup v1 hierarchies mounted: %w", ErrControllerNotMounted)
+		}
+		return CgroupMounts{Controllers: mounts.Controllers}, nil
+	case CgroupV2:
+		if mounts.Unified == nil {
+			return CgroupMounts{}, fmt.Errorf("no cgroup v2 hierarchy mounted: %w", ErrControllerNotMounted)
+		}
+		return CgroupMounts{Unified: mounts.Unified}, nil
+	}
+	return CgroupMounts{}, fmt.Errorf("unknown cgroup version %d", version)
+}
+
+// CgroupVersion returns the cgroup version in use: v2 if only the unified
+// hierarchy is mounted, otherwise v1.
+func (fs *FS) CgroupVersion() CgroupVersion {
+	if _, err := fs.CgroupMountRoot(CgroupV1); err != nil {
+		if _, err := fs.CgroupMountRoot(CgroupV2); err == nil {
+			return CgroupV2
+		}
+	}
+	return CgroupV1
+}
+
+// cgroupMount returns the mount of the hierarchy cg belongs to.
+func (fs *FS) cgroupMount(cg Cgroup) (CgroupMount, error) {
+	if cg.HierarchyID == 0 {
+		mounts, err := fs.CgroupMountRoot(CgroupV2)
+		if err != nil {
+			return CgroupMount{}, err
+		}
+		return *mounts.Unified, nil
+	}
+	mounts, err := fs.CgroupMountRoot(CgroupV1)
+	if err != nil {
+		return CgroupMount{}, err
+	}
+	for _, c := range cg.Controllers {
+		if m, ok := mounts.Controllers[c]; ok {
+			return m, nil
+		}
+	}
+	return CgroupMount{}, fmt.Errorf("no mount found for cgroup hierarchy %d: %w", cg.HierarchyID, ErrControllerNotMounted)
+}
+
+// cgroupFor returns the cgroup from cgroups which holds the files for the
+// given controller: the unified hierarchy on v2, or the hierarchy the
+// controller is bound to on v1.  It's an ErrControllerNotMounted error if
+// that hierarchy isn't mounted or cgroups has no cgroup in it.
+func (fs *FS) cgroupFor(cgroups []Cgroup, controller string) (Cgroup, error) {
+	version := fs.CgroupVersion()
+	for _, cg := range cgroups {
+		if version == CgroupV2 {
+			if cg.HierarchyID == 0 {
+				_, err := fs.cgroupMount(cg)
+				return cg, err
+			}
+			continue
+		}
+		for _, c := range cg.Controllers {
+			if c == controller {
+				_, err := fs.cgroupMount(cg)
+				return cg, err
+			}
+		}
+	}
+	return Cgroup{}, fmt.Errorf("no cgroup found for controller %q: %w", controller, ErrControllerNotMounted)
+}
+
+// cgroupDir returns the directory holding the files for cg, whose hierarchy
+// must be mounted, as checked by cgroupFor.
+func (fs *FS) cgroupDir(cg Cgroup) string {
+	m, _ := fs.cgroupMount(cg)
+	rel := cg.Path
+	if m.Root != "/" && (rel == m.Root || strings.HasPrefix(rel, m.Root+"/")) {
+		rel = strings.TrimPrefix(rel, m.Root)
+	}
+	return filepath.Join(m.Point, rel)
+}
+
+// parseKeyValues parses the flat keyed "key value" lines used by many cgroup
+// files.  Values that aren't numbers are ignored.
+func parseKeyValues(data []byte) map[string]uint64 {
+	kvs := make(map[string]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		kvs[fields[0]] = v
+	}
+	return kvs
+}
+
+// cgroupMountPointOf returns the mount point of the cgroup hierarchy dir is
+// in, or "" if it's in none, e.g. because the cgroup path had "..".  With
+// CgroupNoSymlinks, reads outside every mount are refused.
+func (fs *FS) cgroupMountPointOf(dir string) string {
+	mounts := fs.cgroupMounts()
+	points := make([]string, 0, len(mounts.Controllers)+1)
+	for _, m := range mounts.Controllers {
+		points = append(points, m.Point)
+	}
+	if mounts.Unified != nil {
+		points = append(points, mounts.Unified.Point)
+	}
+	root := ""
+	for _, p := range points {
+		if (dir == p || strings.HasPrefix(dir, p+"/")) && len(p) > len(root) {
+			root = p
+		}
+	}
+	return root
+}
+
+// cgroupBufMax is the capacity above which a buffer isn't returned to
+// cgroupBufPool, so that one large file doesn't pin its memory for good.
+const cgroupBufMax = 64 << 10
+
+// cgroupBufPool holds the buffers of readCgroupFilePooled.  Most cgroup files
+// are small, and thousands of them are read per scrape, so reusing buffers
+// saves allocating one per file.
+var cgroupBufPool = sync.Pool{
+	New: func() interface{} { return &cgroupBuf{data: make([]byte, 0, 512)} },
+}
+
+// cgroupBuf holds a cgroup file read by readCgroupFilePooled.
+type cgroupBuf struct {
+	data []byte
+}
+
+// bytes returns the contents of the file, or nil if b is nil because the file
+// doesn't exist.  They're only valid until release, so parsers must copy
+// whatever they keep, e.g. by converting it to a string.
+func (b *cgroupBuf) bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.data
+}
+
+// release returns b to the pool.  It's safe on a nil b; a buffer that's never
+// released is simply garbage collected.
+func (b *cgroupBuf) release() {
+	if b == nil || cap(b.data) > cgroupBufMax {
+		return
+	}
+	b.data = b.data[:0]
+	cgroupBufPool.Put(b)
+}
+
+// readCgroupFile reads the named file in dir.  With CgroupNoSymlinks, it's
+// read beneath the mount dir is under, see openFileBeneath.  A missing file
+// yields nil and no error, since which files exist depends on the kernel
+// version and which controllers are enabled.  Other errors, e.g. EACCES on a
+// hardened mount, are returned and counted rather than treated as a missing
+// file.  Readers that parse the contents right away should use
+// readCgroupFilePooled instead.
+func (fs *FS) readCgroupFile(dir, name string) ([]byte, error) {
+	data, found, err := fs.appendCgroupFile(nil, dir, name)
+	if !found {
+		return nil, err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
+
+// readCgroupFilePooled is readCgroupFile reading into a pooled buffer, which
+// the caller should release once done parsing it.  A missing file yields a
+// nil buffer.
+func (fs *FS) readCgroupFilePooled(dir, name string) (*cgroupBuf, error) {
+	buf := cgroupBufPool.Get().(*cgroupBuf)
+	data, found, err := fs.appendCgroupFile(buf.data[:0], dir, name)
+	buf.data = data
+	if !found {
+		buf.release()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// appendCgroupFile appends the named file in dir to buf, see readCgroupFile.
+// found is false if it doesn't exist or can't be read.
+func (fs *FS) appendCgroupFile(buf []byte, dir, name string) (data []byte, found bool, err error) {
+	if fs.cgroupReadFile != nil {
+		data, err = fs.cgroupReadFile(filepath.Join(dir, name))
+		data = append(buf, data...)
+	} else {
+		var f *os.File
+		if f, err = fs.openCgroupFile(dir, name); err == nil {
+			data, err = appendAll(buf, f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return buf, false, nil
+		}
+		fs.cgroupReadError(err)
+		return buf, false, err
+	}
+	return data, true, nil
+}
+
+// openCgroupFile opens the named file in dir, beneath the mount dir is under
+// with CgroupNoSymlinks.
+func (fs *FS) openCgroupFile(dir, name string) (*os.File, error) {
+	filename := filepath.Join(dir, name)
+	if !fs.CgroupNoSymlinks {
+		return os.Open(filename)
+	}
+	root := fs.cgroupMountPointOf(dir)
+	if root == "" {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: syscall.EXDEV}
+	}
+	rel, err := filepath.Rel(root, filename)
+	if err != nil {
+		return nil, err
+	}
+	return openFileBeneath(root, rel)
+}
+
+// appendAll appends everything read from r to buf.  Unlike ioutil.ReadAll, it
+// only allocates if buf is too small.
+func appendAll(buf []byte, r io.Reader) ([]byte, error) {
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			return buf, err
+		}
+	}
+}
+
+// cgroupErrorClass classifies the errno underlying err, if any.
+func cgroupErrorClass(err error) string {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EACCES, syscall.EPERM:
+			return CgroupErrPermission
+		case syscall.EIO:
+			return CgroupErrIO
+		case syscall.ENODEV, syscall.EOPNOTSUPP, syscall.EINVAL:
+			return CgroupErrUnsupported
+		}
+	}
+	return CgroupErrOther
+}
+
+// cgroupReadError counts err by class, logging the first error of each
+// class since errors such as EACCES usually affect every cgroup read.
+func (fs *FS) cgroupReadError(err error) {
+	fs.readError(err, ReadErrCgroup)
+	class := cgroupErrorClass(err)
+	fs.cgroupMu.Lock()
+	defer fs.cgroupMu.Unlock()
+	if fs.cgroupReadErrors == nil {
+		fs.cgroupReadErrors = make(map[string]uint64)
+	}
+	if fs.cgroupReadErrors[class] == 0 {
+		log.Printf("error reading cgroupfs, cgroup metrics may be missing: %v", err)
+	}
+	fs.cgroupReadErrors[class]++
+}
+
+// CgroupReadErrors returns how many times reading a cgroup file has failed,
+// by error class.  Missing files aren't errors.
+func (fs *FS) CgroupReadErrors() map[string]uint64 {
+	fs.cgroupMu.Lock()
+	defer fs.cgroupMu.Unlock()
+	errs := make(map[string]uint64, len(fs.cgroupReadErrors))
+	for class, n := range fs.cgroupReadErrors {
+		errs[class] = n
+	}
+	return errs
+}
+
+// readCgroupUint reads the named file in dir as a single number.  A missing
+// file yields 0.
+func (fs *FS) readCgroupUint(dir, name string) (uint64, error) {
+	buf, err := fs.readCgroupFilePooled(dir, name)
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil || data == nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	return v, nil
+}
+
+// readCgroupKeyValues reads the named flat keyed file in dir.  A missing
+// file yields an empty map.
+func (fs *FS) readCgroupKeyValues(dir, name string) (map[string]uint64, error) {
+	buf, err := fs.readCgroupFilePooled(dir, name)
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyValues(data), nil
+}
+
+// String returns the limit's value, or "max" if unlimited, or "unset".
+func (l CgroupLimit) String() string {
+	switch {
+	case !l.Set:
+		return "unset"
+	case l.Unlimited:
+		return "max"
+	}
+	return strconv.FormatUint(l.Value, 10)
+}
+
+// Bytes returns the limit as a number usable in arithmetic, e.g. as the
+// denominator of a ratio: math.MaxInt64 if unlimited, i.e. effectively
+// infinite, and 0 if unset.  Values beyond math.MaxInt64 are capped to it.
+func (l CgroupLimit) Bytes() int64 {
+	switch {
+	case !l.Set:
+		return 0
+	case l.Unlimited, l.Value > math.MaxInt64:
+		return math.MaxInt64
+	}
+	return int64(l.Value)
+}
+
+// parseCgroupLimit parses a limit value in either v1 or v2 form.
+func parseCgroupLimit(s string) (CgroupLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "max" || s == "-1" {
+		return CgroupLimit{Set: true, Unlimited: true}, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return CgroupLimit{}, err
+	}
+	if v >= cgroupV1Unlimited {
+		return CgroupLimit{Set: true, Unlimited: true}, nil
+	}
+	return CgroupLimit{Value: v, Set: true}, nil
+}
+
+// readCgroupLimit reads the named file in dir as a limit.  A missing file
+// yields an unset limit.
+func (fs *FS) readCgroupLimit(dir, name string) (CgroupLimit, error) {
+	buf, err := fs.readCgroupFilePooled(dir, name)
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil || data == nil {
+		return CgroupLimit{}, err
+	}
+	limit, err := parseCgroupLimit(string(data))
+	if err != nil {
+		return CgroupLimit{}, fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	return limit, nil
+}
+
+// CgroupMemoryInfo returns the memory usage of the memory cgroup among
+// cgroups, reading the v1 or v2 files depending on CgroupVersion.
+func (fs *FS) CgroupMemoryInfo(cgroups []Cgroup) (CgroupMemoryInfo, error) {
+	cg, err := fs.cgroupFor(cgroups, "memory")
+	if err != nil {
+		return CgroupMemoryInfo{}, err
+	}
+	dir := fs.cgroupDir(cg)
+
+	usageFile := "memory.usage_in_bytes"
+	anonKey, fileKey, inactiveFileKey := "total_rss", "total_cache", "total_inactive_file"
+	if fs.CgroupVersion() == CgroupV2 {
+		usageFile = "memory.current"
+		anonKey, fileKey, inactiveFileKey = "anon", "file", "inactive_file"
+	}
+
+	var mi CgroupMemoryInfo
+	if mi.Usage, err = fs.readCgroupUint(dir, usageFile); err != nil {
+		return CgroupMemoryInfo{}, err
+	}
+	if mi.Limit, err = fs.CgroupMemMax(cgroups); err != nil {
+		return CgroupMemoryInfo{}, err
+	}
+	stat, err := fs.readCgroupKeyValues(dir, "memory.stat")
+	if err != nil {
+		return CgroupMemoryInfo{}, err
+	}
+	mi.Anon, mi.File = stat[anonKey], stat[fileKey]
+	if inactive := stat[inactiveFileKey]; inactive < mi.Usage {
+		mi.WorkingSet = mi.Usage - inactive
+	}
+	if mi.Peak, _, err = fs.CgroupMemoryPeak(cgroups); err != nil {
+		return CgroupMemoryInfo{}, err
+	}
+	return mi, nil
+}
+
+// CgroupMemoryPeak returns the highest memory usage of the memory cgroup
+// among cgroups, read from memory.peak (v2) or memory.max_usage_in_bytes
+// (v1).  ok is false if there's no such file, e.g. in the root cgroup or on
+// v2 before Linux 5.19.
+func (fs *FS) CgroupMemoryPeak(cgroups []Cgroup) (peak uint64, ok bool, err error) {
+	cg, err := fs.cgroupFor(cgroups, "memory")
+	if err != nil {
+		return 0, false, err
+	}
+	peakFile := "memory.max_usage_in_bytes"
+	if fs.CgroupVersion() == CgroupV2 {
+		peakFile = "memory.peak"
+	}
+
+	buf, err := fs.readCgroupFilePooled(fs.cgroupDir(cg), peakFile)
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil || data == nil {
+		return 0, false, err
+	}
+	peak, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("error parsing %s: %v", peakFile, err)
+	}
+	return peak, true, nil
+}
+
+// ParseCgroupMemorySource returns the CgroupMemorySource named by s.
+func ParseCgroupMemorySource(s string) (CgroupMemorySource, error) {
+	switch src := CgroupMemorySource(s); src {
+	case CgroupMemoryCurrent, CgroupMemoryWorkingSet, CgroupMemoryLimit:
+		return src, nil
+	}
+	return "", fmt.Errorf("unknown cgroup memory source %q, want one of %q, %q or %q",
+		s, CgroupMemoryCurrent, CgroupMemoryWorkingSet, CgroupMemoryLimit)
+}
+
+// CgroupMemory returns the value selected by src of the memory cgroup among
+// cgroups, reading only the files needed for it.  ok is false if there's no
+// such value, e.g. no usage file in the root cgroup or no finite limit.
+func (fs *FS) CgroupMemory(cgroups []Cgroup, src CgroupMemorySource) (v uint64, ok bool, err error) {
+	if src == CgroupMemoryLimit {
+		limit, err := fs.CgroupMemMax(cgroups)
+		if err != nil || !limit.Set || limit.Unlimited {
+			return 0, false, err
+		}
+		return limit.Value, true, nil
+	}
+
+	cg, err := fs.cgroupFor(cgroups, "memory")
+	if err != nil {
+		return 0, false, err
+	}
+	dir := fs.cgroupDir(cg)
+	usageFile, inactiveFileKey := "memory.usage_in_bytes", "total_inactive_file"
+	if fs.CgroupVersion() == CgroupV2 {
+		usageFile, inactiveFileKey = "memory.current", "inactive_file"
+	}
+
+	buf, err := fs.readCgroupFilePooled(dir, usageFile)
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil || data == nil {
+		return 0, false, err
+	}
+	usage, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("error parsing %s: %v", usageFile, err)
+	}
+	if src == CgroupMemoryCurrent {
+		return usage, true, nil
+	}
+
+	stat, err := fs.readCgroupKeyValues(dir, "memory.stat")
+	if err != nil {
+		return 0, false, err
+	}
+	if inactive := stat[inactiveFileKey]; inactive < usage {
+		return usage - inactive, true, nil
+	}
+	return 0, true, nil
+}
+
+// CgroupsMemory returns the sum of the values selected by src of the distinct
+// memory cgroups among placements, e.g. those of the procs in a group.  ok is
+// false if no value was found.
+func (fs *FS) CgroupsMemory(placements [][]Cgroup, src CgroupMemorySource) (total uint64, ok bool, err error) {
+	seen := make(map[string]bool)
+	for _, cgroups := range placements {
+		cg, err := fs.cgroupFor(cgroups, "memory")
+		if err != nil {
+			return 0, false, err
+		}
+		dir := fs.cgroupDir(cg)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		v, vok, err := fs.CgroupMemory(cgroups, src)
+		if err != nil {
+			return 0, false, err
+		}
+		total += v
+		ok = ok || vok
+	}
+	return total, ok, nil
+}
+
+// CgroupSwapAccounting returns whether the kernel accounts swap per cgroup.
+// On v1 that's detected once, by the presence of memory.memsw.usage_in_bytes
+// at the root of the memory hierarchy, and cached.  On v2 it's taken to be
+// enabled; cgroups without memory.swap.current simply have no swap usage.
+func (fs *FS) CgroupSwapAccounting() (bool, error) {
+	if fs.CgroupVersion() == CgroupV2 {
+		return true, nil
+	}
+	mounts, err := fs.CgroupMountRoot(CgroupV1)
+	if err != nil {
+		return false, err
+	}
+	m, ok := mounts.Controllers["memory"]
+	if !ok {
+		return false, fmt.Errorf("no memory hierarchy: %w", ErrControllerNotMounted)
+	}
+
+	fs.cgroupMu.Lock()
+	defer fs.cgroupMu.Unlock()
+	if fs.swapAccounting != nil {
+		return *fs.swapAccounting, nil
+	}
+	_, err = os.Stat(filepath.Join(m.Point, "memory.memsw.usage_in_bytes"))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	enabled := err == nil
+	fs.swapAccounting = &enabled
+	return enabled, nil
+}
+
+// CgroupSwapUsage returns the swap usage in bytes of the memory cgroup among
+// cgroups, read from memory.swap.current (v2), or memory.memsw.usage_in_bytes
+// minus memory.usage_in_bytes (v1).  On v1 it returns
+// ErrSwapAccountingDisabled without reading the cgroup if swap isn't
+// accounted, see CgroupSwapAccounting.
+func (fs *FS) CgroupSwapUsage(cgroups []Cgroup) (uint64, error) {
+	enabled, err := fs.CgroupSwapAccounting()
+	if err != nil {
+		return 0, err
+	}
+	if !enabled {
+		return 0, ErrSwapAccountingDisabled
+	}
+	cg, err := fs.cgroupFor(cgroups, "memory")
+	if err != nil {
+		return 0, err
+	}
+	dir := fs.cgroupDir(cg)
+	if fs.CgroupVersion() == CgroupV2 {
+		return fs.readCgroupUint(dir, "memory.swap.current")
+	}
+
+	memsw, err := fs.readCgroupUint(dir, "memory.memsw.usage_in_bytes")
+	if err != nil {
+		return 0, err
+	}
+	usage, err := fs.readCgroupUint(dir, "memory.usage_in_bytes")
+	if err != nil || memsw <= usage {
+		return 0, err
+	}
+	return memsw - usage, nil
+}
+
+// CgroupSwapEvents returns the swap limit events of the memory cgroup among
+// cgroups, read from memory.swap.events.  Those the file doesn't have are
+// zero, as are all of them if it's missing, e.g. on v1 or without swap
+// accounting.
+func (fs *FS) CgroupSwapEvents(cgroups []Cgroup) (CgroupSwapEvents, error) {
+	cg, err := fs.cgroupFor(cgroups, "memory")
+	if err != nil {
+		return CgroupSwapEvents{}, err
+	}
+	if fs.CgroupVersion() != CgroupV2 {
+		return CgroupSwapEvents{}, nil
+	}
+	kvs, err := fs.readCgroupKeyValues(fs.cgroupDir(cg), "memory.swap.events")
+	if err != nil {
+		return CgroupSwapEvents{}, err
+	}
+	return swapEvents(kvs), nil
+}
+
+// swapEvents returns the swap events of the entries of memory.swap.events.
+func swapEvents(kvs map[string]uint64) CgroupSwapEvents {
+	return CgroupSwapEvents{High: kvs["high"], Max: kvs["max"], Fail: kvs["fail"]}
+}
+
+// CgroupMemoryReclaim returns the reclaim activity of the memory cgroup among
+// cgroups, read from memory.stat.  ok is false if the file doesn't have it,
+// e.g. on v1.
+func (fs *FS) CgroupMemoryReclaim(cgroups []Cgroup) (reclaim CgroupMemoryReclaim, ok bool, err error) {
+	cg, err := fs.cgroupFor(cgroups, "memory")
+	if err != nil {
+		return CgroupMemoryReclaim{}, false, err
+	}
+	return fs.readCgroupMemoryReclaim(fs.cgroupDir(cg))
+}
+
+// readCgroupMemoryReclaim reads the reclaim activity of the memory cgroup
+// dir, see CgroupMemoryReclaim.
+func (fs *FS) readCgroupMemoryReclaim(dir string) (CgroupMemoryReclaim, bool, error) {
+	if fs.CgroupVersion() != CgroupV2 {
+		return CgroupMemoryReclaim{}, false, nil
+	}
+	kvs, err := fs.readCgroupKeyValues(dir, "memory.stat")
+	if err != nil {
+		return CgroupMemoryReclaim{}, false, err
+	}
+	reclaim, ok := memoryReclaim(kvs)
+	return reclaim, ok, nil
+}
+
+// memoryReclaim returns the reclaim activity of the entries of memory.stat,
+// or false if they don't have it.
+func memoryReclaim(kvs map[string]uint64) (CgroupMemoryReclaim, bool) {
+	scan, ok := kvs["pgscan"]
+	steal, ok2 := kvs["pgsteal"]
+	return CgroupMemoryReclaim{PgScan: scan, PgSteal: steal}, ok && ok2
+}
+
+// CgroupNUMAStat returns the per-node memory of the memory cgroup among
+// cgroups, read from memory.numa_stat.  It's nil if the file is missing, e.g.
+// on v1 or on hosts without NUMA.  Since the file has a line per type with a
+// field per node, it's parsed as it's read rather than buffered.
+func (fs *FS) CgroupNUMAStat(cgroups []Cgroup) (CgroupNUMAStat, error) {
+	cg, err := fs.cgroupFor(cgroups, "memory")
+	if err != nil {
+		return nil, err
+	}
+	if fs.CgroupVersion() != CgroupV2 {
+		return nil, nil
+	}
+	dir := fs.cgroupDir(cg)
+	var r io.Reader
+	if fs.cgroupReadFile != nil {
+		var data []byte
+		data, err = fs.cgroupReadFile(filepath.Join(dir, "memory.numa_stat"))
+		r = bytes.NewReader(data)
+	} else {
+		var f *os.File
+		if f, err = fs.openCgroupFile(dir, "memory.numa_stat"); err == nil {
+			defer f.Close()
+			r = f
+		}
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		fs.cgroupReadError(err)
+		return nil, err
+	}
+	stat, err := parseNUMAStat(r)
+	if err != nil {
+		fs.cgroupReadError(err)
+		return nil, fmt.Errorf("error reading memory.numa_stat: %v", err)
+	}
+	return stat, nil
+}
+
+// parseNUMAStat parses memory.numa_stat, whose lines are a type followed by
+// N<node>=<bytes> fields, e.g. "anon N0=4096 N1=8192".  Lines in v1's form,
+// total=<pages> N0=<pages> ..., and fields that don't parse are skipped.
+func parseNUMAStat(r io.Reader) (CgroupNUMAStat, error) {
+	stat := make(CgroupNUMAStat)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.Contains(fields[0], "=") {
+			continue
+		}
+		for _, field := range fields[1:] {
+			eq := strings.IndexByte(field, '=')
+			if eq < 2 || field[0] != 'N' {
+				continue
+			}
+			node, err := strconv.Atoi(field[1:eq])
+			if err != nil {
+				continue
+			}
+			v, err := strconv.ParseUint(field[eq+1:], 10, 64)
+			if err != nil {
+				continue
+			}
+			if stat[node] == nil {
+				stat[node] = make(map[string]uint64)
+			}
+			stat[node][fields[0]] = v
+		}
+	}
+	return stat, scanner.Err()
+}
+
+// CgroupMemMax returns the effective memory limit of the memory cgroup
+// among cgroups.  See CgroupMemMaxWithSource.
+func (fs *FS) CgroupMemMax(cgroups []Cgroup) (CgroupLimit, error) {
+	mm, err := fs.CgroupMemMaxWithSource(cgroups)
+	return mm.Limit, err
+}
+
+// CgroupMemMaxBytes returns the effective memory limit of the memory cgroup
+// among cgroups in bytes, see CgroupLimit.Bytes: math.MaxInt64 if unlimited
+// and 0 if unset.
+func (fs *FS) CgroupMemMaxBytes(cgroups []Cgroup) (int64, error) {
+	limit, err := fs.CgroupMemMax(cgroups)
+	if err != nil {
+		return 0, err
+	}
+	return limit.Bytes(), nil
+}
+
+// memoryLimitCgroup returns the cgroup among cgroups holding the memory
+// limit, and the name of the file it's in.  On a hybrid host, where v1
+// hierarchies are mounted but the memory controller is bound to the unified
+// hierarchy instead, that's the unified cgroup's memory.max.
+func (fs *FS) memoryLimitCgroup(cgroups []Cgroup) (Cgroup, string, error) {
+	cg, err := fs.cgroupFor(cgroups, "memory")
+	if fs.CgroupVersion() == CgroupV2 {
+		return cg, "memory.max", err
+	}
+	if !errors.Is(err, ErrControllerNotMounted) {
+		return cg, "memory.limit_in_bytes", err
+	}
+	for _, ucg := range cgroups {
+		if ucg.HierarchyID != 0 {
+			continue
+		}
+		m, uerr := fs.cgroupMount(ucg)
+		if uerr != nil {
+			break
+		}
+		buf, uerr := fs.readCgroupFilePooled(m.Point, "cgroup.controllers")
+		controllers := strings.Fields(string(buf.bytes()))
+		buf.release()
+		if uerr != nil {
+			return Cgroup{}, "", uerr
+		}
+		for _, c := range controllers {
+			if c == "memory" {
+				return ucg, "memory.max", nil
+			}
+		}
+		break
+	}
+	return cg, "", err
+}
+
+// CgroupMemMaxWithSource returns the effective memory limit of the memory
+// cgroup among cgroups, and where it came from.  A cgroup is also bound by
+// the limits of its ancestors, e.g. a Kubernetes container by that of its pod,
+// so the cgroup hierarchy is walked up to the root looking for a lower limit.
+// This also covers cgroups the memory controller isn't delegated to, which
+// have no memory.max, so that their limit is that of the nearest enforcing
+// ancestor rather than none.
+func (fs *FS) CgroupMemMaxWithSource(cgroups []Cgroup) (CgroupMemLimit, error) {
+	cg, limitFile, err := fs.memoryLimitCgroup(cgroups)
+	if err != nil {
+		return CgroupMemLimit{}, err
+	}
+
+	var mm CgroupMemLimit
+	own := path.Clean(cg.Path)
+	undelegated, err := fs.cgroupControllerDisabled(fs.cgroupDir(cg), "memory")
+	if err != nil {
+		return CgroupMemLimit{}, err
+	}
+	for p := own; ; p = path.Dir(p) {
+		ancestor := cg
+		ancestor.Path = p
+		buf, err := fs.readCgroupFilePooled(fs.cgroupDir(ancestor), limitFile)
+		if err != nil {
+			return CgroupMemLimit{}, err
+		}
+		if data := buf.bytes(); data != nil {
+			limit, err := parseCgroupLimit(string(data))
+			if err != nil {
+				return CgroupMemLimit{}, fmt.Errorf("error parsing %s: %v", limitFile, err)
+			}
+			if !mm.Limit.Set || (mm.Limit.Unlimited && !limit.Unlimited) ||
+				(!limit.Unlimited && limit.Value < mm.Limit.Value) {
+				mm = CgroupMemLimit{
+					Limit:      limit,
+					Source:     p,
+					Inherited:  p != own,
+					Normalized: limit.Unlimited && strings.TrimSpace(string(data)) != "max",
+				}
+			}
+		}
+		buf.release()
+		if p == "/" || p == "." {
+			break
+		}
+	}
+	mm.Undelegated = undelegated
+	return mm, nil
+}
+
+// cgroupControllerDisabled returns true if the v2 cgroup dir has a
+// cgroup.controllers file which doesn't list controller, i.e. the
+// controller hasn't been delegated to it by its parent.  On v1, or if there's
+// no such file, it returns false.
+func (fs *FS) cgroupControllerDisabled(dir, controller string) (bool, error) {
+	if fs.CgroupVersion() != CgroupV2 {
+		return false, nil
+	}
+	buf, err := fs.readCgroupFilePooled(dir, "cgroup.controllers")
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil || data == nil {
+		return false, err
+	}
+	for _, c := range strings.Fields(string(data)) {
+		if c == controller {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// CgroupControllersEnabled returns the controllers that apply to pid, so
+// that callers can skip reading files of controllers that don't.  With cgroup
+// v1 they're those listed in /proc/<pid>/cgroup, other than named hierarchies
+// like name=systemd.  With v2 they're those listed in the cgroup.controllers
+// file of pid's cgroup.
+func (fs *FS) CgroupControllersEnabled(pid int) ([]string, error) {
+	cgroups, err := fs.Cgroups(pid)
+	if err != nil {
+		return nil, err
+	}
+	return fs.cgroupControllersEnabled(cgroups)
+}
+
+func (fs *FS) cgroupControllersEnabled(cgroups []Cgroup) ([]string, error) {
+	controllers := []string{}
+	if fs.CgroupVersion() == CgroupV2 {
+		cg, err := fs.cgroupFor(cgroups, "")
+		if err != nil {
+			return nil, err
+		}
+		buf, err := fs.readCgroupFilePooled(fs.cgroupDir(cg), "cgroup.controllers")
+		defer buf.release()
+		data := buf.bytes()
+		if err != nil {
+			return nil, err
+		}
+		return append(controllers, strings.Fields(string(data))...), nil
+	}
+
+	for _, cg := range cgroups {
+		for _, c := range cg.Controllers {
+			if !strings.HasPrefix(c, "name=") {
+				controllers = append(controllers, c)
+			}
+		}
+	}
+	return controllers, nil
+}
+
+// CgroupCPUInfo returns the CPU usage and bandwidth limits of the cpu cgroup
+// among cgroups, reading the v1 or v2 files depending on CgroupVersion.
+func (fs *FS) CgroupCPUInfo(cgroups []Cgroup) (CgroupCPUInfo, error) {
+	if fs.CgroupVersion() == CgroupV2 {
+		cg, err := fs.cgroupFor(cgroups, "cpu")
+		if err != nil {
+			return CgroupCPUInfo{}, err
+		}
+		return fs.readCgroupCPUInfoV2(fs.cgroupDir(cg))
+	}
+
+	cpuacct, err := fs.cgroupFor(cgroups, "cpuacct")
+	if err != nil {
+		return CgroupCPUInfo{}, err
+	}
+	cpu, err := fs.cgroupFor(cgroups, "cpu")
+	if err != nil {
+		return CgroupCPUInfo{}, err
+	}
+	return fs.readCgroupCPUInfoV1(fs.cgroupDir(cpuacct), fs.cgroupDir(cpu))
+}
+
+func (fs *FS) readCgroupCPUInfoV2(dir string) (CgroupCPUInfo, error) {
+	stat, err := fs.readCgroupKeyValues(dir, "cpu.stat")
+	if err != nil {
+		return CgroupCPUInfo{}, err
+	}
+	ci := CgroupCPUInfo{
+		UsageSeconds:     float64(stat["usage_usec"]) / 1e6,
+		UserSeconds:      float64(stat["user_usec"]) / 1e6,
+		SystemSeconds:    float64(stat["system_usec"]) / 1e6,
+		Periods:          stat["nr_periods"],
+		ThrottledPeriods: stat["nr_throttled"],
+		ThrottledSeconds: float64(stat["throttled_usec"]) / 1e6,
+	}
+
+	// cpu.max has the format "$MAX $PERIOD", where $MAX may be "max".
+	buf, err := fs.readCgroupFilePooled(dir, "cpu.max")
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil {
+		return CgroupCPUInfo{}, err
+	}
+	if fields := strings.Fields(string(data)); len(fields) == 2 {
+		if ci.Quota, err = parseCgroupLimit(fields[0]); err != nil {
+			return CgroupCPUInfo{}, fmt.Errorf("error parsing cpu.max: %v", err)
+		}
+		if ci.PeriodMicros, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return CgroupCPUInfo{}, fmt.Errorf("error parsing cpu.max: %v", err)
+		}
+	}
+	if ci.BurstMicros, err = fs.readCgroupUint(dir, "cpu.max.burst"); err != nil {
+		return CgroupCPUInfo{}, err
+	}
+	return ci, nil
+}
+
+func (fs *FS) readCgroupCPUInfoV1(cpuacctDir, cpuDir string) (CgroupCPUInfo, error) {
+	var ci CgroupCPUInfo
+	usage, err := fs.readCgroupUint(cpuacctDir, "cpuacct.usage")
+	if err != nil {
+		return CgroupCPUInfo{}, err
+	}
+	ci.UsageSeconds = float64(usage) / 1e9
+
+	// cpuacct.stat is in USER_HZ ticks.
+	acct, err := fs.readCgroupKeyValues(cpuacctDir, "cpuacct.stat")
+	if err != nil {
+		return CgroupCPUInfo{}, err
+	}
+	ci.UserSeconds = float64(acct["user"]) / userHZ
+	ci.SystemSeconds = float64(acct["system"]) / userHZ
+
+	if ci.Quota, err = fs.readCgroupLimit(cpuDir, "cpu.cfs_quota_us"); err != nil {
+		return CgroupCPUInfo{}, err
+	}
+	if ci.PeriodMicros, err = fs.readCgroupUint(cpuDir, "cpu.cfs_period_us"); err != nil {
+		return CgroupCPUInfo{}, err
+	}
+	if ci.BurstMicros, err = fs.readCgroupUint(cpuDir, "cpu.cfs_burst_us"); err != nil {
+		return CgroupCPUInfo{}, err
+	}
+
+	stat, err := fs.readCgroupKeyValues(cpuDir, "cpu.stat")
+	if err != nil {
+		return CgroupCPUInfo{}, err
+	}
+	ci.Periods = stat["nr_periods"]
+	ci.ThrottledPeriods = stat["nr_throttled"]
+	ci.ThrottledSeconds = float64(stat["throttled_time"]) / 1e9
+	return ci, nil
+}
+
+// parseCPUAcctPerCPU parses cpuacct.usage_percpu, the space-separated CPU
+// times in nanoseconds of each CPU in turn.
+func parseCPUAcctPerCPU(s string) ([]uint64, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	usage := make([]uint64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad usage %q for cpu %d", f, i)
+		}
+		usage[i] = v
+	}
+	return usage, nil
+}
+
+// CgroupCPUAcct returns the total and per-CPU usage of the cpuacct cgroup
+// among cgroups, the v1 counterpart of cpu.stat usage_usec.  cpuacct only
+// exists on v1, so on v2 the controller counts as not mounted.
+func (fs *FS) CgroupCPUAcct(cgroups []Cgroup) (CgroupCPUAcct, error) {
+	if fs.CgroupVersion() != CgroupV1 {
+		return CgroupCPUAcct{}, fmt.Errorf("cpuacct requires cgroup v1: %w", ErrControllerNotMounted)
+	}
+	cg, err := fs.cgroupFor(cgroups, "cpuacct")
+	if err != nil {
+		return CgroupCPUAcct{}, err
+	}
+	dir := fs.cgroupDir(cg)
+
+	var ca CgroupCPUAcct
+	if ca.UsageNanos, err = fs.readCgroupUint(dir, "cpuacct.usage"); err != nil {
+		return CgroupCPUAcct{}, err
+	}
+	buf, err := fs.readCgroupFilePooled(dir, "cpuacct.usage_percpu")
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil {
+		return CgroupCPUAcct{}, err
+	}
+	if ca.PerCPUNanos, err = parseCPUAcctPerCPU(string(data)); err != nil {
+		return CgroupCPUAcct{}, fmt.Errorf("error parsing cpuacct.usage_percpu: %v", err)
+	}
+	return ca, nil
+}
+
+// CgroupsCPUThrottling returns the throttling summed over the distinct cpu
+// cgroups among placements, e.g. those of the procs in a group, so that a
+// cgroup shared by many procs counts once.  It's read from cpu.stat
+// nr_throttled and throttled_usec (v2) or throttled_time (v1).  ok is false if
+// no cpu.stat was found.  The sum goes down when a cgroup leaves the
+// placements or is recreated; CPUThrottlingCounter accumulates it so that it
+// doesn't.
+func (fs *FS) CgroupsCPUThrottling(placements [][]Cgroup) (total CgroupCPUThrottling, ok bool, err error) {
+	seen := make(map[string]bool)
+	for _, cgroups := range placements {
+		cg, err := fs.cgroupFor(cgroups, "cpu")
+		if err != nil {
+			return CgroupCPUThrottling{}, false, err
+		}
+		dir := fs.cgroupDir(cg)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		counts, found, err := fs.readCgroupCPUThrottling(dir)
+		if err != nil {
+			return CgroupCPUThrottling{}, false, err
+		}
+		if !found {
+			continue
+		}
+		total.ThrottledPeriods += counts[0]
+		total.ThrottledSeconds += fs.cpuThrottledSeconds(counts[1])
+		ok = true
+	}
+	return total, ok, nil
+}
+
+// readCgroupCPUThrottling returns the throttled periods and time of the cpu
+// cgroup dir, the latter in the units of its cpu.stat, see
+// cpuThrottledSeconds, or false if it has no cpu.stat.
+func (fs *FS) readCgroupCPUThrottling(dir string) ([]uint64, bool, error) {
+	buf, err := fs.readCgroupFilePooled(dir, "cpu.stat")
+	if err != nil || buf == nil {
+		return nil, false, err
+	}
+	defer buf.release()
+	timeKey := "throttled_time"
+	if fs.CgroupVersion() == CgroupV2 {
+		timeKey = "throttled_usec"
+	}
+	stat := parseKeyValues(buf.bytes())
+	return []uint64{stat["nr_throttled"], stat[timeKey]}, true, nil
+}
+
+// cpuThrottledSeconds converts a throttled time read from cpu.stat, in
+// microseconds on v2 and nanoseconds on v1, to seconds.
+func (fs *FS) cpuThrottledSeconds(t uint64) float64 {
+	if fs.CgroupVersion() == CgroupV2 {
+		return float64(t) / 1e6
+	}
+	return float64(t) / 1e9
+}
+
+// maxCPUListID is the highest id parseCPUList accepts, well past the kernel's
+// limit on CPUs, so that a malformed list can't make it allocate without
+// bound.
+const maxCPUListID = 1<<16 - 1
+
+// lastCPU returns the highest id of a CPU the kernel may bring online, where
+// open-ended ranges end.  It's read once from /sys/devices/system/cpu/possible,
+// e.g. "0-63", falling back to the number of CPUs this proc may run on.
+var lastCPU = func() func() int {
+	var (
+		once sync.Once
+		last int
+	)
+	return func() int {
+		once.Do(func() {
+			last = runtime.NumCPU() - 1
+			data, err := ioutil.ReadFile("/sys/devices/system/cpu/possible")
+			if err != nil {
+				return
+			}
+			list := strings.TrimSpace(string(data))
+			if n, err := strconv.Atoi(list[strings.LastIndexAny(list, ",-")+1:]); err == nil && n <= maxCPUListID {
+				last = n
+			}
+		})
+		return last
+	}
+}()
+
+// parseCPUList parses a CPU or memory node list such as "0-3,8,10-11" into the
+// list of ids it contains, in the order given.  An open-ended range such as
+// "4-" runs to lastCPU.  An empty list yields nil.
+func parseCPUList(s string) ([]int, error) {
+	var ids []int
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("bad range %q in list %q", r, s)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if bounds[1] == "" {
+				last = lastCPU()
+			} else if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("bad range %q in list %q", r, s)
+			}
+			if last < first {
+				return nil, fmt.Errorf("bad range %q in list %q", r, s)
+			}
+		}
+		if last > maxCPUListID || len(ids)+last-first >= maxCPUListID+1 {
+			return nil, fmt.Errorf("range %q in list %q has more than %d ids", r, s, maxCPUListID+1)
+		}
+		for id := first; id <= last; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// readCgroupCPUList reads the named file in dir as a CPU or memory node list.
+// A missing file yields nil.
+func (fs *FS) readCgroupCPUList(dir, name string) ([]int, error) {
+	buf, err := fs.readCgroupFilePooled(dir, name)
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := parseCPUList(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	return ids, nil
+}
+
+// CgroupCpuset returns the configured and effective CPUs and memory nodes of
+// the cpuset cgroup among cgroups.
+func (fs *FS) CgroupCpuset(cgroups []Cgroup) (CgroupCpuset, error) {
+	cg, err := fs.cgroupFor(cgroups, "cpuset")
+	if err != nil {
+		return CgroupCpuset{}, err
+	}
+	dir := fs.cgroupDir(cg)
+
+	effectiveCPUsFile, effectiveMemsFile := "cpuset.effective_cpus", "cpuset.effective_mems"
+	if fs.CgroupVersion() == CgroupV2 {
+		effectiveCPUsFile, effectiveMemsFile = "cpuset.cpus.effective", "cpuset.mems.effective"
+	}
+
+	var cs CgroupCpuset
+	for _, f := range []struct {
+		name string
+		ids  *[]int
+	}{
+		{"cpuset.cpus", &cs.CPUs},
+		{effectiveCPUsFile, &cs.EffectiveCPUs},
+		{"cpuset.mems", &cs.Mems},
+		{effectiveMemsFile, &cs.EffectiveMems},
+	} {
+		if *f.ids, err = fs.readCgroupCPUList(dir, f.name); err != nil {
+			return CgroupCpuset{}, err
+		}
+	}
+	return cs, nil
+}
+
+// EffectiveCPUCount returns the number of CPUs the cgroup may run on, which is
+// what bounds how much CPU it can use.
+func (cs CgroupCpuset) EffectiveCPUCount() int {
+	return len(cs.EffectiveCPUs)
+}
+
+// CgroupMisc returns the resources of the misc cgroup among cgroups, read from
+// misc.current and misc.max, keyed by resource name.  A resource whose max is
+// "max" is unlimited; one missing from misc.max has an unset Max.
+func (fs *FS) CgroupMisc(cgroups []Cgroup) (map[string]CgroupMiscResource, error) {
+	cg, err := fs.cgroupFor(cgroups, "misc")
+	if err != nil {
+		return nil, err
+	}
+	dir := fs.cgroupDir(cg)
+
+	current, err := fs.readCgroupKeyValues(dir, "misc.current")
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]CgroupMiscResource, len(current))
+	for key, v := range current {
+		res[key] = CgroupMiscResource{Current: v}
+	}
+
+	buf, err := fs.readCgroupFilePooled(dir, "misc.max")
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		limit, err := parseCgroupLimit(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing misc.max: %v", err)
+		}
+		r := res[fields[0]]
+		r.Max = limit
+		res[fields[0]] = r
+	}
+	return res, scanner.Err()
+}
+
+// parseCgroupIOParams parses the lines of a v2 io controller file, each of
+// which is a device number followed by key=value pairs.
+func parseCgroupIOParams(data []byte) (CgroupIOParams, error) {
+	params := make(CgroupIOParams)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		dev := make(map[string]string, len(fields)-1)
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("malformed parameter %q for device %s", field, fields[0])
+			}
+			dev[kv[0]] = kv[1]
+		}
+		params[fields[0]] = dev
+	}
+	return params, scanner.Err()
+}
+
+// readCgroupIOParams reads the named io controller file in dir.  A missing
+// file yields nil.
+func (fs *FS) readCgroupIOParams(dir, name string) (CgroupIOParams, error) {
+	buf, err := fs.readCgroupFilePooled(dir, name)
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil || data == nil {
+		return nil, err
+	}
+	params, err := parseCgroupIOParams(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	return params, nil
+}
+
+// CgroupIOLatency returns the io.latency targets in microseconds of the io
+// cgroup among cgroups, keyed by device number.  A nil map means no target is
+// configured.  io.latency only exists on v2, so on v1 the io controller
+// counts as not mounted.
+func (fs *FS) CgroupIOLatency(cgroups []Cgroup) (map[string]uint64, error) {
+	if fs.CgroupVersion() != CgroupV2 {
+		return nil, fmt.Errorf("io.latency requires cgroup v2: %w", ErrControllerNotMounted)
+	}
+	cg, err := fs.cgroupFor(cgroups, "io")
+	if err != nil {
+		return nil, err
+	}
+	params, err := fs.readCgroupIOParams(fs.cgroupDir(cg), "io.latency")
+	if err != nil || params == nil {
+		return nil, err
+	}
+
+	targets := make(map[string]uint64, len(params))
+	for dev, p := range params {
+		target, ok := p["target"]
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseUint(target, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing io.latency target for device %s: %v", dev, err)
+		}
+		targets[dev] = v
+	}
+	return targets, nil
+}
+
+// CgroupIOCost returns the io.cost parameters, read from the v2 unified mount,
+// which must be the root cgroup for them to be found.  On v1 there are none,
+// and the io controller counts as not mounted.
+func (fs *FS) CgroupIOCost() (CgroupIOCost, error) {
+	if fs.CgroupVersion() != CgroupV2 {
+		return CgroupIOCost{}, fmt.Errorf("io.cost requires cgroup v2: %w", ErrControllerNotMounted)
+	}
+	mounts, err := fs.CgroupMountRoot(CgroupV2)
+	if err != nil {
+		return CgroupIOCost{}, err
+	}
+	dir := mounts.Unified.Point
+
+	var cost CgroupIOCost
+	if cost.QoS, err = fs.readCgroupIOParams(dir, "io.cost.qos"); err != nil {
+		return CgroupIOCost{}, err
+	}
+	if cost.Model, err = fs.readCgroupIOParams(dir, "io.cost.model"); err != nil {
+		return CgroupIOCost{}, err
+	}
+	return cost, nil
+}
+
+// readCgroupOOMKills reads the number of processes OOM-killed in the memory
+// cgroup dir, from the oom_kill field of memory.events (v2) or
+// memory.oom_control (v1).  ok is false if there's no such field, e.g. on
+// kernels older than 4.13.
+func (fs *FS) readCgroupOOMKills(dir string) (kills uint64, ok bool, err error) {
+	file := "memory.oom_control"
+	if fs.CgroupVersion() == CgroupV2 {
+		file = "memory.events"
+	}
+	kvs, err := fs.readCgroupKeyValues(dir, file)
+	if err != nil {
+		return 0, false, err
+	}
+	kills, ok = kvs["oom_kill"]
+	return kills, ok, nil
+}
+
+// CgroupMemOOMGroup returns whether the memory cgroup among cgroups is killed
+// as a whole when one of its procs is OOM-killed, read from memory.oom.group.
+// ok is false if there's no such file, e.g. on v1, in the root cgroup or
+// before Linux 4.19.
+func (fs *FS) CgroupMemOOMGroup(cgroups []Cgroup) (group bool, ok bool, err error) {
+	cg, err := fs.cgroupFor(cgroups, "memory")
+	if err != nil {
+		return false, false, err
+	}
+	if fs.CgroupVersion() != CgroupV2 {
+		return false, false, nil
+	}
+	return fs.readCgroupOOMGroup(fs.cgroupDir(cg))
+}
+
+// readCgroupOOMGroup reads memory.oom.group in the memory cgroup dir.
+func (fs *FS) readCgroupOOMGroup(dir string) (group bool, ok bool, err error) {
+	buf, err := fs.readCgroupFilePooled(dir, "memory.oom.group")
+	defer buf.release()
+	data := buf.bytes()
+	if err != nil || data == nil {
+		return false, false, err
+	}
+	switch s := strings.TrimSpace(string(data)); s {
+	case "0":
+		return false, true, nil
+	case "1":
+		return true, true, nil
+	default:
+		return false, false, fmt.Errorf("error parsing memory.oom.group: %q", s)
+	}
+}
+
+// CgroupPidsMax returns the limit on the number of tasks, i.e. threads, of the
+// pids cgroup among cgroups, read from pids.max.
+func (fs *FS) CgroupPidsMax(cgroups []Cgroup) (CgroupLimit, error) {
+	cg, err := fs.cgroupFor(cgroups, "pids")
+	if err != nil {
+		return CgroupLimit{}, err
+	}
+	return fs.readCgroupLimit(fs.cgroupDir(cg), "pids.max")
+}
+
+// CgroupReadFile returns the contents of the file at relpath in the cgroup
+// among cgroups holding the files for controller, e.g. memory.stat for
+// "memory", for files no other reader covers.  The cgroup is found as by the
+// other readers: the unified hierarchy on v2, or the hierarchy the controller
+// is bound to on v1, under CgroupMountPoint if set, and CgroupNoSymlinks
+// applies.  relpath may name a file in a child cgroup but mustn't leave the
+// cgroup.  Unlike the other readers, a missing file is an error, wrapping
+// os.ErrNotExist.
+func (fs *FS) CgroupReadFile(cgroups []Cgroup, controller, relpath string) ([]byte, error) {
+	clean := filepath.Clean(relpath)
+	if relpath == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return nil, fmt.Errorf("cgroup file %q isn't relative to the cgroup", relpath)
+	}
+	cg, err := fs.cgroupFor(cgroups, controller)
+	if err != nil {
+		return nil, err
+	}
+	dir := fs.cgroupDir(cg)
+	data, err := fs.readCgroupFile(dir, clean)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(dir, clean), os.ErrNotExist)
+	}
+	return data, nil
+}
+
+// CgroupsCount returns the number of distinct memory cgroups among
+// placements, e.g. those of the procs in a group.  No cgroupfs files are
+// read.
+func (fs *FS) CgroupsCount(placements [][]Cgroup) (int, error) {
+	seen := make(map[string]bool)
+	for _, cgroups := range placements {
+		cg, err := fs.cgroupFor(cgroups, "memory")
+		if err != nil {
+			return 0, err
+		}
+		seen[fs.cgroupDir(cg)] = true
+	}
+	return len(seen), nil
+}
+
+// CgroupsOOMGroup returns the number of the distinct memory cgroups among
+// placements, e.g. those of the procs in a group, that are killed as a whole
+// on OOM, see CgroupMemOOMGroup.  ok is false if none has memory.oom.group.
+func (fs *FS) CgroupsOOMGroup(placements [][]Cgroup) (n int, ok bool, err error) {
+	if fs.CgroupVersion() != CgroupV2 {
+		return 0, false, nil
+	}
+	seen := make(map[string]bool)
+	for _, cgroups := range placements {
+		cg, err := fs.cgroupFor(cgroups, "memory")
+		if err != nil {
+			return 0, false, err
+		}
+		dir := fs.cgroupDir(cg)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		group, found, err := fs.readCgroupOOMGroup(dir)
+		if err != nil {
+			return 0, false, err
+		}
+		if group {
+			n++
+		}
+		ok = ok || found
+	}
+	return n, ok, nil
+}
+
+// CgroupsPidsMax returns the sum of the pids limits of the distinct pids
+// cgroups among placements, e.g. those of the procs in a group.  ok is false
+// if none was found or any of them is unlimited.
+func (fs *FS) CgroupsPidsMax(placements [][]Cgroup) (total uint64, ok bool, err error) {
+	seen := make(map[string]bool)
+	for _, cgroups := range placements {
+		cg, err := fs.cgroupFor(cgroups, "pids")
+		if err != nil {
+			return 0, false, err
+		}
+		dir := fs.cgroupDir(cg)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		limit, err := fs.readCgroupLimit(dir, "pids.max")
+		if err != nil {
+			return 0, false, err
+		}
+		if !limit.Set || limit.Unlimited {
+			return 0, false, nil
+		}
+		total += limit.Value
+	}
+	return total, total > 0, nil
+}
+
+// CgroupsMemoryPressure returns the highest share of time, from 0 to 1, in
+// which some task was stalled on memory over the last 10 seconds, among the
+// distinct memory cgroups among placements.  ok is false if none has a
+// memory.pressure file, e.g. with v1 or a kernel without PSI.
+func (fs *FS) CgroupsMemoryPressure(placements [][]Cgroup) (ratio float64, ok bool, err error) {
+	if fs.CgroupVersion() != CgroupV2 {
+		return 0, false, nil
+	}
+	seen := make(map[string]bool)
+	for _, cgroups := range placements {
+		cg, err := fs.cgroupFor(cgroups, "memory")
+		if err != nil {
+			return 0, false, err
+		}
+		dir := fs.cgroupDir(cg)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		buf, err := fs.readCgroupFilePooled(dir, "memory.pressure")
+		if err != nil {
+			return 0, false, err
+		}
+		if buf == nil {
+			continue
+		}
+		p, err := parseCgroupPressure(buf.bytes())
+		buf.release()
+		if err != nil {
+			return 0, false, fmt.Errorf("error parsing memory.pressure: %v", err)
+		}
+		if r := p.Some.Avg10 / 100; !ok || r > ratio {
+			ratio = r
+		}
+		ok = true
+	}
+	return ratio, ok, nil
+}
+
+// cgroupDirFiles lists the files in dir.  A missing dir yields no files.
+func (fs *FS) cgroupDirFiles(dir string) (map[string]bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		fs.cgroupReadError(err)
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		fs.cgroupReadError(err)
+		return nil, err
+	}
+	files := make(map[string]bool, len(names))
+	for _, name := range names {
+		files[name] = true
+	}
+	return files, nil
+}
+
+// parseCgroupPressure parses a pressure stall information file.
+func parseCgroupPressure(data []byte) (CgroupPressure, error) {
+	var p CgroupPressure
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var stats *CgroupPressureStats
+		switch fields[0] {
+		case "some":
+			stats = &p.Some
+		case "full":
+			stats = &p.Full
+		default:
+			continue
+		}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return CgroupPressure{}, fmt.Errorf("malformed field %q", field)
+			}
+			var err error
+			switch kv[0] {
+			case "avg10":
+				stats.Avg10, err = strconv.ParseFloat(kv[1], 64)
+			case "avg60":
+				stats.Avg60, err = strconv.ParseFloat(kv[1], 64)
+			case "avg300":
+				stats.Avg300, err = strconv.ParseFloat(kv[1], 64)
+			case "total":
+				stats.TotalMicros, err = strconv.ParseUint(kv[1], 10, 64)
+			}
+			if err != nil {
+				return CgroupPressure{}, fmt.Errorf("malformed field %q: %v", field, err)
+			}
+		}
+	}
+	return p, scanner.Err()
+}
+
+// AllCgroupMetrics reads the memory, cpu and pids controller files and the
+// pressure stall information of the cgroups of pid in one go.  It's meant for
+// collectors: /proc/<pid>/cgroup is read and each cgroup dir resolved and
+// listed once, and only the files the listing shows are read, so controllers
+// that aren't enabled cost nothing.
+func (fs *FS) AllCgroupMetrics(pid int) (CgroupMetrics, error) {
+	cgroups, err := fs.Cgroups(pid)
+	if err != nil {
+		return CgroupMetrics{}, err
+	}
+	return fs.allCgroupMetrics(cgroups)
+}
+
+// CgroupMetricsForPIDs reads the cgroup metrics of each of pids as
+// AllCgroupMetrics does, for callers that already know the procs of interest
+// and so needn't list /proc.  The metrics of a cgroup are read once however
+// many of pids are in it, and the procs in it share the Memory, CPU, Pids and
+// Pressure of their results, which mustn't be modified.  Pids that don't
+// exist, e.g. because the proc has exited, are left out of the result rather
+// than being an error.
+func (fs *FS) CgroupMetricsForPIDs(pids []int) (map[int]CgroupMetrics, error) {
+	return fs.CgroupMetricsForPIDsParallel(pids, 1)
+}
+
+// CgroupMetricsForPIDsParallel is CgroupMetricsForPIDs reading the cgroups
+// of up to parallelism procs at a time, which pays off on hosts with many
+// procs since reading cgroupfs is mostly waiting on the kernel.  A cgroup
+// that several procs share is still read once.  If several procs can't be
+// read, the error is that of the first in pids.
+func (fs *FS) CgroupMetricsForPIDsParallel(pids []int, parallelism int) (map[int]CgroupMetrics, error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	type cgroupsMetrics struct {
+		once sync.Once
+		cm   CgroupMetrics
+		err  error
+	}
+	var mu sync.Mutex
+	byCgroups := make(map[string]*cgroupsMetrics)
+	read := func(pid int) (CgroupMetrics, bool, error) {
+		cgroups, err := fs.Cgroups(pid)
+		if err != nil {
+			if readErrorReason(err) == ReadErrVanished {
+				return CgroupMetrics{}, false, nil
+			}
+			return CgroupMetrics{}, false, fmt.Errorf("error reading cgroups of pid %d: %v", pid, err)
+		}
+		key := cgroupsKey(cgroups)
+		mu.Lock()
+		m, ok := byCgroups[key]
+		if !ok {
+			m = &cgroupsMetrics{}
+			byCgroups[key] = m
+		}
+		mu.Unlock()
+		m.once.Do(func() { m.cm, m.err = fs.allCgroupMetrics(cgroups) })
+		if m.err != nil {
+			return CgroupMetrics{}, false, fmt.Errorf("error reading cgroup metrics of pid %d: %v", pid, m.err)
+		}
+		cm := m.cm
+		cm.Cgroups = cgroups
+		return cm, true, nil
+	}
+
+	metrics := make([]CgroupMetrics, len(pids))
+	found := make([]bool, len(pids))
+	errs := make([]error, len(pids))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism && w < len(pids); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				metrics[i], found[i], errs[i] = read(pids[i])
+			}
+		}()
+	}
+	for i := range pids {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	result := make(map[int]CgroupMetrics, len(pids))
+	for i, pid := range pids {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if found[i] {
+			result[pid] = metrics[i]
+		}
+	}
+	return result, nil
+}
+
+// cgroupsKey returns a string that's the same for two placements if and only
+// if they put a proc in the same cgroups.
+func cgroupsKey(cgroups []Cgroup) string {
+	var sb strings.Builder
+	for _, cg := range cgroups {
+		fmt.Fprintf(&sb, "%d:%s:%s\n", cg.HierarchyID, strings.Join(cg.Controllers, ","), cg.Path)
+	}
+	return sb.String()
+}
+
+func (fs *FS) allCgroupMetrics(cgroups []Cgroup) (CgroupMetrics, error) {
+	if fs.CgroupVersion() == CgroupV2 {
+		return fs.allCgroupMetricsV2(cgroups)
+	}
+	return fs.allCgroupMetricsV1(cgroups)
+}
+
+func (fs *FS) allCgroupMetricsV2(cgroups []Cgroup) (CgroupMetrics, error) {
+	cm := CgroupMetrics{Cgroups: cgroups}
+	// All controllers share the unified hierarchy, so any will do.
+	cg, err := fs.cgroupFor(cgroups, "")
+	if err != nil {
+		return cm, err
+	}
+	dir := fs.cgroupDir(cg)
+	files, err := fs.cgroupDirFiles(dir)
+	if err != nil {
+		return cm, err
+	}
+
+	if files["memory.current"] {
+		var mem CgroupMemoryMetrics
+		if mem.Current, err = fs.readCgroupUint(dir, "memory.current"); err != nil {
+			return cm, err
+		}
+		for _, l := range []struct {
+			name  string
+			limit *CgroupLimit
+		}{{"memory.max", &mem.Max}, {"memory.high", &mem.High}, {"memory.swap.max", &mem.SwapMax}} {
+			if files[l.name] {
+				if *l.limit, err = fs.readCgroupLimit(dir, l.name); err != nil {
+					return cm, err
+				}
+			}
+		}
+		if files["memory.swap.current"] {
+			if mem.SwapCurrent, err = fs.readCgroupUint(dir, "memory.swap.current"); err != nil {
+				return cm, err
+			}
+		}
+		if files["memory.swap.events"] {
+			events, err := fs.readCgroupKeyValues(dir, "memory.swap.events")
+			if err != nil {
+				return cm, err
+			}
+			mem.SwapEvents = swapEvents(events)
+		}
+		if mem.Stat, err = fs.readCgroupKeyValues(dir, "memory.stat"); err != nil {
+			return cm, err
+		}
+		cm.Memory = &mem
+	}
+
+	if files["cpu.stat"] {
+		cpu, err := fs.readCgroupCPUInfoV2(dir)
+		if err != nil {
+			return cm, err
+		}
+		cm.CPU = &cpu
+	}
+
+	if files["pids.current"] {
+		var pids CgroupPidsMetrics
+		if pids.Current, err = fs.readCgroupUint(dir, "pids.current"); err != nil {
+			return cm, err
+		}
+		if pids.Max, err = fs.readCgroupLimit(dir, "pids.max"); err != nil {
+			return cm, err
+		}
+		cm.Pids = &pids
+	}
+
+	for _, resource := range []string{"cpu", "memory", "io"} {
+		name := resource + ".pressure"
+		if !files[name] {
+			continue
+		}
+		buf, err := fs.readCgroupFilePooled(dir, name)
+		if err != nil {
+			return cm, err
+		}
+		p, err := parseCgroupPressure(buf.bytes())
+		buf.release()
+		if err != nil {
+			return cm, fmt.Errorf("error parsing %s: %v", name, err)
+		}
+		if cm.Pressure == nil {
+			cm.Pressure = make(map[string]CgroupPressure)
+		}
+		cm.Pressure[resource] = p
+	}
+	return cm, nil
+}
+
+func (fs *FS) allCgroupMetricsV1(cgroups []Cgroup) (CgroupMetrics, error) {
+	cm := CgroupMetrics{Cgroups: cgroups}
+	if cg, err := fs.cgroupFor(cgroups, "memory"); err == nil {
+		dir := fs.cgroupDir(cg)
+		files, err := fs.cgroupDirFiles(dir)
+		if err != nil {
+			return cm, err
+		}
+		if files["memory.usage_in_bytes"] {
+			var mem CgroupMemoryMetrics
+			if mem.Current, err = fs.readCgroupUint(dir, "memory.usage_in_bytes"); err != nil {
+				return cm, err
+			}
+			if mem.Max, err = fs.readCgroupLimit(dir, "memory.limit_in_bytes"); err != nil {
+				return cm, err
+			}
+			if files["memory.memsw.usage_in_bytes"] {
+				memsw, err := fs.readCgroupUint(dir, "memory.memsw.usage_in_bytes")
+				if err != nil {
+					return cm, err
+				}
+				if memsw > mem.Current {
+					mem.SwapCurrent = memsw - mem.Current
+				}
+			}
+			if mem.Stat, err = fs.readCgroupKeyValues(dir, "memory.stat"); err != nil {
+				return cm, err
+			}
+			cm.Memory = &mem
+		}
+	}
+
+	cpuacct, err1 := fs.cgroupFor(cgroups, "cpuacct")
+	cpu, err2 := fs.cgroupFor(cgroups, "cpu")
+	if err1 == nil && err2 == nil {
+		ci, err := fs.readCgroupCPUInfoV1(fs.cgroupDir(cpuacct), fs.cgroupDir(cpu))
+		if err != nil {
+			return cm, err
+		}
+		cm.CPU = &ci
+	}
+
+	if cg, err := fs.cgroupFor(cgroups, "pids"); err == nil {
+		dir := fs.cgroupDir(cg)
+		files, err := fs.cgroupDirFiles(dir)
+		if err != nil {
+			return cm, err
+		}
+		if files["pids.current"] {
+			var pids CgroupPidsMetrics
+			if pids.Current, err = fs.readCgroupUint(dir, "pids.current"); err != nil {
+				return cm, err
+			}
+			if pids.Max, err = fs.readCgroupLimit(dir, "pids.max"); err != nil {
+				return cm, err
+			}
+			cm.Pids = &pids
+		}
+	}
+	return cm, nil
+}
+
+// CgroupStat reads cgroup.stat for the v2 cgroup cg.  A cgroup without a
+// cgroup.stat file, e.g. because the host uses cgroup v1, yields a zero
+// CgroupStat and no error.
+func (fs *FS) CgroupStat(cg Cgroup) (CgroupStat, error) {
+	if _, err := fs.cgroupMount(cg); err != nil {
+		return CgroupStat{}, nil
+	}
+	kvs, err := fs.readCgroupKeyValues(fs.cgroupDir(cg), "cgroup.stat")
+	if err != nil {
+		return CgroupStat{}, err
+	}
+
+	return CgroupStat{
+		NrDescendants:      kvs["nr_descendants"],
+		NrDyingDescendants: kvs["nr_dying_descendants"],
+	}, nil
+}
+
+// CgroupCreatedAt returns the modification time of the directory of cgroup
+// cg, which is set when the cgroup is created and only changes afterwards
+// when child cgroups are created or removed.  It approximates when the
+// workload in cg started, even if its processes have since exec'ed.  An error
+// is returned if the directory can't be stat'ed, e.g. because cg is gone.
+func (fs *FS) CgroupCreatedAt(cg Cgroup) (time.Time, error) {
+	if _, err := fs.cgroupMount(cg); err != nil {
+		return time.Time{}, err
+	}
+	fi, err := os.Stat(fs.cgroupDir(cg))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fs.cgroupReadError(err)
+		}
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+type (
+	// CgroupCheck is the result of SelfCgroupCheck and CgroupCheck.
+	CgroupCheck struct {
+		// Pid is the proc checked, 0 for process-exporter itself.
+		Pid         int                     `json:"pid,omitempty"`
+		Version     CgroupVersion           `json:"version"`
+		Cgroups     []Cgroup                `json:"cgroups"`
+		Controllers []CgroupControllerCheck `json:"controllers"`
+		// Error is set if the proc's cgroup file couldn't be read or parsed.
+		Error string `json:"error,omitempty"`
+	}
+
+	// CgroupControllerCheck describes what could be read for one controller.
+	CgroupControllerCheck struct {
+		Controller string `json:"controller"`
+		// Dir is the cgroupfs directory used for the controller, if any.
+		Dir string `json:"dir,omitempty"`
+		// Mounted is false if the controller's hierarchy isn't mounted or
+		// the proc isn't in it.
+		Mounted  bool   `json:"mounted"`
+		Readable bool   `json:"readable"`
+		Error    string `json:"error,omitempty"`
+		// Limits maps limit names to their values, as per CgroupLimit.String.
+		Limits map[string]string `json:"limits,omitempty"`
+		// Usage maps the names of the controller's key usage figures, e.g.
+		// current memory, to their values.
+		Usage map[string]string `json:"usage,omitempty"`
+	}
+)
+
+// SelfCgroupCheck parses the cgroup placement of the running process (i.e.
+// <MountPoint>/self/cgroup) and reports, for each controller we use, whether
+// its cgroup files could be read and which limits were found.  It's meant to
+// help diagnose why cgroup metrics are missing or zero, so problems are
+// recorded in the result rather than returned as errors.
+func (fs *FS) SelfCgroupCheck() CgroupCheck {
+	return fs.cgroupCheck(0, "self")
+}
+
+// CgroupCheck is SelfCgroupCheck for the proc with pid, e.g. to tell in a bug
+// report why its group lacks cgroup metrics.  It's ErrProcNotExist if there's
+// no such proc.
+func (fs *FS) CgroupCheck(pid int) (CgroupCheck, error) {
+	if _, err := os.Stat(filepath.Join(fs.MountPoint, strconv.Itoa(pid))); os.IsNotExist(err) {
+		return CgroupCheck{}, ErrProcNotExist
+	}
+	return fs.cgroupCheck(pid, strconv.Itoa(pid)), nil
+}
+
+// cgroupCheck checks the cgroups of the proc with pid, whose dir under
+// MountPoint is procdir, see SelfCgroupCheck.
+func (fs *FS) cgroupCheck(pid int, procdir string) CgroupCheck {
+	check := CgroupCheck{Pid: pid, Version: fs.CgroupVersion()}
+	cgroups, err := fs.readCgroups(procdir)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.Cgroups = cgroups
+
+	for _, c := range []struct {
+		controller string
+		read       func(cc *CgroupControllerCheck) error
+	}{
+		{"memory", func(cc *CgroupControllerCheck) error {
+			mem, err := fs.CgroupMemoryInfo(cgroups)
+			cc.Limits = map[string]string{"memory": mem.Limit.String()}
+			cc.Usage = map[string]string{"current": strconv.FormatUint(mem.Usage, 10)}
+			return err
+		}},
+		{"cpu", func(cc *CgroupControllerCheck) error {
+			cpu, err := fs.CgroupCPUInfo(cgroups)
+			cc.Limits = map[string]string{
+				"quota_us":  cpu.Quota.String(),
+				"period_us": strconv.FormatUint(cpu.PeriodMicros, 10),
+			}
+			cc.Usage = map[string]string{"usage_seconds": strconv.FormatFloat(cpu.UsageSeconds, 'g', -1, 64)}
+			return err
+		}},
+		{"cpuset", func(cc *CgroupControllerCheck) error {
+			cs, err := fs.CgroupCpuset(cgroups)
+			cc.Limits = map[string]string{"effective_cpus": strconv.Itoa(cs.EffectiveCPUCount())}
+			return err
+		}},
+		{"pids", func(cc *CgroupControllerCheck) error {
+			limit, err := fs.CgroupPidsMax(cgroups)
+			if err != nil {
+				return err
+			}
+			current, err := fs.readCgroupUint(cc.Dir, "pids.current")
+			cc.Limits = map[string]string{"max": limit.String()}
+			cc.Usage = map[string]string{"current": strconv.FormatUint(current, 10)}
+			return err
+		}},
+	} {
+		check.Controllers = append(check.Controllers,
+			fs.checkController(cgroups, c.controller, c.read))
+	}
+	return check
+}
+
+// checkController fills in a CgroupControllerCheck for controller using the
+// read func to read its limits and usage.
+func (fs *FS) checkController(cgroups []Cgroup, controller string, read func(cc *CgroupControllerCheck) error) CgroupControllerCheck {
+	cc := CgroupControllerCheck{Controller: controller}
+	cg, err := fs.cgroupFor(cgroups, controller)
+	if err != nil {
+		cc.Error = err.Error()
+		cc.Mounted = !errors.Is(err, ErrControllerNotMounted)
+		return cc
+	}
+	cc.Dir, cc.Mounted = fs.cgroupDir(cg), true
+	if _, err := os.Stat(cc.Dir); err != nil {
+		cc.Error = err.Error()
+		return cc
+	}
+	if err := read(&cc); err != nil {
+		cc.Error, cc.Limits, cc.Usage = err.Error(), nil, nil
+		return cc
+	}
+	cc.Readable = true
+	return cc
+}
@@ -0,0 +1,1630 @@
+package proc
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// cgroupfs returns an FS reading procs from the fixtures dir and cgroups
+// from the given fixture cgroupfs.
+func cgroupfs(t *testing.T, cgroupdir string) *FS {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	fs.CgroupMountPoint = "../fixtures/" + cgroupdir
+	return fs
+}
+
+var (
+	// cgroupsV1Fixture is the placement of a proc in the cgroupv1 fixture.
+	cgroupsV1Fixture = []Cgroup{
+		{HierarchyID: 4, Controllers: []string{"memory"}, Path: "/system.slice/process-exporter.service"},
+		{HierarchyID: 3, Controllers: []string{"cpu", "cpuacct"}, Path: "/system.slice/process-exporter.service"},
+		{HierarchyID: 2, Controllers: []string{"cpuset"}, Path: "/system.slice/process-exporter.service"},
+		{HierarchyID: 1, Controllers: []string{"name=systemd"}, Path: "/system.slice/process-exporter.service"},
+	}
+	// cgroupsV2Fixture is the placement of a proc in the cgroupv2 fixture.
+	cgroupsV2Fixture = []Cgroup{
+		{HierarchyID: 0, Path: "/system.slice/process-exporter.service"},
+	}
+)
+
+func TestCgroupsFixture(t *testing.T) {
+	fs := cgroupfs(t, "cgroupv2")
+	got, err := fs.Cgroups(14804)
+	noerr(t, err)
+	want := []Cgroup{{HierarchyID: 0, Path: "/system.slice/process-exporter.service"}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("cgroups differs: (-got +want)\n%s", diff)
+	}
+}
+
+func TestParseCgroups(t *testing.T) {
+	data := "12:cpu,cpuacct:/user.slice\n1:name=systemd:/user.slice/session-2.scope\n0::/user.slice/session-2.scope\n"
+	got, err := parseCgroups([]byte(data))
+	noerr(t, err)
+	want := []Cgroup{
+		{HierarchyID: 0, Path: "/user.slice/session-2.scope"},
+		{HierarchyID: 1, Controllers: []string{"name=systemd"}, Path: "/user.slice/session-2.scope"},
+		{HierarchyID: 12, Controllers: []string{"cpu", "cpuacct"}, Path: "/user.slice"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("cgroups differs: (-got +want)\n%s", diff)
+	}
+
+	if _, err := parseCgroups([]byte("12:cpu\n")); err == nil {
+		t.Errorf("expected error for line with too few fields")
+	}
+}
+
+// TestParseCgroupsOrder verifies that cgroups are sorted by hierarchy id
+// whatever order the lines come in.
+func TestParseCgroupsOrder(t *testing.T) {
+	lines := []string{"0::/init.scope", "1:name=systemd:/init.scope", "3:cpu,cpuacct:/", "4:memory:/", "12:pids:/init.scope"}
+	want, err := parseCgroups([]byte(strings.Join(lines, "\n")))
+	noerr(t, err)
+	for i := range want {
+		if want[i].HierarchyID != []int{0, 1, 3, 4, 12}[i] {
+			t.Fatalf("got hierarchy ids out of order: %+v", want)
+		}
+	}
+	for _, order := range [][]int{{4, 3, 2, 1, 0}, {2, 0, 4, 1, 3}, {1, 4, 0, 3, 2}} {
+		var shuffled []string
+		for _, i := range order {
+			shuffled = append(shuffled, lines[i])
+		}
+		got, err := parseCgroups([]byte(strings.Join(shuffled, "\n")))
+		noerr(t, err)
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("%v: cgroups differs: (-got +want)\n%s", order, diff)
+		}
+	}
+}
+
+// TestCgroupsPath verifies that the unified hierarchy's path is preferred,
+// then systemd's, and that it's read by GetStatic when asked.
+func TestCgroupsPath(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want string
+	}{
+		{"12:cpu,cpuacct:/user.slice\n1:name=systemd:/user.slice/session-2.scope\n0::/init.scope\n", "/init.scope"},
+		{"12:cpu,cpuacct:/user.slice\n1:name=systemd:/user.slice/session-2.scope\n", "/user.slice/session-2.scope"},
+		{"12:cpu,cpuacct:/user.slice\n", ""},
+		{"", ""},
+	} {
+		cgroups, err := parseCgroups([]byte(tc.data))
+		noerr(t, err)
+		if got := CgroupsPath(cgroups); got != tc.want {
+			t.Errorf("%q: got path %q, want %q", tc.data, got, tc.want)
+		}
+	}
+
+	fs := cgroupfs(t, "cgroupv2")
+	for _, gather := range []bool{false, true} {
+		fs.GatherCgroupPath = gather
+		procs := fs.AllProcs()
+		for procs.Next() {
+			static, err := procs.GetStatic()
+			noerr(t, err)
+			want := ""
+			if gather {
+				want = "/system.slice/process-exporter.service"
+			}
+			if static.CgroupPath != want {
+				t.Errorf("gather=%v: got cgroup path %q, want %q", gather, static.CgroupPath, want)
+			}
+		}
+		noerr(t, procs.Close())
+	}
+}
+
+// TestCgroupsByController verifies that a hierarchy with co-mounted
+// controllers is found under each of them, and the unified one under "".
+func TestCgroupsByController(t *testing.T) {
+	data := "12:cpu,cpuacct:/user.slice\n1:name=systemd:/user.slice/session-2.scope\n0::/user.slice/session-2.scope\n"
+	cgroups, err := parseCgroups([]byte(data))
+	noerr(t, err)
+	got := cgroupsByController(cgroups)
+	want := map[string]Cgroup{
+		"cpu":          {HierarchyID: 12, Controllers: []string{"cpu", "cpuacct"}, Path: "/user.slice"},
+		"cpuacct":      {HierarchyID: 12, Controllers: []string{"cpu", "cpuacct"}, Path: "/user.slice"},
+		"name=systemd": {HierarchyID: 1, Controllers: []string{"name=systemd"}, Path: "/user.slice/session-2.scope"},
+		"":             {HierarchyID: 0, Path: "/user.slice/session-2.scope"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("cgroups differs: (-got +want)\n%s", diff)
+	}
+
+	fs := cgroupfs(t, "cgroupv2")
+	got, err = fs.CgroupsByController(14804)
+	noerr(t, err)
+	want = map[string]Cgroup{"": {HierarchyID: 0, Path: "/system.slice/process-exporter.service"}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("fixture cgroups differs: (-got +want)\n%s", diff)
+	}
+}
+
+// TestParseCgroupsWhitespace verifies that trailing whitespace and CRLF line
+// endings are trimmed from each field.
+func TestParseCgroupsWhitespace(t *testing.T) {
+	data := "12:cpu,cpuacct :/user.slice  \r\n0::/user.slice/session-2.scope\r\n"
+	got, err := parseCgroups([]byte(data))
+	noerr(t, err)
+	want := []Cgroup{
+		{HierarchyID: 0, Path: "/user.slice/session-2.scope"},
+		{HierarchyID: 12, Controllers: []string{"cpu", "cpuacct"}, Path: "/user.slice"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("cgroups differs: (-got +want)\n%s", diff)
+	}
+}
+
+// TestCgroupFilter verifies that prefixes match whole subtrees and that a
+// proc matches if any of its cgroups does.
+func TestCgroupFilter(t *testing.T) {
+	filter := CgroupFilter{
+		Prefixes: []string{"/kubepods.slice/", "/system.slice/docker.service"},
+		Regexp:   regexp.MustCompile(`^/user\.slice/.*\.scope$`),
+	}
+	for _, tc := range []struct {
+		paths []string
+		want  bool
+	}{
+		{[]string{"/kubepods.slice"}, true},
+		{[]string{"/kubepods.slice/kubepods-pod1.slice/cri-ctr1.scope"}, true},
+		{[]string{"/kubepods.slice2"}, false},
+		{[]string{"/system.slice/docker.service"}, true},
+		{[]string{"/system.slice/docker.service.d"}, false},
+		{[]string{"/user.slice/user-1000.slice/session-2.scope"}, true},
+		{[]string{"/user.slice"}, false},
+		{[]string{"/", "/kubepods.slice/x"}, true},
+		{nil, false},
+	} {
+		var cgroups []Cgroup
+		for _, path := range tc.paths {
+			cgroups = append(cgroups, Cgroup{Path: path})
+		}
+		if got := filter.Match(cgroups); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.paths, got, tc.want)
+		}
+	}
+}
+
+func TestParseCgroupsEmpty(t *testing.T) {
+	for _, data := range []string{"", "\n"} {
+		got, err := parseCgroups([]byte(data))
+		noerr(t, err)
+		if got == nil || len(got) != 0 {
+			t.Errorf("parseCgroups(%q) = %#v, want empty slice", data, got)
+		}
+	}
+}
+
+func TestCgroupStat(t *testing.T) {
+	fs := cgroupfs(t, "cgroupv2")
+
+	tests := []struct {
+		cg   Cgroup
+		want CgroupStat
+	}{
+		{Cgroup{Path: "/"}, CgroupStat{NrDescendants: 127, NrDyingDescendants: 34}},
+		{Cgroup{Path: "/system.slice/process-exporter.service"}, CgroupStat{}},
+		// No cgroup.stat: zero value, no error.
+		{Cgroup{Path: "/nonexistent.slice"}, CgroupStat{}},
+	}
+	for i, tc := range tests {
+		got, err := fs.CgroupStat(tc.cg)
+		noerr(t, err)
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("%d: cgroup stat differs: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestCgroupMountRoot verifies that cgroup mounts are found from a mountinfo
+// with nonstandard mount points, a bind mount of part of a hierarchy, and a
+// hierarchy mounted twice.
+func TestCgroupMountRoot(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+
+	v1, err := fs.CgroupMountRoot(CgroupV1)
+	noerr(t, err)
+	want := CgroupMounts{Controllers: map[string]CgroupMount{
+		"name=systemd": {Point: "/cgroups/systemd", Root: "/"},
+		"cpu":          {Point: "/cgroups/cpu,cpuacct", Root: "/"},
+		"cpuacct":      {Point: "/cgroups/cpu,cpuacct", Root: "/"},
+		"memory":       {Point: "/mnt/memory cg", Root: "/docker/abc123"},
+		"cpuset":       {Point: "/cgroups/cpuset", Root: "/"},
+	}}
+	if diff := cmp.Diff(v1, want); diff != "" {
+		t.Errorf("v1 mounts differ: (-got +want)\n%s", diff)
+	}
+
+	v2, err := fs.CgroupMountRoot(CgroupV2)
+	noerr(t, err)
+	want = CgroupMounts{Unified: &CgroupMount{Point: "/cgroups/unified", Root: "/"}}
+	if diff := cmp.Diff(v2, want); diff != "" {
+		t.Errorf("v2 mounts differ: (-got +want)\n%s", diff)
+	}
+
+	// Hybrid hosts count as v1.
+	if v := fs.CgroupVersion(); v != CgroupV1 {
+		t.Errorf("got version %d, want %d", v, CgroupV1)
+	}
+
+	for _, tc := range []struct {
+		cg   Cgroup
+		want string
+	}{
+		{Cgroup{HierarchyID: 4, Controllers: []string{"memory"}, Path: "/docker/abc123"}, "/mnt/memory cg"},
+		{Cgroup{HierarchyID: 4, Controllers: []string{"memory"}, Path: "/docker/abc123/sub"}, "/mnt/memory cg/sub"},
+		{Cgroup{HierarchyID: 3, Controllers: []string{"cpu", "cpuacct"}, Path: "/user.slice"}, "/cgroups/cpu,cpuacct/user.slice"},
+		{Cgroup{HierarchyID: 0, Path: "/user.slice"}, "/cgroups/unified/user.slice"},
+	} {
+		if got := fs.cgroupDir(tc.cg); got != tc.want {
+			t.Errorf("%v: got dir %q, want %q", tc.cg, got, tc.want)
+		}
+	}
+
+	if _, err := cgroupfs(t, "cgroupv1").CgroupMountRoot(CgroupV2); err == nil {
+		t.Errorf("expected error for v2 mounts on v1 fixture")
+	}
+}
+
+func TestCgroupVersion(t *testing.T) {
+	if v := cgroupfs(t, "cgroupv1").CgroupVersion(); v != CgroupV1 {
+		t.Errorf("got version %d for cgroupv1, want %d", v, CgroupV1)
+	}
+	if v := cgroupfs(t, "cgroupv2").CgroupVersion(); v != CgroupV2 {
+		t.Errorf("got version %d for cgroupv2, want %d", v, CgroupV2)
+	}
+}
+
+// TestReadCgroupFilePooled verifies that pooled reads give the same contents
+// as plain ones, that a missing file gives no buffer, and that what's parsed
+// from a buffer doesn't change when the buffer is reused.
+func TestReadCgroupFilePooled(t *testing.T) {
+	fs := cgroupfs(t, "cgroupv2")
+	dir := fs.cgroupDir(cgroupsV2Fixture[0])
+	want, err := fs.readCgroupFile(dir, "memory.stat")
+	noerr(t, err)
+
+	buf, err := fs.readCgroupFilePooled(dir, "memory.stat")
+	noerr(t, err)
+	if diff := cmp.Diff(string(buf.bytes()), string(want)); diff != "" {
+		t.Errorf("memory.stat differs: (-got +want)\n%s", diff)
+	}
+	kvs := parseKeyValues(buf.bytes())
+	wantKVs := parseKeyValues(want)
+	for i := range buf.data {
+		buf.data[i] = '9'
+	}
+	buf.release()
+	if diff := cmp.Diff(kvs, wantKVs); diff != "" {
+		t.Errorf("parsed memory.stat changed with its buffer: (-got +want)\n%s", diff)
+	}
+
+	buf, err = fs.readCgroupFilePooled(dir, "memory.missing")
+	noerr(t, err)
+	if buf != nil {
+		t.Errorf("got buffer %q for a missing file, want nil", buf.bytes())
+	}
+	buf.release()
+}
+
+// TestCgroupReadFile verifies that arbitrary files are read from the cgroup
+// for the controller on either version, and that paths leaving the cgroup
+// and missing files are errors.
+func TestCgroupReadFile(t *testing.T) {
+	for _, tc := range []struct {
+		dir     string
+		cgroups []Cgroup
+		file    string
+		want    string
+	}{
+		{"cgroupv1", cgroupsV1Fixture, "memory.numa_stat", "total=2560 N0=2560\n"},
+		{"cgroupv2", cgroupsV2Fixture, "memory.events.local", "low 0\n"},
+	} {
+		fs := cgroupfs(t, tc.dir)
+		data, err := fs.CgroupReadFile(tc.cgroups, "memory", tc.file)
+		noerr(t, err)
+		if !strings.HasPrefix(string(data), tc.want) {
+			t.Errorf("%s: got %q, want it to start with %q", tc.dir, data, tc.want)
+		}
+
+		if _, err := fs.CgroupReadFile(tc.cgroups, "memory", "memory.nonexistent"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: got error %v for missing file, want one wrapping os.ErrNotExist", tc.dir, err)
+		}
+		for _, bad := range []string{"", "../memory.stat", "/memory.stat", "a/../../memory.stat"} {
+			if _, err := fs.CgroupReadFile(tc.cgroups, "memory", bad); err == nil {
+				t.Errorf("%s: expected error reading %q", tc.dir, bad)
+			}
+		}
+	}
+
+	// On v1 the file is looked for in the controller's own hierarchy.
+	fs := cgroupfs(t, "cgroupv1")
+	if _, err := fs.CgroupReadFile(cgroupsV1Fixture, "cpu", "memory.numa_stat"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v reading a memory file for cpu, want one wrapping os.ErrNotExist", err)
+	}
+	if _, err := fs.CgroupReadFile(cgroupsV1Fixture, "pids", "pids.max"); !errors.Is(err, ErrControllerNotMounted) {
+		t.Errorf("got error %v for unmounted controller, want ErrControllerNotMounted", err)
+	}
+}
+
+// TestCgroupUnifiedInfo verifies that equivalent v1 and v2 fixtures yield
+// identical version-independent memory and CPU info.
+func TestCgroupUnifiedInfo(t *testing.T) {
+	wantmem := CgroupMemoryInfo{
+		Usage:      104857600,
+		WorkingSet: 83886080,
+		Anon:       62914560,
+		File:       41943040,
+		Limit:      CgroupLimit{Value: 536870912, Set: true},
+		Peak:       157286400,
+	}
+	wantcpu := CgroupCPUInfo{
+		UsageSeconds:     2.5,
+		UserSeconds:      2,
+		SystemSeconds:    0.5,
+		Quota:            CgroupLimit{Value: 50000, Set: true},
+		PeriodMicros:     100000,
+		BurstMicros:      20000,
+		Periods:          100,
+		ThrottledPeriods: 10,
+		ThrottledSeconds: 1.5,
+	}
+
+	for _, tc := range []struct {
+		dir     string
+		cgroups []Cgroup
+	}{
+		{"cgroupv1", cgroupsV1Fixture},
+		{"cgroupv2", cgroupsV2Fixture},
+	} {
+		fs := cgroupfs(t, tc.dir)
+		mem, err := fs.CgroupMemoryInfo(tc.cgroups)
+		noerr(t, err)
+		if diff := cmp.Diff(mem, wantmem); diff != "" {
+			t.Errorf("%s: memory info differs: (-got +want)\n%s", tc.dir, diff)
+		}
+		cpu, err := fs.CgroupCPUInfo(tc.cgroups)
+		noerr(t, err)
+		if diff := cmp.Diff(cpu, wantcpu); diff != "" {
+			t.Errorf("%s: cpu info differs: (-got +want)\n%s", tc.dir, diff)
+		}
+	}
+}
+
+func TestParseCgroupLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want CgroupLimit
+	}{
+		{"max\n", CgroupLimit{Set: true, Unlimited: true}},
+		{"-1", CgroupLimit{Set: true, Unlimited: true}},
+		{"9223372036854771712", CgroupLimit{Set: true, Unlimited: true}},
+		{"536870912\n", CgroupLimit{Value: 536870912, Set: true}},
+	}
+	for i, tc := range tests {
+		got, err := parseCgroupLimit(tc.in)
+		noerr(t, err)
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("%d: limit differs: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestCgroupMemMaxBytes verifies that limits that are a value, unlimited and
+// unset are bytes, math.MaxInt64 and 0 respectively.
+func TestCgroupMemMaxBytes(t *testing.T) {
+	for _, tc := range []struct {
+		dir     string
+		cgroups []Cgroup
+		want    int64
+	}{
+		{"cgroupv2", cgroupsV2Fixture, 536870912},
+		{"cgroupv1", []Cgroup{{HierarchyID: 4, Controllers: []string{"memory"}, Path: "/user.slice"}}, math.MaxInt64},
+		{"cgroupv2", []Cgroup{{Path: "/user.slice"}}, 0},
+	} {
+		got, err := cgroupfs(t, tc.dir).CgroupMemMaxBytes(tc.cgroups)
+		noerr(t, err)
+		if got != tc.want {
+			t.Errorf("%s %s: got %d bytes, want %d", tc.dir, tc.cgroups[0].Path, got, tc.want)
+		}
+	}
+
+	if got := (CgroupLimit{Value: math.MaxUint64, Set: true}).Bytes(); got != math.MaxInt64 {
+		t.Errorf("got %d bytes for a limit beyond math.MaxInt64, want math.MaxInt64", got)
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+	}{
+		{"", nil},
+		{"\n", nil},
+		{"5", []int{5}},
+		{"0-3", []int{0, 1, 2, 3}},
+		{"0-1,4,8-9\n", []int{0, 1, 4, 8, 9}},
+		{"2-2", []int{2}},
+		{"2-", []int{2, 3}},
+		{"0,2-", []int{0, 2, 3}},
+		{"3-", []int{3}},
+	}
+	defer func(f func() int) { lastCPU = f }(lastCPU)
+	lastCPU = func() int { return 3 }
+	for i, tc := range tests {
+		got, err := parseCPUList(tc.in)
+		noerr(t, err)
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("%d: cpu list differs: (-got +want)\n%s", i, diff)
+		}
+	}
+
+	for _, bad := range []string{"a", "3-1", "4-", "-1", "1,,2", "0-4294967295", "65536", "0-65535,0-65535"} {
+		if _, err := parseCPUList(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+// TestCgroupCpuset verifies that the effective cpuset is reported separately
+// from the configured one, e.g. when half the CPUs have been taken offline.
+func TestCgroupCpuset(t *testing.T) {
+	for _, tc := range []struct {
+		dir     string
+		cgroups []Cgroup
+		want    CgroupCpuset
+	}{
+		{"cgroupv1", cgroupsV1Fixture, CgroupCpuset{
+			CPUs:          []int{0, 1, 2, 3, 4, 5, 6, 7},
+			EffectiveCPUs: []int{0, 1, 2, 3},
+			Mems:          []int{0},
+			EffectiveMems: []int{0},
+		}},
+		{"cgroupv2", cgroupsV2Fixture, CgroupCpuset{
+			CPUs:          []int{0, 1, 2, 3, 4, 5, 6, 7},
+			EffectiveCPUs: []int{0, 1, 2, 3},
+			EffectiveMems: []int{0},
+		}},
+	} {
+		got, err := cgroupfs(t, tc.dir).CgroupCpuset(tc.cgroups)
+		noerr(t, err)
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("%s: cpuset differs: (-got +want)\n%s", tc.dir, diff)
+		}
+		if n := got.EffectiveCPUCount(); n != 4 {
+			t.Errorf("%s: got %d effective cpus, want 4", tc.dir, n)
+		}
+	}
+}
+
+func TestCgroupCPUAcct(t *testing.T) {
+	got, err := cgroupfs(t, "cgroupv1").CgroupCPUAcct(cgroupsV1Fixture)
+	noerr(t, err)
+	want := CgroupCPUAcct{
+		UsageNanos:  2500000000,
+		PerCPUNanos: []uint64{1000000000, 750000000, 500000000, 250000000},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("cpuacct differs: (-got +want)\n%s", diff)
+	}
+
+	if _, err := cgroupfs(t, "cgroupv2").CgroupCPUAcct(cgroupsV2Fixture); !errors.Is(err, ErrControllerNotMounted) {
+		t.Errorf("got error %v on v2, want ErrControllerNotMounted", err)
+	}
+	if _, err := parseCPUAcctPerCPU("100 x 300"); err == nil {
+		t.Errorf("expected error for malformed usage_percpu")
+	}
+}
+
+func TestSelfCgroupCheck(t *testing.T) {
+	dir := "../fixtures/cgroupv2/system.slice/process-exporter.service"
+	want := CgroupCheck{
+		Version: CgroupV2,
+		Cgroups: cgroupsV2Fixture,
+		Controllers: []CgroupControllerCheck{
+			{Controller: "memory", Dir: dir, Mounted: true, Readable: true,
+				Limits: map[string]string{"memory": "536870912"},
+				Usage:  map[string]string{"current": "104857600"}},
+			{Controller: "cpu", Dir: dir, Mounted: true, Readable: true,
+				Limits: map[string]string{"quota_us": "50000", "period_us": "100000"},
+				Usage:  map[string]string{"usage_seconds": "2.5"}},
+			{Controller: "cpuset", Dir: dir, Mounted: true, Readable: true,
+				Limits: map[string]string{"effective_cpus": "4"}},
+			{Controller: "pids", Dir: dir, Mounted: true, Readable: true,
+				Limits: map[string]string{"max": "4096"},
+				Usage:  map[string]string{"current": "12"}},
+		},
+	}
+	got := cgroupfs(t, "cgroupv2").SelfCgroupCheck()
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("self check differs: (-got +want)\n%s", diff)
+	}
+
+	// The fixture's placement is v2-only, so on a v1 host no controller is
+	// found, and each is reported unmounted rather than failing the check.
+	got = cgroupfs(t, "cgroupv1").SelfCgroupCheck()
+	if got.Error != "" || len(got.Controllers) != 4 {
+		t.Fatalf("unexpected v1 self check: %+v", got)
+	}
+	for _, cc := range got.Controllers {
+		if cc.Mounted || cc.Readable || cc.Error == "" {
+			t.Errorf("controller %s: want unmounted with error, got %+v", cc.Controller, cc)
+		}
+	}
+
+	fs := cgroupfs(t, "cgroupv2")
+	fs.MountPoint = "../fixtures/nonexistent"
+	if got := fs.SelfCgroupCheck(); got.Error == "" {
+		t.Errorf("want error for missing self cgroup file, got %+v", got)
+	}
+}
+
+// TestCgroupCheck verifies that a proc's cgroups are checked as our own are,
+// and that a missing proc is an error rather than a failed check.
+func TestCgroupCheck(t *testing.T) {
+	fs := cgroupfs(t, "cgroupv2")
+	got, err := fs.CgroupCheck(14804)
+	noerr(t, err)
+	want := fs.SelfCgroupCheck()
+	want.Pid = 14804
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("check differs: (-got +want)\n%s", diff)
+	}
+
+	if _, err := fs.CgroupCheck(99999); err != ErrProcNotExist {
+		t.Errorf("got error %v for missing proc, want ErrProcNotExist", err)
+	}
+}
+
+// TestCgroupReadErrors verifies that errors other than a missing file are
+// returned rather than yielding zero values, and counted by class.
+func TestCgroupReadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class string
+	}{
+		{syscall.EACCES, CgroupErrPermission},
+		{syscall.EPERM, CgroupErrPermission},
+		{syscall.EIO, CgroupErrIO},
+		{syscall.ENODEV, CgroupErrUnsupported},
+		{syscall.EBUSY, CgroupErrOther},
+		{fmt.Errorf("not an errno"), CgroupErrOther},
+	} {
+		fs := cgroupfs(t, "cgroupv2")
+		fs.cgroupReadFile = func(filename string) ([]byte, error) {
+			return nil, &os.PathError{Op: "open", Path: filename, Err: tc.err}
+		}
+		if _, err := fs.CgroupMemoryInfo(cgroupsV2Fixture); err == nil {
+			t.Errorf("%v: expected error reading memory info", tc.err)
+		}
+		if _, err := fs.CgroupMemoryInfo(cgroupsV2Fixture); err == nil {
+			t.Errorf("%v: expected error reading memory info", tc.err)
+		}
+		want := map[string]uint64{tc.class: 2}
+		if diff := cmp.Diff(fs.CgroupReadErrors(), want); diff != "" {
+			t.Errorf("%v: read errors differ: (-got +want)\n%s", tc.err, diff)
+		}
+	}
+
+	// Missing files aren't errors.
+	fs := cgroupfs(t, "cgroupv2")
+	fs.cgroupReadFile = func(filename string) ([]byte, error) {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: syscall.ENOENT}
+	}
+	mem, err := fs.CgroupMemoryInfo(cgroupsV2Fixture)
+	noerr(t, err)
+	if diff := cmp.Diff(mem, CgroupMemoryInfo{}); diff != "" {
+		t.Errorf("memory info differs: (-got +want)\n%s", diff)
+	}
+	if errs := fs.CgroupReadErrors(); len(errs) != 0 {
+		t.Errorf("got read errors %v for missing files, want none", errs)
+	}
+}
+
+// TestCgroupMemMaxWithSource verifies that a container without a limit of
+// its own reports the limit inherited from its pod, on both v1 and v2.
+func TestCgroupMemMaxWithSource(t *testing.T) {
+	for _, tc := range []struct {
+		dir     string
+		cgroups []Cgroup
+		want    CgroupMemLimit
+	}{
+		{"cgroupv2", []Cgroup{{Path: "/kubepods.slice/kubepods-pod1.slice/cri-ctr1.scope"}},
+			CgroupMemLimit{Limit: CgroupLimit{Value: 1073741824, Set: true},
+				Source: "/kubepods.slice/kubepods-pod1.slice", Inherited: true}},
+		// The memory controller isn't delegated to the container, so its
+		// pod enforces the limit.
+		{"cgroupv2", []Cgroup{{Path: "/kubepods.slice/kubepods-pod2.slice/cri-ctr2.scope"}},
+			CgroupMemLimit{Limit: CgroupLimit{Value: 2147483648, Set: true},
+				Source: "/kubepods.slice/kubepods-pod2.slice", Inherited: true, Undelegated: true}},
+		{"cgroupv1", []Cgroup{{HierarchyID: 4, Controllers: []string{"memory"}, Path: "/kubepods/pod1/ctr1"}},
+			CgroupMemLimit{Limit: CgroupLimit{Value: 1073741824, Set: true},
+				Source: "/kubepods/pod1", Inherited: true}},
+		{"cgroupv2", cgroupsV2Fixture,
+			CgroupMemLimit{Limit: CgroupLimit{Value: 536870912, Set: true},
+				Source: "/system.slice/process-exporter.service"}},
+		// Only the root's sentinel "no limit" value is found.
+		{"cgroupv1", []Cgroup{{HierarchyID: 4, Controllers: []string{"memory"}, Path: "/user.slice"}},
+			CgroupMemLimit{Limit: CgroupLimit{Set: true, Unlimited: true},
+				Source: "/", Inherited: true, Normalized: true}},
+		// No limit file at all.
+		{"cgroupv2", []Cgroup{{Path: "/user.slice"}}, CgroupMemLimit{}},
+	} {
+		fs := cgroupfs(t, tc.dir)
+		got, err := fs.CgroupMemMaxWithSource(tc.cgroups)
+		noerr(t, err)
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("%s %s: limit differs: (-got +want)\n%s", tc.dir, tc.cgroups[0].Path, diff)
+		}
+		limit, err := fs.CgroupMemMax(tc.cgroups)
+		noerr(t, err)
+		if limit != tc.want.Limit {
+			t.Errorf("%s %s: got limit %v, want %v", tc.dir, tc.cgroups[0].Path, limit, tc.want.Limit)
+		}
+		mem, err := fs.CgroupMemoryInfo(tc.cgroups)
+		noerr(t, err)
+		if mem.Limit != tc.want.Limit {
+			t.Errorf("%s %s: got memory info limit %v, want %v", tc.dir, tc.cgroups[0].Path, mem.Limit, tc.want.Limit)
+		}
+	}
+}
+
+// TestCgroupMemMaxHybrid verifies that on a hybrid host whose memory
+// controller is bound to the unified hierarchy rather than a v1 one, the limit
+// is read from the unified cgroup's memory.max.
+func TestCgroupMemMaxHybrid(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroupfs")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	for _, dir := range []string{"cpu,cpuacct/svc", "unified/svc"} {
+		noerr(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	noerr(t, ioutil.WriteFile(filepath.Join(root, "unified/svc/memory.max"), []byte("1000\n"), 0644))
+	cgroups := []Cgroup{
+		{HierarchyID: 3, Controllers: []string{"cpu", "cpuacct"}, Path: "/svc"},
+		{Path: "/svc"},
+	}
+
+	for _, tc := range []struct {
+		controllers string
+		want        CgroupLimit
+		wantErr     bool
+	}{
+		{"cpu memory pids\n", CgroupLimit{Value: 1000, Set: true}, false},
+		// Nor is the memory controller in the unified hierarchy.
+		{"pids\n", CgroupLimit{}, true},
+	} {
+		noerr(t, ioutil.WriteFile(filepath.Join(root, "unified/cgroup.controllers"), []byte(tc.controllers), 0644))
+		fs, err := NewFS("../fixtures", false)
+		noerr(t, err)
+		fs.CgroupMountPoint = root
+		if fs.CgroupVersion() != CgroupV1 {
+			t.Fatalf("got cgroup version %v, want v1", fs.CgroupVersion())
+		}
+		limit, err := fs.CgroupMemMax(cgroups)
+		if tc.wantErr {
+			if !errors.Is(err, ErrControllerNotMounted) {
+				t.Errorf("%q: got error %v, want ErrControllerNotMounted", tc.controllers, err)
+			}
+			continue
+		}
+		noerr(t, err)
+		if limit != tc.want {
+			t.Errorf("%q: got limit %v, want %v", tc.controllers, limit, tc.want)
+		}
+	}
+}
+
+// TestCgroupMemoryPeak verifies that the peak is read from either version's
+// file, and that a cgroup without one has none.
+func TestCgroupMemoryPeak(t *testing.T) {
+	for _, tc := range []struct {
+		dir     string
+		cgroups []Cgroup
+		want    uint64
+		wantOK  bool
+	}{
+		{"cgroupv1", cgroupsV1Fixture, 157286400, true},
+		{"cgroupv2", cgroupsV2Fixture, 157286400, true},
+		{"cgroupv2", []Cgroup{{Path: "/user.slice"}}, 0, false},
+	} {
+		peak, ok, err := cgroupfs(t, tc.dir).CgroupMemoryPeak(tc.cgroups)
+		noerr(t, err)
+		if peak != tc.want || ok != tc.wantOK {
+			t.Errorf("%s %s: got peak %d (ok=%v), want %d (ok=%v)",
+				tc.dir, tc.cgroups[0].Path, peak, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestCgroupMisc(t *testing.T) {
+	got, err := cgroupfs(t, "cgroupv2").CgroupMisc(cgroupsV2Fixture)
+	noerr(t, err)
+	want := map[string]CgroupMiscResource{
+		"sev":    {Current: 3, Max: CgroupLimit{Value: 16, Set: true}},
+		"sev_es": {Current: 1, Max: CgroupLimit{Set: true, Unlimited: true}},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("misc differs: (-got +want)\n%s", diff)
+	}
+
+	// No misc files: no resources.
+	got, err = cgroupfs(t, "cgroupv2").CgroupMisc([]Cgroup{{Path: "/user.slice"}})
+	noerr(t, err)
+	if len(got) != 0 {
+		t.Errorf("got misc resources %v, want none", got)
+	}
+}
+
+// TestCgroupMemorySource verifies that each source reads only the files it
+// needs, and yields the expected value.
+func TestCgroupMemorySource(t *testing.T) {
+	for _, tc := range []struct {
+		src   string
+		files []string
+		want  uint64
+	}{
+		{"current", []string{"memory.current"}, 104857600},
+		{"working_set", []string{"memory.current", "memory.stat"}, 83886080},
+		{"limit", []string{"cgroup.controllers", "memory.max"}, 536870912},
+	} {
+		src, err := ParseCgroupMemorySource(tc.src)
+		noerr(t, err)
+
+		fs := cgroupfs(t, "cgroupv2")
+		read := make(map[string]bool)
+		fs.cgroupReadFile = func(filename string) ([]byte, error) {
+			read[filepath.Base(filename)] = true
+			return ioutil.ReadFile(filename)
+		}
+		got, ok, err := fs.CgroupMemory(cgroupsV2Fixture, src)
+		noerr(t, err)
+		if !ok || got != tc.want {
+			t.Errorf("%s: got %d (ok=%v), want %d", tc.src, got, ok, tc.want)
+		}
+		var files []string
+		for f := range read {
+			files = append(files, f)
+		}
+		sort.Strings(files)
+		if diff := cmp.Diff(files, tc.files); diff != "" {
+			t.Errorf("%s: files read differ: (-got +want)\n%s", tc.src, diff)
+		}
+	}
+
+	if _, err := ParseCgroupMemorySource("rss"); err == nil {
+		t.Errorf("expected error parsing unknown source")
+	}
+}
+
+// TestCgroupsMemory verifies that procs sharing a cgroup contribute its
+// memory only once.
+func TestCgroupsMemory(t *testing.T) {
+	fs := cgroupfs(t, "cgroupv2")
+	got, ok, err := fs.CgroupsMemory([][]Cgroup{cgroupsV2Fixture, cgroupsV2Fixture,
+		{{Path: "/kubepods.slice/kubepods-pod1.slice/cri-ctr1.scope"}}}, CgroupMemoryCurrent)
+	noerr(t, err)
+	if !ok || got != 104857600 {
+		t.Errorf("got %d (ok=%v), want 104857600", got, ok)
+	}
+
+	// No usage file: no value.
+	_, ok, err = fs.CgroupsMemory([][]Cgroup{{{Path: "/user.slice"}}}, CgroupMemoryCurrent)
+	noerr(t, err)
+	if ok {
+		t.Errorf("got value for cgroup without usage file")
+	}
+}
+
+// TestCgroupsPidsMax verifies that the pids limits of distinct cgroups are
+// summed, and that an unlimited or missing limit yields no value.
+func TestCgroupsPidsMax(t *testing.T) {
+	fs := cgroupfs(t, "cgroupv2")
+	limit, err := fs.CgroupPidsMax(cgroupsV2Fixture)
+	noerr(t, err)
+	if want := (CgroupLimit{Value: 4096, Set: true}); limit != want {
+		t.Errorf("got limit %v, want %v", limit, want)
+	}
+
+	ctr := []Cgroup{{Path: "/kubepods.slice/kubepods-pod1.slice/cri-ctr1.scope"}}
+	got, ok, err := fs.CgroupsPidsMax([][]Cgroup{cgroupsV2Fixture, cgroupsV2Fixture, ctr})
+	noerr(t, err)
+	if !ok || got != 5120 {
+		t.Errorf("got %d (ok=%v), want 5120", got, ok)
+	}
+
+	// No pids.max: no value.
+	_, ok, err = fs.CgroupsPidsMax([][]Cgroup{cgroupsV2Fixture, {{Path: "/user.slice"}}})
+	noerr(t, err)
+	if ok {
+		t.Errorf("got value for cgroup without pids.max")
+	}
+}
+
+// TestCgroupsCPUThrottling verifies that ten procs sharing one throttled
+// cgroup count its throttling once, including on v1 where their placements
+// differ in other hierarchies.
+func TestCgroupsCPUThrottling(t *testing.T) {
+	want := CgroupCPUThrottling{ThrottledPeriods: 10, ThrottledSeconds: 1.5}
+
+	var v2 [][]Cgroup
+	for i := 0; i < 10; i++ {
+		v2 = append(v2, cgroupsV2Fixture)
+	}
+	got, ok, err := cgroupfs(t, "cgroupv2").CgroupsCPUThrottling(v2)
+	noerr(t, err)
+	if !ok || got != want {
+		t.Errorf("v2: got %+v (ok=%v), want %+v", got, ok, want)
+	}
+
+	var v1 [][]Cgroup
+	for i := 0; i < 10; i++ {
+		cgroups := append([]Cgroup(nil), cgroupsV1Fixture...)
+		cgroups[0] = Cgroup{HierarchyID: 4, Controllers: []string{"memory"},
+			Path: fmt.Sprintf("/system.slice/process-exporter.service/%d", i)}
+		v1 = append(v1, cgroups)
+	}
+	got, ok, err = cgroupfs(t, "cgroupv1").CgroupsCPUThrottling(v1)
+	noerr(t, err)
+	if !ok || got != want {
+		t.Errorf("v1: got %+v (ok=%v), want %+v", got, ok, want)
+	}
+
+	// No cpu.stat: no value.
+	_, ok, err = cgroupfs(t, "cgroupv2").CgroupsCPUThrottling([][]Cgroup{{{Path: "/user.slice"}}})
+	noerr(t, err)
+	if ok {
+		t.Errorf("got value for cgroup without cpu.stat")
+	}
+}
+
+func TestCgroupIOLatency(t *testing.T) {
+	fs := cgroupfs(t, "cgroupv2")
+	got, err := fs.CgroupIOLatency(cgroupsV2Fixture)
+	noerr(t, err)
+	want := map[string]uint64{"8:0": 75000, "259:0": 10000}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("io.latency differs: (-got +want)\n%s", diff)
+	}
+
+	// No io.latency: not configured.
+	got, err = fs.CgroupIOLatency([]Cgroup{{Path: "/user.slice"}})
+	noerr(t, err)
+	if got != nil {
+		t.Errorf("got %v for cgroup without io.latency, want nil", got)
+	}
+
+	// Not available on v1.
+	got, err = cgroupfs(t, "cgroupv1").CgroupIOLatency(cgroupsV1Fixture)
+	if !errors.Is(err, ErrControllerNotMounted) || got != nil {
+		t.Errorf("got %v, %v on v1, want nil, ErrControllerNotMounted", got, err)
+	}
+
+	if _, err := parseCgroupIOParams([]byte("8:0 target\n")); err == nil {
+		t.Errorf("expected error for parameter without value")
+	}
+}
+
+func TestCgroupIOCost(t *testing.T) {
+	got, err := cgroupfs(t, "cgroupv2").CgroupIOCost()
+	noerr(t, err)
+	want := CgroupIOCost{
+		QoS: CgroupIOParams{"8:0": {"enable": "1", "ctrl": "auto", "rpct": "95.00", "rlat": "10000",
+			"wpct": "95.00", "wlat": "20000", "min": "50.00", "max": "150.00"}},
+		Model: CgroupIOParams{"8:0": {"ctrl": "auto", "model": "linear", "rbps": "174019176",
+			"rseqiops": "41708", "rrandiops": "370", "wbps": "178075866", "wseqiops": "42705",
+			"wrandiops": "378"}},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("io.cost differs: (-got +want)\n%s", diff)
+	}
+}
+
+// TestCgroupSwapAccounting verifies that swap accounting is detected from the
+// v1 memory hierarchy's root, and that swap usage isn't read without it.
+func TestCgroupSwapAccounting(t *testing.T) {
+	// The v1 fixture has no memsw files, as without swapaccount=1.
+	v1 := cgroupfs(t, "cgroupv1")
+	enabled, err := v1.CgroupSwapAccounting()
+	noerr(t, err)
+	if enabled {
+		t.Errorf("got swap accounting enabled for fixture without memsw files")
+	}
+	if _, err := v1.CgroupSwapUsage(cgroupsV1Fixture); !errors.Is(err, ErrSwapAccountingDisabled) {
+		t.Errorf("got error %v, want ErrSwapAccountingDisabled", err)
+	}
+
+	root, err := ioutil.TempDir("", "memsw")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "memory", "system.slice", "process-exporter.service")
+	noerr(t, os.MkdirAll(dir, 0755))
+	for path, v := range map[string]string{
+		filepath.Join(root, "memory", "memory.memsw.usage_in_bytes"): "0",
+		filepath.Join(dir, "memory.usage_in_bytes"):                  "104857600",
+		filepath.Join(dir, "memory.memsw.usage_in_bytes"):            "109051904",
+	} {
+		noerr(t, ioutil.WriteFile(path, []byte(v+"\n"), 0644))
+	}
+	fs := cgroupfs(t, "cgroupv1")
+	fs.CgroupMountPoint = root
+	enabled, err = fs.CgroupSwapAccounting()
+	noerr(t, err)
+	if !enabled {
+		t.Errorf("got swap accounting disabled with memsw files")
+	}
+	swap, err := fs.CgroupSwapUsage(cgroupsV1Fixture)
+	noerr(t, err)
+	if swap != 4194304 {
+		t.Errorf("got v1 swap %d, want 4194304", swap)
+	}
+
+	// The result is cached, as the kernel's boot options can't change.
+	noerr(t, os.Remove(filepath.Join(root, "memory", "memory.memsw.usage_in_bytes")))
+	if enabled, err := fs.CgroupSwapAccounting(); err != nil || !enabled {
+		t.Errorf("got %v, %v after removing memsw, want cached true", enabled, err)
+	}
+
+	swap, err = cgroupfs(t, "cgroupv2").CgroupSwapUsage(cgroupsV2Fixture)
+	noerr(t, err)
+	if swap != 4194304 {
+		t.Errorf("got v2 swap %d, want 4194304", swap)
+	}
+}
+
+// TestCgroupSwapEvents verifies that swap events are read on v2, and are zero
+// without memory.swap.events, as on v1.
+func TestCgroupSwapEvents(t *testing.T) {
+	got, err := cgroupfs(t, "cgroupv2").CgroupSwapEvents(cgroupsV2Fixture)
+	noerr(t, err)
+	if diff := cmp.Diff(got, CgroupSwapEvents{Max: 3, Fail: 5}); diff != "" {
+		t.Errorf("v2 swap events differ: (-got +want)\n%s", diff)
+	}
+
+	got, err = cgroupfs(t, "cgroupv1").CgroupSwapEvents(cgroupsV1Fixture)
+	noerr(t, err)
+	if got != (CgroupSwapEvents{}) {
+		t.Errorf("got v1 swap events %+v, want none", got)
+	}
+
+	got, err = cgroupfs(t, "cgroupv2").CgroupSwapEvents([]Cgroup{{Path: "/system.slice"}})
+	noerr(t, err)
+	if got != (CgroupSwapEvents{}) {
+		t.Errorf("got swap events %+v without memory.swap.events, want none", got)
+	}
+}
+
+// TestCgroupMemoryReclaim verifies that pgscan and pgsteal are read from a v2
+// memory.stat, and that there are none on v1 or without them.
+func TestCgroupMemoryReclaim(t *testing.T) {
+	got, ok, err := cgroupfs(t, "cgroupv2").CgroupMemoryReclaim(cgroupsV2Fixture)
+	noerr(t, err)
+	if diff := cmp.Diff(got, CgroupMemoryReclaim{PgScan: 48213, PgSteal: 45120}); !ok || diff != "" {
+		t.Errorf("v2 reclaim differs (ok=%v): (-got +want)\n%s", ok, diff)
+	}
+
+	_, ok, err = cgroupfs(t, "cgroupv1").CgroupMemoryReclaim(cgroupsV1Fixture)
+	noerr(t, err)
+	if ok {
+		t.Errorf("got v1 reclaim, want none")
+	}
+
+	if _, ok := memoryReclaim(map[string]uint64{"anon": 1, "pgscan": 2}); ok {
+		t.Errorf("got reclaim without pgsteal, want none")
+	}
+}
+
+// TestCgroupMemOOMGroup verifies that memory.oom.group is read as a flag,
+// and that a group's cgroups with it set are counted once each.
+func TestCgroupMemOOMGroup(t *testing.T) {
+	fs := cgroupfs(t, "cgroupv2")
+	ctr := []Cgroup{{Path: "/kubepods.slice/kubepods-pod1.slice/cri-ctr1.scope"}}
+	for _, tc := range []struct {
+		cgroups []Cgroup
+		want    bool
+		wantOK  bool
+	}{
+		{cgroupsV2Fixture, true, true},
+		{ctr, false, true},
+		{[]Cgroup{{Path: "/user.slice"}}, false, false},
+	} {
+		group, ok, err := fs.CgroupMemOOMGroup(tc.cgroups)
+		noerr(t, err)
+		if group != tc.want || ok != tc.wantOK {
+			t.Errorf("%s: got group %v (ok=%v), want %v (ok=%v)",
+				tc.cgroups[0].Path, group, ok, tc.want, tc.wantOK)
+		}
+	}
+
+	_, ok, err := cgroupfs(t, "cgroupv1").CgroupMemOOMGroup(cgroupsV1Fixture)
+	noerr(t, err)
+	if ok {
+		t.Errorf("got oom group flag on v1")
+	}
+
+	n, ok, err := fs.CgroupsOOMGroup([][]Cgroup{cgroupsV2Fixture, cgroupsV2Fixture, ctr})
+	noerr(t, err)
+	if n != 1 || !ok {
+		t.Errorf("got %d cgroups with oom group (ok=%v), want 1", n, ok)
+	}
+	_, ok, err = fs.CgroupsOOMGroup([][]Cgroup{{{Path: "/user.slice"}}})
+	noerr(t, err)
+	if ok {
+		t.Errorf("got oom group count without memory.oom.group")
+	}
+}
+
+// TestCgroupNUMAStat verifies that memory.numa_stat is broken down by node
+// and type, and that it's nil when missing or on v1.
+func TestCgroupNUMAStat(t *testing.T) {
+	got, err := cgroupfs(t, "cgroupv2").CgroupNUMAStat(cgroupsV2Fixture)
+	noerr(t, err)
+	if len(got) != 2 || len(got[0]) != 19 || len(got[1]) != 19 {
+		t.Errorf("got %d nodes with %d and %d types, want 2 with 19 each", len(got), len(got[0]), len(got[1]))
+	}
+	for _, tc := range []struct {
+		node int
+		typ  string
+		want uint64
+	}{
+		{0, "anon", 2437120},
+		{1, "anon", 1048576},
+		{0, "file", 8192000},
+		{1, "file", 0},
+		{1, "slab_unreclaimable", 32768},
+	} {
+		if v := got[tc.node][tc.typ]; v != tc.want {
+			t.Errorf("node %d %s: got %d, want %d", tc.node, tc.typ, v, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		fs      *FS
+		cgroups []Cgroup
+	}{
+		{"v1", cgroupfs(t, "cgroupv1"), cgroupsV1Fixture},
+		{"missing", cgroupfs(t, "cgroupv2"), []Cgroup{{Path: "/system.slice"}}},
+	} {
+		got, err := tc.fs.CgroupNUMAStat(tc.cgroups)
+		noerr(t, err)
+		if got != nil {
+			t.Errorf("%s: got numa stat %v, want none", tc.name, got)
+		}
+	}
+}
+
+// TestParseNUMAStat verifies that v1's lines and fields other than
+// N<node>=<value> are skipped.
+func TestParseNUMAStat(t *testing.T) {
+	got, err := parseNUMAStat(strings.NewReader("total=10 N0=6 N1=4\nanon N0=4096 N1=bad Nx=1 =2\n\n"))
+	noerr(t, err)
+	want := CgroupNUMAStat{0: {"anon": 4096}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("numa stat differs: (-got +want)\n%s", diff)
+	}
+}
+
+// TestErrControllerNotMounted verifies that readers return
+// ErrControllerNotMounted, distinct from a zero value, when the controller's
+// hierarchy isn't mounted or the proc isn't placed in it, and that it can be
+// ignored to get the zero value.
+func TestErrControllerNotMounted(t *testing.T) {
+	v1, v2 := cgroupfs(t, "cgroupv1"), cgroupfs(t, "cgroupv2")
+	for _, tc := range []struct {
+		name string
+		read func() error
+	}{
+		{"v2 memory of v1 placement", func() error {
+			_, err := v2.CgroupMemoryInfo(cgroupsV1Fixture)
+			return err
+		}},
+		{"v1 cpu of v2 placement", func() error {
+			_, err := v1.CgroupCPUInfo(cgroupsV2Fixture)
+			return err
+		}},
+		{"v1 pids of v2 placement", func() error {
+			_, err := v1.CgroupPidsMax(cgroupsV2Fixture)
+			return err
+		}},
+		{"v2 memory of group", func() error {
+			_, _, err := v2.CgroupsMemory([][]Cgroup{cgroupsV1Fixture}, CgroupMemoryCurrent)
+			return err
+		}},
+		{"v1 io.cost", func() error {
+			_, err := v1.CgroupIOCost()
+			return err
+		}},
+	} {
+		err := tc.read()
+		if !errors.Is(err, ErrControllerNotMounted) {
+			t.Errorf("%s: got error %v, want ErrControllerNotMounted", tc.name, err)
+		}
+		if err := IgnoreControllerNotMounted(err); err != nil {
+			t.Errorf("%s: got error %v after ignoring ErrControllerNotMounted", tc.name, err)
+		}
+	}
+
+	// A mounted controller reads fine, and other errors aren't ignored.
+	_, err := v2.CgroupMemoryInfo(cgroupsV2Fixture)
+	noerr(t, err)
+	other := fmt.Errorf("error parsing memory.max: %v", strconv.ErrSyntax)
+	if err := IgnoreControllerNotMounted(other); err != other {
+		t.Errorf("got %v, want %v", err, other)
+	}
+}
+
+func TestAllCgroupMetrics(t *testing.T) {
+	fs := cgroupfs(t, "cgroupv2")
+	got, err := fs.AllCgroupMetrics(14804)
+	noerr(t, err)
+
+	dir := "../fixtures/cgroupv2/system.slice/process-exporter.service"
+	stat, err := fs.readCgroupKeyValues(dir, "memory.stat")
+	noerr(t, err)
+	cpu, err := fs.CgroupCPUInfo(cgroupsV2Fixture)
+	noerr(t, err)
+	want := CgroupMetrics{
+		Cgroups: cgroupsV2Fixture,
+		Memory: &CgroupMemoryMetrics{
+			Current:     104857600,
+			Max:         CgroupLimit{Value: 536870912, Set: true},
+			High:        CgroupLimit{Value: 402653184, Set: true},
+			SwapCurrent: 4194304,
+			SwapMax:     CgroupLimit{Set: true, Unlimited: true},
+			SwapEvents:  CgroupSwapEvents{Max: 3, Fail: 5},
+			Stat:        stat,
+		},
+		CPU:  &cpu,
+		Pids: &CgroupPidsMetrics{Current: 12, Max: CgroupLimit{Value: 4096, Set: true}},
+		Pressure: map[string]CgroupPressure{
+			"cpu": {
+				Some: CgroupPressureStats{Avg10: 1.5, Avg60: 0.75, Avg300: 0.2, TotalMicros: 123456},
+			},
+			"memory": {
+				Some: CgroupPressureStats{Avg10: 2.5, Avg60: 0.1, Avg300: 0.05, TotalMicros: 5000},
+				Full: CgroupPressureStats{Avg60: 0.05, Avg300: 0.01, TotalMicros: 2500},
+			},
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("cgroup metrics differ: (-got +want)\n%s", diff)
+	}
+
+	// Controllers without files are left out.
+	got, err = fs.allCgroupMetricsV2([]Cgroup{{Path: "/user.slice"}})
+	noerr(t, err)
+	if got.Memory != nil || got.CPU != nil || got.Pids != nil || got.Pressure != nil {
+		t.Errorf("got %+v for cgroup without files, want no controllers", got)
+	}
+}
+
+func TestAllCgroupMetricsV1(t *testing.T) {
+	fs := cgroupfs(t, "cgroupv1")
+	got, err := fs.allCgroupMetricsV1(cgroupsV1Fixture)
+	noerr(t, err)
+	mem, err := fs.CgroupMemoryInfo(cgroupsV1Fixture)
+	noerr(t, err)
+	cpu, err := fs.CgroupCPUInfo(cgroupsV1Fixture)
+	noerr(t, err)
+
+	if got.Memory == nil || got.Memory.Current != mem.Usage || got.Memory.Max != mem.Limit {
+		t.Errorf("got memory %+v, want usage %d limit %v", got.Memory, mem.Usage, mem.Limit)
+	}
+	if got.CPU == nil || *got.CPU != cpu {
+		t.Errorf("got cpu %+v, want %+v", got.CPU, cpu)
+	}
+	if got.Pids != nil || got.Pressure != nil {
+		t.Errorf("got pids %+v pressure %+v, want none", got.Pids, got.Pressure)
+	}
+}
+
+// readSyscalls returns the number of read syscalls made by this process.
+func readSyscalls(b *testing.B) uint64 {
+	data, err := ioutil.ReadFile("/proc/self/io")
+	if err != nil {
+		b.Skipf("can't read /proc/self/io: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "syscr: ") {
+			n, err := strconv.ParseUint(strings.TrimPrefix(line, "syscr: "), 10, 64)
+			if err == nil {
+				return n
+			}
+		}
+	}
+	b.Skip("no syscr in /proc/self/io")
+	return 0
+}
+
+// BenchmarkAllCgroupMetrics compares AllCgroupMetrics with reading the same
+// files with one call per controller, each looking up the pid's cgroups, as a
+// collector would without it.  It reports read syscalls per op.
+func BenchmarkAllCgroupMetrics(b *testing.B) {
+	fs, err := NewFS("../fixtures", false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	fs.CgroupMountPoint = "../fixtures/cgroupv2"
+
+	for _, bc := range []struct {
+		name string
+		f    func() error
+	}{
+		{"oneshot", func() error {
+			_, err := fs.AllCgroupMetrics(14804)
+			return err
+		}},
+		{"separate", func() error {
+			for _, names := range [][]string{
+				{"memory.current", "memory.max", "memory.high", "memory.swap.current", "memory.swap.max", "memory.stat"},
+				{"cpu.stat", "cpu.max"},
+				{"pids.current", "pids.max"},
+				{"cpu.pressure", "memory.pressure", "io.pressure"},
+			} {
+				cgroups, err := fs.Cgroups(14804)
+				if err != nil {
+					return err
+				}
+				cg, err := fs.cgroupFor(cgroups, "")
+				if err != nil {
+					return err
+				}
+				for _, name := range names {
+					if _, err := fs.readCgroupFile(fs.cgroupDir(cg), name); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			before := readSyscalls(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := bc.f(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(readSyscalls(b)-before)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+// BenchmarkCgroups compares reading just a proc's cgroup placement with also
+// reading its memory limit from cgroupfs.  It reports read syscalls per op.
+func BenchmarkCgroups(b *testing.B) {
+	fs, err := NewFS("../fixtures", false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	fs.CgroupMountPoint = "../fixtures/cgroupv2"
+
+	for _, bc := range []struct {
+		name string
+		f    func() error
+	}{
+		{"placement", func() error {
+			_, err := fs.Cgroups(14804)
+			return err
+		}},
+		{"memmax", func() error {
+			cgroups, err := fs.Cgroups(14804)
+			if err != nil {
+				return err
+			}
+			_, err = fs.CgroupMemMax(cgroups)
+			return err
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			before := readSyscalls(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := bc.f(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(readSyscalls(b)-before)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+// cgroupScanFS returns an FS with procs procs, pids 1 to procs, put in
+// cgroups of perCgroup procs each, and the temp dir it's in.
+func cgroupScanFS(tb testing.TB, procs, perCgroup int) (*FS, string) {
+	root, err := ioutil.TempDir("", "cgroupscan")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	write := func(name, content string) {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	stat, err := ioutil.ReadFile("../fixtures/stat")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	write(filepath.Join(root, "proc", "stat"), string(stat))
+	cgroupRoot := filepath.Join(root, "cgroup")
+	write(filepath.Join(cgroupRoot, "cgroup.controllers"), "cpu memory pids\n")
+	for pid := 1; pid <= procs; pid++ {
+		cgroup := strconv.Itoa((pid-1)/perCgroup + 1)
+		write(filepath.Join(root, "proc", strconv.Itoa(pid), "cgroup"), "0::/scan/"+cgroup+"\n")
+		dir := filepath.Join(cgroupRoot, "scan", cgroup)
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		}
+		write(filepath.Join(dir, "memory.current"), "4096000\n")
+		write(filepath.Join(dir, "memory.max"), "max\n")
+		write(filepath.Join(dir, "memory.stat"), "anon 1024000\nfile 2048000\ninactive_file 512000\n")
+		write(filepath.Join(dir, "cpu.stat"), "usage_usec 1000\nuser_usec 600\nsystem_usec 400\nnr_throttled 0\nthrottled_usec 0\n")
+		write(filepath.Join(dir, "cpu.max"), "max 100000\n")
+		write(filepath.Join(dir, "pids.current"), "3\n")
+		write(filepath.Join(dir, "pids.max"), "max\n")
+	}
+	fs, err := NewFS(filepath.Join(root, "proc"), false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	fs.CgroupMountPoint = cgroupRoot
+	return fs, root
+}
+
+// BenchmarkCgroupScan reads the cgroup metrics of 5000 procs, each in a
+// cgroup of its own, as a scrape of a busy host would.  Run it with
+// -benchmem to see what reading cgroup files allocates.
+func BenchmarkCgroupScan(b *testing.B) {
+	const procs = 5000
+	fs, root := cgroupScanFS(b, procs, 1)
+	defer os.RemoveAll(root)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for pid := 1; pid <= procs; pid++ {
+			if _, err := fs.AllCgroupMetrics(pid); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkCgroupMetricsForPIDs compares reading the cgroup metrics of 50
+// procs of interest, 5 to a cgroup, with CgroupMetricsForPIDs and with a scan
+// of all 5000 procs of the host, as a collector would.
+func BenchmarkCgroupMetricsForPIDs(b *testing.B) {
+	const procs = 5000
+	fs, root := cgroupScanFS(b, procs, 5)
+	defer os.RemoveAll(root)
+	var pids []int
+	for pid := 1001; pid <= 1050; pid++ {
+		pids = append(pids, pid)
+	}
+
+	for _, bc := range []struct {
+		name string
+		f    func() error
+	}{
+		{"pids", func() error {
+			_, err := fs.CgroupMetricsForPIDs(pids)
+			return err
+		}},
+		{"scan", func() error {
+			infos, err := ioutil.ReadDir(fs.MountPoint)
+			if err != nil {
+				return err
+			}
+			for _, info := range infos {
+				pid, err := strconv.Atoi(info.Name())
+				if err != nil {
+					continue
+				}
+				if _, err := fs.AllCgroupMetrics(pid); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := bc.f(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCgroupMetricsForPIDsParallel reads the cgroup metrics of all 5000
+// procs of a host, each in a cgroup of its own, one at a time and in
+// parallel.
+func BenchmarkCgroupMetricsForPIDsParallel(b *testing.B) {
+	const procs = 5000
+	fs, root := cgroupScanFS(b, procs, 1)
+	defer os.RemoveAll(root)
+	var pids []int
+	for pid := 1; pid <= procs; pid++ {
+		pids = append(pids, pid)
+	}
+
+	for _, parallelism := range []int{1, 4, 16} {
+		b.Run(strconv.Itoa(parallelism), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := fs.CgroupMetricsForPIDsParallel(pids, parallelism); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestCgroupMetricsForPIDs verifies that each proc gets the metrics
+// AllCgroupMetrics gives it, that those of procs in the same cgroup are read
+// once, and that pids that don't exist are left out.
+func TestCgroupMetricsForPIDs(t *testing.T) {
+	fs := cgroupfs(t, "cgroupv2")
+	want, err := fs.AllCgroupMetrics(14804)
+	noerr(t, err)
+	got, err := fs.CgroupMetricsForPIDs([]int{14804, 99999})
+	noerr(t, err)
+	if diff := cmp.Diff(got, map[int]CgroupMetrics{14804: want}); diff != "" {
+		t.Errorf("metrics differ: (-got +want)\n%s", diff)
+	}
+
+	fs, root := cgroupScanFS(t, 4, 2)
+	defer os.RemoveAll(root)
+	got, err = fs.CgroupMetricsForPIDs([]int{1, 2, 3, 4, 5})
+	noerr(t, err)
+	if len(got) != 4 {
+		t.Fatalf("got metrics for %d procs, want 4", len(got))
+	}
+	if got[1].Memory != got[2].Memory || got[3].Memory != got[4].Memory || got[1].Memory == got[3].Memory {
+		t.Errorf("procs in the same cgroup don't share its metrics, or those in different ones do")
+	}
+	if got[3].Cgroups[0].Path != "/scan/2" {
+		t.Errorf("got cgroups %v for pid 3, want /scan/2", got[3].Cgroups)
+	}
+}
+
+// TestCgroupMetricsForPIDsParallel verifies that reading procs in parallel
+// gives what reading them one at a time does, procs in the same cgroup still
+// sharing its metrics, and that the error is that of the first proc in error.
+// Run it with -race.
+func TestCgroupMetricsForPIDsParallel(t *testing.T) {
+	fs, root := cgroupScanFS(t, 200, 5)
+	defer os.RemoveAll(root)
+	var pids []int
+	for pid := 1; pid <= 210; pid++ {
+		pids = append(pids, pid)
+	}
+	want, err := fs.CgroupMetricsForPIDs(pids)
+	noerr(t, err)
+	for _, parallelism := range []int{0, 2, 8, 500} {
+		got, err := fs.CgroupMetricsForPIDsParallel(pids, parallelism)
+		noerr(t, err)
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("parallelism %d: metrics differ: (-got +want)\n%s", parallelism, diff)
+		}
+		if got[1].Memory != got[5].Memory || got[5].Memory == got[6].Memory {
+			t.Errorf("parallelism %d: procs in the same cgroup don't share its metrics, or those in different ones do",
+				parallelism)
+		}
+	}
+
+	for _, pid := range []int{150, 50} {
+		name := filepath.Join(fs.MountPoint, strconv.Itoa(pid), "cgroup")
+		noerr(t, ioutil.WriteFile(name, []byte("bad\n"), 0644))
+	}
+	for _, parallelism := range []int{1, 8} {
+		_, err := fs.CgroupMetricsForPIDsParallel(pids, parallelism)
+		if err == nil || !strings.Contains(err.Error(), "pid 50:") {
+			t.Errorf("parallelism %d: got error %v, want that of pid 50", parallelism, err)
+		}
+	}
+}
+
+// TestCgroupControllersEnabled verifies that controllers come from the cgroup
+// lines with v1, leaving out named hierarchies, and from cgroup.controllers
+// with v2.
+func TestCgroupControllersEnabled(t *testing.T) {
+	got, err := cgroupfs(t, "cgroupv2").CgroupControllersEnabled(14804)
+	noerr(t, err)
+	if diff := cmp.Diff(got, []string{"memory", "pids"}); diff != "" {
+		t.Errorf("v2 controllers differ: (-got +want)\n%s", diff)
+	}
+
+	got, err = cgroupfs(t, "cgroupv2").cgroupControllersEnabled([]Cgroup{{Path: "/user.slice"}})
+	noerr(t, err)
+	if len(got) != 0 {
+		t.Errorf("got v2 controllers %v without cgroup.controllers, want none", got)
+	}
+
+	cgroups, err := parseCgroups([]byte(`4:memory:/system.slice/process-exporter.service
+3:cpu,cpuacct:/system.slice/process-exporter.service
+2:cpuset:/system.slice/process-exporter.service
+1:name=systemd:/system.slice/process-exporter.service
+0::/system.slice/process-exporter.service
+`))
+	noerr(t, err)
+	got, err = cgroupfs(t, "cgroupv1").cgroupControllersEnabled(cgroups)
+	noerr(t, err)
+	if diff := cmp.Diff(got, []string{"cpuset", "cpu", "cpuacct", "memory"}); diff != "" {
+		t.Errorf("v1 controllers differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestCgroupsMemoryPressure verifies that a group's memory pressure is that
+// of its most stalled cgroup.
+func TestCgroupsMemoryPressure(t *testing.T) {
+	ctr := []Cgroup{{Path: "/kubepods.slice/kubepods-pod1.slice/cri-ctr1.scope"}}
+	for _, tc := range []struct {
+		placements [][]Cgroup
+		want       float64
+		wantOK     bool
+	}{
+		{[][]Cgroup{cgroupsV2Fixture, ctr, cgroupsV2Fixture}, 0.125, true},
+		{[][]Cgroup{cgroupsV2Fixture}, 0.025, true},
+		{[][]Cgroup{{{Path: "/user.slice"}}}, 0, false},
+	} {
+		got, ok, err := cgroupfs(t, "cgroupv2").CgroupsMemoryPressure(tc.placements)
+		noerr(t, err)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("%v: got %v (ok=%v), want %v (ok=%v)", tc.placements, got, ok, tc.want, tc.wantOK)
+		}
+	}
+
+	if _, ok, err := cgroupfs(t, "cgroupv1").CgroupsMemoryPressure([][]Cgroup{cgroupsV1Fixture}); err != nil || ok {
+		t.Errorf("got ok=%v err=%v with v1, want no pressure", ok, err)
+	}
+}
+
+// TestCgroupCreatedAt verifies that a cgroup's creation time is its
+// directory's mtime, and that a missing cgroup is an error.
+func TestCgroupCreatedAt(t *testing.T) {
+	fs, root, _ := oomfs(t)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "pod", "ctr")
+	noerr(t, os.MkdirAll(dir, 0755))
+	created := time.Date(2021, 7, 8, 12, 0, 0, 0, time.UTC)
+	noerr(t, os.Chtimes(dir, created, created))
+
+	got, err := fs.CgroupCreatedAt(Cgroup{Path: "/pod/ctr"})
+	noerr(t, err)
+	if !got.Equal(created) {
+		t.Errorf("got creation time %v, want %v", got, created)
+	}
+
+	if _, err := fs.CgroupCreatedAt(Cgroup{Path: "/pod/gone"}); err == nil {
+		t.Errorf("expected error for missing cgroup")
+	}
+}
@@ -0,0 +1,184 @@
+package proc
+
+import (
+	"os"
+	"syscall"
+)
+
+type (
+	// cgroupCounter accumulates counters of the cgroups of a controller,
+	// memory unless said otherwise, of each group so that they never
+	// decrease.  The kernel's counters start over when a cgroup is
+	// recreated, e.g. when a container restarts, and a group's procs may
+	// move to new cgroups, so rather than summing the kernel's counters it
+	// adds up how much each has grown since last seen.
+	cgroupCounter struct {
+		fs         *FS
+		controller string
+		// read returns the counters of the cgroup dir, always as many, or
+		// false if it has none.
+		read   func(dir string) ([]uint64, bool, error)
+		groups map[string]*counterGroup
+	}
+
+	// counterGroup is the accumulated counters of a group.
+	counterGroup struct {
+		totals  []uint64
+		cgroups map[string]counterCgroup
+	}
+
+	// counterCgroup is the last values read for a cgroup, along with the
+	// inode of its directory, which identifies that incarnation of the
+	// cgroup.
+	counterCgroup struct {
+		inode  uint64
+		values []uint64
+	}
+
+	// PgStealCounter accumulates the pages reclaimed from the memory
+	// cgroups of each group, see CgroupMemoryReclaim, across cgroup
+	// recreation.
+	PgStealCounter struct {
+		cgroupCounter
+	}
+
+	// CPUThrottlingCounter accumulates the throttling of the cpu cgroups of
+	// each group, see CgroupsCPUThrottling, across cgroup recreation and
+	// cgroups leaving the group.
+	CPUThrottlingCounter struct {
+		cgroupCounter
+	}
+)
+
+// newCgroupCounter returns a cgroupCounter reading a single counter of
+// memory cgroups using fs.
+func newCgroupCounter(fs *FS, read func(dir string) (uint64, bool, error)) cgroupCounter {
+	return newCgroupCounters(fs, "memory", func(dir string) ([]uint64, bool, error) {
+		value, ok, err := read(dir)
+		return []uint64{value}, ok, err
+	})
+}
+
+// newCgroupCounters returns a cgroupCounter reading counters of the cgroups
+// of controller using fs.
+func newCgroupCounters(fs *FS, controller string, read func(dir string) ([]uint64, bool, error)) cgroupCounter {
+	return cgroupCounter{fs: fs, controller: controller, read: read, groups: make(map[string]*counterGroup)}
+}
+
+// NewPgStealCounter returns a PgStealCounter reading cgroups using fs.
+func NewPgStealCounter(fs *FS) *PgStealCounter {
+	return &PgStealCounter{newCgroupCounter(fs, func(dir string) (uint64, bool, error) {
+		reclaim, ok, err := fs.readCgroupMemoryReclaim(dir)
+		return reclaim.PgSteal, ok, err
+	})}
+}
+
+// NewCPUThrottlingCounter returns a CPUThrottlingCounter reading cgroups
+// using fs.
+func NewCPUThrottlingCounter(fs *FS) *CPUThrottlingCounter {
+	return &CPUThrottlingCounter{newCgroupCounters(fs, "cpu", fs.readCgroupCPUThrottling)}
+}
+
+// Update reads the throttling of the distinct cpu cgroups among placements,
+// the cgroups of the procs in group, and returns the group's accumulated
+// throttling, see cgroupCounter.update.
+func (c *CPUThrottlingCounter) Update(group string, placements [][]Cgroup) (CgroupCPUThrottling, bool, error) {
+	totals, ok, err := c.update(group, placements)
+	if !ok || err != nil {
+		return CgroupCPUThrottling{}, ok, err
+	}
+	return CgroupCPUThrottling{
+		ThrottledPeriods: totals[0],
+		ThrottledSeconds: c.fs.cpuThrottledSeconds(totals[1]),
+	}, true, nil
+}
+
+// cgroupInode returns the inode of dir, or false if it can't be determined.
+func cgroupInode(dir string) (uint64, bool) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return 0, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Ino), true
+}
+
+// Update reads the counter of the distinct cgroups among placements, the
+// cgroups of the procs in group, and returns the group's accumulated total,
+// see update.
+func (c *cgroupCounter) Update(group string, placements [][]Cgroup) (total uint64, ok bool, err error) {
+	totals, ok, err := c.update(group, placements)
+	if !ok || err != nil {
+		return 0, ok, err
+	}
+	return totals[0], true, nil
+}
+
+// update reads the counters of the distinct cgroups among placements, the
+// cgroups of the procs in group, and returns the group's accumulated totals.
+// A cgroup seen for the first time contributes its whole counts.  One seen
+// before contributes their growth since, unless it has been recreated,
+// detected by a new inode or by any of its counts going down, in which case
+// its whole counts are new.  ok is false if no count has ever been read for
+// the group.
+func (c *cgroupCounter) update(group string, placements [][]Cgroup) (totals []uint64, ok bool, err error) {
+	grp := c.groups[group]
+	seen := make(map[string]bool)
+	for _, cgroups := range placements {
+		cg, err := c.fs.cgroupFor(cgroups, c.controller)
+		if err != nil {
+			return nil, false, err
+		}
+		dir := c.fs.cgroupDir(cg)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+
+		values, found, err := c.read(dir)
+		if err != nil {
+			return nil, false, err
+		}
+		if !found {
+			continue
+		}
+		inode, _ := cgroupInode(dir)
+
+		if grp == nil {
+			grp = &counterGroup{totals: make([]uint64, len(values)), cgroups: make(map[string]counterCgroup)}
+			c.groups[group] = grp
+		}
+		last, known := grp.cgroups[dir]
+		recreated := !known || inode != last.inode
+		for i := range values {
+			if !recreated && values[i] < last.values[i] {
+				recreated = true
+			}
+		}
+		for i, value := range values {
+			if recreated {
+				grp.totals[i] += value
+			} else {
+				grp.totals[i] += value - last.values[i]
+			}
+		}
+		grp.cgroups[dir] = counterCgroup{inode: inode, values: values}
+	}
+	if grp == nil {
+		return nil, false, nil
+	}
+
+	// Forget cgroups that no longer exist, so a cgroup recreated at the same
+	// path is new, and so the baselines don't grow without bound.
+	for dir := range grp.cgroups {
+		if !seen[dir] {
+			if _, exists := cgroupInode(dir); !exists {
+				delete(grp.cgroups, dir)
+			}
+		}
+	}
+	return grp.totals, true, nil
+}
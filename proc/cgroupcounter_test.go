@@ -0,0 +1,88 @@
+package proc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPgStealCounter verifies that the pages reclaimed from a group's
+// cgroups are read from memory.stat and keep growing when a cgroup is
+// recreated with its counter starting over.
+func TestPgStealCounter(t *testing.T) {
+	fs, root, _ := oomfs(t)
+	defer os.RemoveAll(root)
+	setSteal := func(path string, steal int) {
+		dir := filepath.Join(root, path)
+		noerr(t, os.MkdirAll(dir, 0755))
+		stat := fmt.Sprintf("anon 4096\npgscan %d\npgsteal %d\n", 2*steal, steal)
+		noerr(t, ioutil.WriteFile(filepath.Join(dir, "memory.stat"), []byte(stat), 0644))
+	}
+	c := NewPgStealCounter(fs)
+	ctr := placement("/pod/ctr")
+	for i, tc := range []struct {
+		steal    int
+		recreate bool
+		want     uint64
+	}{
+		{100, false, 100},
+		{250, false, 250},
+		{30, true, 280},
+		{40, false, 290},
+	} {
+		if tc.recreate {
+			noerr(t, os.RemoveAll(filepath.Join(root, "pod")))
+		}
+		setSteal("/pod/ctr", tc.steal)
+		got, ok, err := c.Update("g1", [][]Cgroup{ctr, ctr})
+		noerr(t, err)
+		if !ok || got != tc.want {
+			t.Errorf("%d: got %d (ok=%v), want %d", i, got, ok, tc.want)
+		}
+	}
+
+	noerr(t, os.Mkdir(filepath.Join(root, "bare"), 0755))
+	if _, ok, err := c.Update("g2", [][]Cgroup{placement("/bare")}); err != nil || ok {
+		t.Errorf("got ok=%v err=%v for cgroup without memory.stat, want no count", ok, err)
+	}
+}
+
+// TestCPUThrottlingCounter verifies that a group's throttling never
+// decreases when one of its cgroups leaves it or is recreated, while a cgroup
+// shared by its procs counts once.
+func TestCPUThrottlingCounter(t *testing.T) {
+	fs, root, _ := oomfs(t)
+	defer os.RemoveAll(root)
+	noerr(t, ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory\n"), 0644))
+	setThrottled := func(path string, periods int) {
+		dir := filepath.Join(root, path)
+		noerr(t, os.MkdirAll(dir, 0755))
+		stat := fmt.Sprintf("usage_usec 9000\nnr_periods 500\nnr_throttled %d\nthrottled_usec %d\n", periods, periods*100000)
+		noerr(t, ioutil.WriteFile(filepath.Join(dir, "cpu.stat"), []byte(stat), 0644))
+	}
+	c := NewCPUThrottlingCounter(fs)
+	a, b := placement("/a"), placement("/b")
+	for i, tc := range []struct {
+		step       func()
+		placements [][]Cgroup
+		want       uint64
+	}{
+		{func() { setThrottled("/a", 10); setThrottled("/b", 5) }, [][]Cgroup{a, a, b}, 15},
+		// b leaves the group: what it counted stays.
+		{func() { setThrottled("/a", 12) }, [][]Cgroup{a}, 17},
+		// a is recreated, starting over.
+		{func() { noerr(t, os.RemoveAll(filepath.Join(root, "a"))); setThrottled("/a", 3) }, [][]Cgroup{a}, 20},
+		// b comes back having grown: only its growth counts.
+		{func() { setThrottled("/b", 6) }, [][]Cgroup{a, b}, 21},
+	} {
+		tc.step()
+		got, ok, err := c.Update("g1", tc.placements)
+		noerr(t, err)
+		want := CgroupCPUThrottling{ThrottledPeriods: tc.want, ThrottledSeconds: float64(tc.want) / 10}
+		if !ok || got != want {
+			t.Errorf("%d: got %+v (ok=%v), want %+v", i, got, ok, want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package proc
+
+type (
+	// CgroupLimitChangeCounter counts the changes of the memory limits of
+	// the memory cgroups of each group, e.g. when a deployment is resized.
+	// It compares each cgroup's effective limit, see CgroupMemMax, with the
+	// one read the last time round.
+	CgroupLimitChangeCounter struct {
+		fs     *FS
+		groups map[string]*limitGroup
+	}
+
+	// limitGroup is the limit changes counted for a group.
+	limitGroup struct {
+		changes uint64
+		cgroups map[string]limitCgroup
+	}
+
+	// limitCgroup is the last memory limit read for a memory cgroup, along
+	// with the inode of its directory, which identifies that incarnation of
+	// the cgroup.
+	limitCgroup struct {
+		inode uint64
+		limit CgroupLimit
+	}
+)
+
+// NewCgroupLimitChangeCounter returns a CgroupLimitChangeCounter reading
+// cgroups using fs.
+func NewCgroupLimitChangeCounter(fs *FS) *CgroupLimitChangeCounter {
+	return &CgroupLimitChangeCounter{fs: fs, groups: make(map[string]*limitGroup)}
+}
+
+// Update reads the memory limits of the distinct memory cgroups among
+// placements, the cgroups of the procs in group, and returns the number of
+// times one has changed.  A cgroup seen for the first time, or recreated
+// since last seen, as detected by a new inode, only sets the baseline: a
+// container restarting with a different limit is a new cgroup, not a
+// change.  A limit being removed or added counts as a change too.  ok is
+// false if no limit has ever been read for the group.
+func (c *CgroupLimitChangeCounter) Update(group string, placements [][]Cgroup) (changes uint64, ok bool, err error) {
+	grp := c.groups[group]
+	seen := make(map[string]bool)
+	for _, cgroups := range placements {
+		cg, err := c.fs.cgroupFor(cgroups, "memory")
+		if err != nil {
+			return 0, false, err
+		}
+		dir := c.fs.cgroupDir(cg)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+
+		limit, err := c.fs.CgroupMemMax(cgroups)
+		if err != nil {
+			return 0, false, err
+		}
+		var (
+			last  limitCgroup
+			known bool
+		)
+		if grp != nil {
+			last, known = grp.cgroups[dir]
+		}
+		if !known && !limit.Set {
+			// There's no limit yet to see change.
+			continue
+		}
+		inode, _ := cgroupInode(dir)
+
+		if grp == nil {
+			grp = &limitGroup{cgroups: make(map[string]limitCgroup)}
+			c.groups[group] = grp
+		}
+		// A limit going away, e.g. because the memory controller was
+		// disabled for the cgroup, is a change like any other, as is one
+		// coming back; the unset limit is kept as the baseline meanwhile.
+		if known && inode == last.inode && limit != last.limit {
+			grp.changes++
+		}
+		grp.cgroups[dir] = limitCgroup{inode: inode, limit: limit}
+	}
+	if grp == nil {
+		return 0, false, nil
+	}
+
+	// Forget cgroups that no longer exist, so a cgroup recreated at the same
+	// path is new, and so the baselines don't grow without bound.
+	for dir := range grp.cgroups {
+		if !seen[dir] {
+			if _, exists := cgroupInode(dir); !exists {
+				delete(grp.cgroups, dir)
+			}
+		}
+	}
+	return grp.changes, true, nil
+}
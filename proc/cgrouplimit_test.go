@@ -0,0 +1,74 @@
+package proc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCgroupLimitChangeCounter verifies that changes of a memory limit,
+// including its removal, are counted, but not a cgroup appearing, being
+// recreated or going away.
+func TestCgroupLimitChangeCounter(t *testing.T) {
+	fs, root, _ := oomfs(t)
+	defer os.RemoveAll(root)
+	setLimit := func(path, limit string) {
+		dir := filepath.Join(root, path)
+		noerr(t, os.MkdirAll(dir, 0755))
+		noerr(t, ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte(limit+"\n"), 0644))
+	}
+	c := NewCgroupLimitChangeCounter(fs)
+
+	ctr := placement("/pod/ctr")
+	update := func(step string, placements [][]Cgroup, want uint64) {
+		t.Helper()
+		got, ok, err := c.Update("g1", placements)
+		noerr(t, err)
+		if !ok || got != want {
+			t.Errorf("%s: got %d (ok=%v), want %d", step, got, ok, want)
+		}
+	}
+
+	setLimit("/pod/ctr", "1048576")
+	update("first", [][]Cgroup{ctr, ctr}, 0)
+	update("unchanged", [][]Cgroup{ctr}, 0)
+
+	setLimit("/pod/ctr", "2097152")
+	update("resized", [][]Cgroup{ctr, ctr}, 1)
+
+	setLimit("/pod/ctr", "max")
+	update("unlimited", [][]Cgroup{ctr}, 2)
+
+	// The pod's limit bounds the container's, so changing it is a change.
+	setLimit("/pod", "1048576")
+	update("pod resized", [][]Cgroup{ctr}, 3)
+
+	// Recreated with another limit, e.g. a restarted container: a new
+	// cgroup, not a change.  The new dir is made first so it gets a new
+	// inode.
+	setLimit("/pod/ctr.new", "524288")
+	noerr(t, os.RemoveAll(filepath.Join(root, "/pod/ctr")))
+	noerr(t, os.Rename(filepath.Join(root, "/pod/ctr.new"), filepath.Join(root, "/pod/ctr")))
+	update("recreated", [][]Cgroup{ctr}, 3)
+
+	// Gone, then back at the same path with another limit.
+	ctr2 := placement("/pod/ctr2")
+	setLimit("/pod/ctr2", "1048576")
+	noerr(t, os.RemoveAll(filepath.Join(root, "/pod/ctr")))
+	update("moved", [][]Cgroup{ctr2}, 3)
+	setLimit("/pod/ctr", "262144")
+	update("old path reused", [][]Cgroup{ctr, ctr2}, 3)
+
+	// The limit removed, then set again.
+	noerr(t, os.Remove(filepath.Join(root, "/pod/ctr2/memory.max")))
+	noerr(t, os.Remove(filepath.Join(root, "/pod/memory.max")))
+	update("unset", [][]Cgroup{ctr2}, 4)
+	update("still unset", [][]Cgroup{ctr2}, 4)
+	setLimit("/pod/ctr2", "1048576")
+	update("set again", [][]Cgroup{ctr2}, 5)
+
+	if _, ok, err := c.Update("g2", nil); err != nil || ok {
+		t.Errorf("got ok=%v err=%v for group without cgroups, want no count", ok, err)
+	}
+}
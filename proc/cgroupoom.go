@@ -0,0 +1,13 @@
+package proc
+
+// OOMKillCounter accumulates the OOM kills of the memory cgroups of each
+// group so that the count never decreases, across cgroup recreation and
+// procs moving to new cgroups.
+type OOMKillCounter struct {
+	cgroupCounter
+}
+
+// NewOOMKillCounter returns an OOMKillCounter reading cgroups using fs.
+func NewOOMKillCounter(fs *FS) *OOMKillCounter {
+	return &OOMKillCounter{newCgroupCounter(fs, fs.readCgroupOOMKills)}
+}
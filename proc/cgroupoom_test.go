@@ -0,0 +1,121 @@
+package proc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// oomfs returns an FS reading cgroups from a temporary v2 cgroupfs, and a
+// func to set the OOM kill count of a cgroup in it.
+func oomfs(t *testing.T) (*FS, string, func(path string, kills int)) {
+	root, err := ioutil.TempDir("", "oomkills")
+	noerr(t, err)
+	noerr(t, ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("memory\n"), 0644))
+
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	fs.CgroupMountPoint = root
+	setKills := func(path string, kills int) {
+		dir := filepath.Join(root, path)
+		noerr(t, os.MkdirAll(dir, 0755))
+		events := fmt.Sprintf("low 0\nhigh 0\nmax 3\noom 2\noom_kill %d\n", kills)
+		noerr(t, ioutil.WriteFile(filepath.Join(dir, "memory.events"), []byte(events), 0644))
+	}
+	return fs, root, setKills
+}
+
+// recreate replaces the cgroup dir at path with a new one holding kills,
+// making sure it gets a new inode.
+func recreate(t *testing.T, root, path string, kills int) {
+	dir := filepath.Join(root, path)
+	tmp := dir + ".new"
+	noerr(t, os.Mkdir(tmp, 0755))
+	events := fmt.Sprintf("oom_kill %d\n", kills)
+	noerr(t, ioutil.WriteFile(filepath.Join(tmp, "memory.events"), []byte(events), 0644))
+	noerr(t, os.RemoveAll(dir))
+	noerr(t, os.Rename(tmp, dir))
+}
+
+func placement(path string) []Cgroup {
+	return []Cgroup{{Path: path}}
+}
+
+// TestOOMKillCounter verifies that a group's OOM kill count never decreases
+// across cgroup recreation, detected either by inode or by counter
+// regression, and that a cgroup shared by procs counts once.
+func TestOOMKillCounter(t *testing.T) {
+	fs, root, setKills := oomfs(t)
+	defer os.RemoveAll(root)
+	c := NewOOMKillCounter(fs)
+
+	ctr := placement("/pod/ctr")
+	update := func(step string, placements [][]Cgroup, want uint64) {
+		t.Helper()
+		got, ok, err := c.Update("g1", placements)
+		noerr(t, err)
+		if !ok || got != want {
+			t.Errorf("%s: got %d (ok=%v), want %d", step, got, ok, want)
+		}
+	}
+
+	// A cgroup first seen contributes its whole count, once however many
+	// procs share it.
+	setKills("/pod/ctr", 2)
+	update("first", [][]Cgroup{ctr, ctr, ctr}, 2)
+
+	setKills("/pod/ctr", 5)
+	update("growth", [][]Cgroup{ctr, ctr}, 5)
+
+	// Recreated with a lower count: detected by inode and regression.
+	recreate(t, root, "/pod/ctr", 1)
+	update("recreated lower", [][]Cgroup{ctr}, 6)
+
+	// Recreated with a higher count: only the inode tells.
+	recreate(t, root, "/pod/ctr", 4)
+	update("recreated higher", [][]Cgroup{ctr}, 10)
+
+	// Counter regression on the same inode, e.g. on a filesystem that
+	// doesn't give stable inodes.
+	setKills("/pod/ctr", 1)
+	update("regressed", [][]Cgroup{ctr}, 11)
+
+	// The group moves to a new cgroup and the old one goes away.
+	ctr2 := placement("/pod/ctr2")
+	setKills("/pod/ctr2", 3)
+	noerr(t, os.RemoveAll(filepath.Join(root, "/pod/ctr")))
+	update("moved", [][]Cgroup{ctr2}, 14)
+
+	// The old path is recreated: it's a new cgroup.
+	setKills("/pod/ctr", 1)
+	update("old path reused", [][]Cgroup{ctr, ctr2}, 15)
+}
+
+// TestOOMKillCounterGroups verifies that groups are accumulated separately
+// and that a group without counts has none.
+func TestOOMKillCounterGroups(t *testing.T) {
+	fs, root, setKills := oomfs(t)
+	defer os.RemoveAll(root)
+	c := NewOOMKillCounter(fs)
+
+	setKills("/a", 1)
+	setKills("/b", 2)
+	for _, tc := range []struct {
+		group string
+		path  string
+		want  uint64
+	}{{"ga", "/a", 1}, {"gb", "/b", 2}, {"gshared", "/a", 1}} {
+		got, ok, err := c.Update(tc.group, [][]Cgroup{placement(tc.path)})
+		noerr(t, err)
+		if !ok || got != tc.want {
+			t.Errorf("%s: got %d (ok=%v), want %d", tc.group, got, ok, tc.want)
+		}
+	}
+
+	noerr(t, os.Mkdir(filepath.Join(root, "c"), 0755))
+	if _, ok, err := c.Update("gc", [][]Cgroup{placement("/c")}); err != nil || ok {
+		t.Errorf("got ok=%v err=%v for cgroup without memory.events, want no count", ok, err)
+	}
+}
@@ -0,0 +1,33 @@
+package proc
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// openFileBeneath opens the file at rel under root using openat2 with
+// RESOLVE_BENEATH and RESOLVE_NO_SYMLINKS, so that neither a symlink nor ".."
+// in rel can redirect the read.  On kernels without openat2 it falls back to
+// a plain open.
+func openFileBeneath(root, rel string) (*os.File, error) {
+	path := filepath.Join(root, rel)
+	dirfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(dirfd)
+
+	fd, err := unix.Openat2(dirfd, rel, &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS,
+	})
+	if err == unix.ENOSYS {
+		return os.Open(path)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "openat2", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
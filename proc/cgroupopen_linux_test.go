@@ -0,0 +1,53 @@
+package proc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestCgroupNoSymlinks verifies that with CgroupNoSymlinks, cgroup files
+// reached through a symlink or outside the cgroup mount aren't read.
+func TestCgroupNoSymlinks(t *testing.T) {
+	if _, err := unix.Openat2(unix.AT_FDCWD, ".", &unix.OpenHow{Flags: unix.O_PATH}); err == unix.ENOSYS {
+		t.Skip("openat2 not supported by this kernel")
+	}
+
+	root, err := ioutil.TempDir("", "cgroupfs")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "outside")
+	noerr(t, err)
+	defer os.RemoveAll(outside)
+
+	noerr(t, ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("memory\n"), 0644))
+	noerr(t, ioutil.WriteFile(filepath.Join(outside, "memory.max"), []byte("2000\n"), 0644))
+	for _, dir := range []string{"pod/ctr", "pod/evil"} {
+		noerr(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	noerr(t, ioutil.WriteFile(filepath.Join(root, "pod/ctr/memory.max"), []byte("1000\n"), 0644))
+	noerr(t, os.Symlink(filepath.Join(outside, "memory.max"), filepath.Join(root, "pod/evil/memory.max")))
+	noerr(t, os.Symlink(outside, filepath.Join(root, "pod/linked")))
+
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	fs.CgroupMountPoint = root
+
+	// Without the option, symlinks are followed.
+	if lim, err := fs.CgroupMemMax(placement("/pod/evil")); err != nil || lim.Value != 2000 {
+		t.Errorf("got %v, %v reading through symlink without CgroupNoSymlinks, want 2000", lim, err)
+	}
+
+	fs.CgroupNoSymlinks = true
+	if lim, err := fs.CgroupMemMax(placement("/pod/ctr")); err != nil || lim.Value != 1000 {
+		t.Errorf("got %v, %v reading regular file, want 1000", lim, err)
+	}
+	for _, path := range []string{"/pod/evil", "/pod/linked", "/../" + filepath.Base(outside)} {
+		if _, err := fs.readCgroupFile(filepath.Join(root, path), "memory.max"); err == nil {
+			t.Errorf("%s: got no error, want symlink or escape refused", path)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package proc
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// openFileBeneath opens the file at rel under root.  openat2 is Linux only,
+// so elsewhere it's a plain open.
+func openFileBeneath(root, rel string) (*os.File, error) {
+	return os.Open(filepath.Join(root, rel))
+}
@@ -0,0 +1,168 @@
+package proc
+
+import (
+	"path"
+	"strings"
+)
+
+// CgroupRuntime identifies what created a cgroup, as far as its path tells.
+type CgroupRuntime string
+
+const (
+	// CgroupRuntimeDocker is for docker-<id>.scope, or /docker/<id> with
+	// the cgroupfs driver.
+	CgroupRuntimeDocker CgroupRuntime = "docker"
+	// CgroupRuntimeContainerd is for cri-containerd-<id>.scope, as created
+	// for Kubernetes pods by containerd's CRI plugin.
+	CgroupRuntimeContainerd CgroupRuntime = "containerd"
+	// CgroupRuntimeCRIO is for crio-<id>.scope, and crio-conmon-<id>.scope
+	// for the conmon monitoring the container.
+	CgroupRuntimeCRIO CgroupRuntime = "crio"
+	// CgroupRuntimePodman is for libpod-<id>.scope, libpod-conmon-<id>.scope,
+	// or /libpod_parent/libpod-<id> with the cgroupfs driver.
+	CgroupRuntimePodman CgroupRuntime = "podman"
+	// CgroupRuntimeSystemd is for cgroups that aren't a container's and
+	// are a systemd unit, i.e. a .service, .scope or .slice.
+	CgroupRuntimeSystemd CgroupRuntime = "systemd"
+	// CgroupRuntimeUnknown is for the rest, including the root cgroup, as
+	// seen from inside a container with its own cgroup namespace, and the
+	// cgroupfs driver's /kubepods/.../<id>, which doesn't tell runtimes apart.
+	CgroupRuntimeUnknown CgroupRuntime = "unknown"
+)
+
+// cgroupRuntimePrefixes are the prefixes runtimes give the scopes, or with
+// the cgroupfs driver the dirs, of their containers, ahead of the id.
+var cgroupRuntimePrefixes = []struct {
+	prefix  string
+	runtime CgroupRuntime
+}{
+	{"cri-containerd-", CgroupRuntimeContainerd},
+	{"docker-", CgroupRuntimeDocker},
+	{"crio-conmon-", CgroupRuntimeCRIO},
+	{"crio-", CgroupRuntimeCRIO},
+	{"libpod-conmon-", CgroupRuntimePodman},
+	{"libpod-", CgroupRuntimePodman},
+}
+
+// cgroupRuntimeParents are the dirs the cgroupfs driver of some runtimes
+// puts the dirs of their containers in.
+var cgroupRuntimeParents = map[string]CgroupRuntime{
+	"docker":        CgroupRuntimeDocker,
+	"libpod_parent": CgroupRuntimePodman,
+}
+
+// container returns the runtime and id of the innermost container cg is in,
+// judging by its path, or empty strings if it's in none.  The cgroupfs
+// driver's /kubepods/.../pod<uid>/<id> gives an id but an unknown runtime.
+func (cg Cgroup) container() (CgroupRuntime, string) {
+	segments := strings.Split(strings.Trim(cg.Path, "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		name := strings.TrimSuffix(segments[i], ".scope")
+		for _, p := range cgroupRuntimePrefixes {
+			if strings.HasPrefix(name, p.prefix) && isContainerID(name[len(p.prefix):]) {
+				return p.runtime, name[len(p.prefix):]
+			}
+		}
+		if i > 0 && isContainerID(name) {
+			if runtime, ok := cgroupRuntimeParents[segments[i-1]]; ok {
+				return runtime, name
+			}
+			if segments[0] == "kubepods" && strings.HasPrefix(segments[i-1], "pod") {
+				return CgroupRuntimeUnknown, name
+			}
+		}
+	}
+	return "", ""
+}
+
+// Runtime returns what created cg, judging by its path: the runtime of the
+// innermost container it's in, or systemd if it's in none but is a systemd
+// unit.
+func (cg Cgroup) Runtime() CgroupRuntime {
+	if runtime, _ := cg.container(); runtime != "" {
+		return runtime
+	}
+	if isSystemdUnit(path.Base(cg.Path)) {
+		return CgroupRuntimeSystemd
+	}
+	return CgroupRuntimeUnknown
+}
+
+// ContainerID returns the id of the innermost container cg is in, judging by
+// its path, or "" if it's in none.
+func (cg Cgroup) ContainerID() string {
+	_, id := cg.container()
+	return id
+}
+
+// IsContainer returns true if cg is in a container, judging by its path as
+// ContainerID does, whichever runtime made it, rather than e.g. in a host
+// service or a user's slice.
+func (cg Cgroup) IsContainer() bool {
+	return cg.ContainerID() != ""
+}
+
+// SystemdUnit returns the innermost systemd unit cg is in, judging by its
+// path, e.g. nginx.service or docker-<id>.scope, or "" if it's in none.
+func (cg Cgroup) SystemdUnit() string {
+	if units := cg.SystemdUnits(); len(units) > 0 {
+		return units[0]
+	}
+	return ""
+}
+
+// SystemdUnits returns the systemd units cg is in, judging by its path,
+// innermost first, e.g. foo.service, app.slice, user@1000.service,
+// user-1000.slice and user.slice for a user's service.
+func (cg Cgroup) SystemdUnits() []string {
+	var units []string
+	segments := strings.Split(strings.Trim(cg.Path, "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if isSystemdUnit(segments[i]) {
+			units = append(units, segments[i])
+		}
+	}
+	return units
+}
+
+// isSystemdUnit returns true if name is that of a systemd unit that can
+// hold procs, i.e. a service, scope or slice.
+func isSystemdUnit(name string) bool {
+	for _, suffix := range []string{".service", ".scope", ".slice"} {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CgroupsRuntime returns the runtime of a proc placed in cgroups, see
+// Cgroup.Runtime: that of the first cgroup in a container, else systemd if
+// any cgroup is a systemd unit, else unknown.
+func CgroupsRuntime(cgroups []Cgroup) CgroupRuntime {
+	runtime := CgroupRuntimeUnknown
+	for _, cg := range cgroups {
+		switch r := cg.Runtime(); r {
+		case CgroupRuntimeSystemd:
+			runtime = r
+		case CgroupRuntimeUnknown:
+		default:
+			return r
+		}
+	}
+	return runtime
+}
+
+// isContainerID returns true if s looks like a container id: hex, and at
+// least as long as the 12 digits short ids have.
+func isContainerID(s string) bool {
+	if len(s) < 12 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package proc
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestCgroupRuntime verifies that runtimes are told apart by the paths they
+// give their containers with either cgroup driver, and that other cgroups
+// are systemd's if they're units.
+func TestCgroupRuntime(t *testing.T) {
+	id := "4f1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+	for _, tc := range []struct {
+		path string
+		want CgroupRuntime
+	}{
+		{"/system.slice/docker-" + id + ".scope", CgroupRuntimeDocker},
+		{"/docker/" + id, CgroupRuntimeDocker},
+		{"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1234.slice/docker-" + id + ".scope",
+			CgroupRuntimeDocker},
+		{"/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1234.slice/cri-containerd-" + id + ".scope",
+			CgroupRuntimeContainerd},
+		{"/kubepods.slice/kubepods-pod1234.slice/crio-" + id + ".scope", CgroupRuntimeCRIO},
+		{"/kubepods.slice/kubepods-pod1234.slice/crio-conmon-" + id + ".scope", CgroupRuntimeCRIO},
+		{"/kubepods/besteffort/pod1234/crio-" + id, CgroupRuntimeCRIO},
+		{"/machine.slice/libpod-" + id + ".scope", CgroupRuntimePodman},
+		{"/machine.slice/libpod-conmon-" + id + ".scope", CgroupRuntimePodman},
+		{"/user.slice/user-1000.slice/user@1000.service/user.slice/libpod-" + id + ".scope/container",
+			CgroupRuntimePodman},
+		{"/libpod_parent/libpod-" + id, CgroupRuntimePodman},
+		// systemd inside a container is still the container's.
+		{"/system.slice/docker-" + id + ".scope/init.scope", CgroupRuntimeDocker},
+		{"/system.slice/sshd.service", CgroupRuntimeSystemd},
+		{"/system.slice/docker.service", CgroupRuntimeSystemd},
+		{"/system.slice/docker-compose@web.service", CgroupRuntimeSystemd},
+		{"/user.slice/user-1000.slice/session-3.scope", CgroupRuntimeSystemd},
+		{"/init.scope", CgroupRuntimeSystemd},
+		{"/kubepods/besteffort/pod1234/" + id, CgroupRuntimeUnknown},
+		{"/", CgroupRuntimeUnknown},
+		{"", CgroupRuntimeUnknown},
+	} {
+		if got := (Cgroup{Path: tc.path}).Runtime(); got != tc.want {
+			t.Errorf("%s: got runtime %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+// TestCgroupContainerAndUnit verifies that container ids are found whichever
+// runtime or driver made them, and that the unit is the innermost one.
+func TestCgroupContainerAndUnit(t *testing.T) {
+	id := "4f1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+	for _, tc := range []struct {
+		path        string
+		containerID string
+		unit        string
+	}{
+		{"/system.slice/docker-" + id + ".scope", id, "docker-" + id + ".scope"},
+		{"/docker/" + id, id, ""},
+		{"/kubepods.slice/kubepods-pod1234.slice/crio-conmon-" + id + ".scope", id, "crio-conmon-" + id + ".scope"},
+		{"/kubepods/besteffort/pod1234/" + id, id, ""},
+		{"/system.slice/docker-" + id + ".scope/init.scope", id, "init.scope"},
+		{"/system.slice/nginx.service", "", "nginx.service"},
+		{"/system.slice/nginx.service/workers", "", "nginx.service"},
+		{"/user.slice", "", "user.slice"},
+		{"/", "", ""},
+		{"", "", ""},
+	} {
+		cg := Cgroup{Path: tc.path}
+		if got := cg.ContainerID(); got != tc.containerID {
+			t.Errorf("%s: got container id %q, want %q", tc.path, got, tc.containerID)
+		}
+		if got := cg.SystemdUnit(); got != tc.unit {
+			t.Errorf("%s: got unit %q, want %q", tc.path, got, tc.unit)
+		}
+	}
+}
+
+// TestCgroupIsContainer verifies that the cgroups of containers are told
+// from those of the host, including systemd's scopes and slices that merely
+// look like a container's.
+func TestCgroupIsContainer(t *testing.T) {
+	id := "4f1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{"/system.slice/docker-" + id + ".scope", true},
+		{"/docker/" + id, true},
+		{"/kubepods.slice/kubepods-pod1234.slice/cri-containerd-" + id + ".scope", true},
+		{"/kubepods/besteffort/pod1234/" + id, true},
+		{"/machine.slice/libpod-conmon-" + id + ".scope", true},
+		{"/system.slice/docker-" + id + ".scope/init.scope", true},
+		{"/system.slice/docker.service", false},
+		{"/system.slice/docker-compose@web.service", false},
+		{"/system.slice/docker-abc.scope", false},
+		{"/kubepods.slice/kubepods-pod1234.slice", false},
+		{"/user.slice/user-1000.slice/session-3.scope", false},
+		{"/init.scope", false},
+		{"/", false},
+		{"", false},
+	} {
+		if got := (Cgroup{Path: tc.path}).IsContainer(); got != tc.want {
+			t.Errorf("%s: got IsContainer %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+// TestCgroupSystemdUnits verifies that every unit on the path is found,
+// innermost first.
+func TestCgroupSystemdUnits(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want []string
+	}{
+		{"/user.slice/user-1000.slice/user@1000.service/app.slice/foo.service",
+			[]string{"foo.service", "app.slice", "user@1000.service", "user-1000.slice", "user.slice"}},
+		{"/system.slice/nginx.service/workers", []string{"nginx.service", "system.slice"}},
+		{"/", nil},
+	} {
+		if diff := cmp.Diff((Cgroup{Path: tc.path}).SystemdUnits(), tc.want); diff != "" {
+			t.Errorf("%s: units differ: (-got +want)\n%s", tc.path, diff)
+		}
+	}
+}
+
+// TestCgroupsRuntime verifies that a proc's runtime is that of the first of
+// its cgroups in a container, and that it's read by GetStatic when asked.
+func TestCgroupsRuntime(t *testing.T) {
+	id := "4f1b2c3d4e5f"
+	for _, tc := range []struct {
+		cgroups []Cgroup
+		want    CgroupRuntime
+	}{
+		{nil, CgroupRuntimeUnknown},
+		{[]Cgroup{{HierarchyID: 1, Controllers: []string{"name=systemd"}, Path: "/system.slice/docker.service"},
+			{HierarchyID: 4, Controllers: []string{"memory"}, Path: "/docker/" + id}}, CgroupRuntimeDocker},
+		{[]Cgroup{{HierarchyID: 4, Controllers: []string{"memory"}, Path: "/"},
+			{HierarchyID: 1, Controllers: []string{"name=systemd"}, Path: "/system.slice/cron.service"}},
+			CgroupRuntimeSystemd},
+	} {
+		if got := CgroupsRuntime(tc.cgroups); got != tc.want {
+			t.Errorf("%v: got runtime %q, want %q", tc.cgroups, got, tc.want)
+		}
+	}
+
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	for _, gather := range []bool{false, true} {
+		fs.GatherRuntime = gather
+		procs := fs.AllProcs()
+		for procs.Next() {
+			static, err := procs.GetStatic()
+			noerr(t, err)
+			want := CgroupRuntime("")
+			if gather {
+				want = CgroupRuntimeSystemd
+			}
+			if static.Runtime != want {
+				t.Errorf("gather=%v: got runtime %q, want %q", gather, static.Runtime, want)
+			}
+		}
+		noerr(t, procs.Close())
+	}
+}
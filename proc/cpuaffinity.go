@@ -0,0 +1,28 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// parseCPUsAllowed returns the number of CPUs the proc may run on from the
+// contents of /proc/<pid>/status, counting Cpus_allowed_list as a cpuset's
+// list is, e.g. 8 for "0-3,8-11".
+func parseCPUsAllowed(data []byte) (int, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if list := strings.TrimPrefix(scanner.Text(), "Cpus_allowed_list:"); list != scanner.Text() {
+			cpus, err := parseCPUList(list)
+			if err != nil {
+				return 0, fmt.Errorf("malformed Cpus_allowed_list: %v", err)
+			}
+			return len(cpus), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no Cpus_allowed_list in status")
+}
@@ -0,0 +1,61 @@
+package proc
+
+import "testing"
+
+// TestParseCPUsAllowed verifies that Cpus_allowed_list is counted by
+// range, and that malformed ones are rejected.
+func TestParseCPUsAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		list string
+		want int
+	}{
+		{"", 0},
+		{"0", 1},
+		{"0-7", 8},
+		{"0-3,8-11", 8},
+		{" 1,3,5-6", 4},
+	} {
+		got, err := parseCPUsAllowed([]byte("Name:\tbash\nCpus_allowed_list:\t" + tc.list + "\n"))
+		if err != nil {
+			t.Errorf("%q: %v", tc.list, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %d, want %d", tc.list, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"a", "3-1", "1,,2", "-1"} {
+		if _, err := parseCPUsAllowed([]byte("Cpus_allowed_list:\t" + bad + "\n")); err == nil {
+			t.Errorf("expected error counting %q", bad)
+		}
+	}
+}
+
+// TestReadCPUsAllowed verifies that the affinity is read from status only if
+// asked for.
+func TestReadCPUsAllowed(t *testing.T) {
+	if _, err := parseCPUsAllowed([]byte("Name:\tbash\nCpus_allowed:\tff\n")); err == nil {
+		t.Errorf("expected error parsing status without Cpus_allowed_list")
+	}
+
+	for _, gather := range []bool{false, true} {
+		fs, err := NewFS("../fixtures", false)
+		noerr(t, err)
+		fs.GatherCPUsAllowed = gather
+		procs := fs.AllProcs()
+		var got []int
+		for procs.Next() {
+			pii, err := procinfo(procs)
+			noerr(t, err)
+			got = append(got, pii.CPUsAllowed)
+		}
+		noerr(t, procs.Close())
+		want := 0
+		if gather {
+			want = 8
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("gather=%v: got %v, want [%d]", gather, got, want)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package proc
 
 import (
+	"log"
+	"sort"
+	"strings"
 	"time"
 
 	seq "github.com/ncabatoff/go-seq/seq"
@@ -16,9 +19,34 @@ type (
 		groupAccum  map[string]Counts
 		tracker     *Tracker
 		threadAccum map[string]map[string]Threads
+		// members maps each proc seen in the last cycle to its group name.
+		// It is nil until the first cycle has completed.
+		members map[ID]string
+		// churnAccum records the historical process starts and exits of a group.
+		churnAccum map[string]Churn
+		// staleTTL, if positive, is how long a group may have no procs before
+		// it's left out of the results, see SetStaleGroupTTL.  lastActive
+		// records when each group last had procs, according to now.
+		staleTTL   time.Duration
+		lastActive map[string]time.Time
+		// ageBuckets are the upper bounds of the age buckets of groups, see
+		// SetAgeBuckets.
+		ageBuckets []time.Duration
+		// definitions records the definition of each group, if the namer
+		// gives them, see common.DefinitionNamer.
+		definitions map[string]string
+		now         func() time.Time
 		debug       bool
 	}
 
+	// Churn counts the processes that have joined and left a group.
+	Churn struct {
+		// Starts is the number of processes that have joined the group.
+		Starts uint64
+		// Exits is the number of processes that have left the group.
+		Exits uint64
+	}
+
 	// GroupByName maps group name to group metrics.
 	GroupByName map[string]Group
 
@@ -41,6 +69,48 @@ type (
 		WorstFDratio    float64
 		NumThreads      uint64
 		Threads         []Threads
+		Churn
+		NewestStartTime time.Time
+		// SMapsProcs is the number of procs whose Memory includes the
+		// fields read from smaps.
+		SMapsProcs int
+		// Zombies is the number of zombies the namer puts in the group as
+		// of the update, whichever group they were in while alive.
+		Zombies int
+		// Cgroups holds the distinct cgroup placements of the procs in the
+		// group, where known.
+		Cgroups [][]Cgroup
+		// LowestNice is the lowest nice value of the procs in the group.
+		LowestNice int
+		// HighestPriority is the lowest, i.e. most favoured, scheduling
+		// priority of the procs in the group, see Metrics.Priority.
+		HighestPriority int
+		// Realtime is the number of procs with a realtime scheduling policy,
+		// themselves or any of their threads, counted only if policies are
+		// known, see SchedPolicies.
+		Realtime int
+		// WorstThreads is the highest thread count of the procs in the group.
+		WorstThreads uint64
+		// Blocked is how many procs in the group are in uninterruptible
+		// sleep on each wchan, see Metrics.BlockedWchan.  It's nil if none
+		// are.
+		Blocked map[string]int
+		// AgeBuckets is how many procs in the group are no older than each
+		// of the bounds given to SetAgeBuckets.  It's nil if there are none.
+		AgeBuckets []uint64
+		// Capabilities is how many procs in the group hold each capability,
+		// by bit, in their effective set.  It's nil if none do.
+		Capabilities map[int]int
+		// Netns maps the distinct network namespaces of the procs in the
+		// group, where known, to the pid of a proc in each.
+		Netns map[uint64]int
+		// SchedPolicies is how many procs in the group, or threads if
+		// they're gathered, have each scheduling policy.  It's nil if
+		// policies aren't known.
+		SchedPolicies map[string]int
+		// MinCPUsAllowed is the fewest CPUs any proc in the group may run
+		// on, or 0 if none of their affinities are known.
+		MinCPUsAllowed int
 	}
 )
 
@@ -53,6 +123,10 @@ func NewGrouper(namer common.MatchNamer, trackChildren, trackThreads, alwaysRech
 	g := Grouper{
 		groupAccum:  make(map[string]Counts),
 		threadAccum: make(map[string]map[string]Threads),
+		churnAccum:  make(map[string]Churn),
+		lastActive:  make(map[string]time.Time),
+		definitions: make(map[string]string),
+		now:         time.Now,
 		tracker:     NewTracker(namer, trackChildren, trackThreads, alwaysRecheck, debug),
 		debug:       debug,
 	}
@@ -63,11 +137,32 @@ func groupadd(grp Group, ts Update) Group {
 	var zeroTime time.Time
 
 	grp.Procs++
+	if grp.Procs == 1 || ts.Nice < grp.LowestNice {
+		grp.LowestNice = ts.Nice
+	}
+	if grp.Procs == 1 || ts.Priority < grp.HighestPriority {
+		grp.HighestPriority = ts.Priority
+	}
+	for policy, count := range ts.SchedPolicies {
+		if count > 0 && realtimeSchedPolicy(policy) {
+			grp.Realtime++
+			break
+		}
+	}
 	grp.Memory.ResidentBytes += ts.Memory.ResidentBytes
 	grp.Memory.VirtualBytes += ts.Memory.VirtualBytes
 	grp.Memory.VmSwapBytes += ts.Memory.VmSwapBytes
+	grp.Memory.LockedBytes += ts.Memory.LockedBytes
+	grp.Memory.PinnedBytes += ts.Memory.PinnedBytes
+	grp.Memory.ResidentAnonBytes += ts.Memory.ResidentAnonBytes
+	grp.Memory.ResidentFileBytes += ts.Memory.ResidentFileBytes
+	grp.Memory.ResidentShmemBytes += ts.Memory.ResidentShmemBytes
 	grp.Memory.ProportionalBytes += ts.Memory.ProportionalBytes
 	grp.Memory.ProportionalSwapBytes += ts.Memory.ProportionalSwapBytes
+	grp.Memory.UniqueBytes += ts.Memory.UniqueBytes
+	if ts.SMaps {
+		grp.SMapsProcs++
+	}
 	if ts.Filedesc.Open != -1 {
 		grp.OpenFDs += uint64(ts.Filedesc.Open)
 	}
@@ -76,11 +171,17 @@ func groupadd(grp Group, ts Update) Group {
 		grp.WorstFDratio = openratio
 	}
 	grp.NumThreads += ts.NumThreads
+	if grp.WorstThreads < ts.NumThreads {
+		grp.WorstThreads = ts.NumThreads
+	}
 	grp.Counts.Add(ts.Latest)
 	grp.States.Add(ts.States)
 	if grp.OldestStartTime == zeroTime || ts.Start.Before(grp.OldestStartTime) {
 		grp.OldestStartTime = ts.Start
 	}
+	if ts.Start.After(grp.NewestStartTime) {
+		grp.NewestStartTime = ts.Start
+	}
 
 	if grp.Wchans == nil {
 		grp.Wchans = make(map[string]int)
@@ -88,10 +189,143 @@ func groupadd(grp Group, ts Update) Group {
 	for wchan, count := range ts.Wchans {
 		grp.Wchans[wchan] += count
 	}
+	if ts.Blocked {
+		if grp.Blocked == nil {
+			grp.Blocked = make(map[string]int)
+		}
+		grp.Blocked[ts.BlockedWchan]++
+	}
+	for bit := 0; ts.CapEff>>uint(bit) != 0; bit++ {
+		if ts.CapEff&(1<<uint(bit)) != 0 {
+			if grp.Capabilities == nil {
+				grp.Capabilities = make(map[int]int)
+			}
+			grp.Capabilities[bit]++
+		}
+	}
+	if ts.Netns != 0 {
+		if grp.Netns == nil {
+			grp.Netns = make(map[uint64]int)
+		}
+		if _, ok := grp.Netns[ts.Netns]; !ok {
+			grp.Netns[ts.Netns] = ts.ID.Pid
+		}
+	}
+	if ts.CPUsAllowed > 0 && (grp.MinCPUsAllowed == 0 || ts.CPUsAllowed < grp.MinCPUsAllowed) {
+		grp.MinCPUsAllowed = ts.CPUsAllowed
+	}
+	for policy, count := range ts.SchedPolicies {
+		if grp.SchedPolicies == nil {
+			grp.SchedPolicies = make(map[string]int)
+		}
+		grp.SchedPolicies[policy] += count
+	}
 
 	return grp
 }
 
+// OrphanedZombies returns the number of zombies whose parent is pid 1 seen by
+// the last Update, whether tracked or not.
+func (g *Grouper) OrphanedZombies() int {
+	return g.tracker.orphanedZombies
+}
+
+// SetOtherGroup makes procs that aren't tracked otherwise, e.g. because the
+// namer doesn't match them, tracked in a group named name.  Kernel threads
+// are included only if kernelThreads is true.  An empty name disables it.
+func (g *Grouper) SetOtherGroup(name string, kernelThreads bool) {
+	g.tracker.otherGroup = name
+	g.tracker.otherKernelThreads = kernelThreads
+}
+
+// SetStaleGroupTTL makes groups that have had no procs for ttl or longer be
+// left out of the results of Update, so that they stop being reported.  Their
+// counts are still kept, so they resume from where they were if the group
+// gets procs again.  Zero, the default, keeps reporting them forever.
+func (g *Grouper) SetStaleGroupTTL(ttl time.Duration) {
+	g.staleTTL = ttl
+}
+
+// SetRecheckInterval makes ignored procs, those neither matched by the namer
+// nor with trackChildren tracked as children, be matched again every
+// interval, so that procs that change their cmdline after starting end up
+// in their group.  Procs matched that way only count what they use from then
+// on.  Zero, the default, only matches them again on every Update with
+// alwaysRecheck, or without trackChildren.
+func (g *Grouper) SetRecheckInterval(interval time.Duration) {
+	g.tracker.recheckInterval = interval
+}
+
+// SetReadWorkers makes Update read procs on workers goroutines, ahead of
+// handling them, rather than one at a time.  Each worker may have a couple
+// of files open at once, see MaxReadWorkers.  One, the default, reads them
+// as they're handled.
+func (g *Grouper) SetReadWorkers(workers int) {
+	g.tracker.readWorkers = workers
+}
+
+// SetAgeBuckets makes groups count their procs by age, as of each Update,
+// into buckets with the given upper bounds, which must be sorted.  None, the
+// default, disables it.
+func (g *Grouper) SetAgeBuckets(bounds []time.Duration) {
+	g.ageBuckets = bounds
+}
+
+// ProcSamples returns the state of each proc tracked as of the last Update.
+func (g *Grouper) ProcSamples() []ProcSample {
+	return g.tracker.samples()
+}
+
+// Explain returns why proc is or isn't in a group, see ProcExplanation.  The
+// namer's verdict is reached anew, so it may differ from that of the last
+// Update if the proc has changed since.
+func (g *Grouper) Explain(proc Proc) (ProcExplanation, error) {
+	return g.tracker.explain(proc)
+}
+
+// ProcsScanned returns the number of procs seen by the last Update, tracked
+// or not.
+func (g *Grouper) ProcsScanned() int {
+	return g.tracker.procsScanned
+}
+
+// ProcsMatched returns the number of procs belonging to a group in the last
+// Update, not counting the other group.
+func (g *Grouper) ProcsMatched() int {
+	return g.tracker.procsMatched
+}
+
+// SetNamer replaces the namer used to group procs, e.g. after reloading the
+// config it came from.  Tracked procs are named again by it, so they move to
+// their new group on the next Update.  Groups keep their counts, except that
+// if the namer implements common.DefinitionNamer a group whose definition
+// changed starts again from zero.  Groups the namer no longer gives keep
+// being reported until the stale group TTL, if any, retires them.
+func (g *Grouper) SetNamer(namer common.MatchNamer) {
+	g.tracker.setNamer(namer)
+}
+
+// redefined forgets the history of the groups in groups whose definition
+// differs from the one they had when last seen.
+func (g *Grouper) redefined(groups GroupByName) {
+	dn, ok := g.tracker.namer.(common.DefinitionNamer)
+	if !ok {
+		return
+	}
+	for gname := range groups {
+		def := dn.GroupDefinition(gname)
+		if old, ok := g.definitions[gname]; ok && old != def {
+			if g.debug {
+				log.Printf("group %q redefined, resetting its counts", gname)
+			}
+			delete(g.groupAccum, gname)
+			delete(g.threadAccum, gname)
+			delete(g.churnAccum, gname)
+		}
+		g.definitions[gname] = def
+	}
+}
+
 // Update asks the tracker to report on each tracked process by name.
 // These are aggregated by groupname, augmented by accumulated counts
 // from the past, and returned.  Note that while the Tracker reports
@@ -99,7 +333,7 @@ func groupadd(grp Group, ts Update) Group {
 // returns counts that never decrease.  Even once the last process
 // with name X disappears, name X will still appear in the results
 // with the same counts as before; of course, all non-count metrics
-// will be zero.
+// will be zero.  That lasts until the stale group TTL expires, if set.
 func (g *Grouper) Update(iter Iter) (CollectErrors, GroupByName, error) {
 	cerrs, tracked, err := g.tracker.Update(iter)
 	if err != nil {
@@ -112,36 +346,109 @@ func (g *Grouper) Update(iter Iter) (CollectErrors, GroupByName, error) {
 func (g *Grouper) groups(tracked []Update) GroupByName {
 	groups := make(GroupByName)
 	threadsByGroup := make(map[string][]ThreadUpdate)
+	// placements holds the cgroupsKey of each placement in Cgroups, by
+	// group, so that each is only added once.
+	placements := make(map[string]map[string]bool)
 
+	now := g.now()
 	for _, update := range tracked {
-		groups[update.GroupName] = groupadd(groups[update.GroupName], update)
+		group := groupadd(groups[update.GroupName], update)
+		if len(update.Cgroups) > 0 {
+			if placements[update.GroupName] == nil {
+				placements[update.GroupName] = make(map[string]bool)
+			}
+			if key := cgroupsKey(update.Cgroups); !placements[update.GroupName][key] {
+				placements[update.GroupName][key] = true
+				group.Cgroups = append(group.Cgroups, update.Cgroups)
+			}
+		}
+		if len(g.ageBuckets) > 0 {
+			if group.AgeBuckets == nil {
+				group.AgeBuckets = make([]uint64, len(g.ageBuckets))
+			}
+			age := now.Sub(update.Start)
+			for i, bound := range g.ageBuckets {
+				if age <= bound {
+					group.AgeBuckets[i]++
+				}
+			}
+		}
+		groups[update.GroupName] = group
 		if update.Threads != nil {
 			threadsByGroup[update.GroupName] =
 				append(threadsByGroup[update.GroupName], update.Threads...)
 		}
 	}
 
+	g.redefined(groups)
+	g.churn(tracked)
+
 	// Add any accumulated counts to what was just observed,
 	// and update the accumulators.
 	for gname, group := range groups {
+		g.lastActive[gname] = now
 		if oldcounts, ok := g.groupAccum[gname]; ok {
 			group.Counts.Add(Delta(oldcounts))
 		}
 		g.groupAccum[gname] = group.Counts
 		group.Threads = g.threads(gname, threadsByGroup[gname])
+		group.Churn = g.churnAccum[gname]
 		groups[gname] = group
 	}
 
-	// Now add any groups that were observed in the past but aren't running now.
+	// Now add any groups that were observed in the past but aren't running
+	// now, unless they've gone stale.
 	for gname, gcounts := range g.groupAccum {
-		if _, ok := groups[gname]; !ok {
-			groups[gname] = Group{Counts: gcounts}
+		if _, ok := groups[gname]; ok {
+			continue
 		}
+		if g.staleTTL > 0 && now.Sub(g.lastActive[gname]) >= g.staleTTL {
+			continue
+		}
+		groups[gname] = Group{Counts: gcounts, Churn: g.churnAccum[gname]}
+	}
+
+	// Zombies are counted in the group they'd be put in now rather than in
+	// the one they were tracked in, see Tracker.countZombie.  Groups not
+	// reported don't get reported just for them.
+	for gname, group := range groups {
+		group.Zombies = g.tracker.zombies[gname]
+		groups[gname] = group
 	}
 
 	return groups
 }
 
+// churn diffs the membership of each group against the last cycle and
+// updates the accumulated starts and exits.  Procs are identified by
+// (pid,starttime) so that a reused pid counts as one exit and one start.
+// Nothing is counted on the first cycle, since we don't know which of the
+// procs found then are new.
+func (g *Grouper) churn(tracked []Update) {
+	members := make(map[ID]string, len(tracked))
+	for _, update := range tracked {
+		members[update.ID] = update.GroupName
+	}
+
+	if g.members != nil {
+		for id, gname := range members {
+			if oldgname, ok := g.members[id]; !ok || oldgname != gname {
+				c := g.churnAccum[gname]
+				c.Starts++
+				g.churnAccum[gname] = c
+			}
+		}
+		for id, oldgname := range g.members {
+			if gname, ok := members[id]; !ok || oldgname != gname {
+				c := g.churnAccum[oldgname]
+				c.Exits++
+				g.churnAccum[oldgname] = c
+			}
+		}
+	}
+	g.members = members
+}
+
 func (g *Grouper) threads(gname string, tracked []ThreadUpdate) []Threads {
 	if len(tracked) == 0 {
 		delete(g.threadAccum, gname)
@@ -179,3 +486,67 @@ func (g *Grouper) threads(gname string, tracked []ThreadUpdate) []Threads {
 	}
 	return ret
 }
+
+const (
+	// BlockedOther is the wchan TopBlocked folds all but the top wchans into.
+	BlockedOther = "other"
+	// BlockedUnknown is the wchan of blocked procs whose wchan can't be
+	// read, e.g. when the kernel hides it.
+	BlockedUnknown = "unknown"
+	// maxWchanLen is the length wchans are truncated to.
+	maxWchanLen = 64
+)
+
+// sanitizeWchan returns wchan with anything but the characters kernel symbols
+// are normally made of replaced by underscores, truncated to maxWchanLen.
+func sanitizeWchan(wchan string) string {
+	if wchan == "" {
+		return BlockedUnknown
+	}
+	if len(wchan) > maxWchanLen {
+		wchan = wchan[:maxWchanLen]
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, wchan)
+}
+
+// TopBlocked returns the k wchans in blocked, a Group.Blocked, with the most
+// procs blocked on them, and the procs blocked on any other wchan counted
+// under BlockedOther.  Wchans are sanitized for use as label values.
+func TopBlocked(blocked map[string]int, k int) map[string]int {
+	counts := make(map[string]int, len(blocked))
+	for wchan, count := range blocked {
+		counts[sanitizeWchan(wchan)] += count
+	}
+	if len(counts) <= k {
+		return counts
+	}
+
+	wchans := make([]string, 0, len(counts))
+	for wchan := range counts {
+		wchans = append(wchans, wchan)
+	}
+	// Break ties by name so that the same wchans are kept on each scrape.
+	sort.Slice(wchans, func(i, j int) bool {
+		ci, cj := counts[wchans[i]], counts[wchans[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		return wchans[i] < wchans[j]
+	})
+
+	top := make(map[string]int, k+1)
+	for i, wchan := range wchans {
+		if i < k {
+			top[wchan] += counts[wchan]
+		} else {
+			top[BlockedOther] += counts[wchan]
+		}
+	}
+	return top
+}
@@ -1,11 +1,14 @@
 package proc
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	common "github.com/ncabatoff/process-exporter"
 )
 
 type grouptest struct {
@@ -45,30 +48,30 @@ func TestGrouperBasic(t *testing.T) {
 	}{
 		{
 			[]IDInfo{
-				piinfost(p1, n1, Counts{1, 2, 3, 4, 5, 6, 0, 0}, Memory{7, 8, 0, 0, 0},
+				piinfost(p1, n1, Counts{1, 2, 3, 4, 5, 6, 0, 0, 0, 0, 0, 0}, Memory{7, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0},
 					Filedesc{4, 400}, 2, States{Other: 1}),
-				piinfost(p2, n2, Counts{2, 3, 4, 5, 6, 7, 0, 0}, Memory{8, 9, 0, 0, 0},
+				piinfost(p2, n2, Counts{2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 0, 0}, Memory{8, 9, 0, 0, 0, 0, 0, 0, 0, 0, 0},
 					Filedesc{40, 400}, 3, States{Waiting: 1}),
 			},
 			GroupByName{
-				"g1": Group{Counts{}, States{Other: 1}, msi{}, 1, Memory{7, 8, 0, 0, 0}, starttime,
-					4, 0.01, 2, nil},
-				"g2": Group{Counts{}, States{Waiting: 1}, msi{}, 1, Memory{8, 9, 0, 0, 0}, starttime,
-					40, 0.1, 3, nil},
+				"g1": Group{Counts{}, States{Other: 1}, msi{}, 1, Memory{7, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0}, starttime,
+					4, 0.01, 2, nil, Churn{}, starttime, 0, 0, nil, 0, 0, 0, 2, nil, nil, nil, nil, nil, 0},
+				"g2": Group{Counts{}, States{Waiting: 1}, msi{}, 1, Memory{8, 9, 0, 0, 0, 0, 0, 0, 0, 0, 0}, starttime,
+					40, 0.1, 3, nil, Churn{}, starttime, 0, 0, nil, 0, 0, 0, 3, msi{"": 1}, nil, nil, nil, nil, 0},
 			},
 		},
 		{
 			[]IDInfo{
-				piinfost(p1, n1, Counts{2, 3, 4, 5, 6, 7, 0, 0},
-					Memory{6, 7, 0, 0, 0}, Filedesc{100, 400}, 4, States{Zombie: 1}),
-				piinfost(p2, n2, Counts{4, 5, 6, 7, 8, 9, 0, 0},
-					Memory{9, 8, 0, 0, 0}, Filedesc{400, 400}, 2, States{Running: 1}),
+				piinfost(p1, n1, Counts{2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 0, 0},
+					Memory{6, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Filedesc{100, 400}, 4, States{Zombie: 1}),
+				piinfost(p2, n2, Counts{4, 5, 6, 7, 8, 9, 0, 0, 0, 0, 0, 0},
+					Memory{9, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Filedesc{400, 400}, 2, States{Running: 1}),
 			},
 			GroupByName{
-				"g1": Group{Counts{1, 1, 1, 1, 1, 1, 0, 0}, States{Zombie: 1}, msi{}, 1,
-					Memory{6, 7, 0, 0, 0}, starttime, 100, 0.25, 4, nil},
-				"g2": Group{Counts{2, 2, 2, 2, 2, 2, 0, 0}, States{Running: 1}, msi{}, 1,
-					Memory{9, 8, 0, 0, 0}, starttime, 400, 1, 2, nil},
+				"g1": Group{Counts{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}, States{Zombie: 1}, msi{}, 1,
+					Memory{6, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0}, starttime, 100, 0.25, 4, nil, Churn{}, starttime, 0, 1, nil, 0, 0, 0, 4, nil, nil, nil, nil, nil, 0},
+				"g2": Group{Counts{2, 2, 2, 2, 2, 2, 0, 0, 0, 0, 0, 0}, States{Running: 1}, msi{}, 1,
+					Memory{9, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0}, starttime, 400, 1, 2, nil, Churn{}, starttime, 0, 0, nil, 0, 0, 0, 2, nil, nil, nil, nil, nil, 0},
 			},
 		},
 	}
@@ -95,35 +98,35 @@ func TestGrouperProcJoin(t *testing.T) {
 	}{
 		{
 			[]IDInfo{
-				piinfo(p1, n1, Counts{1, 2, 3, 4, 5, 6, 0, 0}, Memory{3, 4, 0, 0, 0}, Filedesc{4, 400}, 2),
+				piinfo(p1, n1, Counts{1, 2, 3, 4, 5, 6, 0, 0, 0, 0, 0, 0}, Memory{3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Filedesc{4, 400}, 2),
 			},
 			GroupByName{
-				"g1": Group{Counts{}, States{}, msi{}, 1, Memory{3, 4, 0, 0, 0}, starttime, 4, 0.01, 2, nil},
+				"g1": Group{Counts{}, States{}, msi{}, 1, Memory{3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0}, starttime, 4, 0.01, 2, nil, Churn{}, starttime, 0, 0, nil, 0, 0, 0, 2, nil, nil, nil, nil, nil, 0},
 			},
 		}, {
 			// The counts for pid2 won't be factored into the total yet because we only add
 			// to counts starting with the second time we see a proc. Memory and FDs are
 			// affected though.
 			[]IDInfo{
-				piinfost(p1, n1, Counts{3, 4, 5, 6, 7, 8, 0, 0},
-					Memory{3, 4, 0, 0, 0}, Filedesc{4, 400}, 2, States{Running: 1}),
-				piinfost(p2, n2, Counts{1, 1, 1, 1, 1, 1, 0, 0},
-					Memory{1, 2, 0, 0, 0}, Filedesc{40, 400}, 3, States{Sleeping: 1}),
+				piinfost(p1, n1, Counts{3, 4, 5, 6, 7, 8, 0, 0, 0, 0, 0, 0},
+					Memory{3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Filedesc{4, 400}, 2, States{Running: 1}),
+				piinfost(p2, n2, Counts{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0},
+					Memory{1, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Filedesc{40, 400}, 3, States{Sleeping: 1}),
 			},
 			GroupByName{
-				"g1": Group{Counts{2, 2, 2, 2, 2, 2, 0, 0}, States{Running: 1, Sleeping: 1}, msi{}, 2,
-					Memory{4, 6, 0, 0, 0}, starttime, 44, 0.1, 5, nil},
+				"g1": Group{Counts{2, 2, 2, 2, 2, 2, 0, 0, 0, 0, 0, 0}, States{Running: 1, Sleeping: 1}, msi{}, 2,
+					Memory{4, 6, 0, 0, 0, 0, 0, 0, 0, 0, 0}, starttime, 44, 0.1, 5, nil, Churn{Starts: 1}, starttime, 0, 0, nil, 0, 0, 0, 3, nil, nil, nil, nil, nil, 0},
 			},
 		}, {
 			[]IDInfo{
-				piinfost(p1, n1, Counts{4, 5, 6, 7, 8, 9, 0, 0},
-					Memory{1, 5, 0, 0, 0}, Filedesc{4, 400}, 2, States{Running: 1}),
-				piinfost(p2, n2, Counts{2, 2, 2, 2, 2, 2, 0, 0},
-					Memory{2, 4, 0, 0, 0}, Filedesc{40, 400}, 3, States{Running: 1}),
+				piinfost(p1, n1, Counts{4, 5, 6, 7, 8, 9, 0, 0, 0, 0, 0, 0},
+					Memory{1, 5, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Filedesc{4, 400}, 2, States{Running: 1}),
+				piinfost(p2, n2, Counts{2, 2, 2, 2, 2, 2, 0, 0, 0, 0, 0, 0},
+					Memory{2, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Filedesc{40, 400}, 3, States{Running: 1}),
 			},
 			GroupByName{
-				"g1": Group{Counts{4, 4, 4, 4, 4, 4, 0, 0}, States{Running: 2}, msi{}, 2,
-					Memory{3, 9, 0, 0, 0}, starttime, 44, 0.1, 5, nil},
+				"g1": Group{Counts{4, 4, 4, 4, 4, 4, 0, 0, 0, 0, 0, 0}, States{Running: 2}, msi{}, 2,
+					Memory{3, 9, 0, 0, 0, 0, 0, 0, 0, 0, 0}, starttime, 44, 0.1, 5, nil, Churn{Starts: 1}, starttime, 0, 0, nil, 0, 0, 0, 3, nil, nil, nil, nil, nil, 0},
 			},
 		},
 	}
@@ -150,23 +153,23 @@ func TestGrouperNonDecreasing(t *testing.T) {
 	}{
 		{
 			[]IDInfo{
-				piinfo(p1, n1, Counts{3, 4, 5, 6, 7, 8, 0, 0}, Memory{3, 4, 0, 0, 0}, Filedesc{4, 400}, 2),
-				piinfo(p2, n2, Counts{1, 1, 1, 1, 1, 1, 0, 0}, Memory{1, 2, 0, 0, 0}, Filedesc{40, 400}, 3),
+				piinfo(p1, n1, Counts{3, 4, 5, 6, 7, 8, 0, 0, 0, 0, 0, 0}, Memory{3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Filedesc{4, 400}, 2),
+				piinfo(p2, n2, Counts{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}, Memory{1, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Filedesc{40, 400}, 3),
 			},
 			GroupByName{
-				"g1": Group{Counts{}, States{}, msi{}, 2, Memory{4, 6, 0, 0, 0}, starttime, 44, 0.1, 5, nil},
+				"g1": Group{Counts{}, States{}, msi{}, 2, Memory{4, 6, 0, 0, 0, 0, 0, 0, 0, 0, 0}, starttime, 44, 0.1, 5, nil, Churn{}, starttime, 0, 0, nil, 0, 0, 0, 3, nil, nil, nil, nil, nil, 0},
 			},
 		}, {
 			[]IDInfo{
-				piinfo(p1, n1, Counts{4, 5, 6, 7, 8, 9, 0, 0}, Memory{1, 5, 0, 0, 0}, Filedesc{4, 400}, 2),
+				piinfo(p1, n1, Counts{4, 5, 6, 7, 8, 9, 0, 0, 0, 0, 0, 0}, Memory{1, 5, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Filedesc{4, 400}, 2),
 			},
 			GroupByName{
-				"g1": Group{Counts{1, 1, 1, 1, 1, 1, 0, 0}, States{}, msi{}, 1, Memory{1, 5, 0, 0, 0}, starttime, 4, 0.01, 2, nil},
+				"g1": Group{Counts{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}, States{}, msi{}, 1, Memory{1, 5, 0, 0, 0, 0, 0, 0, 0, 0, 0}, starttime, 4, 0.01, 2, nil, Churn{Exits: 1}, starttime, 0, 0, nil, 0, 0, 0, 2, nil, nil, nil, nil, nil, 0},
 			},
 		}, {
 			[]IDInfo{},
 			GroupByName{
-				"g1": Group{Counts{1, 1, 1, 1, 1, 1, 0, 0}, States{}, nil, 0, Memory{}, time.Time{}, 0, 0, 0, nil},
+				"g1": Group{Counts{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}, States{}, nil, 0, Memory{}, time.Time{}, 0, 0, 0, nil, Churn{Exits: 2}, time.Time{}, 0, 0, nil, 0, 0, 0, 0, nil, nil, nil, nil, nil, 0},
 			},
 		},
 	}
@@ -189,36 +192,36 @@ func TestGrouperThreads(t *testing.T) {
 	}{
 		{
 			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p, 0}), "t1", Counts{1, 2, 3, 4, 5, 6, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 1, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0}, "", States{}},
+				{ThreadID(ID{p, 0}), "t1", Counts{1, 2, 3, 4, 5, 6, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
+				{ThreadID(ID{p + 1, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
 			}),
 			GroupByName{
 				"g1": Group{Counts{}, States{}, msi{}, 1, Memory{}, tm, 1, 1, 2, []Threads{
 					Threads{"t1", 1, Counts{}},
 					Threads{"t2", 1, Counts{}},
-				}},
+				}, Churn{}, tm, 0, 0, nil, 0, 0, 0, 2, nil, nil, nil, nil, nil, 0},
 			},
 		}, {
 			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p, 0}), "t1", Counts{2, 3, 4, 5, 6, 7, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 1, 0}), "t2", Counts{2, 2, 2, 2, 2, 2, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 2, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0}, "", States{}},
+				{ThreadID(ID{p, 0}), "t1", Counts{2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
+				{ThreadID(ID{p + 1, 0}), "t2", Counts{2, 2, 2, 2, 2, 2, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
+				{ThreadID(ID{p + 2, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
 			}),
 			GroupByName{
 				"g1": Group{Counts{}, States{}, msi{}, 1, Memory{}, tm, 1, 1, 3, []Threads{
-					Threads{"t1", 1, Counts{1, 1, 1, 1, 1, 1, 0, 0}},
-					Threads{"t2", 2, Counts{1, 1, 1, 1, 1, 1, 0, 0}},
-				}},
+					Threads{"t1", 1, Counts{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}},
+					Threads{"t2", 2, Counts{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}},
+				}, Churn{}, tm, 0, 0, nil, 0, 0, 0, 3, nil, nil, nil, nil, nil, 0},
 			},
 		}, {
 			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p + 1, 0}), "t2", Counts{4, 4, 4, 4, 4, 4, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 2, 0}), "t2", Counts{2, 3, 4, 5, 6, 7, 0, 0}, "", States{}},
+				{ThreadID(ID{p + 1, 0}), "t2", Counts{4, 4, 4, 4, 4, 4, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
+				{ThreadID(ID{p + 2, 0}), "t2", Counts{2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
 			}),
 			GroupByName{
 				"g1": Group{Counts{}, States{}, msi{}, 1, Memory{}, tm, 1, 1, 2, []Threads{
-					Threads{"t2", 2, Counts{4, 5, 6, 7, 8, 9, 0, 0}},
-				}},
+					Threads{"t2", 2, Counts{4, 5, 6, 7, 8, 9, 0, 0, 0, 0, 0, 0}},
+				}, Churn{}, tm, 0, 0, nil, 0, 0, 0, 2, nil, nil, nil, nil, nil, 0},
 			},
 		},
 	}
@@ -232,3 +235,511 @@ func TestGrouperThreads(t *testing.T) {
 		}
 	}
 }
+
+// TestGrouperChurn verifies that procs joining and leaving a group are counted
+// even when the number of procs in the group stays the same, and that a pid
+// reused by a new proc counts as an exit and a start.
+func TestGrouperChurn(t *testing.T) {
+	p1, p2, p3 := 1, 2, 3
+	n1 := "g1"
+
+	tests := []struct {
+		procs []IDInfo
+		want  Churn
+	}{
+		{
+			[]IDInfo{newProcStart(p1, n1, 1), newProcStart(p2, n1, 1)},
+			Churn{},
+		},
+		{
+			[]IDInfo{newProcStart(p1, n1, 1), newProcStart(p2, n1, 1), newProcStart(p3, n1, 2)},
+			Churn{Starts: 1},
+		},
+		{
+			// p2 was restarted and its new incarnation got the same pid.
+			[]IDInfo{newProcStart(p1, n1, 1), newProcStart(p2, n1, 3), newProcStart(p3, n1, 2)},
+			Churn{Starts: 2, Exits: 1},
+		},
+		{
+			[]IDInfo{newProcStart(p1, n1, 1)},
+			Churn{Starts: 2, Exits: 3},
+		},
+		{
+			[]IDInfo{},
+			Churn{Starts: 2, Exits: 4},
+		},
+	}
+
+	gr := NewGrouper(newNamer(n1), false, false, false, false)
+	for i, tc := range tests {
+		got := rungroup(t, gr, procInfoIter(tc.procs...))
+		if diff := cmp.Diff(got[n1].Churn, tc.want); diff != "" {
+			t.Errorf("%d: churn differs: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestGrouperStartTimes verifies that the oldest and newest start times
+// track the group's members as they come and go.
+func TestGrouperStartTimes(t *testing.T) {
+	p1, p2, p3 := 1, 2, 3
+	n1 := "g1"
+
+	tests := []struct {
+		procs                  []IDInfo
+		wantOldest, wantNewest int64
+	}{
+		{
+			[]IDInfo{newProcStart(p1, n1, 5), newProcStart(p2, n1, 3), newProcStart(p3, n1, 9)},
+			3, 9,
+		},
+		{
+			// The oldest member has exited.
+			[]IDInfo{newProcStart(p1, n1, 5), newProcStart(p3, n1, 9)},
+			5, 9,
+		},
+		{
+			// A new member was started.
+			[]IDInfo{newProcStart(p1, n1, 5), newProcStart(p2, n1, 12), newProcStart(p3, n1, 9)},
+			5, 12,
+		},
+	}
+
+	gr := NewGrouper(newNamer(n1), false, false, false, false)
+	for i, tc := range tests {
+		got := rungroup(t, gr, procInfoIter(tc.procs...))[n1]
+		if got.OldestStartTime.Unix() != tc.wantOldest {
+			t.Errorf("%d: got oldest start %d, want %d", i, got.OldestStartTime.Unix(), tc.wantOldest)
+		}
+		if got.NewestStartTime.Unix() != tc.wantNewest {
+			t.Errorf("%d: got newest start %d, want %d", i, got.NewestStartTime.Unix(), tc.wantNewest)
+		}
+	}
+}
+
+// TestGrouperCgroups verifies that a group lists each distinct cgroup
+// placement of its procs once.
+func TestGrouperCgroups(t *testing.T) {
+	n1 := "g1"
+	svc := []Cgroup{{Path: "/system.slice/a.service"}}
+	other := []Cgroup{{Path: "/system.slice/b.service"}}
+	procs := []IDInfo{newProc(1, n1, Metrics{Cgroups: svc}),
+		newProc(2, n1, Metrics{Cgroups: svc}),
+		newProc(3, n1, Metrics{Cgroups: other}),
+		newProc(4, n1, Metrics{})}
+
+	gr := NewGrouper(newNamer(n1), false, false, false, false)
+	got := rungroup(t, gr, procInfoIter(procs...))[n1].Cgroups
+	want := [][]Cgroup{svc, other}
+	opts := cmpopts.SortSlices(func(x, y []Cgroup) bool { return x[0].Path < y[0].Path })
+	if diff := cmp.Diff(got, want, opts); diff != "" {
+		t.Errorf("cgroups differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestGrouperScheduling verifies the group's lowest nice, highest priority
+// and count of realtime procs, which is by policy rather than priority:
+// SCHED_DEADLINE procs have a negative priority too.
+func TestGrouperScheduling(t *testing.T) {
+	n1 := "g1"
+	procs := []IDInfo{newProc(1, n1, Metrics{Nice: 19, Priority: 39, SchedPolicy: "other"}),
+		newProc(2, n1, Metrics{Nice: 5, Priority: 25, SchedPolicy: "batch"}),
+		newProc(3, n1, Metrics{Nice: 10, Priority: -51, SchedPolicy: "fifo"}),
+		newProc(4, n1, Metrics{Nice: 10, Priority: -2, SchedPolicy: "rr"}),
+		newProc(5, n1, Metrics{Nice: 10, Priority: -101, SchedPolicy: "deadline"})}
+
+	gr := NewGrouper(newNamer(n1), false, false, false, false)
+	got := rungroup(t, gr, procInfoIter(procs...))[n1]
+	if got.LowestNice != 5 || got.HighestPriority != -101 || got.Realtime != 2 {
+		t.Errorf("got lowest nice %d, highest priority %d, realtime %d; want 5, -101, 2",
+			got.LowestNice, got.HighestPriority, got.Realtime)
+	}
+}
+
+// TestGrouperCapabilities verifies that a group counts its procs holding
+// each capability, and that it has no counts if none hold any.
+func TestGrouperCapabilities(t *testing.T) {
+	n1, n2 := "g1", "g2"
+	procs := []IDInfo{newProc(1, n1, Metrics{CapEff: 1<<21 | 1<<12}),
+		newProc(2, n1, Metrics{CapEff: 1 << 12}),
+		newProc(3, n1, Metrics{CapEff: 1 << 63}),
+		newProc(4, n2, Metrics{})}
+
+	gr := NewGrouper(newNamer(n1, n2), false, false, false, false)
+	got := rungroup(t, gr, procInfoIter(procs...))
+	if diff := cmp.Diff(got[n1].Capabilities, map[int]int{12: 2, 21: 1, 63: 1}); diff != "" {
+		t.Errorf("capabilities differ: (-got +want)\n%s", diff)
+	}
+	if got[n2].Capabilities != nil {
+		t.Errorf("got capabilities %v for group without any, want nil", got[n2].Capabilities)
+	}
+}
+
+// TestGrouperSchedPolicies verifies that scheduling policies are counted
+// over the threads of procs whose threads are known, and over procs
+// otherwise, and that a proc with a realtime thread is a realtime one.
+func TestGrouperSchedPolicies(t *testing.T) {
+	n1, n2 := "g1", "g2"
+	threaded := newProc(1, n1, Metrics{SchedPolicy: "other"})
+	threaded.Threads = []Thread{
+		{ThreadID: ThreadID(ID{1, 0}), SchedPolicy: "other"},
+		{ThreadID: ThreadID(ID{2, 0}), SchedPolicy: "fifo"},
+		{ThreadID: ThreadID(ID{3, 0}), SchedPolicy: "fifo"},
+	}
+	procs := []IDInfo{threaded,
+		newProc(4, n1, Metrics{SchedPolicy: "batch"}),
+		newProc(5, n2, Metrics{})}
+
+	gr := NewGrouper(newNamer(n1, n2), false, false, false, false)
+	got := rungroup(t, gr, procInfoIter(procs...))
+	if diff := cmp.Diff(got[n1].SchedPolicies, map[string]int{"other": 1, "fifo": 2, "batch": 1}); diff != "" {
+		t.Errorf("policies differ: (-got +want)\n%s", diff)
+	}
+	// The threaded proc is realtime by its threads, however many.
+	if got[n1].Realtime != 1 {
+		t.Errorf("got %d realtime procs, want 1", got[n1].Realtime)
+	}
+	if got[n2].SchedPolicies != nil {
+		t.Errorf("got policies %v for group without any known, want nil", got[n2].SchedPolicies)
+	}
+}
+
+// TestGrouperMinCPUsAllowed verifies that a group reports its most
+// constrained proc, ignoring those whose affinity isn't known.
+func TestGrouperMinCPUsAllowed(t *testing.T) {
+	n1, n2 := "g1", "g2"
+	procs := []IDInfo{newProc(1, n1, Metrics{CPUsAllowed: 64}),
+		newProc(2, n1, Metrics{CPUsAllowed: 2}),
+		newProc(3, n1, Metrics{}),
+		newProc(4, n2, Metrics{})}
+
+	gr := NewGrouper(newNamer(n1, n2), false, false, false, false)
+	got := rungroup(t, gr, procInfoIter(procs...))
+	if got[n1].MinCPUsAllowed != 2 || got[n2].MinCPUsAllowed != 0 {
+		t.Errorf("got min CPUs allowed %d and %d, want 2 and 0",
+			got[n1].MinCPUsAllowed, got[n2].MinCPUsAllowed)
+	}
+}
+
+// TestGrouperOtherGroup verifies that the other group gets the procs that
+// aren't tracked otherwise, optionally leaving out kernel threads, and that
+// it makes no difference to the other groups.
+func TestGrouperOtherGroup(t *testing.T) {
+	cycle := func(i int, lateName string) Iter {
+		c := Counts{CPUUserTime: float64(i), ReadBytes: uint64(i)}
+		proc := func(pid, ppid int, name string) IDInfo {
+			id, static := newProcIDStatic(pid, ppid, 0, name, nil)
+			return IDInfo{id, static, Metrics{Counts: c}, nil}
+		}
+		return procInfoIter(
+			proc(2, 0, "kthreadd"), proc(3, 2, "kworker"),
+			proc(10, 1, "g1"), proc(11, 10, "g1child"),
+			proc(20, 1, "u"), proc(21, 20, "uchild"),
+			proc(30, 1, lateName))
+	}
+
+	for _, tc := range []struct {
+		children, recheck bool
+		// wantOther is the number of procs in the other group in each
+		// cycle, the last being when proc 30 is renamed to match g2.
+		wantOther []int
+	}{
+		{true, false, []int{5, 5, 5}},
+		{true, true, []int{5, 5, 4}},
+		{false, false, []int{6, 6, 5}},
+		{false, true, []int{6, 6, 5}},
+	} {
+		for _, kernelThreads := range []bool{true, false} {
+			base := NewGrouper(newNamer("g1", "g2"), tc.children, false, tc.recheck, false)
+			gr := NewGrouper(newNamer("g1", "g2"), tc.children, false, tc.recheck, false)
+			gr.SetOtherGroup("other", kernelThreads)
+
+			for i, want := range tc.wantOther {
+				lateName := "late"
+				if i == len(tc.wantOther)-1 {
+					lateName = "g2"
+				}
+				wantgroups := rungroup(t, base, cycle(i, lateName))
+				got := rungroup(t, gr, cycle(i, lateName))
+
+				other := got["other"]
+				delete(got, "other")
+				if diff := cmp.Diff(got, wantgroups); diff != "" {
+					t.Errorf("children=%v recheck=%v kthreads=%v %d: groups differ: (-got +want)\n%s",
+						tc.children, tc.recheck, kernelThreads, i, diff)
+				}
+				if !kernelThreads {
+					want -= 2
+				}
+				if other.Procs != want {
+					t.Errorf("children=%v recheck=%v kthreads=%v %d: got %d other procs, want %d",
+						tc.children, tc.recheck, kernelThreads, i, other.Procs, want)
+				}
+				if i > 0 && other.CPUUserTime == 0 {
+					t.Errorf("children=%v recheck=%v kthreads=%v %d: other group has no CPU time",
+						tc.children, tc.recheck, kernelThreads, i)
+				}
+			}
+		}
+	}
+}
+
+// TestGrouperZombies verifies that zombies are counted in the group their
+// comm and cmdline put them in as of the update, rather than in the one they
+// were tracked in while alive, and that unmatched ones go to the other group.
+func TestGrouperZombies(t *testing.T) {
+	proc := func(pid int, name string, zombie bool) IDInfo {
+		p := newProcParent(pid, name, 1)
+		if zombie {
+			p.Metrics.States.Zombie = 1
+		}
+		return p
+	}
+	gr := NewGrouper(newNamer("g1", "g2"), false, false, false, false)
+	gr.SetOtherGroup("other", true)
+	rungroup(t, gr, procInfoIter(proc(10, "g1", false), proc(20, "g2", false), proc(30, "x", false)))
+
+	// 10 changed its comm before exiting, 30 exited unmatched.
+	got := rungroup(t, gr, procInfoIter(proc(10, "g2", true), proc(20, "g2", false), proc(30, "x", true)))
+	for gname, want := range map[string]int{"g1": 0, "g2": 1, "other": 1} {
+		if got[gname].Zombies != want {
+			t.Errorf("got %d zombies in %s, want %d", got[gname].Zombies, gname, want)
+		}
+	}
+	if got["g1"].States.Zombie != 1 {
+		t.Errorf("got %d zombie threads in g1, want 1", got["g1"].States.Zombie)
+	}
+}
+
+// TestTopBlocked verifies that wchans are sanitized, and that only the top
+// ones are kept with the rest folded into other.
+func TestTopBlocked(t *testing.T) {
+	blocked := msi{
+		"io_schedule":           5,
+		"rpc_wait_bit_killable": 3,
+		"":                      3,
+		"nfs_wait+0x10/0x20":    1,
+		"nfs_wait_0x10_0x20":    1,
+		"jbd2_log_wait_commit":  1,
+	}
+	for _, tc := range []struct {
+		k    int
+		want msi
+	}{
+		{10, msi{"io_schedule": 5, "rpc_wait_bit_killable": 3, BlockedUnknown: 3,
+			"nfs_wait_0x10_0x20": 2, "jbd2_log_wait_commit": 1}},
+		{3, msi{"io_schedule": 5, "rpc_wait_bit_killable": 3, BlockedUnknown: 3, BlockedOther: 3}},
+		{1, msi{"io_schedule": 5, BlockedOther: 9}},
+	} {
+		if diff := cmp.Diff(msi(TopBlocked(blocked, tc.k)), tc.want); diff != "" {
+			t.Errorf("k=%d: (-got +want)\n%s", tc.k, diff)
+		}
+	}
+
+	long := strings.Repeat("x", 100)
+	if got := TopBlocked(msi{long: 1}, 1); got[long[:maxWchanLen]] != 1 {
+		t.Errorf("got %v, want wchan truncated to %d", got, maxWchanLen)
+	}
+}
+
+// TestGrouperStaleGroupTTL verifies that a group without procs is reported
+// until the TTL expires, and that when it returns its counts resume from where
+// they were rather than being reset.
+func TestGrouperStaleGroupTTL(t *testing.T) {
+	clock := time.Unix(0, 0)
+	gr := NewGrouper(newNamer("g1"), false, false, false, false)
+	gr.now = func() time.Time { return clock }
+	gr.SetStaleGroupTTL(5 * time.Minute)
+
+	proc := func(pid int, cpu float64) IDInfo {
+		return newProc(pid, "g1", Metrics{Counts: Counts{CPUUserTime: cpu}})
+	}
+	for i, tc := range []struct {
+		step  string
+		after time.Duration
+		procs []IDInfo
+		// wantCPU is the group's CPU time, or -1 if it shouldn't be reported.
+		wantCPU float64
+	}{
+		{"first seen", 0, []IDInfo{proc(1, 1)}, 0},
+		{"running", time.Minute, []IDInfo{proc(1, 3)}, 2},
+		{"disappeared", time.Minute, nil, 2},
+		{"within ttl", 3 * time.Minute, nil, 2},
+		{"ttl expired", 2 * time.Minute, nil, -1},
+		{"still stale", time.Hour, nil, -1},
+		{"returned", time.Minute, []IDInfo{proc(2, 10)}, 2},
+		{"running again", time.Minute, []IDInfo{proc(2, 11)}, 3},
+	} {
+		clock = clock.Add(tc.after)
+		got, ok := rungroup(t, gr, procInfoIter(tc.procs...))["g1"]
+		switch {
+		case tc.wantCPU < 0 && ok:
+			t.Errorf("%d %s: got group %+v, want none", i, tc.step, got)
+		case tc.wantCPU >= 0 && !ok:
+			t.Errorf("%d %s: got no group, want one", i, tc.step)
+		case ok && got.CPUUserTime != tc.wantCPU:
+			t.Errorf("%d %s: got cpu %v, want %v", i, tc.step, got.CPUUserTime, tc.wantCPU)
+		}
+	}
+}
+
+// TestGrouperCounterContinuity replays a scripted series of scrapes in which
+// pids are reused and counters go backwards, verifying that group counters
+// never decrease, keep what departed procs contributed, and that regressions
+// are counted rather than subtracted.
+func TestGrouperCounterContinuity(t *testing.T) {
+	proc := func(pid int, start uint64, name string, cpu float64, ctx uint64) IDInfo {
+		id, static := newProcIDStatic(pid, 0, start, name, nil)
+		return IDInfo{id, static, Metrics{Counts: Counts{CPUUserTime: cpu, CtxSwitchVoluntary: ctx}}, nil}
+	}
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, false)
+	for i, tc := range []struct {
+		step        string
+		procs       []IDInfo
+		wantCPU     float64
+		wantCtx     uint64
+		regressions int
+	}{
+		{"first seen", []IDInfo{proc(10, 1, "g1", 5, 100)}, 0, 0, 0},
+		{"growth", []IDInfo{proc(10, 1, "g1", 7, 110)}, 2, 10, 0},
+		// Pid 10 is reused by a new member with lower counts: that's a new
+		// proc, not a regression.
+		{"pid reused in group", []IDInfo{proc(10, 2, "g1", 1, 5)}, 2, 10, 0},
+		{"ctx regressed", []IDInfo{proc(10, 2, "g1", 4, 3)}, 5, 10, 1},
+		{"growth from regressed", []IDInfo{proc(10, 2, "g1", 6, 8)}, 7, 15, 0},
+		// Pid 10 is reused by an unrelated proc: the group keeps its counts.
+		{"pid reused outside group", []IDInfo{proc(10, 3, "u", 100, 1000)}, 7, 15, 0},
+		{"new member", []IDInfo{proc(10, 3, "u", 101, 1001), proc(11, 4, "g1", 50, 500)}, 7, 15, 0},
+		{"new member growth", []IDInfo{proc(11, 4, "g1", 51, 501)}, 8, 16, 0},
+	} {
+		cerrs, groups, err := gr.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		got := groups["g1"]
+		if got.CPUUserTime != tc.wantCPU || got.CtxSwitchVoluntary != tc.wantCtx {
+			t.Errorf("%d %s: got cpu %v ctx %d, want %v and %d",
+				i, tc.step, got.CPUUserTime, got.CtxSwitchVoluntary, tc.wantCPU, tc.wantCtx)
+		}
+		if cerrs.Regressions != tc.regressions {
+			t.Errorf("%d %s: got %d regressions, want %d", i, tc.step, cerrs.Regressions, tc.regressions)
+		}
+	}
+}
+
+// TestGrouperAgeBuckets verifies that procs are counted by age into
+// cumulative buckets, and that the buckets are nil unless set.
+func TestGrouperAgeBuckets(t *testing.T) {
+	clock := time.Unix(100000, 0)
+	procs := func() Iter {
+		return procInfoIter(
+			newProcStart(1, "g1", 100000-30),
+			newProcStart(2, "g1", 100000-300),
+			newProcStart(3, "g1", 100000-7200),
+		)
+	}
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, false)
+	gr.now = func() time.Time { return clock }
+	if got := rungroup(t, gr, procs())["g1"].AgeBuckets; got != nil {
+		t.Errorf("got age buckets %v without bounds, want nil", got)
+	}
+
+	gr = NewGrouper(newNamer("g1"), false, false, false, false)
+	gr.now = func() time.Time { return clock }
+	gr.SetAgeBuckets([]time.Duration{time.Minute, 10 * time.Minute, time.Hour})
+	got := rungroup(t, gr, procs())["g1"].AgeBuckets
+	if diff := cmp.Diff(got, []uint64{1, 2, 2}); diff != "" {
+		t.Errorf("age buckets differ: (-got +want)\n%s", diff)
+	}
+}
+
+// defNamer names procs by comm, giving each comm a group and the definition
+// of the group.
+type defNamer map[string][2]string
+
+func (n defNamer) String() string { return fmt.Sprintf("%v", map[string][2]string(n)) }
+
+func (n defNamer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
+	if gd, ok := n[nacl.Name]; ok {
+		return true, gd[0]
+	}
+	return false, ""
+}
+
+func (n defNamer) GroupDefinition(groupname string) string {
+	for _, gd := range n {
+		if gd[0] == groupname {
+			return gd[1]
+		}
+	}
+	return ""
+}
+
+// TestGrouperSetNamer verifies that after the namer is replaced procs move
+// to their new group without losing or repeating counts, that unchanged
+// groups keep their counts, redefined groups start again, and removed groups
+// are still reported.
+func TestGrouperSetNamer(t *testing.T) {
+	cycle := func(i int) Iter {
+		c := Counts{CPUUserTime: float64(i)}
+		return procInfoIter(newProc(1, "a", Metrics{Counts: c}), newProc(2, "b", Metrics{Counts: c}),
+			newProc(3, "c", Metrics{Counts: c}), newProc(4, "d", Metrics{Counts: c}))
+	}
+	type cpu struct {
+		Procs int
+		CPU   float64
+	}
+	check := func(step string, groups GroupByName, want map[string]cpu) {
+		t.Helper()
+		got := make(map[string]cpu)
+		for gname, g := range groups {
+			got[gname] = cpu{g.Procs, g.CPUUserTime}
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("%s: groups differ: (-got +want)\n%s", step, diff)
+		}
+	}
+
+	gr := NewGrouper(defNamer{"a": {"ga", "1"}, "b": {"gb", "2"}, "c": {"gc", "3"}}, false, false, false, false)
+	gr.SetOtherGroup("other", true)
+	rungroup(t, gr, cycle(1))
+	check("before", rungroup(t, gr, cycle(2)),
+		map[string]cpu{"ga": {1, 1}, "gb": {1, 1}, "gc": {1, 1}, "other": {1, 1}})
+
+	// ga is unchanged, gb redefined, gc removed, so that its proc goes to
+	// the other group, and gd new, taking its proc from the other group.
+	gr.SetNamer(defNamer{"a": {"ga", "1"}, "b": {"gb", "2b"}, "d": {"gd", "4"}})
+	check("reloaded", rungroup(t, gr, cycle(3)),
+		map[string]cpu{"ga": {1, 2}, "gb": {1, 1}, "gc": {0, 1}, "gd": {1, 1}, "other": {1, 2}})
+	check("after", rungroup(t, gr, cycle(4)),
+		map[string]cpu{"ga": {1, 3}, "gb": {1, 2}, "gc": {0, 1}, "gd": {1, 2}, "other": {1, 3}})
+}
+
+// TestGrouperSetNamerChildren verifies that children follow their parent to
+// its new group, however deep, and are ignored if it's no longer matched.
+func TestGrouperSetNamerChildren(t *testing.T) {
+	procs := func() Iter {
+		return procInfoIter(newProcParent(1, "a", 0), newProcParent(2, "x", 1),
+			newProcParent(3, "y", 2), newProcParent(4, "b", 0), newProcParent(5, "z", 4))
+	}
+	members := func(groups GroupByName) map[string]int {
+		got := make(map[string]int)
+		for gname, g := range groups {
+			if g.Procs > 0 {
+				got[gname] = g.Procs
+			}
+		}
+		return got
+	}
+
+	gr := NewGrouper(defNamer{"a": {"ga", "1"}, "b": {"gb", "2"}}, true, false, false, false)
+	rungroup(t, gr, procs())
+	if diff := cmp.Diff(members(rungroup(t, gr, procs())), map[string]int{"ga": 3, "gb": 2}); diff != "" {
+		t.Errorf("before: groups differ: (-got +want)\n%s", diff)
+	}
+
+	gr.SetNamer(defNamer{"a": {"ga2", "1"}})
+	if diff := cmp.Diff(members(rungroup(t, gr, procs())), map[string]int{"ga2": 3}); diff != "" {
+		t.Errorf("after: groups differ: (-got +want)\n%s", diff)
+	}
+}
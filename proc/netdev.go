@@ -0,0 +1,244 @@
+package proc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// netnsBaselineTTL is how long a group keeps the traffic of a namespace it
+// no longer has procs in, so that re-entering it within that time only
+// counts the growth since.
+const netnsBaselineTTL = time.Hour
+
+type (
+	// NetTraffic is the traffic of the interfaces of network namespaces.
+	NetTraffic struct {
+		ReceiveBytes    uint64
+		TransmitBytes   uint64
+		ReceivePackets  uint64
+		TransmitPackets uint64
+	}
+
+	// NetDevCounter accumulates the traffic of the network namespaces of
+	// each group.  Interface counters are per namespace, so each namespace
+	// is read once per Update, through any proc in it, and its traffic is
+	// attributed in full to every group with a proc in it.  As with
+	// OOMKillCounter, a group's total adds up how much each namespace's
+	// counters have grown since last seen, so that it never decreases as
+	// namespaces come and go.
+	NetDevCounter struct {
+		fs *FS
+		// excludeLoopback leaves out the traffic of lo.
+		excludeLoopback bool
+		// includeHost attributes the host's namespace like any other;
+		// otherwise hostNetns is the namespace left out, see HostNetns, or
+		// 0 if it couldn't be read yet.
+		includeHost bool
+		hostNetns   uint64
+		groups      map[string]*netGroup
+		now         func() time.Time
+	}
+
+	// netGroup is the accumulated traffic of a group, and the traffic of
+	// each of its namespaces when last read.
+	netGroup struct {
+		total NetTraffic
+		netns map[uint64]netnsBaseline
+	}
+
+	// netnsBaseline is the traffic of a namespace when a group last read it,
+	// and when that was.
+	netnsBaseline struct {
+		traffic NetTraffic
+		seen    time.Time
+	}
+)
+
+// parseNetns parses the target of a /proc/<pid>/ns/net link, e.g.
+// "net:[4026531992]", into the namespace's inode.
+func parseNetns(link string) (uint64, error) {
+	if !strings.HasPrefix(link, "net:[") || !strings.HasSuffix(link, "]") {
+		return 0, fmt.Errorf("malformed network namespace %q", link)
+	}
+	return strconv.ParseUint(link[len("net:["):len(link)-1], 10, 64)
+}
+
+// readNetns returns the inode of the network namespace of the proc in the
+// named dir of procfs.
+func (fs *FS) readNetns(procdir string) (uint64, error) {
+	link, err := os.Readlink(filepath.Join(fs.MountPoint, procdir, "ns", "net"))
+	if err != nil {
+		return 0, err
+	}
+	return parseNetns(link)
+}
+
+// Netns returns the inode identifying the network namespace of the proc with
+// the given pid.  Reading it for a proc owned by another user requires
+// privileges.
+func (fs *FS) Netns(pid int) (uint64, error) {
+	return fs.readNetns(strconv.Itoa(pid))
+}
+
+// HostNetns returns the network namespace of pid 1, which is the host's
+// unless procfs is that of a container.
+func (fs *FS) HostNetns() (uint64, error) {
+	return fs.Netns(1)
+}
+
+// CheckNetDev returns an error if the network namespace and interface
+// counters of the proc of probeDir can't be read.
+func (fs *FS) CheckNetDev() error {
+	dir := fs.probeDir()
+	if _, err := fs.readNetns(dir); err != nil {
+		return err
+	}
+	_, err := os.Stat(filepath.Join(fs.MountPoint, dir, "net", "dev"))
+	return err
+}
+
+// NetDev returns the traffic of each interface of the network namespace of
+// the proc with the given pid, read from /proc/<pid>/net/dev.  The counters
+// are the namespace's, so every proc in it reports the same; to aggregate
+// over procs, read each namespace once, as told by Netns.
+func (fs *FS) NetDev(pid int) (map[string]NetTraffic, error) {
+	p, err := fs.FS.Proc(pid)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := p.NetDev()
+	if err != nil {
+		return nil, err
+	}
+	ifaces := make(map[string]NetTraffic, len(dev))
+	for name, line := range dev {
+		ifaces[name] = NetTraffic{
+			ReceiveBytes:    line.RxBytes,
+			TransmitBytes:   line.TxBytes,
+			ReceivePackets:  line.RxPackets,
+			TransmitPackets: line.TxPackets,
+		}
+	}
+	return ifaces, nil
+}
+
+// readNetTraffic returns the traffic of the network namespace of the proc
+// with the given pid, summed over its interfaces.
+func (fs *FS) readNetTraffic(pid int, excludeLoopback bool) (NetTraffic, error) {
+	ifaces, err := fs.NetDev(pid)
+	if err != nil {
+		return NetTraffic{}, err
+	}
+	var traffic NetTraffic
+	for name, iface := range ifaces {
+		if excludeLoopback && name == "lo" {
+			continue
+		}
+		traffic.ReceiveBytes += iface.ReceiveBytes
+		traffic.TransmitBytes += iface.TransmitBytes
+		traffic.ReceivePackets += iface.ReceivePackets
+		traffic.TransmitPackets += iface.TransmitPackets
+	}
+	return traffic, nil
+}
+
+// NewNetDevCounter returns a NetDevCounter reading procs using fs.  Unless
+// includeHost is true, the host's network namespace is left out, so that
+// groups aren't attributed the traffic of the whole node.
+func NewNetDevCounter(fs *FS, excludeLoopback, includeHost bool) *NetDevCounter {
+	c := &NetDevCounter{
+		fs:              fs,
+		excludeLoopback: excludeLoopback,
+		includeHost:     includeHost,
+		groups:          make(map[string]*netGroup),
+		now:             time.Now,
+	}
+	if !includeHost {
+		c.hostNetns, _ = fs.HostNetns()
+	}
+	return c
+}
+
+// Update reads the traffic of the distinct network namespaces of the procs
+// of groups, once each, and returns the accumulated traffic of each group
+// with a namespace that could be read.  A namespace seen for the first time
+// by a group contributes its whole traffic; one seen before contributes its
+// growth since, unless its counters went down, e.g. because an interface was
+// recreated, in which case they count in full.  A group keeps the counters
+// of a namespace it no longer has procs in for netnsBaselineTTL, so that
+// coming back to it doesn't count its traffic again.  Unless the host's
+// namespace is included, nothing is returned while it can't be read, since
+// then it couldn't be left out.
+func (c *NetDevCounter) Update(groups GroupByName) map[string]NetTraffic {
+	if !c.includeHost && c.hostNetns == 0 {
+		hostNetns, err := c.fs.HostNetns()
+		if err != nil {
+			return nil
+		}
+		c.hostNetns = hostNetns
+	}
+
+	now := c.now()
+	reads := make(map[uint64]NetTraffic)
+	failed := make(map[uint64]bool)
+	for _, g := range groups {
+		for netns, pid := range g.Netns {
+			if netns == c.hostNetns || failed[netns] {
+				continue
+			}
+			if _, ok := reads[netns]; ok {
+				continue
+			}
+			traffic, err := c.fs.readNetTraffic(pid, c.excludeLoopback)
+			if err != nil {
+				// Most likely the proc exited; another may do next time.
+				failed[netns] = true
+				continue
+			}
+			reads[netns] = traffic
+		}
+	}
+
+	totals := make(map[string]NetTraffic)
+	for name, g := range groups {
+		grp := c.groups[name]
+		for netns := range g.Netns {
+			traffic, ok := reads[netns]
+			if !ok {
+				continue
+			}
+			if grp == nil {
+				grp = &netGroup{netns: make(map[uint64]netnsBaseline)}
+				c.groups[name] = grp
+			}
+			base, known := grp.netns[netns]
+			last := base.traffic
+			if !known || traffic.ReceiveBytes < last.ReceiveBytes || traffic.TransmitBytes < last.TransmitBytes ||
+				traffic.ReceivePackets < last.ReceivePackets || traffic.TransmitPackets < last.TransmitPackets {
+				last = NetTraffic{}
+			}
+			grp.total.ReceiveBytes += traffic.ReceiveBytes - last.ReceiveBytes
+			grp.total.TransmitBytes += traffic.TransmitBytes - last.TransmitBytes
+			grp.total.ReceivePackets += traffic.ReceivePackets - last.ReceivePackets
+			grp.total.TransmitPackets += traffic.TransmitPackets - last.TransmitPackets
+			grp.netns[netns] = netnsBaseline{traffic: traffic, seen: now}
+		}
+		if grp == nil {
+			continue
+		}
+		totals[name] = grp.total
+	}
+
+	for _, grp := range c.groups {
+		for netns, last := range grp.netns {
+			if now.Sub(last.seen) >= netnsBaselineTTL {
+				delete(grp.netns, netns)
+			}
+		}
+	}
+	return totals
+}
@@ -0,0 +1,160 @@
+package proc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const netDevHeader = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+`
+
+// netfs returns an FS on a temporary procfs, and a func to add a proc to it
+// in the given network namespace with the given eth0 traffic.
+func netfs(t *testing.T) (*FS, string, func(pid int, netns uint64, rx, tx uint64)) {
+	root, err := ioutil.TempDir("", "netdev")
+	noerr(t, err)
+	stat, err := filepath.Abs("../fixtures/stat")
+	noerr(t, err)
+	noerr(t, os.Symlink(stat, filepath.Join(root, "stat")))
+	fs, err := NewFS(root, false)
+	noerr(t, err)
+	setProc := func(pid int, netns uint64, rx, tx uint64) {
+		dir := filepath.Join(root, strconv.Itoa(pid))
+		noerr(t, os.MkdirAll(filepath.Join(dir, "ns"), 0755))
+		noerr(t, os.MkdirAll(filepath.Join(dir, "net"), 0755))
+		link := filepath.Join(dir, "ns", "net")
+		os.Remove(link)
+		noerr(t, os.Symlink(fmt.Sprintf("net:[%d]", netns), link))
+		dev := netDevHeader +
+			"    lo:     100       1    0    0    0     0          0         0      100       1    0    0    0     0       0          0\n" +
+			fmt.Sprintf("  eth0: %d 10 0 0 0 0 0 0 %d 10 0 0 0 0 0 0\n", rx, tx)
+		noerr(t, ioutil.WriteFile(filepath.Join(dir, "net", "dev"), []byte(dev), 0644))
+	}
+	return fs, root, setProc
+}
+
+// TestNetDev verifies that each interface of the fixture proc's namespace is
+// read, including lo.
+func TestNetDev(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	got, err := fs.NetDev(14804)
+	noerr(t, err)
+	want := map[string]NetTraffic{
+		"lo":   {ReceiveBytes: 1000, TransmitBytes: 1000, ReceivePackets: 10, TransmitPackets: 10},
+		"eth0": {ReceiveBytes: 2000000, TransmitBytes: 300000, ReceivePackets: 1500, TransmitPackets: 900},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("interfaces differ: (-got +want)\n%s", diff)
+	}
+}
+
+func TestParseNetns(t *testing.T) {
+	got, err := parseNetns("net:[4026531992]")
+	noerr(t, err)
+	if got != 4026531992 {
+		t.Errorf("got %d, want 4026531992", got)
+	}
+	for _, bad := range []string{"mnt:[4026531992]", "net:[abc]", "net:4026531992", ""} {
+		if _, err := parseNetns(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+// TestNetDevCounter verifies that a namespace's traffic is attributed in
+// full to each group with procs in it, that the host's namespace is left
+// out, and that totals never decrease as namespaces come and go, nor count a
+// namespace again when a group comes back to it before netnsBaselineTTL.
+func TestNetDevCounter(t *testing.T) {
+	fs, root, setProc := netfs(t)
+	defer os.RemoveAll(root)
+	const host, netA, netB = 1000, 2000, 3000
+	setProc(1, host, 1e9, 1e9)
+	setProc(10, netA, 1000, 100)
+	setProc(11, netA, 1000, 100)
+	setProc(12, netB, 5000, 500)
+
+	c := NewNetDevCounter(fs, true, false)
+	now := time.Unix(0, 0)
+	c.now = func() time.Time { return now }
+	groups := GroupByName{
+		"g1":   Group{Netns: map[uint64]int{netA: 10}},
+		"g2":   Group{Netns: map[uint64]int{netA: 11, netB: 12}},
+		"host": Group{Netns: map[uint64]int{host: 1}},
+		"none": Group{},
+	}
+	update := func(step string, want map[string]NetTraffic) {
+		t.Helper()
+		if diff := cmp.Diff(c.Update(groups), want); diff != "" {
+			t.Errorf("%s: traffic differs: (-got +want)\n%s", step, diff)
+		}
+	}
+
+	update("first", map[string]NetTraffic{"g1": {1000, 100, 10, 10}, "g2": {6000, 600, 20, 20}})
+
+	// Procs in the same namespace see the same counters.
+	setProc(10, netA, 1500, 150)
+	setProc(11, netA, 1500, 150)
+	setProc(12, netB, 5100, 510)
+	update("growth", map[string]NetTraffic{"g1": {1500, 150, 10, 10}, "g2": {6600, 660, 20, 20}})
+
+	// netB's interface counters go down, e.g. it was recreated.
+	setProc(12, netB, 40, 4)
+	update("regressed", map[string]NetTraffic{"g1": {1500, 150, 10, 10}, "g2": {6640, 664, 30, 30}})
+
+	// g2 leaves netB; its total keeps what netB contributed.
+	groups["g2"] = Group{Netns: map[uint64]int{netA: 11}}
+	update("left", map[string]NetTraffic{"g1": {1500, 150, 10, 10}, "g2": {6640, 664, 30, 30}})
+
+	// Coming back to netB only counts its growth while g2 was away.
+	setProc(12, netB, 100, 10)
+	groups["g2"] = Group{Netns: map[uint64]int{netA: 11, netB: 12}}
+	update("returned", map[string]NetTraffic{"g1": {1500, 150, 10, 10}, "g2": {6700, 670, 30, 30}})
+
+	// Once away for netnsBaselineTTL, netB is forgotten and counts in full.
+	groups["g2"] = Group{Netns: map[uint64]int{netA: 11}}
+	now = now.Add(netnsBaselineTTL)
+	update("expired", map[string]NetTraffic{"g1": {1500, 150, 10, 10}, "g2": {6700, 670, 30, 30}})
+	groups["g2"] = Group{Netns: map[uint64]int{netA: 11, netB: 12}}
+	update("returned after expiry", map[string]NetTraffic{"g1": {1500, 150, 10, 10}, "g2": {6800, 680, 40, 40}})
+
+	// With the host's namespace included it's attributed like any other.
+	c = NewNetDevCounter(fs, false, true)
+	if got := c.Update(groups)["host"]; got != (NetTraffic{1e9 + 100, 1e9 + 100, 11, 11}) {
+		t.Errorf("got host traffic %v with host included, want it with lo", got)
+	}
+}
+
+// TestNetDevCounterNoHost verifies that nothing is attributed while the
+// host's namespace, which would be left out, can't be read.
+func TestNetDevCounterNoHost(t *testing.T) {
+	fs, root, setProc := netfs(t)
+	defer os.RemoveAll(root)
+	const host, netA = 1000, 2000
+	setProc(10, host, 1e9, 1e9)
+	setProc(11, netA, 1000, 100)
+
+	c := NewNetDevCounter(fs, true, false)
+	groups := GroupByName{
+		"host": Group{Netns: map[uint64]int{host: 10}},
+		"g1":   Group{Netns: map[uint64]int{netA: 11}},
+	}
+	if got := c.Update(groups); got != nil {
+		t.Errorf("got traffic %v without the host's namespace, want none", got)
+	}
+
+	setProc(1, host, 1e9, 1e9)
+	want := map[string]NetTraffic{"g1": {1000, 100, 10, 10}}
+	if diff := cmp.Diff(c.Update(groups), want); diff != "" {
+		t.Errorf("traffic differs: (-got +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,151 @@
+package proc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/procfs"
+)
+
+const (
+	// tcpListen is the state of listening TCP sockets in /proc/net/tcp.
+	tcpListen = "0A"
+	// udpUnconnected is the state of UDP sockets that aren't connected.
+	// Besides those bound to receive from anyone, that includes clients
+	// sending with sendto, e.g. some DNS resolvers, on the ephemeral port
+	// they were bound to; there's no telling them apart.
+	udpUnconnected = "07"
+)
+
+// ListeningPorts returns the TCP and UDP ports each of procs listens on, as
+// "tcp/<port>" or "udp/<port>", sorted, by pid, see listeningSockets and
+// listeningPorts.
+func (fs *FS) ListeningPorts(procs []procfs.Proc) map[int][]string {
+	sockets := fs.listeningSockets(procs)
+	ports := make(map[int][]string)
+	for _, p := range procs {
+		if found := listeningPorts(p, sockets); len(found) > 0 {
+			ports[p.PID] = found
+		}
+	}
+	return ports
+}
+
+// listeningSockets returns the sockets listening in the network namespaces
+// of procs, by inode, as "<proto>/<port>".  Those of each namespace are read
+// once, from /proc/<pid>/net of any of procs in it.  Reading them takes
+// privileges for procs owned by another user.
+func (fs *FS) listeningSockets(procs []procfs.Proc) map[uint64]string {
+	// Socket inodes are unique across namespaces, so one map will do.
+	sockets := make(map[uint64]string)
+	seen := make(map[uint64]bool)
+	for _, p := range procs {
+		procdir := strconv.Itoa(p.PID)
+		netns, err := fs.readNetns(procdir)
+		if err != nil || seen[netns] {
+			continue
+		}
+		// If the proc exited, its namespace is read through the next one
+		// in it.
+		read := false
+		for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+			err := readListeningSockets(filepath.Join(fs.MountPoint, procdir, "net", proto), proto[:3], sockets)
+			if err == nil {
+				read = true
+			} else if !os.IsNotExist(err) {
+				fs.readError(err, "")
+			}
+		}
+		seen[netns] = read
+	}
+	return sockets
+}
+
+// listeningPorts returns the ports of sockets, as from listeningSockets,
+// among the open file descriptors of p, sorted.  Reading those takes the
+// same access as ptrace, and a proc whose can't be read listens on none.
+func listeningPorts(p procfs.Proc, sockets map[uint64]string) []string {
+	if len(sockets) == 0 {
+		return nil
+	}
+	targets, err := p.FileDescriptorTargets()
+	if err != nil {
+		return nil
+	}
+	var ports []string
+	found := make(map[string]bool)
+	for _, target := range targets {
+		inode, ok := parseSocketInode(target)
+		if !ok {
+			continue
+		}
+		if port, ok := sockets[inode]; ok && !found[port] {
+			found[port] = true
+			ports = append(ports, port)
+		}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// parseSocketInode parses the target of a /proc/<pid>/fd link to a socket,
+// e.g. "socket:[12345]", into the socket's inode.
+func parseSocketInode(target string) (uint64, bool) {
+	if !strings.HasPrefix(target, "socket:[") || !strings.HasSuffix(target, "]") {
+		return 0, false
+	}
+	inode, err := strconv.ParseUint(target[len("socket:["):len(target)-1], 10, 64)
+	return inode, err == nil
+}
+
+// readListeningSockets adds the sockets listening in filename, a
+// /proc/<pid>/net/tcp, tcp6, udp or udp6 file, to sockets, by inode, as
+// "<proto>/<port>".
+func readListeningSockets(filename, proto string, sockets map[uint64]string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Skip the header.
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			return fmt.Errorf("malformed line in %s: %q", filename, scanner.Text())
+		}
+		local, remote, state := fields[1], fields[2], fields[3]
+		switch {
+		case proto == "tcp" && state == tcpListen:
+		case proto == "udp" && state == udpUnconnected && strings.HasSuffix(remote, ":0000"):
+		default:
+			continue
+		}
+		i := strings.LastIndexByte(local, ':')
+		if i < 0 {
+			return fmt.Errorf("malformed address in %s: %q", filename, local)
+		}
+		port, err := strconv.ParseUint(local[i+1:], 16, 16)
+		if err != nil {
+			return fmt.Errorf("malformed address in %s: %q", filename, local)
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed inode in %s: %q", filename, fields[9])
+		}
+		// Sockets that are closing have no inode.
+		if inode != 0 {
+			sockets[inode] = fmt.Sprintf("%s/%d", proto, port)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,119 @@
+package proc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	tcpHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	udpHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops\n"
+)
+
+// socketLine returns a line of /proc/<pid>/net/tcp or udp for a socket.
+func socketLine(local, remote, state string, inode int) string {
+	return fmt.Sprintf("   0: %s %s %s 00000000:00000000 00:00000000 00000000     0        0 %d 1 0000000000000000 100 0 0 10 0\n",
+		local, remote, state, inode)
+}
+
+// portsfs returns an FS on a temporary procfs, and a func to add a proc to
+// it in the given network namespace, with the given sockets tables, by file
+// name, and file descriptor targets.
+func portsfs(t *testing.T) (*FS, string, func(pid int, netns uint64, net map[string]string, fds ...string)) {
+	root, err := ioutil.TempDir("", "ports")
+	noerr(t, err)
+	stat, err := filepath.Abs("../fixtures/stat")
+	noerr(t, err)
+	noerr(t, os.Symlink(stat, filepath.Join(root, "stat")))
+	fs, err := NewFS(root, false)
+	noerr(t, err)
+	addProc := func(pid int, netns uint64, net map[string]string, fds ...string) {
+		dir := filepath.Join(root, strconv.Itoa(pid))
+		for _, sub := range []string{"ns", "net", "fd"} {
+			noerr(t, os.MkdirAll(filepath.Join(dir, sub), 0755))
+		}
+		noerr(t, os.Symlink(fmt.Sprintf("net:[%d]", netns), filepath.Join(dir, "ns", "net")))
+		for name, content := range net {
+			noerr(t, ioutil.WriteFile(filepath.Join(dir, "net", name), []byte(content), 0644))
+		}
+		for i, target := range fds {
+			noerr(t, os.Symlink(target, filepath.Join(dir, "fd", strconv.Itoa(i))))
+		}
+	}
+	return fs, root, addProc
+}
+
+// TestListeningPorts verifies that procs are given the TCP ports they listen
+// on and the UDP ports they're bound to unconnected, but not those of
+// connected sockets, in their own network namespace.
+func TestListeningPorts(t *testing.T) {
+	fs, root, addProc := portsfs(t)
+	defer os.RemoveAll(root)
+	const host, netA = 1000, 2000
+	addProc(1, host, map[string]string{
+		"tcp": tcpHeader +
+			socketLine("00000000:1538", "00000000:0000", tcpListen, 100) +
+			socketLine("0100007F:1538", "0100007F:D431", "01", 101),
+		"tcp6": tcpHeader +
+			socketLine("00000000000000000000000000000000:1F90", "00000000000000000000000000000000:0000", tcpListen, 102),
+		"udp": udpHeader +
+			socketLine("00000000:0035", "00000000:0000", udpUnconnected, 103) +
+			socketLine("0100007F:B0A2", "0100007F:0035", "01", 104),
+	}, "socket:[100]", "socket:[101]", "/dev/null", "pipe:[5]")
+	addProc(2, host, nil, "socket:[102]", "socket:[103]", "socket:[104]", "socket:[102]")
+	addProc(3, netA, map[string]string{
+		"tcp": tcpHeader + socketLine("00000000:1538", "00000000:0000", tcpListen, 200),
+	}, "socket:[200]")
+	addProc(4, netA, nil, "socket:[100]")
+
+	procs, err := fs.FS.AllProcs()
+	noerr(t, err)
+	got := fs.ListeningPorts(procs)
+	want := map[int][]string{
+		1: {"tcp/5432"},
+		2: {"tcp/8080", "udp/53"},
+		3: {"tcp/5432"},
+		// Inodes are unique, so 4's socket is 1's even if it's not in the
+		// tables of 4's namespace.
+		4: {"tcp/5432"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ports differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestStaticListeningPorts verifies that procs read with
+// GatherListeningPorts are given their ports, and others none.
+func TestStaticListeningPorts(t *testing.T) {
+	fs, root, addProc := portsfs(t)
+	defer os.RemoveAll(root)
+	addProc(1, 1000, map[string]string{
+		"tcp": tcpHeader + socketLine("00000000:1538", "00000000:0000", tcpListen, 100),
+	}, "socket:[100]")
+	for _, name := range []string{"stat", "status", "cmdline"} {
+		target, err := filepath.Abs(filepath.Join("../fixtures/14804", name))
+		noerr(t, err)
+		noerr(t, os.Symlink(target, filepath.Join(root, "1", name)))
+	}
+
+	for _, gather := range []bool{false, true} {
+		fs.GatherListeningPorts = gather
+		var want []string
+		if gather {
+			want = []string{"tcp/5432"}
+		}
+		p, err := fs.Proc(1)
+		noerr(t, err)
+		static, err := p.GetStatic()
+		noerr(t, err)
+		if diff := cmp.Diff(static.ListeningPorts, want); diff != "" {
+			t.Errorf("gather %v: ports differ: (-got +want)\n%s", gather, diff)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package proc
+
+import (
+	"sync"
+	"syscall"
+)
+
+// prefetchBatch is how many procs each worker of a prefetchIterator reads
+// ahead per batch.  Batches bound how much is held at once and how long the
+// Tracker waits before it can start on a batch.
+const prefetchBatch = 64
+
+// fdsPerReadWorker is the most files a worker reading a proc has open at
+// once: the /proc/<pid>/task directory and a file of one of its threads.
+const fdsPerReadWorker = 2
+
+type (
+	// prefetcher is implemented by the Procs of FS, whose reads can be done
+	// ahead of being asked for, by another goroutine.
+	prefetcher interface {
+		// prefetch reads and keeps the static details of the proc if
+		// static, and its metrics and threads as selectReads(reads.io,
+		// reads.threads) would if metrics.  Their errors are kept too,
+		// so that they're only counted once.
+		prefetch(static bool, reads procReads, metrics bool)
+	}
+
+	// prefetchedMetrics is what GetMetrics and GetThreads returned for a
+	// prefetched proc with the given noIO and noThreads.
+	prefetchedMetrics struct {
+		noIO, noThreads bool
+		metrics         Metrics
+		softerrors      int
+		err             error
+		threads         []Thread
+		threadsErr      error
+	}
+
+	// prefetchIterator is a procIterator whose procs are read ahead in
+	// batches by a pool of workers, so that reading /proc, which is most of
+	// the time an update takes, isn't done one proc at a time.  A batch is
+	// only read once the previous one has been consumed, so prefetch may
+	// read whatever the consumer changes without locking.
+	prefetchIterator struct {
+		*procIterator
+		workers  int
+		prefetch func(Proc)
+		// batch holds the procs read ahead, from index start of procs.
+		batch []Proc
+		start int
+	}
+)
+
+// MaxReadWorkers returns the most workers procs can be read with, see
+// Grouper.SetReadWorkers, without using more than half of the soft limit on
+// open files, leaving the rest for serving scrapes and reading cgroups.
+func MaxReadWorkers() int {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 1
+	}
+	// The limit may be RLIM_INFINITY, which doesn't fit an int.
+	max := rlim.Cur / 2 / fdsPerReadWorker
+	if max > 1<<16 {
+		max = 1 << 16
+	}
+	if max < 1 {
+		return 1
+	}
+	return int(max)
+}
+
+// newPrefetchIterator returns an iterator over the procs of pi, reading
+// each ahead with prefetch on one of workers goroutines.
+func newPrefetchIterator(pi *procIterator, workers int, prefetch func(Proc)) *prefetchIterator {
+	return &prefetchIterator{procIterator: pi, workers: workers, prefetch: prefetch}
+}
+
+// Next implements Iter.
+func (pi *prefetchIterator) Next() bool {
+	pi.idx++
+	if pi.procs == nil || pi.idx >= pi.procs.length() {
+		pi.Proc = nil
+		return false
+	}
+	if pi.idx >= pi.start+len(pi.batch) {
+		pi.readBatch()
+	}
+	pi.Proc = pi.batch[pi.idx-pi.start]
+	return true
+}
+
+// Close implements Iter.
+func (pi *prefetchIterator) Close() error {
+	pi.batch = nil
+	pi.procs = nil
+	pi.Proc = nil
+	return pi.err
+}
+
+// readBatch reads ahead the next batch of procs, from the current one on,
+// handing them out to the workers over a channel and returning once
+// they're all read.
+func (pi *prefetchIterator) readBatch() {
+	n := pi.procs.length() - pi.idx
+	if max := pi.workers * prefetchBatch; n > max {
+		n = max
+	}
+	pi.start = pi.idx
+	pi.batch = pi.batch[:0]
+	for i := 0; i < n; i++ {
+		pi.batch = append(pi.batch, pi.procs.get(pi.start+i))
+	}
+
+	workers := pi.workers
+	if workers > n {
+		workers = n
+	}
+	todo := make(chan Proc)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range todo {
+				pi.prefetch(p)
+			}
+		}()
+	}
+	for _, p := range pi.batch {
+		todo <- p
+	}
+	close(todo)
+	wg.Wait()
+}
+
+// prefetch implements prefetcher.
+func (p *proc) prefetch(static bool, reads procReads, metrics bool) {
+	if static {
+		if _, err := p.GetStatic(); err != nil {
+			p.staticErr = err
+		}
+	}
+	if metrics {
+		p.selectReads(reads.io, reads.threads)
+		pm := &prefetchedMetrics{noIO: p.noIO, noThreads: p.noThreads}
+		pm.metrics, pm.softerrors, pm.err = p.GetMetrics()
+		if pm.err == nil {
+			pm.threads, pm.threadsErr = p.GetThreads()
+		}
+		p.prefetchedMetrics = pm
+	}
+}
+
+// prefetched returns what was read ahead of p's metrics and threads, if
+// anything was, with the reads p now selects.
+func (p proc) prefetched() *prefetchedMetrics {
+	pm := p.prefetchedMetrics
+	if pm == nil || pm.noIO != p.noIO || pm.noThreads != p.noThreads {
+		return nil
+	}
+	return pm
+}
@@ -0,0 +1,127 @@
+package proc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// procTreeFS returns an FS on a temporary procfs of procs procs, copies of
+// fixtures/14804 whose parent is pid 1, named p0 to p3 by pid modulo 4, each
+// with a task directory holding itself as its only thread.
+func procTreeFS(tb testing.TB, procs int) (*FS, string) {
+	root, err := ioutil.TempDir("", "proctree")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	check := func(err error) {
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	fixture, err := filepath.Abs("../fixtures/14804")
+	check(err)
+	stat, err := ioutil.ReadFile(filepath.Join(fixture, "stat"))
+	check(err)
+	// Everything after the comm and the state.
+	rest := strings.SplitN(string(stat), ") S ", 2)[1]
+	rest = rest[strings.IndexByte(rest, ' '):]
+	statRoot, err := filepath.Abs("../fixtures/stat")
+	check(err)
+	check(os.Symlink(statRoot, filepath.Join(root, "stat")))
+
+	for pid := 1; pid <= procs; pid++ {
+		dir := filepath.Join(root, strconv.Itoa(pid))
+		check(os.MkdirAll(filepath.Join(dir, "task"), 0755))
+		for _, name := range []string{"cmdline", "status", "io", "limits", "cgroup", "fd"} {
+			check(os.Symlink(filepath.Join(fixture, name), filepath.Join(dir, name)))
+		}
+		check(ioutil.WriteFile(filepath.Join(dir, "wchan"), []byte("0"), 0644))
+		check(ioutil.WriteFile(filepath.Join(dir, "stat"),
+			[]byte(fmt.Sprintf("%d (p%d) S 1%s", pid, pid%4, rest)), 0644))
+		check(os.Symlink("..", filepath.Join(dir, "task", strconv.Itoa(pid))))
+	}
+	fs, err := NewFS(root, false)
+	check(err)
+	return fs, root
+}
+
+// TestGrouperReadWorkers verifies that updates reading procs ahead on
+// workers give the same groups, and count the same errors, as those reading
+// them one at a time, for new, tracked and ignored procs, rechecked or not.
+func TestGrouperReadWorkers(t *testing.T) {
+	for _, recheck := range []bool{false, true} {
+		var want []GroupByName
+		var wantErrs []CollectErrors
+		var wantReadErrs map[string]uint64
+		for _, workers := range []int{1, 2, 8} {
+			fs, root := procTreeFS(t, 100)
+			defer os.RemoveAll(root)
+			gr := NewGrouper(newNamer("p0", "p1"), false, true, recheck, false)
+			gr.SetReadWorkers(workers)
+
+			var got []GroupByName
+			var gotErrs []CollectErrors
+			for i := 0; i < 3; i++ {
+				colErrs, groups, err := gr.Update(fs.AllProcs())
+				noerr(t, err)
+				got = append(got, groups)
+				gotErrs = append(gotErrs, colErrs)
+			}
+			if workers == 1 {
+				want, wantErrs, wantReadErrs = got, gotErrs, fs.ReadErrors()
+				continue
+			}
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Errorf("recheck %v, %d workers: groups differ: (-got +want)\n%s", recheck, workers, diff)
+			}
+			if diff := cmp.Diff(gotErrs, wantErrs); diff != "" {
+				t.Errorf("recheck %v, %d workers: errors differ: (-got +want)\n%s", recheck, workers, diff)
+			}
+			if diff := cmp.Diff(fs.ReadErrors(), wantReadErrs); diff != "" {
+				t.Errorf("recheck %v, %d workers: read errors differ: (-got +want)\n%s", recheck, workers, diff)
+			}
+		}
+	}
+}
+
+// BenchmarkGrouperReadWorkers updates a grouper tracking half of 2000
+// procs, reading them with 1, 4 and 16 workers.  The speedup depends on how
+// many CPUs there are and on reading procfs being the bottleneck, which with
+// a temporary directory standing in for it is less so than for the real
+// thing.
+func BenchmarkGrouperReadWorkers(b *testing.B) {
+	fs, root := procTreeFS(b, 2000)
+	defer os.RemoveAll(root)
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			gr := NewGrouper(newNamer("p0", "p1"), false, true, false, false)
+			gr.SetReadWorkers(workers)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := gr.Update(fs.AllProcs()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestMaxReadWorkers verifies that the workers allowed have at most half of
+// the open files limit open between them.
+func TestMaxReadWorkers(t *testing.T) {
+	var rlim syscall.Rlimit
+	noerr(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim))
+	max := MaxReadWorkers()
+	if max < 1 || uint64(max*fdsPerReadWorker) > rlim.Cur/2 {
+		t.Errorf("got %d workers for an open files limit of %d", max, rlim.Cur)
+	}
+}
@@ -1,10 +1,16 @@
 package proc
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/procfs"
@@ -14,6 +20,21 @@ import (
 // typically because it disappeared while we were reading it.
 var ErrProcNotExist = fmt.Errorf("process does not exist")
 
+// Reasons for ReadErrors.
+const (
+	// ReadErrPermission is for EACCES and EPERM, e.g. reading another
+	// user's /proc/<pid>/io without privileges.
+	ReadErrPermission = "permission_denied"
+	// ReadErrVanished is for procs that exited while being read.
+	ReadErrVanished = "vanished"
+	// ReadErrParse is for files whose contents couldn't be parsed.
+	ReadErrParse = "parse_error"
+	// ReadErrCgroup is for errors reading cgroupfs, see CgroupReadErrors.
+	ReadErrCgroup = "cgroup_read_error"
+	// ReadErrOther is for all other errors.
+	ReadErrOther = "other"
+)
+
 type (
 	// ID uniquely identifies a process.
 	ID struct {
@@ -33,6 +54,28 @@ type (
 		ParentPid    int
 		StartTime    time.Time
 		EffectiveUID int
+		RealUID      int
+		// UIDs and GIDs are the proc's user and group ids, from the Uid and
+		// Gid lines of /proc/<pid>/status.  EffectiveUID and RealUID are
+		// those of UIDs.
+		UIDs Creds
+		GIDs Creds
+		// Runtime is the container runtime of the proc, if
+		// FS.GatherRuntime.
+		Runtime CgroupRuntime
+		// Exe is the path of the executable, from /proc/<pid>/exe, or empty
+		// if it can't be read, e.g. for lack of permission, or for kernel
+		// threads.
+		Exe string
+		// CgroupPath is the cgroup path of the proc, see CgroupsPath, if
+		// FS.GatherCgroupPath.
+		CgroupPath string
+		// Env holds those of FS.EnvVars that are set in the environment of
+		// the proc.  It's nil if its environ can't be read.
+		Env map[string]string
+		// ListeningPorts are the ports the proc listens on, see
+		// FS.ListeningPorts, if FS.GatherListeningPorts.
+		ListeningPorts []string
 	}
 
 	// Counts are metric counters common to threads and processes and groups.
@@ -45,6 +88,21 @@ type (
 		MinorPageFaults       uint64
 		CtxSwitchVoluntary    uint64
 		CtxSwitchNonvoluntary uint64
+		ReadSyscalls          uint64
+		WriteSyscalls         uint64
+		// CancelledWriteBytes counts bytes which were accounted in
+		// WriteBytes but never written, e.g. due to truncating dirty
+		// pagecache.
+		CancelledWriteBytes uint64
+		// CPUChildTime is the CPU time of reaped children, i.e. cutime
+		// plus cstime.  For threads it's the same as for their proc.
+		CPUChildTime float64
+	}
+
+	// Creds are the real, effective, saved set and filesystem ids of a
+	// proc, users or groups, in the order of /proc/<pid>/status.
+	Creds struct {
+		Real, Effective, Saved, FS int
 	}
 
 	// Memory describes a proc's memory usage.
@@ -54,6 +112,20 @@ type (
 		VmSwapBytes           uint64
 		ProportionalBytes     uint64
 		ProportionalSwapBytes uint64
+		// UniqueBytes is the memory private to the proc (USS), i.e.
+		// Private_Clean+Private_Dirty from smaps.
+		UniqueBytes uint64
+		// LockedBytes and PinnedBytes are VmLck and VmPin from status: memory
+		// that can't be reclaimed because it's mlocked, or pinned by the
+		// kernel, e.g. for RDMA.
+		LockedBytes uint64
+		PinnedBytes uint64
+		// ResidentAnonBytes, ResidentFileBytes and ResidentShmemBytes are
+		// RssAnon, RssFile and RssShmem from status: the anonymous,
+		// file-backed and shared memory parts of ResidentBytes.
+		ResidentAnonBytes  uint64
+		ResidentFileBytes  uint64
+		ResidentShmemBytes uint64
 	}
 
 	// Filedesc describes a proc's file descriptor usage and soft limit.
@@ -81,6 +153,33 @@ type (
 		NumThreads uint64
 		States
 		Wchan string
+		// Cgroups is the proc's cgroup placement, if FS.GatherCgroups.
+		Cgroups []Cgroup
+		// Nice is the nice value, from 19 (lowest priority) to -20.
+		Nice int
+		// Priority is the kernel's scheduling priority: 20+Nice for normal
+		// procs, or for procs with a realtime policy (SCHED_FIFO/SCHED_RR)
+		// the negated realtime priority minus one, i.e. -2 to -100.
+		Priority int
+		// Blocked is true if the proc, or with threads any of them, is in
+		// uninterruptible sleep (D state).  BlockedWchan is then the wchan
+		// of the main thread if it's blocked, else of a blocked thread.
+		Blocked      bool
+		BlockedWchan string
+		// CapEff is the effective capability set, if FS.GatherCapabilities.
+		CapEff uint64
+		// Netns is the inode of the network namespace, if FS.GatherNetns.
+		Netns uint64
+		// SchedPolicy is the name of the scheduling policy, see
+		// SchedPolicyName, if FS.GatherSchedPolicy.
+		SchedPolicy string
+		// CPUsAllowed is the number of CPUs the proc may run on, from
+		// Cpus_allowed_list of status, if FS.GatherCPUsAllowed.
+		CPUsAllowed int
+		// IOSkipped is true if FS.GatherIO but reading /proc/<pid>/io was
+		// denied, as it is for other users' procs without privileges, in
+		// which case the I/O fields of Counts are zero.
+		IOSkipped bool
 	}
 
 	// Thread contains per-thread data.
@@ -90,6 +189,8 @@ type (
 		Counts
 		Wchan string
 		States
+		// SchedPolicy is the thread's scheduling policy, see Metrics.
+		SchedPolicy string
 	}
 
 	// IDInfo groups all info for a single process.
@@ -125,6 +226,10 @@ type (
 		GetWchan() (string, error)
 		GetCounts() (Counts, int, error)
 		GetThreads() ([]Thread, error)
+		// GetSMaps() returns a Memory with only the fields derived from
+		// /proc/<pid>/smaps_rollup set.  Reading it can take milliseconds for
+		// procs with large address spaces, so it's not done by GetMetrics.
+		GetSMaps() (Memory, error)
 	}
 
 	// proccache implements the Proc interface by acting as wrapper for procfs.Proc
@@ -138,6 +243,23 @@ type (
 		io      *procfs.ProcIO
 		fs      *FS
 		wchan   *string
+		// statErr is the error reading stat, which is cached too so that
+		// it's only counted once.
+		statErr error
+		// noIO and noThreads skip reading /proc/<pid>/io and
+		// /proc/<pid>/task even if fs enables it, see selectReads.
+		noIO, noThreads bool
+		// sockets are the sockets listening in the namespaces of the procs
+		// read along with this one, see FS.listeningSockets, if
+		// fs.GatherListeningPorts.
+		sockets map[uint64]string
+		// static is the result of GetStatic, once it's succeeded.
+		// staticErr is its error if it failed when read ahead by a worker
+		// of a prefetchIterator, and prefetchedMetrics what GetMetrics
+		// and GetThreads returned then, if not nil.
+		static            *Static
+		staticErr         error
+		prefetchedMetrics *prefetchedMetrics
 	}
 
 	proc struct {
@@ -152,8 +274,9 @@ type (
 
 	// procfsprocs implements procs using procfs.
 	procfsprocs struct {
-		Procs []procfs.Proc
-		fs    *FS
+		Procs   []procfs.Proc
+		fs      *FS
+		sockets map[uint64]string
 	}
 
 	// Iter is an iterator over a sequence of procs.
@@ -166,6 +289,16 @@ type (
 		Proc
 	}
 
+	// readSelector is implemented by the Procs of FS, whose optional reads
+	// can be chosen proc by proc, e.g. by the Tracker according to their
+	// group.
+	readSelector interface {
+		// selectReads returns the proc with /proc/<pid>/io read only if
+		// io, and /proc/<pid>/task only if threads, and then only if its
+		// FS enables them.
+		selectReads(io, threads bool) Proc
+	}
+
 	// procIterator implements the Iter interface
 	procIterator struct {
 		// procs is the list of Proc we're iterating over.
@@ -186,13 +319,77 @@ type (
 		AllProcs() Iter
 	}
 
+	// readErrorCounts counts errors by reason.
+	readErrorCounts struct {
+		sync.Mutex
+		counts map[string]uint64
+	}
+
 	// FS implements Source.
 	FS struct {
 		procfs.FS
-		BootTime    uint64
-		MountPoint  string
-		GatherSMaps bool
-		debug       bool
+		BootTime   uint64
+		MountPoint string
+		// GatherIO enables reading /proc/<pid>/io, see CheckIO.
+		GatherIO bool
+		// GatherCgroups enables reading /proc/<pid>/cgroup.
+		GatherCgroups bool
+		// GatherWchan enables reading /proc/<pid>/wchan.
+		GatherWchan bool
+		// GatherThreads enables reading /proc/<pid>/task.  Without it, the
+		// states and context switches of a proc are those of its main thread.
+		GatherThreads bool
+		// GatherCapabilities enables reading the effective capability set
+		// from /proc/<pid>/status.
+		GatherCapabilities bool
+		// GatherNetns enables reading the network namespace from
+		// /proc/<pid>/ns/net.
+		GatherNetns bool
+		// GatherSchedPolicy enables reading the scheduling policy of procs,
+		// and of threads with GatherThreads, from their stat.
+		GatherSchedPolicy bool
+		// GatherCPUsAllowed enables reading the CPU affinity of procs
+		// from /proc/<pid>/status.
+		GatherCPUsAllowed bool
+		// GatherRuntime enables reading the container runtime of new procs
+		// from /proc/<pid>/cgroup, see CgroupsRuntime.
+		GatherRuntime bool
+		// GatherCgroupPath enables reading the cgroup path of new procs
+		// from /proc/<pid>/cgroup, see CgroupsPath.
+		GatherCgroupPath bool
+		// EnvVars are the names of the environment variables to read for
+		// new procs from /proc/<pid>/environ, if any.  Reading it takes
+		// the same access as ptrace.
+		EnvVars []string
+		// GatherListeningPorts enables finding the TCP and UDP ports new
+		// procs listen on, see ListeningPorts.  The listening sockets are
+		// read once per AllProcs, and the file descriptors of a proc only
+		// when its static details are, which takes the same access as
+		// ptrace.
+		GatherListeningPorts bool
+		// CgroupMountPoint is where cgroupfs is mounted.  If empty, the
+		// cgroup mounts are found from mountinfo, see CgroupMountRoot.
+		CgroupMountPoint string
+		// CgroupNoSymlinks makes cgroup files be opened with openat2 relative
+		// to the mount they're under, refusing symlinks and paths escaping
+		// it, so that a writable cgroup can't redirect reads elsewhere.
+		CgroupNoSymlinks bool
+		// CgroupFilter, if not nil, restricts AllProcs to the procs it
+		// matches, checked from /proc/<pid>/cgroup before anything else of
+		// the proc is read.
+		CgroupFilter *CgroupFilter
+		// cgroupMu guards cgroupMountsCache and swapAccounting, which are
+		// found lazily, and cgroupReadErrors.
+		cgroupMu          sync.Mutex
+		cgroupMountsCache *CgroupMounts
+		swapAccounting    *bool
+		cgroupReadErrors  map[string]uint64
+		// readErrors counts errors reading procs by reason.  It's shared
+		// with the FS used for their threads.
+		readErrors *readErrorCounts
+		// cgroupReadFile reads cgroup files, ioutil.ReadFile if nil.
+		cgroupReadFile func(filename string) ([]byte, error)
+		debug          bool
 	}
 )
 
@@ -210,6 +407,10 @@ func (c *Counts) Add(c2 Delta) {
 	c.MinorPageFaults += c2.MinorPageFaults
 	c.CtxSwitchVoluntary += c2.CtxSwitchVoluntary
 	c.CtxSwitchNonvoluntary += c2.CtxSwitchNonvoluntary
+	c.ReadSyscalls += c2.ReadSyscalls
+	c.WriteSyscalls += c2.WriteSyscalls
+	c.CancelledWriteBytes += c2.CancelledWriteBytes
+	c.CPUChildTime += c2.CPUChildTime
 }
 
 // Sub subtracts c2 from the counts.
@@ -222,9 +423,54 @@ func (c Counts) Sub(c2 Counts) Delta {
 	c.MinorPageFaults -= c2.MinorPageFaults
 	c.CtxSwitchVoluntary -= c2.CtxSwitchVoluntary
 	c.CtxSwitchNonvoluntary -= c2.CtxSwitchNonvoluntary
+	c.ReadSyscalls -= c2.ReadSyscalls
+	c.WriteSyscalls -= c2.WriteSyscalls
+	c.CancelledWriteBytes -= c2.CancelledWriteBytes
+	c.CPUChildTime -= c2.CPUChildTime
 	return Delta(c)
 }
 
+// withIO returns c with the fields read from /proc/<pid>/io taken from c2.
+func (c Counts) withIO(c2 Counts) Counts {
+	c.ReadBytes, c.WriteBytes = c2.ReadBytes, c2.WriteBytes
+	c.ReadSyscalls, c.WriteSyscalls = c2.ReadSyscalls, c2.WriteSyscalls
+	c.CancelledWriteBytes = c2.CancelledWriteBytes
+	return c
+}
+
+// subClamped is like Sub, except that fields of c which are less than those
+// of c2 yield zero rather than a negative or wrapped around delta.
+// regressed is true if there were any.
+func (c Counts) subClamped(c2 Counts) (d Delta, regressed bool) {
+	subf := func(x, y float64) float64 {
+		if x < y {
+			regressed = true
+			return 0
+		}
+		return x - y
+	}
+	subu := func(x, y uint64) uint64 {
+		if x < y {
+			regressed = true
+			return 0
+		}
+		return x - y
+	}
+	d.CPUUserTime = subf(c.CPUUserTime, c2.CPUUserTime)
+	d.CPUSystemTime = subf(c.CPUSystemTime, c2.CPUSystemTime)
+	d.ReadBytes = subu(c.ReadBytes, c2.ReadBytes)
+	d.WriteBytes = subu(c.WriteBytes, c2.WriteBytes)
+	d.MajorPageFaults = subu(c.MajorPageFaults, c2.MajorPageFaults)
+	d.MinorPageFaults = subu(c.MinorPageFaults, c2.MinorPageFaults)
+	d.CtxSwitchVoluntary = subu(c.CtxSwitchVoluntary, c2.CtxSwitchVoluntary)
+	d.CtxSwitchNonvoluntary = subu(c.CtxSwitchNonvoluntary, c2.CtxSwitchNonvoluntary)
+	d.ReadSyscalls = subu(c.ReadSyscalls, c2.ReadSyscalls)
+	d.WriteSyscalls = subu(c.WriteSyscalls, c2.WriteSyscalls)
+	d.CancelledWriteBytes = subu(c.CancelledWriteBytes, c2.CancelledWriteBytes)
+	d.CPUChildTime = subf(c.CPUChildTime, c2.CPUChildTime)
+	return d, regressed
+}
+
 func (s *States) Add(s2 States) {
 	s.Other += s2.Other
 	s.Running += s2.Running
@@ -271,14 +517,28 @@ func (p IDInfo) GetWchan() (string, error) {
 	return p.Wchan, nil
 }
 
+// GetSMaps implements Proc.
+func (p IDInfo) GetSMaps() (Memory, error) {
+	return Memory{
+		ProportionalBytes:     p.Memory.ProportionalBytes,
+		ProportionalSwapBytes: p.Memory.ProportionalSwapBytes,
+		UniqueBytes:           p.Memory.UniqueBytes,
+	}, nil
+}
+
 func (p *proccache) GetPid() int {
 	return p.Proc.PID
 }
 
 func (p *proccache) getStat() (procfs.ProcStat, error) {
+	if p.statErr != nil {
+		return procfs.ProcStat{}, p.statErr
+	}
 	if p.stat == nil {
 		stat, err := p.Proc.NewStat()
 		if err != nil {
+			p.fs.readError(err, "")
+			p.statErr = err
 			return procfs.ProcStat{}, err
 		}
 		p.stat = &stat
@@ -287,10 +547,17 @@ func (p *proccache) getStat() (procfs.ProcStat, error) {
 	return *p.stat, nil
 }
 
+// readStatus returns the contents of /proc/<pid>/status, for the fields
+// procfs doesn't parse.
+func (fs *FS) readStatus(pid int) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(fs.MountPoint, strconv.Itoa(pid), "status"))
+}
+
 func (p *proccache) getStatus() (procfs.ProcStatus, error) {
 	if p.status == nil {
 		status, err := p.Proc.NewStatus()
 		if err != nil {
+			p.fs.readError(err, "")
 			return procfs.ProcStatus{}, err
 		}
 		p.status = &status
@@ -316,6 +583,7 @@ func (p *proccache) getCmdLine() ([]string, error) {
 	if p.cmdline == nil {
 		cmdline, err := p.Proc.CmdLine()
 		if err != nil {
+			p.fs.readError(err, "")
 			return nil, err
 		}
 		p.cmdline = cmdline
@@ -323,10 +591,48 @@ func (p *proccache) getCmdLine() ([]string, error) {
 	return p.cmdline, nil
 }
 
+// getExe returns the path of the executable, or "" if it can't be read.
+// Reading it takes ptrace access, which an unprivileged exporter only has to
+// its own user's procs, so failing to isn't counted as an error.
+func (p *proccache) getExe() string {
+	exe, err := p.Proc.Executable()
+	if err != nil {
+		return ""
+	}
+	return exe
+}
+
+// getEnv returns the FS.EnvVars set in the environment, or nil if there are
+// none to read or it can't be read.  Unlike for the executable, failing to
+// read it is counted as an error, since it's only read when asked for.
+func (p *proccache) getEnv() map[string]string {
+	if len(p.fs.EnvVars) == 0 {
+		return nil
+	}
+	environ, err := p.Proc.Environ()
+	if err != nil {
+		p.fs.readError(err, "")
+		return nil
+	}
+	env := make(map[string]string)
+	for _, kv := range environ {
+		for _, name := range p.fs.EnvVars {
+			if len(kv) > len(name) && kv[len(name)] == '=' && strings.HasPrefix(kv, name) {
+				env[name] = kv[len(name)+1:]
+			}
+		}
+	}
+	return env
+}
+
 func (p *proccache) getWchan() (string, error) {
+	if !p.fs.GatherWchan {
+		return "", nil
+	}
 	if p.wchan == nil {
 		wchan, err := p.Proc.Wchan()
 		if err != nil {
+			p.fs.readError(err, "")
 			return "", err
 		}
 		p.wchan = &wchan
@@ -338,6 +644,7 @@ func (p *proccache) getIo() (procfs.ProcIO, error) {
 	if p.io == nil {
 		io, err := p.Proc.IO()
 		if err != nil {
+			p.fs.readError(err, "")
 			return procfs.ProcIO{}, err
 		}
 		p.io = &io
@@ -347,6 +654,22 @@ func (p *proccache) getIo() (procfs.ProcIO, error) {
 
 // GetStatic returns the ProcStatic corresponding to this proc.
 func (p *proccache) GetStatic() (Static, error) {
+	if p.static != nil {
+		return *p.static, nil
+	}
+	if p.staticErr != nil {
+		return Static{}, p.staticErr
+	}
+	static, err := p.readStatic()
+	if err != nil {
+		return Static{}, err
+	}
+	p.static = &static
+	return static, nil
+}
+
+// readStatic reads the static details of the proc, see GetStatic.
+func (p *proccache) readStatic() (Static, error) {
 	// /proc/<pid>/cmdline is normally world-readable.
 	cmdline, err := p.getCmdLine()
 	if err != nil {
@@ -359,7 +682,7 @@ func (p *proccache) GetStatic() (Static, error) {
 		return Static{}, err
 	}
 	startTime := time.Unix(int64(p.fs.BootTime), 0).UTC()
-	startTime = startTime.Add(time.Second / userHZ * time.Duration(stat.Starttime))
+	startTime = startTime.Add(time.Second / time.Duration(userHZ) * time.Duration(stat.Starttime))
 
 	// /proc/<pid>/status is normally world-readable.
 	status, err := p.getStatus()
@@ -367,41 +690,99 @@ func (p *proccache) GetStatic() (Static, error) {
 		return Static{}, err
 	}
 
-	effectiveUID, err := strconv.ParseInt(status.UIDs[1], 10, 64)
+	uids, err := parseCreds(status.UIDs)
+	if err != nil {
+		p.fs.readError(err, ReadErrParse)
+		return Static{}, err
+	}
+	gids, err := parseCreds(status.GIDs)
 	if err != nil {
+		p.fs.readError(err, ReadErrParse)
 		return Static{}, err
 	}
 
+	var runtime CgroupRuntime
+	var cgroupPath string
+	if p.fs.GatherRuntime || p.fs.GatherCgroupPath {
+		cgroups, err := p.fs.Cgroups(p.PID)
+		if err != nil {
+			p.fs.readError(err, "")
+		}
+		if p.fs.GatherRuntime {
+			runtime = CgroupsRuntime(cgroups)
+		}
+		if p.fs.GatherCgroupPath {
+			cgroupPath = CgroupsPath(cgroups)
+		}
+	}
+
 	return Static{
-		Name:         stat.Comm,
-		Cmdline:      cmdline,
-		ParentPid:    stat.PPID,
-		StartTime:    startTime,
-		EffectiveUID: int(effectiveUID),
+		Name:           stat.Comm,
+		Cmdline:        cmdline,
+		ParentPid:      stat.PPID,
+		StartTime:      startTime,
+		EffectiveUID:   uids.Effective,
+		RealUID:        uids.Real,
+		UIDs:           uids,
+		GIDs:           gids,
+		Runtime:        runtime,
+		Exe:            p.getExe(),
+		CgroupPath:     cgroupPath,
+		Env:            p.getEnv(),
+		ListeningPorts: listeningPorts(p.Proc, p.sockets),
 	}, nil
 }
 
+// parseCreds parses the fields of the Uid or Gid line of /proc/<pid>/status.
+func parseCreds(fields [4]string) (Creds, error) {
+	var ids [4]int
+	for i, f := range fields {
+		id, err := strconv.Atoi(f)
+		if err != nil {
+			return Creds{}, fmt.Errorf("malformed id %q: %v", f, err)
+		}
+		ids[i] = id
+	}
+	return Creds{Real: ids[0], Effective: ids[1], Saved: ids[2], FS: ids[3]}, nil
+}
+
 func (p proc) GetCounts() (Counts, int, error) {
+	counts, _, softerrors, err := p.getCounts()
+	return counts, softerrors, err
+}
+
+// getCounts is GetCounts, also returning true if /proc/<pid>/io was skipped
+// for want of permission, which isn't counted as a soft error.
+func (p proc) getCounts() (Counts, bool, int, error) {
 	stat, err := p.getStat()
 	if err != nil {
-		if err == os.ErrNotExist {
-			err = ErrProcNotExist
+		if os.IsNotExist(err) {
+			return Counts{}, false, 0, ErrProcNotExist
 		}
-		return Counts{}, 0, fmt.Errorf("error reading stat file: %v", err)
+		return Counts{}, false, 0, fmt.Errorf("error reading stat file: %v", err)
 	}
 
+	// Without status we can't report memory (e.g. VmSwap) or context
+	// switches, so treat it as a failure to read the proc rather than
+	// reporting zeroes that would skew the group sums.
 	status, err := p.getStatus()
 	if err != nil {
-		if err == os.ErrNotExist {
-			err = ErrProcNotExist
+		if os.IsNotExist(err) {
+			return Counts{}, false, 0, ErrProcNotExist
 		}
-		return Counts{}, 0, fmt.Errorf("error reading status file: %v", err)
+		return Counts{}, false, 0, fmt.Errorf("error reading status file: %v", err)
 	}
 
-	io, err := p.getIo()
+	var io procfs.ProcIO
+	var ioSkipped bool
 	softerrors := 0
-	if err != nil {
-		softerrors++
+	if p.fs.GatherIO && !p.noIO {
+		io, err = p.getIo()
+		if os.IsPermission(err) {
+			ioSkipped = true
+		} else if err != nil {
+			softerrors++
+		}
 	}
 	return Counts{
 		CPUUserTime:           float64(stat.UTime) / userHZ,
@@ -412,7 +793,11 @@ func (p proc) GetCounts() (Counts, int, error) {
 		MinorPageFaults:       uint64(stat.MinFlt),
 		CtxSwitchVoluntary:    uint64(status.VoluntaryCtxtSwitches),
 		CtxSwitchNonvoluntary: uint64(status.NonVoluntaryCtxtSwitches),
-	}, softerrors, nil
+		ReadSyscalls:          io.SyscR,
+		WriteSyscalls:         io.SyscW,
+		CancelledWriteBytes:   uint64(io.CancelledWriteBytes),
+		CPUChildTime:          float64(stat.CUTime+stat.CSTime) / userHZ,
+	}, ioSkipped, softerrors, nil
 }
 
 func (p proc) GetWchan() (string, error) {
@@ -442,9 +827,13 @@ func (p proc) GetStates() (States, error) {
 }
 
 // GetMetrics returns the current metrics for the proc.  The results are
-// not cached.
+// not cached, unless they were read ahead, see prefetcher.
 func (p proc) GetMetrics() (Metrics, int, error) {
-	counts, softerrors, err := p.GetCounts()
+	if pm := p.prefetched(); pm != nil {
+		return pm.metrics, pm.softerrors, pm.err
+	}
+
+	counts, ioSkipped, softerrors, err := p.getCounts()
 	if err != nil {
 		return Metrics{}, 0, err
 	}
@@ -463,12 +852,14 @@ func (p proc) GetMetrics() (Metrics, int, error) {
 
 	numfds, err := p.Proc.FileDescriptorsLen()
 	if err != nil {
+		p.fs.readError(err, "")
 		numfds = -1
 		softerrors |= 1
 	}
 
 	limits, err := p.Proc.NewLimits()
 	if err != nil {
+		p.fs.readError(err, "")
 		return Metrics{}, 0, err
 	}
 
@@ -481,15 +872,62 @@ func (p proc) GetMetrics() (Metrics, int, error) {
 		ResidentBytes: uint64(stat.ResidentMemory()),
 		VirtualBytes:  uint64(stat.VirtualMemory()),
 		VmSwapBytes:   uint64(status.VmSwap),
+		LockedBytes:   uint64(status.VmLck),
+		PinnedBytes:   uint64(status.VmPin),
+
+		ResidentAnonBytes:  uint64(status.RssAnon),
+		ResidentFileBytes:  uint64(status.RssFile),
+		ResidentShmemBytes: uint64(status.RssShmem),
 	}
 
-	if p.proccache.fs.GatherSMaps {
-		smaps, err := p.Proc.ProcSMapsRollup()
-		if err != nil {
+	var blockedWchan string
+	if states.Waiting > 0 {
+		blockedWchan = wchan
+	}
+
+	var cgroups []Cgroup
+	if p.fs.GatherCgroups {
+		if cgroups, err = p.fs.Cgroups(p.PID); err != nil {
+			p.fs.readError(err, "")
+			softerrors |= 1
+		}
+	}
+
+	var capEff uint64
+	var cpusAllowed int
+	if p.fs.GatherCapabilities || p.fs.GatherCPUsAllowed {
+		var rawStatus []byte
+		if rawStatus, err = p.fs.readStatus(p.PID); err != nil {
+			p.fs.readError(err, "")
+			softerrors |= 1
+		}
+		if rawStatus != nil && p.fs.GatherCapabilities {
+			caps, err := parseProcCapabilities(rawStatus)
+			if err != nil {
+				softerrors |= 1
+			}
+			capEff = uint64(caps.Effective)
+		}
+		if rawStatus != nil && p.fs.GatherCPUsAllowed {
+			if cpusAllowed, err = parseCPUsAllowed(rawStatus); err != nil {
+				softerrors |= 1
+			}
+		}
+	}
+
+	var netns uint64
+	if p.fs.GatherNetns {
+		if netns, err = p.fs.Netns(p.PID); err != nil {
+			p.fs.readError(err, "")
+			softerrors |= 1
+		}
+	}
+
+	var policy string
+	if p.fs.GatherSchedPolicy {
+		if policy, err = p.fs.readSchedPolicy(p.PID); err != nil {
+			p.fs.readError(err, "")
 			softerrors |= 1
-		} else {
-			memory.ProportionalBytes = smaps.Pss
-			memory.ProportionalSwapBytes = smaps.SwapPss
 		}
 	}
 
@@ -500,17 +938,49 @@ func (p proc) GetMetrics() (Metrics, int, error) {
 			Open:  int64(numfds),
 			Limit: uint64(limits.OpenFiles),
 		},
-		NumThreads: uint64(stat.NumThreads),
-		States:     states,
-		Wchan:      wchan,
+		NumThreads:   uint64(stat.NumThreads),
+		States:       states,
+		Wchan:        wchan,
+		Cgroups:      cgroups,
+		Nice:         stat.Nice,
+		Priority:     stat.Priority,
+		Blocked:      states.Waiting > 0,
+		BlockedWchan: blockedWchan,
+		CapEff:       capEff,
+		Netns:        netns,
+		SchedPolicy:  policy,
+		CPUsAllowed:  cpusAllowed,
+		IOSkipped:    ioSkipped,
 	}, softerrors, nil
 }
 
+// GetSMaps implements Proc.
+func (p proc) GetSMaps() (Memory, error) {
+	smaps, err := p.Proc.ProcSMapsRollup()
+	if err != nil {
+		p.fs.readError(err, "")
+		return Memory{}, err
+	}
+	return Memory{
+		ProportionalBytes:     smaps.Pss,
+		ProportionalSwapBytes: smaps.SwapPss,
+		UniqueBytes:           smaps.PrivateClean + smaps.PrivateDirty,
+	}, nil
+}
+
 func (p proc) GetThreads() ([]Thread, error) {
+	if !p.fs.GatherThreads || p.noThreads {
+		return nil, nil
+	}
+	if pm := p.prefetched(); pm != nil && pm.err == nil {
+		return pm.threads, pm.threadsErr
+	}
 	fs, err := p.fs.threadFs(p.PID)
 	if err != nil {
+		p.fs.readError(err, "")
 		return nil, err
 	}
+	fs.GatherIO = fs.GatherIO && !p.noIO
 
 	threads := []Thread{}
 	iter := fs.AllProcs()
@@ -536,12 +1006,18 @@ func (p proc) GetThreads() ([]Thread, error) {
 		wchan, _ := iter.GetWchan()
 		states, _ := iter.GetStates()
 
+		var policy string
+		if fs.GatherSchedPolicy {
+			policy, _ = fs.readSchedPolicy(id.Pid)
+		}
+
 		threads = append(threads, Thread{
-			ThreadID:   ThreadID(id),
-			ThreadName: static.Name,
-			Counts:     counts,
-			Wchan:      wchan,
-			States:     states,
+			ThreadID:    ThreadID(id),
+			ThreadName:  static.Name,
+			Counts:      counts,
+			Wchan:       wchan,
+			States:      states,
+			SchedPolicy: policy,
 		})
 	}
 	err = iter.Close()
@@ -555,8 +1031,45 @@ func (p proc) GetThreads() ([]Thread, error) {
 	return threads, nil
 }
 
-// See https://github.com/prometheus/procfs/blob/master/proc_stat.go for details on userHZ.
-const userHZ = 100
+// userHZ is the number of clock ticks per second used by the kernel for the
+// time fields in /proc/<pid>/stat.  See
+// https://github.com/prometheus/procfs/blob/master/proc_stat.go for details.
+var userHZ = readUserHZ("/proc/self/auxv")
+
+// defaultUserHZ is the clock tick rate used when the real one can't be
+// determined.  It's what nearly every kernel uses.
+const defaultUserHZ = 100
+
+// atClkTck is the auxiliary vector key for the clock tick rate.
+const atClkTck = 17
+
+// readUserHZ returns the clock tick rate, i.e. sysconf(_SC_CLK_TCK), which
+// the kernel passes to every process in its auxiliary vector.  If the vector
+// can't be read defaultUserHZ is returned.
+func readUserHZ(auxvPath string) float64 {
+	auxv, err := ioutil.ReadFile(auxvPath)
+	if err != nil {
+		return defaultUserHZ
+	}
+
+	// The vector is a sequence of native word sized (key, value) pairs.  Try
+	// both byte orders rather than working out which is native.
+	wordSize := strconv.IntSize / 8
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for i := 0; i+2*wordSize <= len(auxv); i += 2 * wordSize {
+			var key, val uint64
+			if wordSize == 8 {
+				key, val = order.Uint64(auxv[i:]), order.Uint64(auxv[i+wordSize:])
+			} else {
+				key, val = uint64(order.Uint32(auxv[i:])), uint64(order.Uint32(auxv[i+wordSize:]))
+			}
+			if key == atClkTck && val > 0 && val <= 10000 {
+				return float64(val)
+			}
+		}
+	}
+	return defaultUserHZ
+}
 
 // NewFS returns a new FS mounted under the given mountPoint. It will error
 // if the mount point can't be read.
@@ -569,7 +1082,127 @@ func NewFS(mountPoint string, debug bool) (*FS, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &FS{fs, stat.BootTime, mountPoint, false, debug}, nil
+	return &FS{
+		FS:            fs,
+		BootTime:      stat.BootTime,
+		MountPoint:    mountPoint,
+		GatherIO:      true,
+		GatherWchan:   true,
+		GatherThreads: true,
+		readErrors:    &readErrorCounts{counts: make(map[string]uint64)},
+		debug:         debug,
+	}, nil
+}
+
+// CheckIO returns an error if /proc/<pid>/io can't be read for pid 1.  Since
+// reading it for a process owned by another user requires privileges, this
+// indicates whether I/O metrics will be available for procs in general.
+func (fs *FS) CheckIO() error {
+	p, err := fs.FS.Proc(1)
+	if err != nil {
+		return err
+	}
+	_, err = p.IO()
+	return err
+}
+
+// CheckProcFile returns an error if the kernel doesn't provide the named file
+// under /proc/<pid>, as checked for the proc of probeDir.  Only that the file
+// exists is checked: reading it for other users' procs may still take
+// privileges.
+func (fs *FS) CheckProcFile(name string) error {
+	_, err := os.Stat(filepath.Join(fs.MountPoint, fs.probeDir(), name))
+	return err
+}
+
+// probeDir returns the directory in procfs of the proc to check what the
+// kernel provides with: our own, or if it isn't in this procfs, e.g. one of
+// another pid namespace, the first one listed.
+func (fs *FS) probeDir() string {
+	if _, err := os.Stat(filepath.Join(fs.MountPoint, "self")); err == nil {
+		return "self"
+	}
+	if procs, err := fs.FS.AllProcs(); err == nil && len(procs) > 0 {
+		return strconv.Itoa(procs[0].PID)
+	}
+	return "self"
+}
+
+// CheckVmPin returns true if the kernel reports VmPin in /proc/<pid>/status,
+// as checked for the proc of probeDir.  VmPin was added in Linux 3.2; without it
+// PinnedBytes is always zero.
+func (fs *FS) CheckVmPin() bool {
+	return fs.checkStatusField("VmPin")
+}
+
+// CheckRssBreakdown returns true if the kernel reports RssAnon, RssFile and
+// RssShmem in /proc/<pid>/status, as checked for the proc of probeDir.  They were
+// added in Linux 4.5; without them the Resident*Bytes breakdown of
+// ResidentBytes is always zero.
+func (fs *FS) CheckRssBreakdown() bool {
+	return fs.checkStatusField("RssAnon")
+}
+
+// checkStatusField returns true if the /proc/<pid>/status of the proc of
+// probeDir has the named field.
+func (fs *FS) checkStatusField(name string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(fs.MountPoint, fs.probeDir(), "status"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, name+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// readErrorReason classifies err as one of the ReadErr reasons.
+func readErrorReason(err error) string {
+	var errno syscall.Errno
+	var numErr *strconv.NumError
+	switch {
+	case err == ErrProcNotExist || os.IsNotExist(err):
+		return ReadErrVanished
+	case errors.As(err, &errno) && errno == syscall.ESRCH:
+		return ReadErrVanished
+	case os.IsPermission(err):
+		return ReadErrPermission
+	case errors.As(err, &numErr) || strings.Contains(err.Error(), "pars"):
+		// procfs doesn't wrap its parse errors, so fall back to the message.
+		return ReadErrParse
+	}
+	return ReadErrOther
+}
+
+// readError counts err under its reason, or under reason if that's given.
+func (fs *FS) readError(err error, reason string) {
+	if fs.readErrors == nil {
+		return
+	}
+	if reason == "" {
+		reason = readErrorReason(err)
+	}
+	fs.readErrors.Lock()
+	fs.readErrors.counts[reason]++
+	fs.readErrors.Unlock()
+}
+
+// ReadErrors returns the number of errors reading procs so far, by reason.
+// Unlike CollectErrors it includes procs which vanished while being read,
+// which aren't a problem as such but explain why their data is missing.
+func (fs *FS) ReadErrors() map[string]uint64 {
+	errs := make(map[string]uint64)
+	if fs.readErrors == nil {
+		return errs
+	}
+	fs.readErrors.Lock()
+	defer fs.readErrors.Unlock()
+	for reason, n := range fs.readErrors.counts {
+		errs[reason] = n
+	}
+	return errs
 }
 
 func (fs *FS) threadFs(pid int) (*FS, error) {
@@ -578,7 +1211,17 @@ func (fs *FS) threadFs(pid int) (*FS, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &FS{tfs, fs.BootTime, mountPoint, fs.GatherSMaps, false}, nil
+	return &FS{
+		FS:                tfs,
+		BootTime:          fs.BootTime,
+		MountPoint:        mountPoint,
+		GatherIO:          fs.GatherIO,
+		GatherWchan:       fs.GatherWchan,
+		GatherSchedPolicy: fs.GatherSchedPolicy,
+		CgroupMountPoint:  fs.CgroupMountPoint,
+		CgroupNoSymlinks:  fs.CgroupNoSymlinks,
+		readErrors:        fs.readErrors,
+	}, nil
 }
 
 // AllProcs implements Source.
@@ -587,12 +1230,50 @@ func (fs *FS) AllProcs() Iter {
 	if err != nil {
 		err = fmt.Errorf("Error reading procs: %v", err)
 	}
-	return &procIterator{procs: procfsprocs{procs, fs}, err: err, idx: -1}
+	if fs.CgroupFilter != nil {
+		procs = fs.filterProcs(procs)
+	}
+	var sockets map[uint64]string
+	if fs.GatherListeningPorts {
+		sockets = fs.listeningSockets(procs)
+	}
+	return &procIterator{procs: procfsprocs{procs, fs, sockets}, err: err, idx: -1}
+}
+
+// Proc returns the proc with pid, or ErrProcNotExist if there's none.  Unlike
+// AllProcs, it isn't subject to CgroupFilter.
+func (fs *FS) Proc(pid int) (Proc, error) {
+	p, err := fs.FS.Proc(pid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrProcNotExist
+		}
+		return nil, err
+	}
+	var sockets map[uint64]string
+	if fs.GatherListeningPorts {
+		sockets = fs.listeningSockets([]procfs.Proc{p})
+	}
+	return &proc{proccache{Proc: p, fs: fs, sockets: sockets}}, nil
+}
+
+// filterProcs returns the procs of procs whose cgroup placement matches
+// fs.CgroupFilter.  Procs whose placement can't be read, e.g. because they
+// exited, are dropped.
+func (fs *FS) filterProcs(procs procfs.Procs) procfs.Procs {
+	kept := procs[:0]
+	for _, p := range procs {
+		cgroups, err := fs.Cgroups(p.PID)
+		if err == nil && fs.CgroupFilter.Match(cgroups) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
 }
 
 // get implements procs.
 func (p procfsprocs) get(i int) Proc {
-	return &proc{proccache{Proc: p.Procs[i], fs: p.fs}}
+	return &proc{proccache{Proc: p.Procs[i], fs: p.fs, sockets: p.sockets}}
 }
 
 // length implements procs.
@@ -600,6 +1281,20 @@ func (p procfsprocs) length() int {
 	return len(p.Procs)
 }
 
+// selectReads implements readSelector.
+func (p *proc) selectReads(io, threads bool) Proc {
+	p.noIO, p.noThreads = !io, !threads
+	return p
+}
+
+// selectReads implements readSelector for the current proc.
+func (pi *procIterator) selectReads(io, threads bool) Proc {
+	if rs, ok := pi.Proc.(readSelector); ok {
+		return rs.selectReads(io, threads)
+	}
+	return pi.Proc
+}
+
 // Next implements Iter.
 func (pi *procIterator) Next() bool {
 	pi.idx++
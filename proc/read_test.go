@@ -1,13 +1,20 @@
 package proc
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	common "github.com/ncabatoff/process-exporter"
 )
 
 type (
@@ -66,6 +73,10 @@ func TestReadFixture(t *testing.T) {
 		ParentPid:    10884,
 		StartTime:    stime,
 		EffectiveUID: 1000,
+		RealUID:      1000,
+		UIDs:         Creds{1000, 1000, 1000, 1000},
+		GIDs:         Creds{1000, 1000, 1000, 1000},
+		Exe:          "/usr/local/bin/process-exporter",
 	}
 	if diff := cmp.Diff(pii.Static, wantstatic); diff != "" {
 		t.Errorf("static differs: (-got +want)\n%s", diff)
@@ -81,11 +92,21 @@ func TestReadFixture(t *testing.T) {
 			MinorPageFaults:       0x643,
 			CtxSwitchVoluntary:    72,
 			CtxSwitchNonvoluntary: 6,
+			ReadSyscalls:          5534,
+			WriteSyscalls:         1,
+			CancelledWriteBytes:   4096,
+			CPUChildTime:          0.3,
 		},
 		Memory: Memory{
 			ResidentBytes: 0x7b1000,
 			VirtualBytes:  0x1061000,
 			VmSwapBytes:   0x2800,
+			LockedBytes:   65536,
+			PinnedBytes:   16384,
+
+			ResidentAnonBytes:  5120 * 1024,
+			ResidentFileBytes:  2688 * 1024,
+			ResidentShmemBytes: 68 * 1024,
 		},
 		Filedesc: Filedesc{
 			Open:  5,
@@ -93,12 +114,161 @@ func TestReadFixture(t *testing.T) {
 		},
 		NumThreads: 7,
 		States:     States{Sleeping: 1},
+		Priority:   20,
 	}
 	if diff := cmp.Diff(pii.Metrics, wantmetrics); diff != "" {
 		t.Errorf("metrics differs: (-got +want)\n%s", diff)
 	}
 }
 
+// TestReadFixtureNoIO verifies that with GatherIO disabled the io file isn't
+// read, and so its absence isn't counted as a partial error.
+func TestReadFixtureNoIO(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	if err := fs.CheckIO(); err == nil {
+		t.Errorf("expected error checking io, fixtures have no pid 1")
+	}
+	fs.GatherIO = false
+
+	procs := fs.AllProcs()
+	if !procs.Next() {
+		t.Fatalf("no procs found")
+	}
+	counts, softerrors, err := procs.GetCounts()
+	noerr(t, err)
+	if softerrors != 0 {
+		t.Errorf("got %d soft errors, want 0", softerrors)
+	}
+	if counts.ReadBytes != 0 || counts.ReadSyscalls != 0 || counts.CancelledWriteBytes != 0 {
+		t.Errorf("got io counts %+v with GatherIO disabled", counts)
+	}
+	noerr(t, procs.Close())
+}
+
+// TestReadEnv verifies that only the environment variables asked for are
+// read, and that an environ that can't be read gives none and is counted.
+func TestReadEnv(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	static := func(fs *FS) Static {
+		procs := fs.AllProcs()
+		if !procs.Next() {
+			t.Fatalf("no procs found")
+		}
+		static, err := procs.GetStatic()
+		noerr(t, err)
+		noerr(t, procs.Close())
+		return static
+	}
+	if env := static(fs).Env; env != nil {
+		t.Errorf("got env %v without EnvVars, want none", env)
+	}
+	fs.EnvVars = []string{"TASK_FAMILY", "MISSING"}
+	if diff := cmp.Diff(static(fs).Env, map[string]string{"TASK_FAMILY": "web"}); diff != "" {
+		t.Errorf("env differs: (-got +want)\n%s", diff)
+	}
+
+	// A procfs whose proc has an environ that's a dir rather than a file.
+	root, err := ioutil.TempDir("", "procfs")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	fixtures, err := filepath.Abs("../fixtures")
+	noerr(t, err)
+	noerr(t, os.Symlink(filepath.Join(fixtures, "stat"), filepath.Join(root, "stat")))
+	noerr(t, os.MkdirAll(filepath.Join(root, "14804", "environ"), 0755))
+	for _, name := range []string{"cmdline", "comm", "stat", "status"} {
+		noerr(t, os.Symlink(filepath.Join(fixtures, "14804", name), filepath.Join(root, "14804", name)))
+	}
+	fs, err = NewFS(root, false)
+	noerr(t, err)
+	fs.EnvVars = []string{"TASK_FAMILY"}
+	if env := static(fs).Env; env != nil {
+		t.Errorf("got env %v for unreadable environ, want none", env)
+	}
+	if errs := fs.ReadErrors(); errs[ReadErrOther] != 1 {
+		t.Errorf("got read errors %v, want 1 %s", errs, ReadErrOther)
+	}
+}
+
+// TestReadCreds verifies that the four ids of the Uid and Gid lines of status
+// are told apart, e.g. for a setuid proc, and that a malformed one is an
+// error.
+func TestReadCreds(t *testing.T) {
+	root, err := ioutil.TempDir("", "creds")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	fixtures, err := filepath.Abs("../fixtures")
+	noerr(t, err)
+	noerr(t, os.Symlink(filepath.Join(fixtures, "stat"), filepath.Join(root, "stat")))
+	noerr(t, os.MkdirAll(filepath.Join(root, "14804"), 0755))
+	for _, name := range []string{"cmdline", "comm", "stat"} {
+		noerr(t, os.Symlink(filepath.Join(fixtures, "14804", name), filepath.Join(root, "14804", name)))
+	}
+	content, err := ioutil.ReadFile(filepath.Join(fixtures, "14804", "status"))
+	noerr(t, err)
+	writeStatus := func(uid, gid string) {
+		status := strings.Replace(string(content), "Uid:\t1000\t1000\t1000\t1000", "Uid:\t"+uid, 1)
+		status = strings.Replace(status, "Gid:\t1000\t1000\t1000\t1000", "Gid:\t"+gid, 1)
+		noerr(t, ioutil.WriteFile(filepath.Join(root, "14804", "status"), []byte(status), 0644))
+	}
+	fs, err := NewFS(root, false)
+	noerr(t, err)
+
+	writeStatus("1000\t0\t0\t0", "100\t101\t102\t103")
+	p, err := fs.Proc(14804)
+	noerr(t, err)
+	static, err := p.GetStatic()
+	noerr(t, err)
+	got := []Creds{static.UIDs, static.GIDs}
+	want := []Creds{{Real: 1000}, {Real: 100, Effective: 101, Saved: 102, FS: 103}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("creds differ: (-got +want)\n%s", diff)
+	}
+	if static.RealUID != 1000 || static.EffectiveUID != 0 {
+		t.Errorf("got real uid %d and effective uid %d, want 1000 and 0", static.RealUID, static.EffectiveUID)
+	}
+
+	writeStatus("1000\t0\t0\tx", "100\t101\t102\t103")
+	p, err = fs.Proc(14804)
+	noerr(t, err)
+	if _, err := p.GetStatic(); err == nil {
+		t.Errorf("expected error reading malformed Uid line")
+	}
+}
+
+// TestCheckStatusFields verifies that VmPin and the RSS breakdown are detected
+// in our own status file, and not when the kernel doesn't report them.
+func TestCheckStatusFields(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	if !fs.CheckVmPin() {
+		t.Errorf("VmPin not found in fixture status")
+	}
+	if !fs.CheckRssBreakdown() {
+		t.Errorf("RssAnon not found in fixture status")
+	}
+
+	root, err := ioutil.TempDir("", "vmpin")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	stat, err := filepath.Abs("../fixtures/stat")
+	noerr(t, err)
+	noerr(t, os.Symlink(stat, filepath.Join(root, "stat")))
+	noerr(t, os.Mkdir(filepath.Join(root, "self"), 0755))
+	status := "Name:\tprocess-exporte\nVmLck:\t      64 kB\nVmSwap:\t      10 kB\n"
+	noerr(t, ioutil.WriteFile(filepath.Join(root, "self", "status"), []byte(status), 0644))
+
+	fs, err = NewFS(root, false)
+	noerr(t, err)
+	if fs.CheckVmPin() {
+		t.Errorf("VmPin found in status lacking it")
+	}
+	if fs.CheckRssBreakdown() {
+		t.Errorf("RssAnon found in status lacking it, as before Linux 4.5")
+	}
+}
+
 func noerr(t *testing.T, err error) {
 	if err != nil {
 		t.Fatalf("error: %v", err)
@@ -209,6 +379,67 @@ func TestAllProcsSpawn(t *testing.T) {
 	}
 }
 
+// pidNamer names the proc with the given pid after its comm.
+type pidNamer int
+
+func (n pidNamer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
+	return nacl.PID == int(n), nacl.Name
+}
+
+func (n pidNamer) String() string {
+	return fmt.Sprintf("pidNamer(%d)", int(n))
+}
+
+// TestZombieGroup verifies that a real zombie child, i.e. one which has
+// exited but not yet been waited for, is read with its comm but no cmdline,
+// and counted in the zombies of the group its comm puts it in.
+func TestZombieGroup(t *testing.T) {
+	cmd := exec.Command("/bin/cat")
+	wc, err := cmd.StdinPipe()
+	noerr(t, err)
+	noerr(t, cmd.Start())
+	defer cmd.Wait()
+	pid := cmd.Process.Pid
+
+	grouper := NewGrouper(pidNamer(pid), false, false, false, false)
+	_, groups, err := grouper.Update(allprocs("/proc"))
+	noerr(t, err)
+	if got := groups["cat"]; got.Procs != 1 || got.Zombies != 0 {
+		t.Fatalf("got %d procs and %d zombies in cat while alive, want 1 and 0", got.Procs, got.Zombies)
+	}
+
+	// Let the child exit, leaving a zombie since we don't reap it.
+	noerr(t, wc.Close())
+	statPath := fmt.Sprintf("/proc/%d/stat", pid)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		stat, err := ioutil.ReadFile(statPath)
+		noerr(t, err)
+		if strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("child didn't become a zombie: %s", stat)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fs, err := NewFS("/proc", false)
+	noerr(t, err)
+	zombie, err := fs.Proc(pid)
+	noerr(t, err)
+	static, err := zombie.GetStatic()
+	noerr(t, err)
+	if static.Name != "cat" || len(static.Cmdline) != 0 {
+		t.Errorf("got zombie comm %q and cmdline %q, want cat and none", static.Name, static.Cmdline)
+	}
+
+	_, groups, err = grouper.Update(fs.AllProcs())
+	noerr(t, err)
+	if got := groups["cat"].Zombies; got != 1 {
+		t.Errorf("got %d zombies in cat, want 1", got)
+	}
+}
+
 func TestIterator(t *testing.T) {
 	p1 := newProc(1, "p1", Metrics{})
 	p2 := newProc(2, "p2", Metrics{})
@@ -220,3 +451,117 @@ func TestIterator(t *testing.T) {
 		t.Errorf("procs differs: (-got +want)\n%s", diff)
 	}
 }
+
+func TestReadUserHZ(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auxv")
+	noerr(t, err)
+	defer os.RemoveAll(dir)
+
+	// Build an auxiliary vector with AT_PAGESZ, AT_CLKTCK and AT_NULL entries.
+	wordSize := strconv.IntSize / 8
+	auxv := make([]byte, 6*wordSize)
+	for i, v := range []uint64{6, 4096, atClkTck, 250, 0, 0} {
+		if wordSize == 8 {
+			binary.LittleEndian.PutUint64(auxv[i*wordSize:], v)
+		} else {
+			binary.LittleEndian.PutUint32(auxv[i*wordSize:], uint32(v))
+		}
+	}
+	auxvPath := filepath.Join(dir, "auxv")
+	noerr(t, ioutil.WriteFile(auxvPath, auxv, 0644))
+
+	if got := readUserHZ(auxvPath); got != 250 {
+		t.Errorf("got %v, want 250", got)
+	}
+	if got := readUserHZ(filepath.Join(dir, "missing")); got != defaultUserHZ {
+		t.Errorf("got %v for missing auxv, want %v", got, defaultUserHZ)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+
+	_, numErr := strconv.ParseInt("x", 10, 64)
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{ErrProcNotExist, ReadErrVanished},
+		{&os.PathError{Op: "open", Path: "/proc/1/stat", Err: syscall.ENOENT}, ReadErrVanished},
+		{&os.PathError{Op: "read", Path: "/proc/1/stat", Err: syscall.ESRCH}, ReadErrVanished},
+		{&os.PathError{Op: "open", Path: "/proc/1/io", Err: syscall.EACCES}, ReadErrPermission},
+		{numErr, ReadErrParse},
+		{fmt.Errorf("couldn't parse %s", "x"), ReadErrParse},
+		{&os.PathError{Op: "read", Path: "/proc/1/io", Err: syscall.EIO}, ReadErrOther},
+	} {
+		if got := readErrorReason(tc.err); got != tc.want {
+			t.Errorf("%v: got reason %q, want %q", tc.err, got, tc.want)
+		}
+		fs.readError(tc.err, "")
+	}
+	fs.readError(syscall.EIO, ReadErrCgroup)
+
+	want := map[string]uint64{ReadErrVanished: 3, ReadErrPermission: 1, ReadErrParse: 2,
+		ReadErrOther: 1, ReadErrCgroup: 1}
+	if diff := cmp.Diff(fs.ReadErrors(), want); diff != "" {
+		t.Errorf("read errors differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestCheckProcFile verifies that the files the kernel provides are checked
+// for with a proc of the procfs, even one without self.
+func TestCheckProcFile(t *testing.T) {
+	fs, root := procTreeFS(t, 2)
+	defer os.RemoveAll(root)
+	if err := fs.CheckProcFile("cmdline"); err != nil {
+		t.Errorf("checking cmdline: %v", err)
+	}
+	if err := fs.CheckProcFile("smaps_rollup"); err == nil {
+		t.Errorf("expected error checking smaps_rollup")
+	}
+}
+
+// TestReadStatusErrors verifies that a proc whose status is missing is taken
+// to have vanished, and one whose status can't be read is an error, so that
+// only the latter counts as a read error when tracked.
+func TestReadStatusErrors(t *testing.T) {
+	fs, root := procTreeFS(t, 3)
+	defer os.RemoveAll(root)
+	noerr(t, os.Remove(filepath.Join(root, "2", "status")))
+	// Unlike a file without read permission, a directory can't be read
+	// even by root.
+	status := filepath.Join(root, "3", "status")
+	noerr(t, os.Remove(status))
+	noerr(t, os.Mkdir(status, 0755))
+
+	it := fs.AllProcs()
+	for it.Next() {
+		_, _, err := it.GetCounts()
+		switch pid := it.GetPid(); pid {
+		case 1:
+			if err != nil {
+				t.Errorf("pid 1: got error %v", err)
+			}
+		case 2:
+			if err != ErrProcNotExist {
+				t.Errorf("pid 2: got error %v, want ErrProcNotExist", err)
+			}
+		case 3:
+			if err == nil || err == ErrProcNotExist {
+				t.Errorf("pid 3: got error %v, want a read error", err)
+			}
+		}
+	}
+	noerr(t, it.Close())
+
+	tr := NewTracker(newNamer("p1", "p2", "p3"), false, false, false, false)
+	cerrs, got, err := tr.Update(fs.AllProcs())
+	noerr(t, err)
+	if len(got) != 1 || got[0].GroupName != "p1" {
+		t.Errorf("got updates %v, want one of p1", got)
+	}
+	if cerrs.Read != 1 {
+		t.Errorf("got %d read errors, want 1", cerrs.Read)
+	}
+}
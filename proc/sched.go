@@ -0,0 +1,181 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SchedStats holds the fields of /proc/<pid>/sched by name, e.g.
+// "se.sum_exec_runtime", with their values as given.  Which fields there are
+// depends on the kernel's version and config, e.g. the se.statistics ones
+// need schedstats, so all are kept, and the accessors return false for a
+// field that's missing or isn't a number.
+type SchedStats map[string]string
+
+// parseSched parses the contents of /proc/<pid>/sched.  Its "key : value"
+// lines are kept; the header, which holds comm and so may hold anything, and
+// the NUMA lines in other formats aren't.
+func parseSched(data []byte) (SchedStats, error) {
+	stats := make(SchedStats)
+	header := true
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if header {
+			header = !strings.HasPrefix(scanner.Text(), "---")
+			continue
+		}
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		if key == "" || value == "" || strings.ContainsAny(key, " ,") {
+			continue
+		}
+		stats[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(stats) == 0 {
+		return nil, fmt.Errorf("no fields in sched")
+	}
+	return stats, nil
+}
+
+// Sched returns the scheduler stats of the proc or thread with the given pid,
+// read from /proc/<pid>/sched.
+func (fs *FS) Sched(pid int) (SchedStats, error) {
+	data, err := ioutil.ReadFile(filepath.Join(fs.MountPoint, strconv.Itoa(pid), "sched"))
+	if err != nil {
+		return nil, err
+	}
+	return parseSched(data)
+}
+
+// Uint returns the named field as an integer.
+func (s SchedStats) Uint(key string) (uint64, bool) {
+	v, err := strconv.ParseUint(s[key], 10, 64)
+	return v, err == nil
+}
+
+// Duration returns the named field, one of those given in milliseconds with
+// nanosecond precision such as se.sum_exec_runtime, as a duration.
+func (s SchedStats) Duration(key string) (time.Duration, bool) {
+	ms, err := strconv.ParseFloat(s[key], 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(math.Round(ms * float64(time.Millisecond))), true
+}
+
+// SumExecRuntime returns the CPU time spent running, se.sum_exec_runtime.
+func (s SchedStats) SumExecRuntime() (time.Duration, bool) {
+	return s.Duration("se.sum_exec_runtime")
+}
+
+// WaitSum returns the time spent runnable waiting for a CPU, which needs
+// schedstats.  Kernels since 5.19 name it stats.wait_sum rather than
+// se.statistics.wait_sum.
+func (s SchedStats) WaitSum() (time.Duration, bool) {
+	if d, ok := s.Duration("stats.wait_sum"); ok {
+		return d, true
+	}
+	return s.Duration("se.statistics.wait_sum")
+}
+
+// NrSwitches returns the number of context switches, nr_switches.
+func (s SchedStats) NrSwitches() (uint64, bool) {
+	return s.Uint("nr_switches")
+}
+
+// NrVoluntarySwitches returns the number of voluntary context switches,
+// nr_voluntary_switches.
+func (s SchedStats) NrVoluntarySwitches() (uint64, bool) {
+	return s.Uint("nr_voluntary_switches")
+}
+
+// NrInvoluntarySwitches returns the number of involuntary context switches,
+// nr_involuntary_switches.
+func (s SchedStats) NrInvoluntarySwitches() (uint64, bool) {
+	return s.Uint("nr_involuntary_switches")
+}
+
+// NrMigrations returns the number of migrations between CPUs,
+// se.nr_migrations.
+func (s SchedStats) NrMigrations() (uint64, bool) {
+	return s.Uint("se.nr_migrations")
+}
+
+// Prio returns the kernel priority, 120 for nice 0 under SCHED_OTHER.
+func (s SchedStats) Prio() (int, bool) {
+	v, err := strconv.Atoi(s["prio"])
+	return v, err == nil
+}
+
+// ErrAutogroupUnsupported is returned by Autogroup when the proc isn't in a
+// scheduler autogroup: the kernel is built without CONFIG_SCHED_AUTOGROUP,
+// autogroups are disabled by kernel.sched_autogroup_enabled=0, or the proc's
+// scheduling is governed by a cgroup instead.
+var ErrAutogroupUnsupported = errors.New("autogroup unsupported")
+
+// Autogroup is the scheduler autogroup of a proc, as read from
+// /proc/<pid>/autogroup.  The procs of a session share one, and CPU time is
+// divided fairly between autogroups before being divided between their procs.
+type Autogroup struct {
+	// ID is the autogroup's id, N in /autogroup-N.
+	ID int
+	// Nice is the nice value of the autogroup as a whole, from -20 to 19,
+	// weighting it against other autogroups.
+	Nice int
+}
+
+// parseAutogroup parses the contents of /proc/<pid>/autogroup, e.g.
+// "/autogroup-25 nice 0".  The kernel writes nothing if the proc isn't in an
+// autogroup.
+func parseAutogroup(data []byte) (Autogroup, error) {
+	s := strings.TrimSpace(string(data))
+	if s == "" {
+		return Autogroup{}, ErrAutogroupUnsupported
+	}
+	var ag Autogroup
+	fields := strings.Fields(s)
+	if len(fields) != 3 || fields[1] != "nice" || !strings.HasPrefix(fields[0], "/autogroup-") {
+		return Autogroup{}, fmt.Errorf("malformed autogroup %q", s)
+	}
+	var err error
+	if ag.ID, err = strconv.Atoi(strings.TrimPrefix(fields[0], "/autogroup-")); err != nil {
+		return Autogroup{}, fmt.Errorf("malformed autogroup %q: %v", s, err)
+	}
+	if ag.Nice, err = strconv.Atoi(fields[2]); err != nil {
+		return Autogroup{}, fmt.Errorf("malformed autogroup %q: %v", s, err)
+	}
+	return ag, nil
+}
+
+// Autogroup returns the scheduler autogroup of the proc with the given pid,
+// or ErrAutogroupUnsupported if it isn't in one.
+func (fs *FS) Autogroup(pid int) (Autogroup, error) {
+	dir := filepath.Join(fs.MountPoint, strconv.Itoa(pid))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "autogroup"))
+	if os.IsNotExist(err) {
+		// Without CONFIG_SCHED_AUTOGROUP there's no autogroup file, unless
+		// it's the proc that's missing.
+		if _, serr := os.Stat(dir); serr == nil {
+			return Autogroup{}, ErrAutogroupUnsupported
+		}
+	}
+	if err != nil {
+		return Autogroup{}, err
+	}
+	return parseAutogroup(data)
+}
@@ -0,0 +1,125 @@
+package proc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSched verifies that the fixture's fields are read, including those no
+// accessor knows, and that the accessors convert them.
+func TestSched(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	stats, err := fs.Sched(14804)
+	noerr(t, err)
+
+	for key, want := range map[string]string{
+		"se.vruntime":        "1234.567890",
+		"mm->numa_scan_seq":  "0",
+		"numa_preferred_nid": "-1",
+	} {
+		if got := stats[key]; got != want {
+			t.Errorf("got %s %q, want %q", key, got, want)
+		}
+	}
+	if _, ok := stats["numa_faults node=0 task_private=0 task_shared=0 group_private=0 group_shared=0"]; ok {
+		t.Errorf("got field for NUMA faults line")
+	}
+
+	if got, ok := stats.SumExecRuntime(); !ok || got != 140012345*time.Nanosecond {
+		t.Errorf("got sum_exec_runtime %v, %v, want 140.012345ms", got, ok)
+	}
+	if got, ok := stats.WaitSum(); !ok || got != 25500*time.Microsecond {
+		t.Errorf("got wait_sum %v, %v, want 25.5ms", got, ok)
+	}
+	for _, tc := range []struct {
+		name string
+		get  func() (uint64, bool)
+		want uint64
+	}{
+		{"nr_switches", stats.NrSwitches, 150},
+		{"nr_voluntary_switches", stats.NrVoluntarySwitches, 144},
+		{"nr_involuntary_switches", stats.NrInvoluntarySwitches, 6},
+		{"se.nr_migrations", stats.NrMigrations, 12},
+	} {
+		if got, ok := tc.get(); !ok || got != tc.want {
+			t.Errorf("got %s %d, %v, want %d", tc.name, got, ok, tc.want)
+		}
+	}
+	if got, ok := stats.Prio(); !ok || got != 120 {
+		t.Errorf("got prio %d, %v, want 120", got, ok)
+	}
+}
+
+// TestParseSched verifies that newer kernels' field names are understood,
+// that missing fields are reported as such, and that a comm with colons
+// isn't taken for a field.
+func TestParseSched(t *testing.T) {
+	data := "a:b (42, #threads: 1)\n" +
+		"-------------------------------------------------------------------\n" +
+		"se.sum_exec_runtime                          :             1.000001\n" +
+		"stats.wait_sum                               :             2.000000\n"
+	stats, err := parseSched([]byte(data))
+	noerr(t, err)
+	if len(stats) != 2 {
+		t.Errorf("got fields %v, want 2", stats)
+	}
+	if got, ok := stats.WaitSum(); !ok || got != 2*time.Millisecond {
+		t.Errorf("got wait_sum %v, %v, want 2ms", got, ok)
+	}
+	if got, ok := stats.SumExecRuntime(); !ok || got != time.Millisecond+time.Nanosecond {
+		t.Errorf("got sum_exec_runtime %v, %v, want 1.000001ms", got, ok)
+	}
+	if _, ok := stats.NrSwitches(); ok {
+		t.Errorf("got nr_switches, which is missing")
+	}
+
+	if _, err := parseSched([]byte("x (1, #threads: 1)\n")); err == nil {
+		t.Errorf("expected error for sched without fields")
+	}
+}
+
+// TestAutogroup verifies that the fixture's autogroup is read, and that its
+// absence is reported as unsupported unless the proc is missing.
+func TestAutogroup(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	ag, err := fs.Autogroup(14804)
+	noerr(t, err)
+	if ag != (Autogroup{ID: 211, Nice: 5}) {
+		t.Errorf("got autogroup %+v, want id 211 nice 5", ag)
+	}
+
+	root, err := ioutil.TempDir("", "autogroup")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	noerr(t, os.Mkdir(filepath.Join(root, "1"), 0755))
+	fs.MountPoint = root
+	if _, err := fs.Autogroup(1); err != ErrAutogroupUnsupported {
+		t.Errorf("got error %v without autogroup file, want ErrAutogroupUnsupported", err)
+	}
+	if _, err := fs.Autogroup(2); err == nil || err == ErrAutogroupUnsupported {
+		t.Errorf("got error %v for missing proc, want it not to exist", err)
+	}
+}
+
+// TestParseAutogroup verifies that negative nice values are parsed, that an
+// empty file means unsupported, and that other formats are errors.
+func TestParseAutogroup(t *testing.T) {
+	ag, err := parseAutogroup([]byte("/autogroup-7 nice -10\n"))
+	noerr(t, err)
+	if ag != (Autogroup{ID: 7, Nice: -10}) {
+		t.Errorf("got autogroup %+v, want id 7 nice -10", ag)
+	}
+	if _, err := parseAutogroup(nil); err != ErrAutogroupUnsupported {
+		t.Errorf("got error %v for empty autogroup, want ErrAutogroupUnsupported", err)
+	}
+	for _, data := range []string{"/autogroup-7 nice", "/autogroup-x nice 0", "/group-7 nice 0", "/autogroup-7 prio 0"} {
+		if _, err := parseAutogroup([]byte(data)); err == nil || err == ErrAutogroupUnsupported {
+			t.Errorf("got error %v for %q, want malformed", err, data)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package proc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SchedPolicies are the names of the standard scheduling policies, in the
+// order of their numbers, which skip 4 (SCHED_ISO, never implemented).
+// SCHED_EXT, "ext", only exists on kernels built with sched_ext.
+var SchedPolicies = []string{"other", "fifo", "rr", "batch", "idle", "deadline"}
+
+// schedPolicyNames maps scheduling policy numbers to their names.
+var schedPolicyNames = map[int]string{
+	0: "other",
+	1: "fifo",
+	2: "rr",
+	3: "batch",
+	5: "idle",
+	6: "deadline",
+	7: "ext",
+}
+
+// SchedPolicyName returns the name of the scheduling policy with the given
+// number, e.g. "fifo" for 1 (SCHED_FIFO), or the number in decimal if it has
+// no known name.
+func SchedPolicyName(policy int) string {
+	if name, ok := schedPolicyNames[policy]; ok {
+		return name
+	}
+	return strconv.Itoa(policy)
+}
+
+// realtimeSchedPolicy returns true if the named scheduling policy is a
+// realtime one, SCHED_FIFO or SCHED_RR.
+func realtimeSchedPolicy(name string) bool {
+	return name == "fifo" || name == "rr"
+}
+
+// parseSchedPolicy returns the scheduling policy, field 41, from the contents
+// of /proc/<pid>/stat.  The fields are counted from the end of comm, which may
+// contain spaces and parentheses itself.
+func parseSchedPolicy(data []byte) (int, error) {
+	stat := string(data)
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return 0, fmt.Errorf("malformed stat %q", stat)
+	}
+	// Fields after comm start with state, field 3.
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 41-2 {
+		return 0, fmt.Errorf("no policy in stat %q", stat)
+	}
+	return strconv.Atoi(fields[41-3])
+}
+
+// readSchedPolicy returns the name of the scheduling policy of the proc or
+// thread with the given pid.  procfs doesn't parse it, so stat is read again.
+func (fs *FS) readSchedPolicy(pid int) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(fs.MountPoint, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", err
+	}
+	policy, err := parseSchedPolicy(data)
+	if err != nil {
+		return "", err
+	}
+	return SchedPolicyName(policy), nil
+}
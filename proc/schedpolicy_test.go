@@ -0,0 +1,50 @@
+package proc
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestParseSchedPolicy verifies that the policy is found after a comm with
+// spaces and parentheses, and that unknown policies are named by number.
+func TestParseSchedPolicy(t *testing.T) {
+	stat := "42 (a) (b c) S 1 42 42 0 -1 4194560 100 0 0 0 1 2 0 0 -2 0 1 0 " +
+		"100 1000 10 18446744073709551615 1 1 0 0 0 0 0 0 0 0 0 0 17 3 1 1 0 0 0 0 0 0 0 0 0 0 0\n"
+	policy, err := parseSchedPolicy([]byte(stat))
+	noerr(t, err)
+	if policy != 1 || SchedPolicyName(policy) != "fifo" {
+		t.Errorf("got policy %d named %q, want 1 named fifo", policy, SchedPolicyName(policy))
+	}
+	if name := SchedPolicyName(8); name != "8" {
+		t.Errorf("got %q for unknown policy, want 8", name)
+	}
+	if _, err := parseSchedPolicy([]byte("42 (a) S 1 42")); err == nil {
+		t.Errorf("expected error parsing truncated stat")
+	}
+}
+
+// TestReadSchedPolicy verifies that the policy is read from stat only if
+// asked for.
+func TestReadSchedPolicy(t *testing.T) {
+	for _, gather := range []bool{false, true} {
+		fs, err := NewFS("../fixtures", false)
+		noerr(t, err)
+		fs.GatherSchedPolicy = gather
+		procs := fs.AllProcs()
+		var got []string
+		for procs.Next() {
+			pii, err := procinfo(procs)
+			noerr(t, err)
+			got = append(got, pii.SchedPolicy)
+		}
+		noerr(t, procs.Close())
+		want := []string{""}
+		if gather {
+			want = []string{"other"}
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("gather=%v: SchedPolicy differs: (-got +want)\n%s", gather, diff)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package proc
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type (
+	// ProcSample is the state of a tracked proc as of the last update.
+	ProcSample struct {
+		// GroupName is the name of the proc's group.
+		GroupName string
+		// ID identifies the proc.
+		ID ID
+		// Name and Cmdline are the proc's comm and command line.
+		Name    string
+		Cmdline []string
+		// Username is the name of the proc's effective user, or its uid
+		// if it has none.
+		Username string
+		// Start is the time the proc started.
+		Start time.Time
+		// Counts are the proc's totals since it started.
+		Counts Counts
+		// Latest is how much Counts increased since the last update.
+		Latest Delta
+		// Memory is the current memory usage.
+		Memory
+		// Filedesc is the current fd usage/limit.
+		Filedesc
+		// NumThreads is the number of threads.
+		NumThreads uint64
+		// Cgroups is the proc's cgroup placement, if known.
+		Cgroups []Cgroup
+		// CPUsAllowed is the number of CPUs the proc may run on, if known.
+		CPUsAllowed int
+	}
+
+	// ProcRank selects what TopProcs ranks procs by.
+	ProcRank string
+
+	// sampleHeap is a min-heap of samples by key.
+	sampleHeap struct {
+		samples []ProcSample
+		key     func(ProcSample) float64
+	}
+)
+
+const (
+	// ProcRankCPU ranks procs by the CPU time they used since the last
+	// update.
+	ProcRankCPU ProcRank = "cpu"
+	// ProcRankRSS ranks procs by resident memory.
+	ProcRankRSS ProcRank = "rss"
+	// ProcRankFDs ranks procs by open file descriptors.
+	ProcRankFDs ProcRank = "fds"
+	// ProcRankThreads ranks procs by number of threads.
+	ProcRankThreads ProcRank = "threads"
+)
+
+// ParseProcRank returns the ProcRank named by s.
+func ParseProcRank(s string) (ProcRank, error) {
+	switch r := ProcRank(s); r {
+	case ProcRankCPU, ProcRankRSS, ProcRankFDs, ProcRankThreads:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown proc rank %q, want one of %q, %q, %q or %q",
+		s, ProcRankCPU, ProcRankRSS, ProcRankFDs, ProcRankThreads)
+}
+
+// Value returns the value of s that r ranks by.
+func (r ProcRank) Value(s ProcSample) float64 {
+	switch r {
+	case ProcRankRSS:
+		return float64(s.ResidentBytes)
+	case ProcRankFDs:
+		return float64(s.Filedesc.Open)
+	case ProcRankThreads:
+		return float64(s.NumThreads)
+	}
+	return s.Latest.CPUUserTime + s.Latest.CPUSystemTime
+}
+
+func (h sampleHeap) Len() int { return len(h.samples) }
+
+// Less orders by key, then by pid so that ties are broken the same way on
+// each scrape.
+func (h sampleHeap) Less(i, j int) bool {
+	ki, kj := h.key(h.samples[i]), h.key(h.samples[j])
+	if ki != kj {
+		return ki < kj
+	}
+	return h.samples[i].ID.Pid > h.samples[j].ID.Pid
+}
+
+func (h sampleHeap) Swap(i, j int) { h.samples[i], h.samples[j] = h.samples[j], h.samples[i] }
+
+func (h *sampleHeap) Push(x interface{}) { h.samples = append(h.samples, x.(ProcSample)) }
+
+func (h *sampleHeap) Pop() interface{} {
+	last := h.samples[len(h.samples)-1]
+	h.samples = h.samples[:len(h.samples)-1]
+	return last
+}
+
+// TopProcs splits samples into the n highest ranked by rank, highest first,
+// and the rest, in no particular order.
+func TopProcs(samples []ProcSample, n int, rank ProcRank) (top, rest []ProcSample) {
+	h := &sampleHeap{key: rank.Value}
+	for _, s := range samples {
+		heap.Push(h, s)
+		if h.Len() > n {
+			rest = append(rest, heap.Pop(h).(ProcSample))
+		}
+	}
+	sort.Sort(sort.Reverse(h))
+	return h.samples, rest
+}
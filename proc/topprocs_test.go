@@ -0,0 +1,57 @@
+package proc
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func samplePids(samples []ProcSample) []int {
+	pids := []int{}
+	for _, s := range samples {
+		pids = append(pids, s.ID.Pid)
+	}
+	return pids
+}
+
+// TestTopProcs verifies that TopProcs returns the n highest ranked procs,
+// highest first, breaking ties by pid, and everything else as the rest.
+func TestTopProcs(t *testing.T) {
+	sample := func(pid int, cpu float64, rss uint64, fds int64) ProcSample {
+		return ProcSample{
+			ID:         ID{Pid: pid},
+			Latest:     Delta{CPUUserTime: cpu / 2, CPUSystemTime: cpu / 2},
+			Memory:     Memory{ResidentBytes: rss},
+			Filedesc:   Filedesc{Open: fds},
+			NumThreads: uint64(6 - pid),
+		}
+	}
+	samples := []ProcSample{sample(1, 0.5, 100, 3), sample(2, 3, 10, -1), sample(3, 1, 300, 7),
+		sample(4, 1, 200, 5), sample(5, 0, 400, 0)}
+
+	for _, tc := range []struct {
+		n        int
+		rank     ProcRank
+		wantTop  []int
+		wantRest int
+	}{
+		{2, ProcRankCPU, []int{2, 3}, 3},
+		{3, ProcRankRSS, []int{5, 3, 4}, 2},
+		{10, ProcRankCPU, []int{2, 3, 4, 1, 5}, 0},
+		{0, ProcRankCPU, []int{}, 5},
+		{2, ProcRankFDs, []int{3, 4}, 3},
+		{1, ProcRankThreads, []int{1}, 4},
+	} {
+		top, rest := TopProcs(samples, tc.n, tc.rank)
+		if diff := cmp.Diff(samplePids(top), tc.wantTop); diff != "" {
+			t.Errorf("top %d by %s differs: (-got +want)\n%s", tc.n, tc.rank, diff)
+		}
+		if len(rest) != tc.wantRest {
+			t.Errorf("top %d by %s: got %d rest, want %d", tc.n, tc.rank, len(rest), tc.wantRest)
+		}
+	}
+
+	if _, err := ParseProcRank("vsz"); err == nil {
+		t.Errorf("expected error parsing unknown rank")
+	}
+}
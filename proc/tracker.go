@@ -27,14 +27,73 @@ type (
 		// count first usage of a process started between two Update() calls
 		firstUpdateAt time.Time
 		// trackChildren makes Tracker track descendants of procs the
-		// namer wanted tracked.
+		// namer wanted tracked.  A namer that's a common.ChildrenNamer may
+		// also ask for it for some groups.
 		trackChildren bool
 		// trackThreads makes Tracker track per-thread metrics.
 		trackThreads bool
 		// never ignore processes, i.e. always re-check untracked processes in case comm has changed
 		alwaysRecheck bool
-		username      map[int]string
-		debug         bool
+		// recheckInterval, if positive, is how often ignored procs are
+		// matched again when they wouldn't be otherwise, see rechecking.
+		recheckInterval time.Duration
+		// lastRecheck is when ignored procs were last matched again due to
+		// recheckInterval.
+		lastRecheck time.Time
+		// rechecking is true if the current update matches ignored procs
+		// again, in which case recheckIgnored holds those seen by it.
+		rechecking     bool
+		recheckIgnored []IDInfo
+		// orphanedZombies is the number of zombies whose parent is pid 1
+		// seen by the last update, and zombies the number of zombies it saw
+		// by the group their comm and cmdline then put them in, see
+		// countZombie.
+		orphanedZombies int
+		zombies         map[string]int
+		// procsScanned is the number of procs seen by the last update, and
+		// procsMatched the number of those that are tracked, other than in
+		// the other group.
+		procsScanned int
+		procsMatched int
+		// otherGroup, if not empty, is the name of the group of procs that
+		// would otherwise not be tracked.  otherKernelThreads is true if
+		// kernel threads belong in it.
+		otherGroup         string
+		otherKernelThreads bool
+		// recheckOther holds the procs of the other group seen by the last
+		// update that must be matched again, as they would be if ignored.
+		recheckOther []IDInfo
+		// excluded holds the procs the namer excludes, see
+		// common.ExcludeNamer, with the time of the last update that saw
+		// them.  Unlike ignored procs they're not read again even when
+		// rechecking.
+		excluded map[ID]time.Time
+		// procTable holds the name, exe and parent of the procs seen by
+		// the last update by pid, as read when they were first seen, so
+		// that procs can be matched by their ancestors without reading
+		// those again.  It's left empty if the namer doesn't match procs
+		// by their ancestors.
+		procTable map[int]*procEntry
+		// newReads holds the reads the procs handleProc found new, or
+		// ignored and rechecked, were read with by the last update, see
+		// prematch.
+		newReads map[ID]procReads
+		// readWorkers, if more than one, is how many goroutines read procs
+		// ahead of the update handling them, see prefetch.
+		readWorkers int
+		username    map[int]string
+		debug       bool
+	}
+
+	// procEntry is what the tracker remembers of a proc for its
+	// descendants, see Tracker.parents.
+	procEntry struct {
+		id   ID
+		name string
+		exe  string
+		ppid int
+		// seen is the time of the last update that saw the proc.
+		seen time.Time
 	}
 
 	// Delta is an alias of Counts used to signal that its contents are not
@@ -47,11 +106,14 @@ type (
 		latest     Delta
 		lastUpdate time.Time
 		wchan      string
+		policy     string
 	}
 
 	// trackedProc accumulates metrics for a process, as well as
 	// remembering an optional GroupName tag associated with it.
 	trackedProc struct {
+		// id identifies the process.
+		id ID
 		// lastUpdate is used internally during the update cycle to find which procs have exited
 		lastUpdate time.Time
 		// static
@@ -62,6 +124,36 @@ type (
 		// groupName is the tag for this proc given by the namer.
 		groupName string
 		threads   map[ThreadID]trackedThread
+		// smaps is true if the namer wants smaps read for the proc's group.
+		smaps bool
+		// smapsRead is true if metrics.Memory includes the smaps fields
+		// from the last cycle.
+		smapsRead bool
+		// reads are the optional reads the namer wants for the proc's
+		// group, and readsDone those done in the last cycle.
+		reads, readsDone procReads
+		// other is true if the proc is in the other group.
+		other bool
+	}
+
+	// procReads are which of the optional reads of a proc are done, see
+	// common.GatherNamer.
+	procReads struct {
+		io, threads bool
+	}
+
+	// ProcExplanation tells why a proc is or isn't in a group.
+	ProcExplanation struct {
+		Pid int `json:"pid"`
+		// Attributes are what the namer is told of the proc.
+		Attributes common.ProcAttributes `json:"attributes"`
+		// MatchExplanation is the namer's verdict on the proc, and if it's
+		// a common.ExplainNamer, how each of its selectors fared.
+		common.MatchExplanation
+		// Group is the group the proc is in as of the last update, or ""
+		// if none.  It differs from the namer's verdict if the proc joined
+		// its parent's group or the other group, or was excluded.
+		Group string `json:"group"`
 	}
 
 	// ThreadUpdate describes what's changed for a thread since the last cycle.
@@ -93,6 +185,32 @@ type (
 		// Threads are the thread updates for this process, if the Tracker
 		// has trackThreads==true.
 		Threads []ThreadUpdate
+		// ID identifies the process.
+		ID ID
+		// SMaps is true if Memory includes the fields read from smaps.
+		SMaps bool
+		// Cgroups is the cgroup placement of the process, if known.
+		Cgroups []Cgroup
+		// Nice is the nice value of the process.
+		Nice int
+		// Priority is the scheduling priority of the process, see Metrics.
+		Priority int
+		// Blocked and BlockedWchan report whether the process is in
+		// uninterruptible sleep and on what, see Metrics.
+		Blocked      bool
+		BlockedWchan string
+		// CapEff is the effective capability set of the process, see
+		// Metrics.
+		CapEff uint64
+		// Netns is the network namespace of the process, see Metrics.
+		Netns uint64
+		// SchedPolicies is how many threads of the process, or just the
+		// process if its threads aren't known, have each scheduling
+		// policy.  It's nil if policies aren't known.
+		SchedPolicies map[string]int
+		// CPUsAllowed is the number of CPUs the process may run on, see
+		// Metrics.
+		CPUsAllowed int
 	}
 
 	// CollectErrors describes non-fatal errors found while collecting proc
@@ -106,6 +224,18 @@ type (
 		// some metrics (e.g. I/O) for a tracked proc, but we're still able
 		// to get the basic stuff like cmdline and core stats.
 		Partial int
+		// PartialProcs is the number of procs with any Partial errors.
+		PartialProcs int
+		// Regressions is incremented every time a counter of a tracked proc
+		// or thread is less than in the last cycle, e.g. the context
+		// switches of a proc whose threads have exited.  The counter is
+		// taken not to have grown, rather than contributing a negative
+		// delta.
+		Regressions int
+		// IOSkipped is the number of procs whose I/O counts couldn't be
+		// read for want of permission, see Metrics.IOSkipped.  Their
+		// counts are taken not to have grown.
+		IOSkipped int
 	}
 )
 
@@ -117,14 +247,24 @@ func lessCounts(x, y Counts) bool { return seq.Compare(x, y) < 0 }
 
 func (tp *trackedProc) getUpdate() Update {
 	u := Update{
-		GroupName:  tp.groupName,
-		Latest:     tp.lastaccum,
-		Memory:     tp.metrics.Memory,
-		Filedesc:   tp.metrics.Filedesc,
-		Start:      tp.static.StartTime,
-		NumThreads: tp.metrics.NumThreads,
-		States:     tp.metrics.States,
-		Wchans:     make(map[string]int),
+		GroupName:    tp.groupName,
+		Latest:       tp.lastaccum,
+		Memory:       tp.metrics.Memory,
+		Filedesc:     tp.metrics.Filedesc,
+		Start:        tp.static.StartTime,
+		NumThreads:   tp.metrics.NumThreads,
+		States:       tp.metrics.States,
+		Wchans:       make(map[string]int),
+		ID:           tp.id,
+		SMaps:        tp.smapsRead,
+		Cgroups:      tp.metrics.Cgroups,
+		Nice:         tp.metrics.Nice,
+		Priority:     tp.metrics.Priority,
+		Blocked:      tp.metrics.Blocked,
+		BlockedWchan: tp.metrics.BlockedWchan,
+		CapEff:       tp.metrics.CapEff,
+		Netns:        tp.metrics.Netns,
+		CPUsAllowed:  tp.metrics.CPUsAllowed,
 	}
 	if tp.metrics.Wchan != "" {
 		u.Wchans[tp.metrics.Wchan] = 1
@@ -135,17 +275,33 @@ func (tp *trackedProc) getUpdate() Update {
 			if tt.wchan != "" {
 				u.Wchans[tt.wchan]++
 			}
+			if tt.policy != "" {
+				u.addSchedPolicy(tt.policy)
+			}
 		}
+	} else if tp.metrics.SchedPolicy != "" {
+		u.addSchedPolicy(tp.metrics.SchedPolicy)
 	}
 	return u
 }
 
+// addSchedPolicy counts a thread of the process with the given scheduling
+// policy.
+func (u *Update) addSchedPolicy(policy string) {
+	if u.SchedPolicies == nil {
+		u.SchedPolicies = make(map[string]int)
+	}
+	u.SchedPolicies[policy]++
+}
+
 // NewTracker creates a Tracker.
 func NewTracker(namer common.MatchNamer, trackChildren, trackThreads, alwaysRecheck, debug bool) *Tracker {
 	return &Tracker{
 		namer:         namer,
 		tracked:       make(map[ID]*trackedProc),
 		procIds:       make(map[int]ID),
+		excluded:      make(map[ID]time.Time),
+		procTable:     make(map[int]*procEntry),
 		trackChildren: trackChildren,
 		trackThreads:  trackThreads,
 		alwaysRecheck: alwaysRecheck,
@@ -156,15 +312,25 @@ func NewTracker(namer common.MatchNamer, trackChildren, trackThreads, alwaysRech
 
 func (t *Tracker) track(groupName string, idinfo IDInfo) {
 	tproc := trackedProc{
+		id:        idinfo.ID,
 		groupName: groupName,
 		static:    idinfo.Static,
 		metrics:   idinfo.Metrics,
 	}
+	if sn, ok := t.namer.(common.SMapsNamer); ok {
+		tproc.smaps = sn.GatherSMaps(groupName)
+	}
+	tproc.reads = t.reads(groupName)
+	readsDone := t.reads("")
+	if reads, ok := t.newReads[idinfo.ID]; ok {
+		readsDone = reads
+	}
+	tproc.readsDone = procReads{io: readsDone.io, threads: len(idinfo.Threads) > 0}
 	if len(idinfo.Threads) > 0 {
 		tproc.threads = make(map[ThreadID]trackedThread)
 		for _, thr := range idinfo.Threads {
 			tproc.threads[thr.ThreadID] = trackedThread{
-				thr.ThreadName, thr.Counts, Delta{}, time.Time{}, thr.Wchan}
+				thr.ThreadName, thr.Counts, Delta{}, time.Time{}, thr.Wchan, thr.SchedPolicy}
 		}
 	}
 
@@ -177,17 +343,90 @@ func (t *Tracker) track(groupName string, idinfo IDInfo) {
 	t.tracked[idinfo.ID] = &tproc
 }
 
+// trackOther tracks idinfo in the other group, if there's one and it's not
+// an excluded kernel thread.
+func (t *Tracker) trackOther(idinfo IDInfo) {
+	if t.otherGroup == "" || (!t.otherKernelThreads && isKernelThread(idinfo)) {
+		return
+	}
+	if t.debug {
+		log.Printf("tracking unmatched proc as %q: %+v", t.otherGroup, idinfo)
+	}
+	t.track(t.otherGroup, idinfo)
+	t.tracked[idinfo.ID].other = true
+}
+
+// isKernelThread returns true if idinfo is kthreadd, pid 2, or one of the
+// kernel threads it spawns.
+func isKernelThread(idinfo IDInfo) bool {
+	return idinfo.Pid == 2 || idinfo.ParentPid == 2
+}
+
+// ignore stops tracking the proc with the given id.  It's only looked at
+// again by updates that are rechecking.
 func (t *Tracker) ignore(id ID) {
-	// only ignore ID if we didn't set recheck to true
-	if t.alwaysRecheck == false {
-		t.tracked[id] = nil
+	t.tracked[id] = nil
+}
+
+// trackMatched tracks a proc that was already known, but ignored or in the
+// other group, now that it matches.  Its counts so far are left out, so that
+// its group doesn't see them all at once.
+func (t *Tracker) trackMatched(groupName string, idinfo IDInfo) {
+	t.track(groupName, idinfo)
+	t.tracked[idinfo.ID].lastaccum = Delta{}
+}
+
+// recheckDue returns true if the update at now must match ignored procs
+// again: always with alwaysRecheck, or without trackChildren since procs are
+// only ignored then for want of a match, else every recheckInterval.
+func (t *Tracker) recheckDue(now time.Time) bool {
+	if t.alwaysRecheck || !t.trackChildren {
+		return true
+	}
+	if t.recheckInterval <= 0 {
+		return false
+	}
+	if t.lastRecheck.IsZero() {
+		t.lastRecheck = now
 	}
+	if now.Sub(t.lastRecheck) < t.recheckInterval {
+		return false
+	}
+	t.lastRecheck = now
+	return true
+}
+
+// rebase adjusts the counters of metrics, read as reads says, and of tp so
+// that changing what's read of the proc, e.g. because it joined a group
+// wanting its I/O, makes them neither jump nor regress: I/O that isn't read
+// keeps its last value, and counters whose source changed start again from
+// their new value.  threadsRead is true if the proc's threads were read.
+func (tp *trackedProc) rebase(metrics *Metrics, reads procReads, threadsRead bool) {
+	if !reads.io {
+		metrics.Counts = metrics.Counts.withIO(tp.metrics.Counts)
+	} else if !tp.readsDone.io {
+		tp.metrics.Counts = tp.metrics.Counts.withIO(metrics.Counts)
+	}
+	if threadsRead != tp.readsDone.threads {
+		tp.metrics.Counts.CtxSwitchVoluntary = metrics.Counts.CtxSwitchVoluntary
+		tp.metrics.Counts.CtxSwitchNonvoluntary = metrics.Counts.CtxSwitchNonvoluntary
+	}
+	tp.readsDone = procReads{io: reads.io, threads: threadsRead}
 }
 
 func (tp *trackedProc) update(metrics Metrics, now time.Time, cerrs *CollectErrors, threads []Thread) {
 	// newcounts: resource consumption since last cycle
 	newcounts := metrics.Counts
-	tp.lastaccum = newcounts.Sub(tp.metrics.Counts)
+	if metrics.IOSkipped {
+		// Keep the I/O counts last read, so that they neither regress
+		// nor jump if they can be read again.
+		newcounts = newcounts.withIO(tp.metrics.Counts)
+		metrics.Counts = newcounts
+	}
+	var regressed bool
+	if tp.lastaccum, regressed = newcounts.subClamped(tp.metrics.Counts); regressed {
+		cerrs.Regressions++
+	}
 	tp.metrics = metrics
 	tp.lastUpdate = now
 	if len(threads) > 1 {
@@ -195,9 +434,11 @@ func (tp *trackedProc) update(metrics Metrics, now time.Time, cerrs *CollectErro
 			tp.threads = make(map[ThreadID]trackedThread)
 		}
 		for _, thr := range threads {
-			tt := trackedThread{thr.ThreadName, thr.Counts, Delta{}, now, thr.Wchan}
+			tt := trackedThread{thr.ThreadName, thr.Counts, Delta{}, now, thr.Wchan, thr.SchedPolicy}
 			if old, ok := tp.threads[thr.ThreadID]; ok {
-				tt.latest, tt.accum = thr.Counts.Sub(old.accum), thr.Counts
+				if tt.latest, regressed = thr.Counts.subClamped(old.accum); regressed {
+					cerrs.Regressions++
+				}
 			}
 			tp.threads[thr.ThreadID] = tt
 		}
@@ -211,8 +452,9 @@ func (tp *trackedProc) update(metrics Metrics, now time.Time, cerrs *CollectErro
 	}
 }
 
-// handleProc updates the tracker if it's a known and not ignored proc.
-// If it's neither known nor ignored, newProc will be non-nil.
+// handleProc updates the tracker if it's a known and not ignored proc, and
+// when rechecking adds ignored procs to recheckIgnored.  If it's neither
+// known nor ignored, newProc will be non-nil.
 // It is not an error if the process disappears while we are reading
 // its info out of /proc, it just means nothing will be returned and
 // the tracker will be unchanged.
@@ -226,12 +468,39 @@ func (t *Tracker) handleProc(proc Proc, updateTime time.Time) (*IDInfo, CollectE
 		return nil, cerrs
 	}
 
-	// Do nothing if we're ignoring this proc.
+	if entry := t.procTable[procID.Pid]; entry != nil && entry.id == procID {
+		entry.seen = updateTime
+	}
+
+	// Do nothing if we're ignoring this proc, unless it's to be matched again.
 	last, known := t.tracked[procID]
-	if known && last == nil {
+	if known && last == nil && !t.rechecking {
+		return nil, cerrs
+	}
+	if !known && t.exclude(proc, procID, updateTime) {
+		t.excluded[procID] = updateTime
 		return nil, cerrs
 	}
 
+	// Procs are read as their group wants.  Those not tracked are matched
+	// first, so that they're read as the group they'll be put in wants
+	// from the start, and left alone if they're too young for it.
+	reads := t.reads("")
+	if known && last != nil {
+		reads = last.reads
+	} else if static, err := proc.GetStatic(); err == nil {
+		idinfo := IDInfo{ID: procID, Static: static}
+		wanted, gname := t.match(idinfo)
+		if !known && t.tooYoung(idinfo, gname, updateTime) {
+			return nil, cerrs
+		}
+		reads = t.prematch(idinfo, wanted, gname)
+		t.newReads[procID] = reads
+	}
+	if rs, ok := proc.(readSelector); ok {
+		proc = rs.selectReads(reads.io, reads.threads)
+	}
+
 	metrics, softerrors, err := proc.GetMetrics()
 	if err != nil {
 		if t.debug {
@@ -254,6 +523,9 @@ func (t *Tracker) handleProc(proc Proc, updateTime time.Time) (*IDInfo, CollectE
 		softerrors |= 1
 	}
 	cerrs.Partial += softerrors
+	if metrics.IOSkipped {
+		cerrs.IOSkipped++
+	}
 
 	if len(threads) > 0 {
 		metrics.Counts.CtxSwitchNonvoluntary, metrics.Counts.CtxSwitchVoluntary = 0, 0
@@ -261,12 +533,43 @@ func (t *Tracker) handleProc(proc Proc, updateTime time.Time) (*IDInfo, CollectE
 			metrics.Counts.CtxSwitchNonvoluntary += thread.Counts.CtxSwitchNonvoluntary
 			metrics.Counts.CtxSwitchVoluntary += thread.Counts.CtxSwitchVoluntary
 			metrics.States.Add(thread.States)
+			if !metrics.Blocked && thread.States.Waiting > 0 {
+				metrics.Blocked, metrics.BlockedWchan = true, thread.Wchan
+			}
 		}
 	}
 
 	var newProc *IDInfo
-	if known {
+	if known && last == nil {
+		if static, err := proc.GetStatic(); err == nil {
+			t.recheckIgnored = append(t.recheckIgnored, IDInfo{procID, static, metrics, threads})
+		}
+	} else if known {
+		// New procs don't have their smaps read until their second cycle,
+		// since until they've been named we don't know if they need it.
+		smapsRead := false
+		if last.smaps {
+			smaps, err := proc.GetSMaps()
+			if err != nil {
+				if t.debug {
+					log.Printf("can't read smaps for %+v: %v", procID, err)
+				}
+				cerrs.Partial++
+			} else {
+				metrics.Memory.ProportionalBytes = smaps.ProportionalBytes
+				metrics.Memory.ProportionalSwapBytes = smaps.ProportionalSwapBytes
+				metrics.Memory.UniqueBytes = smaps.UniqueBytes
+				smapsRead = true
+			}
+		}
+		last.rebase(&metrics, reads, len(threads) > 0)
 		last.update(metrics, updateTime, &cerrs, threads)
+		last.smapsRead = smapsRead
+		if last.other && t.rechecking {
+			if static, err := proc.GetStatic(); err == nil {
+				t.recheckOther = append(t.recheckOther, IDInfo{procID, static, metrics, threads})
+			}
+		}
 	} else {
 		static, err := proc.GetStatic()
 		if err != nil {
@@ -276,6 +579,7 @@ func (t *Tracker) handleProc(proc Proc, updateTime time.Time) (*IDInfo, CollectE
 			return nil, cerrs
 		}
 		newProc = &IDInfo{procID, static, metrics, threads}
+		t.remember(procID, static, updateTime)
 		if t.debug {
 			log.Printf("found new proc: %s", newProc)
 		}
@@ -291,6 +595,173 @@ func (t *Tracker) handleProc(proc Proc, updateTime time.Time) (*IDInfo, CollectE
 	return newProc, cerrs
 }
 
+// prematch returns the reads of the group idinfo, which isn't tracked and
+// which the namer matched as told by wanted and gname, would be put in: that
+// it matches, else that of its parent if its children join it, else the
+// other group if it belongs there, else none.
+// Update usually puts it in the same one, but as it's matched once all procs
+// have been seen, it may not if the proc's parent or ancestors are new too.
+// The reads are then those of procs not in a group, or of the wrong group
+// for one cycle, which rebase allows for.
+func (t *Tracker) prematch(idinfo IDInfo, wanted bool, gname string) procReads {
+	if !wanted {
+		if pgroup, ok := t.parentGroup(idinfo.ParentPid); ok {
+			gname = pgroup
+		} else if t.otherGroup != "" && (t.otherKernelThreads || !isKernelThread(idinfo)) {
+			gname = t.otherGroup
+		}
+	}
+	return t.reads(gname)
+}
+
+// exclude returns true if proc, which isn't tracked or ignored, was or is
+// now excluded by the namer.  That's decided from its static details alone,
+// so excluded procs never have their metrics read.
+func (t *Tracker) exclude(proc Proc, procID ID, updateTime time.Time) bool {
+	if _, ok := t.excluded[procID]; ok {
+		return true
+	}
+	en, ok := t.namer.(common.ExcludeNamer)
+	if !ok {
+		return false
+	}
+	static, err := proc.GetStatic()
+	if err != nil {
+		return false
+	}
+	// Excluded procs still count as the ancestors of others.
+	t.remember(procID, static, updateTime)
+	if !en.Excluded(t.attributes(IDInfo{ID: procID, Static: static})) {
+		return false
+	}
+	if t.debug {
+		log.Printf("excluded: %+v", procID)
+	}
+	return true
+}
+
+// tooYoung returns true if idinfo, which isn't tracked or ignored and which
+// the namer matched to gname, started less than the namer's min age for
+// gname ago, see common.MinAgeNamer.  Such a proc is left alone, as if it
+// hadn't been seen, so that once it's old enough it's found as a new proc,
+// and its counts since it started are all counted then rather than only
+// those from then on.
+func (t *Tracker) tooYoung(idinfo IDInfo, gname string, updateTime time.Time) bool {
+	mn, ok := t.namer.(common.MinAgeNamer)
+	if !ok {
+		return false
+	}
+	// Young procs still count as the ancestors of others.
+	t.remember(idinfo.ID, idinfo.Static, updateTime)
+	minAge := mn.MinAge(gname)
+	if minAge <= 0 || updateTime.Sub(idinfo.StartTime) >= minAge {
+		return false
+	}
+	if t.debug {
+		log.Printf("too young: %+v", idinfo.ID)
+	}
+	return true
+}
+
+// remember adds a proc first seen by the update at updateTime to procTable,
+// if the namer matches procs by their ancestors.
+func (t *Tracker) remember(procID ID, static Static, updateTime time.Time) {
+	if t.parentDepth() > 0 {
+		t.procTable[procID.Pid] = &procEntry{procID, static.Name, static.Exe, static.ParentPid, updateTime}
+	}
+}
+
+// parentDepth returns how many ancestors the namer matches procs by, see
+// common.ParentNamer.
+func (t *Tracker) parentDepth() int {
+	if pn, ok := t.namer.(common.ParentNamer); ok {
+		return pn.ParentDepth()
+	}
+	return 0
+}
+
+// parents returns the ancestors from procTable of a proc whose parent is
+// ppid, up to the depth the namer asks for, see common.ProcAttributes.
+func (t *Tracker) parents(ppid int) []common.ParentAttributes {
+	var parents []common.ParentAttributes
+	for depth := t.parentDepth(); len(parents) < depth && ppid > 1; {
+		entry := t.procTable[ppid]
+		if entry == nil {
+			break
+		}
+		parents = append(parents, common.ParentAttributes{Name: entry.name, Exe: entry.exe})
+		ppid = entry.ppid
+	}
+	return parents
+}
+
+// countZombie counts proc in orphanedZombies and zombies if it's a zombie.
+// A zombie is put in the group the namer gives it as it is now, rather than
+// in the one it was tracked in while alive, if any: its comm is kept, but its
+// cmdline is empty by now.  Zombies whose parent is pid 1 should be reaped
+// promptly by init, so if they persist pid 1 isn't doing its job, e.g. in a
+// container not running an init.
+func (t *Tracker) countZombie(proc Proc) {
+	states, err := proc.GetStates()
+	if err != nil || states.Zombie == 0 {
+		return
+	}
+	// Only read static info for zombies, there shouldn't be many.
+	procID, err := proc.GetProcID()
+	if err != nil {
+		return
+	}
+	static, err := proc.GetStatic()
+	if err != nil {
+		return
+	}
+	if static.ParentPid == 1 {
+		t.orphanedZombies++
+	}
+	idinfo := IDInfo{ID: procID, Static: static}
+	if en, ok := t.namer.(common.ExcludeNamer); ok && en.Excluded(t.attributes(idinfo)) {
+		return
+	}
+	if wanted, gname := t.match(idinfo); wanted {
+		t.zombies[gname]++
+	} else if t.otherGroup != "" {
+		t.zombies[t.otherGroup]++
+	}
+}
+
+// prefetch reads ahead what handleProc will read of proc: the metrics and
+// threads of tracked procs, and of ignored ones when rechecking, and the
+// static details of new ones, which are all the exclude and min age checks
+// and matching need.  Those have their metrics read later, since excluded
+// procs mustn't be, and the others are read as their group wants.  Ignored
+// procs are read ahead with ungrouped, the reads of procs not in a group,
+// which they most likely stay out of; if not they're read again.  It's
+// called from the workers of a prefetchIterator, so it only reads the
+// tracker, which isn't changed while they run.
+func (t *Tracker) prefetch(proc Proc, ungrouped procReads) {
+	pf, ok := proc.(prefetcher)
+	if !ok {
+		return
+	}
+	procID, err := proc.GetProcID()
+	if err != nil {
+		return
+	}
+	last, known := t.tracked[procID]
+	switch {
+	case known && last == nil:
+		if t.rechecking {
+			pf.prefetch(true, ungrouped, true)
+		}
+	case known:
+		pf.prefetch(false, last.reads, true)
+	default:
+		if _, excluded := t.excluded[procID]; !excluded {
+			pf.prefetch(true, procReads{}, false)
+		}
+	}
+}
+
 // update scans procs and updates metrics for those which are tracked. Processes
 // that have gone away get removed from the Tracked map. New processes are
 // returned, along with the count of nonfatal errors.
@@ -299,13 +770,33 @@ func (t *Tracker) update(procs Iter) ([]IDInfo, CollectErrors, error) {
 	var colErrs CollectErrors
 	var now = time.Now()
 
+	t.orphanedZombies = 0
+	t.zombies = make(map[string]int)
+	t.newReads = make(map[ID]procReads)
+	t.procsScanned = 0
+	t.recheckOther = t.recheckOther[:0]
+	t.recheckIgnored = t.recheckIgnored[:0]
+	t.rechecking = t.recheckDue(now)
+	if pi, ok := procs.(*procIterator); ok && t.readWorkers > 1 {
+		ungrouped := t.reads("")
+		procs = newPrefetchIterator(pi, t.readWorkers, func(proc Proc) {
+			t.prefetch(proc, ungrouped)
+		})
+	}
 	for procs.Next() {
+		t.procsScanned++
+		t.countZombie(procs)
 		newProc, cerrs := t.handleProc(procs, now)
 		if newProc != nil {
 			newProcs = append(newProcs, *newProc)
 		}
 		colErrs.Read += cerrs.Read
 		colErrs.Partial += cerrs.Partial
+		colErrs.Regressions += cerrs.Regressions
+		colErrs.IOSkipped += cerrs.IOSkipped
+		if cerrs.Partial > 0 {
+			colErrs.PartialProcs++
+		}
 	}
 
 	err := procs.Close()
@@ -317,10 +808,23 @@ func (t *Tracker) update(procs Iter) ([]IDInfo, CollectErrors, error) {
 	// disappeared, we bump the last update time on those that are still
 	// present.  Then as a second pass we traverse the map looking for
 	// stale procs and removing them.
+	// Ignored procs are only seen when rechecking, so that's when those that
+	// have gone away are removed.
+	var seenIgnored map[ID]bool
+	if t.rechecking {
+		seenIgnored = make(map[ID]bool, len(t.recheckIgnored))
+		for _, idinfo := range t.recheckIgnored {
+			seenIgnored[idinfo.ID] = true
+		}
+	}
 	for procID, pinfo := range t.tracked {
 		if pinfo == nil {
-			// TODO is this a bug? we're not tracking the proc so we don't see it go away so ProcIds
-			// and Tracked are leaking?
+			if t.rechecking && !seenIgnored[procID] {
+				delete(t.tracked, procID)
+				if t.procIds[procID.Pid] == procID {
+					delete(t.procIds, procID.Pid)
+				}
+			}
 			continue
 		}
 		if pinfo.lastUpdate != now {
@@ -328,14 +832,51 @@ func (t *Tracker) update(procs Iter) ([]IDInfo, CollectErrors, error) {
 			delete(t.procIds, procID.Pid)
 		}
 	}
+	for procID, seen := range t.excluded {
+		if seen != now {
+			delete(t.excluded, procID)
+		}
+	}
+	for pid, entry := range t.procTable {
+		if entry.seen != now {
+			delete(t.procTable, pid)
+		}
+	}
 
 	return newProcs, colErrs, nil
 }
 
+// childrenTracked returns true if the children of procs in the named group
+// join it: with trackChildren, or if the namer asks for it for the group.
+func (t *Tracker) childrenTracked(groupName string) bool {
+	if t.trackChildren {
+		return true
+	}
+	cn, ok := t.namer.(common.ChildrenNamer)
+	return ok && cn.TrackChildren(groupName)
+}
+
+// mayTrackChildren returns true if the children of procs in some group may
+// join it, see childrenTracked.
+func (t *Tracker) mayTrackChildren() bool {
+	_, ok := t.namer.(common.ChildrenNamer)
+	return t.trackChildren || ok
+}
+
+// parentGroup returns the group of the proc with the given pid if it's
+// tracked, other than in the other group, and its children join it.
+func (t *Tracker) parentGroup(ppid int) (string, bool) {
+	ptproc := t.tracked[t.procIds[ppid]]
+	if ptproc == nil || ptproc.other || !t.childrenTracked(ptproc.groupName) {
+		return "", false
+	}
+	return ptproc.groupName, true
+}
+
 // checkAncestry walks the process tree recursively towards the root,
 // stopping at pid 1 or upon finding a parent that's already tracked
-// or ignored.  If we find a tracked parent track this one too; if not,
-// ignore this one.
+// or ignored.  If we find a tracked parent whose children join its group
+// track this one too; if not, ignore this one.
 func (t *Tracker) checkAncestry(idinfo IDInfo, newprocs map[ID]IDInfo) string {
 	ppid := idinfo.ParentPid
 	pProcID := t.procIds[ppid]
@@ -348,16 +889,17 @@ func (t *Tracker) checkAncestry(idinfo IDInfo, newprocs map[ID]IDInfo) string {
 		return ""
 	}
 
-	// Is the parent already known to the tracker?
-	if ptproc, ok := t.tracked[pProcID]; ok {
-		if ptproc != nil {
+	// Is the parent already known to the tracker?  A parent in the other
+	// group counts as untracked, so that its children are matched as it was.
+	if _, ok := t.tracked[pProcID]; ok {
+		if name, ok := t.parentGroup(ppid); ok {
 			if t.debug {
 				log.Printf("matched as %q because child of %+v: %+v",
-					ptproc.groupName, pProcID, idinfo)
+					name, pProcID, idinfo)
 			}
 			// We've found a tracked parent.
-			t.track(ptproc.groupName, idinfo)
-			return ptproc.groupName
+			t.track(name, idinfo)
+			return name
 		}
 		// We've found an untracked parent.
 		t.ignore(idinfo.ID)
@@ -366,7 +908,7 @@ func (t *Tracker) checkAncestry(idinfo IDInfo, newprocs map[ID]IDInfo) string {
 
 	// Is the parent another new process?
 	if pinfoid, ok := newprocs[pProcID]; ok {
-		if name := t.checkAncestry(pinfoid, newprocs); name != "" {
+		if name := t.checkAncestry(pinfoid, newprocs); name != "" && t.childrenTracked(name) {
 			if t.debug {
 				log.Printf("matched as %q because child of %+v: %+v",
 					name, pProcID, idinfo)
@@ -385,6 +927,82 @@ func (t *Tracker) checkAncestry(idinfo IDInfo, newprocs map[ID]IDInfo) string {
 	return ""
 }
 
+// samples returns the state of the tracked procs as of the last update.
+func (t *Tracker) samples() []ProcSample {
+	samples := make([]ProcSample, 0, len(t.tracked))
+	for _, tproc := range t.tracked {
+		if tproc != nil {
+			samples = append(samples, ProcSample{
+				GroupName:   tproc.groupName,
+				ID:          tproc.id,
+				Name:        tproc.static.Name,
+				Cmdline:     tproc.static.Cmdline,
+				Username:    t.lookupUid(tproc.static.EffectiveUID),
+				Start:       tproc.static.StartTime,
+				Counts:      tproc.metrics.Counts,
+				Latest:      tproc.lastaccum,
+				Memory:      tproc.metrics.Memory,
+				Filedesc:    tproc.metrics.Filedesc,
+				NumThreads:  tproc.metrics.NumThreads,
+				Cgroups:     tproc.metrics.Cgroups,
+				CPUsAllowed: tproc.metrics.CPUsAllowed,
+			})
+		}
+	}
+	return samples
+}
+
+// explain returns what the namer is told of proc, read afresh, and why it
+// does or doesn't match it.
+func (t *Tracker) explain(proc Proc) (ProcExplanation, error) {
+	procID, err := proc.GetProcID()
+	if err != nil {
+		return ProcExplanation{}, err
+	}
+	static, err := proc.GetStatic()
+	if err != nil {
+		return ProcExplanation{}, err
+	}
+	pe := ProcExplanation{Pid: procID.Pid, Attributes: t.attributes(IDInfo{ID: procID, Static: static})}
+	if en, ok := t.namer.(common.ExplainNamer); ok {
+		pe.MatchExplanation = en.Explain(pe.Attributes)
+	} else {
+		pe.Matched, pe.GroupName = t.namer.MatchAndName(pe.Attributes)
+	}
+	if tproc := t.tracked[procID]; tproc != nil {
+		pe.Group = tproc.groupName
+	}
+	return pe, nil
+}
+
+// match returns the namer's verdict on idinfo.
+func (t *Tracker) match(idinfo IDInfo) (bool, string) {
+	return t.namer.MatchAndName(t.attributes(idinfo))
+}
+
+// attributes returns what the namer is told of idinfo.
+func (t *Tracker) attributes(idinfo IDInfo) common.ProcAttributes {
+	return common.ProcAttributes{
+		Name:           idinfo.Name,
+		Cmdline:        idinfo.Cmdline,
+		Username:       t.lookupUid(idinfo.EffectiveUID),
+		PID:            idinfo.Pid,
+		StartTime:      idinfo.StartTime,
+		Runtime:        string(idinfo.Runtime),
+		Exe:            idinfo.Exe,
+		EffectiveUID:   idinfo.EffectiveUID,
+		RealUID:        idinfo.RealUID,
+		RealUsername:   t.lookupUid(idinfo.RealUID),
+		CgroupPath:     idinfo.CgroupPath,
+		ContainerID:    Cgroup{Path: idinfo.CgroupPath}.ContainerID(),
+		SystemdUnit:    Cgroup{Path: idinfo.CgroupPath}.SystemdUnit(),
+		SystemdUnits:   Cgroup{Path: idinfo.CgroupPath}.SystemdUnits(),
+		Env:            idinfo.Env,
+		Parents:        t.parents(idinfo.ParentPid),
+		ListeningPorts: idinfo.ListeningPorts,
+	}
+}
+
 func (t *Tracker) lookupUid(uid int) string {
 	if name, ok := t.username[uid]; ok {
 		return name
@@ -402,6 +1020,139 @@ func (t *Tracker) lookupUid(uid int) string {
 	return name
 }
 
+// setNamer replaces the namer, naming the tracked procs again with it.  Procs
+// it matches, or with trackChildren whose parent's group it keeps, keep
+// their counts so far and just change group if their name changed.  The
+// rest go to the other group if there's one, or are ignored, as new procs
+// would be.  Ignored and excluded procs are forgotten, so that they're
+// matched again by the next Update, as are procs it excludes.  Procs found by Updates from now on only count what they
+// use from now on, even if they started since the first Update, since
+// that's been counted in their old group if they were tracked.
+func (t *Tracker) setNamer(namer common.MatchNamer) {
+	t.namer = namer
+	t.firstUpdateAt = time.Now()
+	t.excluded = make(map[ID]time.Time)
+	// procTable is only kept for namers matching procs by their ancestors.
+	// The tracked procs a previous namer didn't need it for are added now;
+	// the others are as they're seen again.
+	if t.parentDepth() == 0 {
+		t.procTable = make(map[int]*procEntry)
+	} else {
+		for _, tproc := range t.tracked {
+			if tproc != nil && t.procTable[tproc.id.Pid] == nil {
+				t.remember(tproc.id, tproc.static, tproc.lastUpdate)
+			}
+		}
+	}
+
+	var unmatched []*trackedProc
+	for id, tproc := range t.tracked {
+		if tproc == nil {
+			delete(t.tracked, id)
+			continue
+		}
+		idinfo := IDInfo{ID: tproc.id, Static: tproc.static}
+		if en, ok := namer.(common.ExcludeNamer); ok && en.Excluded(t.attributes(idinfo)) {
+			delete(t.tracked, id)
+			delete(t.procIds, id.Pid)
+			continue
+		}
+		if wanted, gname := t.match(idinfo); wanted {
+			t.rename(tproc, gname, false)
+		} else {
+			unmatched = append(unmatched, tproc)
+		}
+	}
+
+	// Children take the group of their parent, which may itself be a
+	// child, so keep going until no more are found.
+	for t.mayTrackChildren() && len(unmatched) > 0 {
+		var orphans []*trackedProc
+		for _, tproc := range unmatched {
+			ptproc := t.tracked[t.procIds[tproc.static.ParentPid]]
+			if name, ok := t.parentGroup(tproc.static.ParentPid); ok && !containsProc(unmatched, ptproc) {
+				t.rename(tproc, name, false)
+			} else {
+				orphans = append(orphans, tproc)
+			}
+		}
+		if len(orphans) == len(unmatched) {
+			break
+		}
+		unmatched = orphans
+	}
+
+	for _, tproc := range unmatched {
+		idinfo := IDInfo{ID: tproc.id, Static: tproc.static}
+		if t.otherGroup != "" && (t.otherKernelThreads || !isKernelThread(idinfo)) {
+			t.rename(tproc, t.otherGroup, true)
+		} else {
+			t.ignore(tproc.id)
+		}
+	}
+}
+
+// rename moves tproc to the named group.
+func (t *Tracker) rename(tproc *trackedProc, groupName string, other bool) {
+	if t.debug && tproc.groupName != groupName {
+		log.Printf("renamed from %q to %q: %+v", tproc.groupName, groupName, tproc.id)
+	}
+	tproc.groupName, tproc.other = groupName, other
+	tproc.smaps = false
+	if sn, ok := t.namer.(common.SMapsNamer); ok {
+		tproc.smaps = sn.GatherSMaps(groupName)
+	}
+	tproc.reads = t.reads(groupName)
+}
+
+// reads returns the optional reads the namer wants for the procs in
+// groupName, or for those not yet in a group if it's empty.  Without a
+// GatherNamer, they're all done if the FS enables them.
+func (t *Tracker) reads(groupName string) procReads {
+	gn, ok := t.namer.(common.GatherNamer)
+	if !ok {
+		return procReads{io: true, threads: true}
+	}
+	return procReads{io: gn.Gather(groupName, "io"), threads: gn.Gather(groupName, "threads")}
+}
+
+// containsProc returns true if procs includes tproc.
+func containsProc(procs []*trackedProc, tproc *trackedProc) bool {
+	for _, p := range procs {
+		if p == tproc {
+			return true
+		}
+	}
+	return false
+}
+
+// recheck matches the ignored procs in idinfos again, tracking those that
+// match, and those whose parent's group they join, see parentGroup.  The rest
+// stay ignored.
+func (t *Tracker) recheck(idinfos []IDInfo) {
+	for len(idinfos) > 0 {
+		var unmatched []IDInfo
+		for _, idinfo := range idinfos {
+			wanted, gname := t.match(idinfo)
+			if !wanted {
+				gname, wanted = t.parentGroup(idinfo.ParentPid)
+			}
+			if !wanted {
+				unmatched = append(unmatched, idinfo)
+				continue
+			}
+			if t.debug {
+				log.Printf("matched as %q on recheck: %+v", gname, idinfo)
+			}
+			t.trackMatched(gname, idinfo)
+		}
+		if len(unmatched) == len(idinfos) || !t.mayTrackChildren() {
+			break
+		}
+		idinfos = unmatched
+	}
+}
+
 // Update modifies the tracker's internal state based on what it reads from
 // iter.  Tracks any new procs the namer wants tracked, and updates
 // its metrics for existing tracked procs.  Returns nonfatal errors
@@ -419,14 +1170,7 @@ func (t *Tracker) Update(iter Iter) (CollectErrors, []Update, error) {
 	// Step 1: track any new proc that should be tracked based on its name and cmdline.
 	untracked := make(map[ID]IDInfo)
 	for _, idinfo := range newProcs {
-		nacl := common.ProcAttributes{
-			Name:      idinfo.Name,
-			Cmdline:   idinfo.Cmdline,
-			Username:  t.lookupUid(idinfo.EffectiveUID),
-			PID:       idinfo.Pid,
-			StartTime: idinfo.StartTime,
-		}
-		wanted, gname := t.namer.MatchAndName(nacl)
+		wanted, gname := t.match(idinfo)
 		if wanted {
 			if t.debug {
 				log.Printf("matched as %q: %+v", gname, idinfo)
@@ -438,7 +1182,7 @@ func (t *Tracker) Update(iter Iter) (CollectErrors, []Update, error) {
 	}
 
 	// Step 2: track any untracked new proc that should be tracked because its parent is tracked.
-	if t.trackChildren {
+	if t.mayTrackChildren() {
 		for _, idinfo := range untracked {
 			if _, ok := t.tracked[idinfo.ID]; ok {
 				// Already tracked or ignored in an earlier iteration
@@ -449,10 +1193,44 @@ func (t *Tracker) Update(iter Iter) (CollectErrors, []Update, error) {
 		}
 	}
 
+	// Step 3: move procs in the other group that now match to their group.
+	for _, idinfo := range t.recheckOther {
+		wanted, gname := t.match(idinfo)
+		if !wanted {
+			gname, wanted = t.parentGroup(idinfo.ParentPid)
+		}
+		if wanted {
+			if t.debug {
+				log.Printf("matched as %q, leaving %q: %+v", gname, t.otherGroup, idinfo)
+			}
+			t.trackMatched(gname, idinfo)
+		}
+	}
+
+	// Step 4: track ignored procs that now match, e.g. because they've
+	// changed their cmdline since they were first seen.  With trackChildren,
+	// the children of those are tracked too, however deep.
+	t.recheck(t.recheckIgnored)
+
+	// Step 5: track the remaining new procs in the other group, ignoring
+	// those that aren't.
+	for _, idinfo := range untracked {
+		if t.tracked[idinfo.ID] == nil {
+			t.trackOther(idinfo)
+		}
+		if t.tracked[idinfo.ID] == nil {
+			t.ignore(idinfo.ID)
+		}
+	}
+
 	tp := []Update{}
+	t.procsMatched = 0
 	for _, tproc := range t.tracked {
 		if tproc != nil {
 			tp = append(tp, tproc.getUpdate())
+			if !tproc.other {
+				t.procsMatched++
+			}
 		}
 	}
 	return colErrs, tp, nil
@@ -1,11 +1,13 @@
 package proc
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	common "github.com/ncabatoff/process-exporter"
 )
 
 // Verify that the tracker finds and tracks or ignores procs based on the
@@ -22,17 +24,19 @@ func TestTrackerBasic(t *testing.T) {
 	}{
 		{
 			[]IDInfo{newProcStart(p1, n1, 1), newProcStart(p3, n3, 1)},
-			[]Update{{GroupName: n1, Start: t1, Wchans: msi{}}},
+			[]Update{{GroupName: n1, Start: t1, Wchans: msi{}, ID: ID{p1, 1}}},
 		},
 		{
 			// p3 (ignored) has exited and p2 has appeared
 			[]IDInfo{newProcStart(p1, n1, 1), newProcStart(p2, n2, 2)},
-			[]Update{{GroupName: n1, Start: t1, Wchans: msi{}}, {GroupName: n2, Start: t2, Wchans: msi{}}},
+			[]Update{{GroupName: n1, Start: t1, Wchans: msi{}, ID: ID{p1, 1}},
+				{GroupName: n2, Start: t2, Wchans: msi{}, ID: ID{p2, 2}}},
 		},
 		{
 			// p1 has exited and a new proc with a new name has taken its pid
 			[]IDInfo{newProcStart(p1, n4, 3), newProcStart(p2, n2, 2)},
-			[]Update{{GroupName: n4, Start: t3, Wchans: msi{}}, {GroupName: n2, Start: t2, Wchans: msi{}}},
+			[]Update{{GroupName: n4, Start: t3, Wchans: msi{}, ID: ID{p1, 3}},
+				{GroupName: n2, Start: t2, Wchans: msi{}, ID: ID{p2, 2}}},
 		},
 	}
 	// Note that n3 should not be tracked according to our namer.
@@ -66,7 +70,7 @@ func TestTrackerChildren(t *testing.T) {
 				newProcParent(p1, n1, 0),
 				newProcParent(p2, n2, p1),
 			},
-			[]Update{{GroupName: n2, Start: t1, Wchans: msi{}}},
+			[]Update{{GroupName: n2, Start: t1, Wchans: msi{}, ID: ID{p2, 0}}},
 		},
 		{
 			[]IDInfo{
@@ -74,21 +78,271 @@ func TestTrackerChildren(t *testing.T) {
 				newProcParent(p2, n2, p1),
 				newProcParent(p3, n3, p2),
 			},
-			[]Update{{GroupName: n2, Start: t1, Wchans: msi{}}, {GroupName: n2, Start: t1, Wchans: msi{}}},
+			[]Update{{GroupName: n2, Start: t1, Wchans: msi{}, ID: ID{p2, 0}},
+				{GroupName: n2, Start: t1, Wchans: msi{}, ID: ID{p3, 0}}},
 		},
 	}
 	// Only n2 and children of n2s should be tracked
 	tr := NewTracker(newNamer(n2), true, false, false, false)
 
+	opts := cmpopts.SortSlices(func(x, y Update) bool { return x.ID.Pid < y.ID.Pid })
 	for i, tc := range tests {
 		_, got, err := tr.Update(procInfoIter(tc.procs...))
 		noerr(t, err)
-		if diff := cmp.Diff(got, tc.want); diff != "" {
+		if diff := cmp.Diff(got, tc.want, opts); diff != "" {
 			t.Errorf("%d: update differs: (-got +want)\n%s", i, diff)
 		}
 	}
 }
 
+// childrenNamer is a namer that asks for the children of procs in some
+// groups to join them.
+type childrenNamer struct {
+	namer
+	children map[string]bool
+}
+
+func (n childrenNamer) TrackChildren(groupname string) bool {
+	return n.children[groupname]
+}
+
+// TestTrackerChildrenNamer verifies that without trackChildren, the
+// descendants of procs in a group whose namer asks for it join the group,
+// however deep, and stay in it when their parent dies, while those of other
+// groups don't.
+func TestTrackerChildrenNamer(t *testing.T) {
+	tr := NewTracker(childrenNamer{newNamer("builder", "web"), map[string]bool{"builder": true}},
+		false, false, false, false)
+	for i, tc := range []struct {
+		procs []IDInfo
+		want  map[int]string
+	}{
+		// A three-level tree, and a child of a group without children.
+		{[]IDInfo{newProcParent(1, "init", 0), newProcParent(10, "builder", 1),
+			newProcParent(11, "cc", 10), newProcParent(12, "as", 11),
+			newProcParent(20, "web", 1), newProcParent(21, "ffmpeg", 20)},
+			map[int]string{10: "builder", 11: "builder", 12: "builder", 20: "web"}},
+		// The middle proc dies and its child is reparented to init, but
+		// stays in the group, as does a new child of it.
+		{[]IDInfo{newProcParent(1, "init", 0), newProcParent(10, "builder", 1),
+			newProcParent(12, "as", 1), newProcParent(13, "ld", 12),
+			newProcParent(20, "web", 1), newProcParent(21, "ffmpeg", 20)},
+			map[int]string{10: "builder", 12: "builder", 13: "builder", 20: "web"}},
+		// A new child of init doesn't join anything.
+		{[]IDInfo{newProcParent(1, "init", 0), newProcParent(10, "builder", 1),
+			newProcParent(14, "cc", 1)},
+			map[int]string{10: "builder"}},
+	} {
+		_, updates, err := tr.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		got := make(map[int]string)
+		for _, u := range updates {
+			got[u.ID.Pid] = u.GroupName
+		}
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("%d: groups differ: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// excludeNamer is a namer that excludes procs by name.
+type excludeNamer struct {
+	namer
+	excluded map[string]bool
+}
+
+func (n excludeNamer) Excluded(nacl common.ProcAttributes) bool {
+	return n.excluded[nacl.Name]
+}
+
+// TestTrackerExclude verifies that excluded procs aren't tracked even in the
+// other group or as children, that their metrics are never read, even when
+// rechecking, and that setNamer forgets exclusions.
+func TestTrackerExclude(t *testing.T) {
+	tr := NewTracker(excludeNamer{newNamer("web"), map[string]bool{"secret": true}}, true, false, true, false)
+	tr.otherGroup, tr.otherKernelThreads = "other", true
+	procs := func() Iter {
+		return &procIterator{procs: procSlice{
+			newProcParent(1, "init", 0), newProcParent(10, "web", 1),
+			errProc{newProcParent(11, "secret", 10), fmt.Errorf("error reading io: permission denied")},
+			errProc{newProcParent(20, "secret", 1), fmt.Errorf("error reading io: permission denied")},
+			newProcParent(21, "sh", 20),
+		}, idx: -1}
+	}
+	want := map[int]string{1: "other", 10: "web", 21: "other"}
+	for i := 0; i < 2; i++ {
+		cerrs, updates, err := tr.Update(procs())
+		noerr(t, err)
+		got := make(map[int]string)
+		for _, u := range updates {
+			got[u.ID.Pid] = u.GroupName
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("%d: groups differ: (-got +want)\n%s", i, diff)
+		}
+		if cerrs.Read != 0 {
+			t.Errorf("%d: got %d read errors, want none", i, cerrs.Read)
+		}
+	}
+	if len(tr.excluded) != 2 {
+		t.Errorf("got %d excluded procs, want 2", len(tr.excluded))
+	}
+
+	tr.setNamer(excludeNamer{newNamer("web"), map[string]bool{"web": true}})
+	if len(tr.excluded) != 0 {
+		t.Errorf("got %d excluded procs after setNamer, want none", len(tr.excluded))
+	}
+	if _, ok := tr.tracked[ID{10, 0}]; ok {
+		t.Errorf("proc excluded by setNamer still tracked")
+	}
+}
+
+// minAgeNamer is a namer that leaves procs alone until they're as old as
+// minAge wants for their name, and asks for depth ancestors.
+type minAgeNamer struct {
+	namer
+	minAge map[string]time.Duration
+	depth  int
+}
+
+func (n minAgeNamer) MinAge(groupname string) time.Duration {
+	return n.minAge[groupname]
+}
+
+func (n minAgeNamer) ParentDepth() int {
+	return n.depth
+}
+
+// TestTrackerMinAge verifies that procs younger than the namer's min age
+// aren't tracked, nor have their metrics read, and that once they're old
+// enough their counts since they started are all counted, as for any proc
+// started since the first update.  Young procs are remembered as ancestors
+// only if the namer matches by them.
+func TestTrackerMinAge(t *testing.T) {
+	for _, depth := range []int{0, 1} {
+		testTrackerMinAge(t, depth)
+	}
+}
+
+func testTrackerMinAge(t *testing.T, depth int) {
+	minAge := map[string]time.Duration{"cc": time.Minute}
+	tr := NewTracker(minAgeNamer{newNamer("web", "cc"), minAge, depth}, false, false, false, false)
+	tr.firstUpdateAt = time.Now().Add(-time.Hour)
+	start := uint64(time.Now().Add(-10 * time.Second).Unix())
+	proc := func(pid int, name string, cpu float64) IDInfo {
+		id, static := newProcIDStatic(pid, 1, start, name, nil)
+		return IDInfo{id, static, Metrics{Counts: Counts{CPUUserTime: cpu}}, nil}
+	}
+	for i, tc := range []struct {
+		minAge time.Duration
+		cc     float64
+		want   map[int]float64
+	}{
+		{time.Minute, 3, map[int]float64{1: 2}},
+		{5 * time.Second, 5, map[int]float64{1: 0, 2: 5}},
+		{5 * time.Second, 6, map[int]float64{1: 0, 2: 1}},
+	} {
+		minAge["cc"] = tc.minAge
+		procs := procSlice{proc(1, "web", 2)}
+		if tc.minAge > 10*time.Second {
+			procs = append(procs, errProc{proc(2, "cc", tc.cc), fmt.Errorf("metrics read")})
+		} else {
+			procs = append(procs, proc(2, "cc", tc.cc))
+		}
+		cerrs, updates, err := tr.Update(&procIterator{procs: procs, idx: -1})
+		noerr(t, err)
+		got := make(map[int]float64)
+		for _, u := range updates {
+			got[u.ID.Pid] = u.Latest.CPUUserTime
+		}
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("depth %d, %d: cpu differs: (-got +want)\n%s", depth, i, diff)
+		}
+		if cerrs.Read != 0 {
+			t.Errorf("depth %d, %d: got %d read errors, want none", depth, i, cerrs.Read)
+		}
+		if want := 2 * depth; len(tr.procTable) != want {
+			t.Errorf("depth %d, %d: got %d procs in table, want %d", depth, i, len(tr.procTable), want)
+		}
+	}
+}
+
+// parentNamer names procs with an ancestor in groups after the nearest one,
+// up to depth.
+type parentNamer struct {
+	groups map[string]bool
+	depth  int
+}
+
+func (n parentNamer) String() string {
+	return fmt.Sprintf("%v %d", n.groups, n.depth)
+}
+
+func (n parentNamer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
+	for _, parent := range nacl.Parents {
+		if n.groups[parent.Name] {
+			return true, parent.Name + "/" + nacl.Name
+		}
+	}
+	return false, ""
+}
+
+func (n parentNamer) ParentDepth() int {
+	return n.depth
+}
+
+// TestTrackerParents verifies that procs are told their ancestors up to the
+// namer's depth from the procs seen by the same update, whatever order they
+// come in, and that those of init or of pids not seen are unknown.
+func TestTrackerParents(t *testing.T) {
+	procs := []IDInfo{newProcParent(11, "sh", 10), newProcParent(22, "sh", 21),
+		newProcParent(1, "init", 0), newProcParent(10, "cron", 1), newProcParent(20, "agent", 1),
+		newProcParent(21, "bash", 20), newProcParent(30, "sh", 1), newProcParent(31, "sh", 99)}
+	for _, tc := range []struct {
+		depth int
+		want  map[int]string
+	}{
+		{1, map[int]string{11: "cron/sh", 21: "agent/bash"}},
+		{2, map[int]string{11: "cron/sh", 21: "agent/bash", 22: "agent/sh"}},
+	} {
+		tr := NewTracker(parentNamer{map[string]bool{"cron": true, "agent": true, "init": true}, tc.depth},
+			false, false, false, false)
+		_, updates, err := tr.Update(procInfoIter(procs...))
+		noerr(t, err)
+		got := make(map[int]string)
+		for _, u := range updates {
+			got[u.ID.Pid] = u.GroupName
+		}
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("depth %d: groups differ: (-got +want)\n%s", tc.depth, diff)
+		}
+		if len(tr.procTable) != len(procs) {
+			t.Errorf("depth %d: got %d procs in table, want %d", tc.depth, len(tr.procTable), len(procs))
+		}
+	}
+}
+
+// TestTrackerParentsSetNamer verifies that procs aren't remembered as
+// ancestors for a namer that doesn't ask for any, and that the tracked ones
+// are once one that does replaces it.
+func TestTrackerParentsSetNamer(t *testing.T) {
+	procs := []IDInfo{newProcParent(10, "cron", 1), newProcParent(11, "sh", 10)}
+	tr := NewTracker(newNamer("cron", "sh"), false, false, false, false)
+	_, _, err := tr.Update(procInfoIter(procs...))
+	noerr(t, err)
+	if len(tr.procTable) != 0 {
+		t.Errorf("got %d procs in table without parent selectors, want none", len(tr.procTable))
+	}
+
+	tr.setNamer(parentNamer{map[string]bool{"cron": true}, 1})
+	if len(tr.procTable) != len(procs) {
+		t.Errorf("got %d procs in table after setNamer, want %d", len(tr.procTable), len(procs))
+	}
+	if got := tr.parents(10); len(got) != 1 || got[0].Name != "cron" {
+		t.Errorf("got parents %v of a child of pid 10, want cron", got)
+	}
+}
+
 // TestTrackerMetrics verifies that the updates returned by the tracker
 // match the input we're giving it.
 func TestTrackerMetrics(t *testing.T) {
@@ -99,16 +353,16 @@ func TestTrackerMetrics(t *testing.T) {
 		want Update
 	}{
 		{
-			piinfost(p, n, Counts{1, 2, 3, 4, 5, 6, 0, 0}, Memory{7, 8, 0, 0, 0},
+			piinfost(p, n, Counts{1, 2, 3, 4, 5, 6, 0, 0, 0, 0, 0, 0}, Memory{7, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0},
 				Filedesc{1, 10}, 9, States{Sleeping: 1}),
-			Update{n, Delta{}, Memory{7, 8, 0, 0, 0}, Filedesc{1, 10}, tm,
-				9, States{Sleeping: 1}, msi{}, nil},
+			Update{n, Delta{}, Memory{7, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Filedesc{1, 10}, tm,
+				9, States{Sleeping: 1}, msi{}, nil, ID{p, 0}, false, nil, 0, 0, false, "", 0, 0, nil, 0},
 		},
 		{
-			piinfost(p, n, Counts{2, 3, 4, 5, 6, 7, 0, 0}, Memory{1, 2, 0, 0, 0},
+			piinfost(p, n, Counts{2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 0, 0}, Memory{1, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0},
 				Filedesc{2, 20}, 1, States{Running: 1}),
-			Update{n, Delta{1, 1, 1, 1, 1, 1, 0, 0}, Memory{1, 2, 0, 0, 0},
-				Filedesc{2, 20}, tm, 1, States{Running: 1}, msi{}, nil},
+			Update{n, Delta{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}, Memory{1, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				Filedesc{2, 20}, tm, 1, States{Running: 1}, msi{}, nil, ID{p, 0}, false, nil, 0, 0, false, "", 0, 0, nil, 0},
 		},
 	}
 	tr := NewTracker(newNamer(n), false, false, false, false)
@@ -131,41 +385,44 @@ func TestTrackerThreads(t *testing.T) {
 	}{
 		{
 			piinfo(p, n, Counts{}, Memory{}, Filedesc{1, 1}, 1),
-			Update{n, Delta{}, Memory{}, Filedesc{1, 1}, tm, 1, States{}, msi{}, nil},
+			Update{n, Delta{}, Memory{}, Filedesc{1, 1}, tm, 1, States{}, msi{}, nil, ID{p, 0}, false, nil, 0, 0, false, "", 0, 0, nil, 0},
 		}, {
 			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p, 0}), "t1", Counts{1, 2, 3, 4, 5, 6, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 1, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0}, "", States{}},
+				{ThreadID(ID{p, 0}), "t1", Counts{1, 2, 3, 4, 5, 6, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
+				{ThreadID(ID{p + 1, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
 			}),
 			Update{n, Delta{}, Memory{}, Filedesc{1, 1}, tm, 2, States{}, msi{},
 				[]ThreadUpdate{
 					{"t1", Delta{}},
 					{"t2", Delta{}},
 				},
+				ID{p, 0}, false, nil, 0, 0, false, "", 0, 0, nil, 0,
 			},
 		}, {
 			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p, 0}), "t1", Counts{2, 3, 4, 5, 6, 7, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 1, 0}), "t2", Counts{2, 2, 2, 2, 2, 2, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 2, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0}, "", States{}},
+				{ThreadID(ID{p, 0}), "t1", Counts{2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
+				{ThreadID(ID{p + 1, 0}), "t2", Counts{2, 2, 2, 2, 2, 2, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
+				{ThreadID(ID{p + 2, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
 			}),
 			Update{n, Delta{}, Memory{}, Filedesc{1, 1}, tm, 3, States{}, msi{},
 				[]ThreadUpdate{
-					{"t1", Delta{1, 1, 1, 1, 1, 1, 0, 0}},
-					{"t2", Delta{1, 1, 1, 1, 1, 1, 0, 0}},
+					{"t1", Delta{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}},
+					{"t2", Delta{1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0}},
 					{"t2", Delta{}},
 				},
+				ID{p, 0}, false, nil, 0, 0, false, "", 0, 0, nil, 0,
 			},
 		}, {
 			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p, 0}), "t1", Counts{2, 3, 4, 5, 6, 7, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 2, 0}), "t2", Counts{1, 2, 3, 4, 5, 6, 0, 0}, "", States{}},
+				{ThreadID(ID{p, 0}), "t1", Counts{2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
+				{ThreadID(ID{p + 2, 0}), "t2", Counts{1, 2, 3, 4, 5, 6, 0, 0, 0, 0, 0, 0}, "", States{}, ""},
 			}),
 			Update{n, Delta{}, Memory{}, Filedesc{1, 1}, tm, 2, States{}, msi{},
 				[]ThreadUpdate{
 					{"t1", Delta{}},
-					{"t2", Delta{0, 1, 2, 3, 4, 5, 0, 0}},
+					{"t2", Delta{0, 1, 2, 3, 4, 5, 0, 0, 0, 0, 0, 0}},
 				},
+				ID{p, 0}, false, nil, 0, 0, false, "", 0, 0, nil, 0,
 			},
 		},
 	}
@@ -180,3 +437,367 @@ func TestTrackerThreads(t *testing.T) {
 		}
 	}
 }
+
+type (
+	// errProc is a Proc whose metrics can't be read.
+	errProc struct {
+		IDInfo
+		err error
+	}
+
+	// procSlice implements procs using a slice of arbitrary Procs.
+	procSlice []Proc
+
+	// smapsErrProc is an IDInfo whose smaps can't be read.
+	smapsErrProc struct {
+		IDInfo
+	}
+
+	// smapsNamer is a namer which asks for smaps for some of its groups.
+	smapsNamer struct {
+		namer
+		smaps map[string]bool
+	}
+
+	// ioProc is an IDInfo whose I/O counts are only read if selected.
+	ioProc struct {
+		IDInfo
+		noIO bool
+	}
+
+	// ioNamer is a namer which asks for I/O to be read for some of its
+	// groups.
+	ioNamer struct {
+		namer
+		io map[string]bool
+	}
+)
+
+func (p *ioProc) selectReads(io, threads bool) Proc {
+	p.noIO = !io
+	return p
+}
+
+func (p *ioProc) GetMetrics() (Metrics, int, error) {
+	metrics := p.Metrics
+	if p.noIO {
+		metrics.Counts = metrics.Counts.withIO(Counts{})
+	}
+	return metrics, 0, nil
+}
+
+func (n ioNamer) Gather(groupname, collector string) bool {
+	return collector == "io" && n.io[groupname]
+}
+
+func (p smapsErrProc) GetSMaps() (Memory, error) {
+	return Memory{}, fmt.Errorf("error reading smaps_rollup: permission denied")
+}
+
+func (n smapsNamer) GatherSMaps(groupname string) bool {
+	return n.smaps[groupname]
+}
+
+func (p errProc) GetMetrics() (Metrics, int, error) {
+	return Metrics{}, 0, p.err
+}
+
+func (p procSlice) get(i int) Proc {
+	return p[i]
+}
+
+func (p procSlice) length() int {
+	return len(p)
+}
+
+// TestTrackerReadErrors verifies that procs whose metrics can't be read are
+// left out of the updates, and counted as read errors unless they simply
+// vanished.
+func TestTrackerReadErrors(t *testing.T) {
+	n := "g1"
+	good := piinfo(1, n, Counts{}, Memory{ResidentBytes: 1024, VmSwapBytes: 10240}, Filedesc{1, 10}, 1)
+	unreadable := errProc{piinfo(2, n, Counts{}, Memory{VmSwapBytes: 4096}, Filedesc{}, 1),
+		fmt.Errorf("error reading status file: permission denied")}
+	vanished := errProc{piinfo(3, n, Counts{}, Memory{VmSwapBytes: 4096}, Filedesc{}, 1),
+		ErrProcNotExist}
+
+	tr := NewTracker(newNamer(n), false, false, false, false)
+	iter := &procIterator{procs: procSlice{&good, unreadable, vanished}, idx: -1}
+	cerrs, got, err := tr.Update(iter)
+	noerr(t, err)
+
+	want := []Update{{GroupName: n, Memory: Memory{ResidentBytes: 1024, VmSwapBytes: 10240},
+		Filedesc: Filedesc{1, 10}, Start: time.Unix(0, 0).UTC(), NumThreads: 1,
+		Wchans: msi{}, ID: ID{1, 0}}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("update differs: (-got +want)\n%s", diff)
+	}
+	if cerrs.Read != 1 {
+		t.Errorf("got %d read errors, want 1", cerrs.Read)
+	}
+}
+
+// TestTrackerIOSkipped verifies that a proc whose I/O counts can't be read
+// is counted as skipped, and keeps those last read rather than regressing.
+func TestTrackerIOSkipped(t *testing.T) {
+	tr := NewTracker(newNamer("g1"), false, false, false, false)
+	for i, tc := range []struct {
+		read      uint64
+		skipped   bool
+		wantDelta uint64
+	}{
+		{1000, false, 0},
+		{0, true, 0},
+		{1500, false, 500},
+	} {
+		proc := piinfo(1, "g1", Counts{ReadBytes: tc.read}, Memory{}, Filedesc{}, 1)
+		proc.Metrics.IOSkipped = tc.skipped
+		cerrs, updates, err := tr.Update(procInfoIter(proc))
+		noerr(t, err)
+		if len(updates) != 1 || updates[0].Latest.ReadBytes != tc.wantDelta {
+			t.Errorf("%d: got updates %+v, want one reading %d bytes", i, updates, tc.wantDelta)
+		}
+		wantSkipped := 0
+		if tc.skipped {
+			wantSkipped = 1
+		}
+		if cerrs.IOSkipped != wantSkipped || cerrs.Regressions != 0 {
+			t.Errorf("%d: got %d skipped and %d regressions, want %d and none",
+				i, cerrs.IOSkipped, cerrs.Regressions, wantSkipped)
+		}
+	}
+}
+
+// TestTrackerGather verifies that procs have their I/O read only if their
+// group wants it, new ones included since they're matched first, and that
+// their I/O counts start from the first value read rather than jumping.
+func TestTrackerGather(t *testing.T) {
+	n1, n2 := "g1", "g2"
+	tr := NewTracker(ioNamer{newNamer(n1, n2), map[string]bool{n1: true}}, false, false, false, false)
+	for i, tc := range []struct {
+		read      uint64
+		wantNoIO  bool
+		wantDelta map[int]uint64
+	}{
+		{1000, false, map[int]uint64{1: 0, 2: 0}},
+		{1000, false, map[int]uint64{1: 0, 2: 0}},
+		{1500, false, map[int]uint64{1: 500, 2: 0}},
+	} {
+		p1 := &ioProc{IDInfo: piinfo(1, n1, Counts{ReadBytes: tc.read}, Memory{}, Filedesc{}, 1)}
+		p2 := &ioProc{IDInfo: piinfo(2, n2, Counts{ReadBytes: tc.read}, Memory{}, Filedesc{}, 1)}
+		cerrs, updates, err := tr.Update(&procIterator{procs: procSlice{p1, p2}, idx: -1})
+		noerr(t, err)
+		if p1.noIO != tc.wantNoIO || !p2.noIO {
+			t.Errorf("%d: got I/O skipped %v and %v, want %v and true", i, p1.noIO, p2.noIO, tc.wantNoIO)
+		}
+		got := make(map[int]uint64)
+		for _, u := range updates {
+			got[u.ID.Pid] = u.Latest.ReadBytes
+		}
+		if diff := cmp.Diff(got, tc.wantDelta); diff != "" {
+			t.Errorf("%d: bytes read differ: (-got +want)\n%s", i, diff)
+		}
+		if cerrs.Regressions != 0 {
+			t.Errorf("%d: got %d regressions, want none", i, cerrs.Regressions)
+		}
+	}
+}
+
+// TestTrackerSMaps verifies that smaps are read only for the groups the
+// namer wants them for, starting from a proc's second cycle, and that
+// failures to read them are counted as partial errors.
+func TestTrackerSMaps(t *testing.T) {
+	n1, n2 := "g1", "g2"
+	mem := Memory{ResidentBytes: 10, ProportionalBytes: 5, UniqueBytes: 3}
+	p1 := piinfo(1, n1, Counts{}, mem, Filedesc{}, 1)
+	p2 := smapsErrProc{piinfo(2, n1, Counts{}, mem, Filedesc{}, 1)}
+	p3 := piinfo(3, n2, Counts{}, mem, Filedesc{}, 1)
+
+	tr := NewTracker(smapsNamer{newNamer(n1, n2), map[string]bool{n1: true}},
+		false, false, false, false)
+	for i, want := range []map[int]bool{
+		{1: false, 2: false, 3: false},
+		{1: true, 2: false, 3: false},
+	} {
+		iter := &procIterator{procs: procSlice{&p1, p2, &p3}, idx: -1}
+		cerrs, updates, err := tr.Update(iter)
+		noerr(t, err)
+		got := make(map[int]bool)
+		for _, u := range updates {
+			got[u.ID.Pid] = u.SMaps
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("%d: smaps read differs: (-got +want)\n%s", i, diff)
+		}
+		if wantPartial := i; cerrs.Partial != wantPartial {
+			t.Errorf("%d: got %d partial errors, want %d", i, cerrs.Partial, wantPartial)
+		}
+		if wantProcs := i; cerrs.PartialProcs != wantProcs {
+			t.Errorf("%d: got %d partial procs, want %d", i, cerrs.PartialProcs, wantProcs)
+		}
+	}
+}
+
+// TestTrackerOrphanedZombies verifies that zombies whose parent is pid 1 are
+// counted whether or not they're tracked.
+func TestTrackerOrphanedZombies(t *testing.T) {
+	zombie := func(pid, ppid int, name string) IDInfo {
+		id, static := newProcIDStatic(pid, ppid, 0, name, nil)
+		return IDInfo{id, static, Metrics{States: States{Zombie: 1}}, nil}
+	}
+	alive := newProcParent(4, "g1", 1)
+
+	tr := NewTracker(newNamer("g1"), false, false, false, false)
+	_, _, err := tr.Update(procInfoIter(zombie(2, 1, "g1"), zombie(3, 1, "g2"), zombie(5, 4, "g1"), alive))
+	noerr(t, err)
+	if tr.orphanedZombies != 2 {
+		t.Errorf("got %d orphaned zombies, want 2", tr.orphanedZombies)
+	}
+
+	_, _, err = tr.Update(procInfoIter(alive))
+	noerr(t, err)
+	if tr.orphanedZombies != 0 {
+		t.Errorf("got %d orphaned zombies after they were reaped, want 0", tr.orphanedZombies)
+	}
+}
+
+// TestTrackerProcsScanned verifies that every proc read counts as scanned,
+// and only those tracked, including via their parent, as matched.
+func TestTrackerProcsScanned(t *testing.T) {
+	p1, p2, p3 := newProc(1, "g1", Metrics{}), newProc(2, "g2", Metrics{}), newProcParent(3, "g3", 1)
+
+	tr := NewTracker(newNamer("g1"), true, false, false, false)
+	for i, tc := range []struct {
+		procs   []IDInfo
+		scanned int
+		matched int
+	}{
+		{[]IDInfo{p1, p2, p3}, 3, 2},
+		{[]IDInfo{p2}, 1, 0},
+	} {
+		_, _, err := tr.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		if tr.procsScanned != tc.scanned || tr.procsMatched != tc.matched {
+			t.Errorf("%d: got %d scanned and %d matched, want %d and %d",
+				i, tr.procsScanned, tr.procsMatched, tc.scanned, tc.matched)
+		}
+	}
+}
+
+// TestTrackerSamples verifies that samples report each tracked proc's totals
+// along with their growth since the last update.
+func TestTrackerSamples(t *testing.T) {
+	tr := NewTracker(newNamer("g1"), false, false, false, false)
+	for _, cpu := range []float64{1, 3} {
+		_, _, err := tr.Update(procInfoIter(newProc(1, "g1", Metrics{Counts: Counts{CPUUserTime: cpu}}),
+			newProc(2, "g2", Metrics{})))
+		noerr(t, err)
+	}
+	got := tr.samples()
+	want := []ProcSample{{GroupName: "g1", ID: ID{1, 0}, Name: "g1", Username: tr.lookupUid(1000), Start: time.Unix(0, 0).UTC(),
+		Counts: Counts{CPUUserTime: 3}, Latest: Delta{CPUUserTime: 2}}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("samples differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestTrackerBlocked verifies that a proc counts as blocked on the wchan of
+// its main thread if that's in D state, else on that of a blocked thread.
+func TestTrackerBlocked(t *testing.T) {
+	running := Thread{ThreadID(ID{3, 0}), "t1", Counts{}, "ep_poll", States{Sleeping: 1}, ""}
+	blocked := Thread{ThreadID(ID{4, 0}), "t2", Counts{}, "io_schedule", States{Waiting: 1}, ""}
+	procs := []IDInfo{
+		newProc(1, "g1", Metrics{States: States{Waiting: 1}, Wchan: "nfs_wait",
+			Blocked: true, BlockedWchan: "nfs_wait"}),
+		newProc(2, "g1", Metrics{States: States{Sleeping: 1}, Wchan: "do_wait"}),
+		piinfot(3, "g1", Counts{}, Memory{}, Filedesc{}, []Thread{running, blocked}),
+	}
+
+	tr := NewTracker(newNamer("g1"), false, true, false, false)
+	_, got, err := tr.Update(procInfoIter(procs...))
+	noerr(t, err)
+	if len(got) != len(procs) {
+		t.Fatalf("got %d updates, want %d", len(got), len(procs))
+	}
+	want := map[int]string{1: "nfs_wait", 3: "io_schedule"}
+	for _, u := range got {
+		if wchan, ok := want[u.ID.Pid]; u.Blocked != ok || u.BlockedWchan != wchan {
+			t.Errorf("pid %d: got blocked=%v on %q, want %v on %q",
+				u.ID.Pid, u.Blocked, u.BlockedWchan, ok, wchan)
+		}
+	}
+}
+
+// argv0Namer names procs by the first word of their cmdline, as given by
+// its map, like a config matching on cmdline would.
+type argv0Namer map[string]string
+
+func (n argv0Namer) String() string {
+	return fmt.Sprintf("%v", map[string]string(n))
+}
+
+func (n argv0Namer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
+	if len(nacl.Cmdline) > 0 {
+		if name, ok := n[nacl.Cmdline[0]]; ok {
+			return true, name
+		}
+	}
+	return false, ""
+}
+
+// TestTrackerRecheckInterval verifies that with a recheck interval, ignored
+// procs that have since changed their cmdline are matched on the next
+// recheck, along with their children, counting only what they use from then
+// on, and that ignored procs that have exited are forgotten.
+func TestTrackerRecheckInterval(t *testing.T) {
+	proc := func(pid, ppid int, cmdline string, cpu float64) IDInfo {
+		id, static := newProcIDStatic(pid, ppid, 1, "postgres", []string{cmdline})
+		return IDInfo{id, static, Metrics{Counts: Counts{CPUUserTime: cpu}}, nil}
+	}
+	type latest struct {
+		Group string
+		CPU   float64
+	}
+
+	for _, interval := range []time.Duration{0, time.Minute} {
+		tr := NewTracker(argv0Namer{"postgres: writer": "writer"}, true, false, false, false)
+		tr.recheckInterval = interval
+		// The procs started after the tracker did, so that they'd count all
+		// they've used if they were new.
+		tr.firstUpdateAt = time.Unix(0, 0)
+
+		for i, tc := range []struct {
+			procs []IDInfo
+			due   bool
+			want  map[int]latest
+		}{
+			{[]IDInfo{proc(1, 0, "postgres", 1), proc(2, 1, "worker", 1), proc(3, 0, "psql", 1)},
+				false, map[int]latest{}},
+			{[]IDInfo{proc(1, 0, "postgres: writer", 2), proc(2, 1, "worker", 2)},
+				false, map[int]latest{}},
+			{[]IDInfo{proc(1, 0, "postgres: writer", 5), proc(2, 1, "worker", 5)},
+				true, map[int]latest{1: {"writer", 0}, 2: {"writer", 0}}},
+			{[]IDInfo{proc(1, 0, "postgres: writer", 6), proc(2, 1, "worker", 8)},
+				false, map[int]latest{1: {"writer", 1}, 2: {"writer", 3}}},
+		} {
+			if tc.due {
+				tr.lastRecheck = tr.lastRecheck.Add(-time.Hour)
+			}
+			_, updates, err := tr.Update(procInfoIter(tc.procs...))
+			noerr(t, err)
+			got := make(map[int]latest)
+			for _, u := range updates {
+				got[u.ID.Pid] = latest{u.GroupName, u.Latest.CPUUserTime}
+			}
+			if interval == 0 {
+				tc.want = map[int]latest{}
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("interval %v, %d: updates differ: (-got +want)\n%s", interval, i, diff)
+			}
+		}
+		if _, ok := tr.tracked[ID{3, 1}]; ok && interval > 0 {
+			t.Errorf("interval %v: exited ignored proc still known", interval)
+		}
+	}
+}